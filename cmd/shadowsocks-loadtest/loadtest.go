@@ -0,0 +1,171 @@
+// shadowsocks-loadtest drives concurrent connections through a running
+// shadowsocks-local and shadowsocks-server pair to an echo server started by
+// itself, and reports throughput and latency.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func echoServer(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("echo server accept:", err)
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+// socksConnect creates a connection to addr through the socks5 proxy.
+func socksConnect(proxy, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, errors.New("echo server must listen on ipv4 address")
+	}
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+	// version 5, 1 method, no authentication
+	if _, err = conn.Write([]byte{5, 1, 0}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	buf := make([]byte, 10)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req := []byte{5, 1, 0, 1, ip[0], ip[1], ip[2], ip[3], byte(port >> 8), byte(port)}
+	if _, err = conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if buf[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("socks connect failed with reply %d", buf[1])
+	}
+	return conn, nil
+}
+
+// request sends payload through a new connection and reads back the echo.
+func request(proxy, addr string, payload []byte) (time.Duration, error) {
+	start := time.Now()
+	conn, err := socksConnect(proxy, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	go conn.Write(payload)
+	buf := make([]byte, len(payload))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(buf, payload) {
+		return 0, errors.New("echo data mismatch")
+	}
+	return time.Since(start), nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func main() {
+	var proxy, echoAddr string
+	var concurrency, total, size int
+
+	flag.StringVar(&proxy, "socks", "127.0.0.1:1080", "socks5 address of shadowsocks-local")
+	flag.StringVar(&echoAddr, "echo", "127.0.0.1:0", "listen address of echo server, must be reachable by shadowsocks-server")
+	flag.IntVar(&concurrency, "c", 10, "number of concurrent connections")
+	flag.IntVar(&total, "n", 1000, "total number of requests")
+	flag.IntVar(&size, "size", 4096, "payload size of each request in bytes")
+	flag.Parse()
+
+	ln, err := net.Listen("tcp", echoAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go echoServer(ln)
+	addr := ln.Addr().String()
+
+	payload := make([]byte, size)
+	rand.Read(payload)
+
+	var next, errCnt int32
+	latency := make([]time.Duration, 0, total)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	log.Printf("sending %d requests of %d bytes to %s via %s, concurrency %d\n",
+		total, size, addr, proxy, concurrency)
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for int(atomic.AddInt32(&next, 1)) <= total {
+				d, err := request(proxy, addr, payload)
+				if err != nil {
+					if atomic.AddInt32(&errCnt, 1) <= 10 {
+						log.Println("request:", err)
+					}
+					continue
+				}
+				mu.Lock()
+				latency = append(latency, d)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latency, func(i, j int) bool { return latency[i] < latency[j] })
+	ok := len(latency)
+	// payload is sent and received back
+	mb := float64(ok*size*2) / (1024 * 1024)
+	fmt.Printf("requests:   %d ok, %d failed in %v\n", ok, errCnt, elapsed)
+	fmt.Printf("throughput: %.2f req/s, %.2f MB/s\n",
+		float64(ok)/elapsed.Seconds(), mb/elapsed.Seconds())
+	fmt.Printf("latency:    p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(latency, 0.5), percentile(latency, 0.9),
+		percentile(latency, 0.99), percentile(latency, 1))
+	if errCnt != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"net"
+	"sync"
+)
+
+// With acl set, destinations of TCP connections are matched against its
+// rules to be proxied, connected directly or rejected. UDP is always
+// proxied. Rules are loaded again when switching profile or reloading config.
+
+var acl struct {
+	sync.RWMutex
+	rules *ss.ACL
+}
+
+var errACLRejected = errors.New("rejected by acl")
+
+// loadACL returns rules in file path, nil if path is empty.
+func loadACL(path, geoipPath string) (*ss.ACL, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return ss.LoadACL(path, geoipPath)
+}
+
+func setACL(rules *ss.ACL) {
+	acl.Lock()
+	acl.rules = rules
+	acl.Unlock()
+}
+
+// aclAction returns the action for addr in the form of host:port, decided
+// by acl rules, then direct routes, then the default of acl.
+func aclAction(addr string) ss.ACLAction {
+	acl.RLock()
+	rules := acl.rules
+	acl.RUnlock()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ss.ACLProxy
+	}
+	action, ok := ss.ACLProxy, false
+	if rules != nil {
+		action, ok = rules.MatchRule(host)
+	}
+	if !ok {
+		if directRoute(host) {
+			action = ss.ACLDirect
+		} else if rules != nil {
+			action = rules.Default()
+		}
+	}
+	if action != ss.ACLProxy {
+		debug.Printf("acl: %s %s\n", action, addr)
+	}
+	return action
+}
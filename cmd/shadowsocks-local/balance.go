@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Strategies to select server among multiple servers.
+const (
+	balanceRoundRobin = "round_robin"
+	balanceLatency    = "latency"
+	balanceRandom     = "random"
+	// switch between round robin and latency based on statistics
+	balanceAuto = "auto"
+)
+
+const regionAuto = "auto"
+
+const (
+	balanceInterval = 30 * time.Second
+	// too few connections in an interval to make a decision
+	balanceMinDials = 10
+	// prefer the fastest server if slowest is this many times slower
+	balanceLatencyRatio = 1.5
+	// don't stick to the fastest server if it fails more than this
+	balanceMaxErrRate = 0.1
+	// servers failed within this time are tried after others by latency
+	balanceFailDemote = time.Minute
+	// latency assumed for servers failing without a successful dial
+	balanceFailLatency = 10 * time.Second
+)
+
+// serverStat records connecting latency and errors of a server.
+type serverStat struct {
+	sync.Mutex
+	latency  time.Duration // moving average of successful dials
+	dials    int           // in current balance interval
+	fails    int
+	lastFail time.Time
+	probing  bool
+}
+
+func (st *serverStat) record(d time.Duration, err error) {
+	st.Lock()
+	st.dials++
+	if err != nil {
+		st.fails++
+		st.lastFail = time.Now()
+	} else if st.latency == 0 {
+		st.latency = d
+	} else {
+		st.latency = (st.latency*7 + d) / 8
+	}
+	st.Unlock()
+}
+
+func (st *serverStat) reset() {
+	st.Lock()
+	st.latency, st.dials, st.fails = 0, 0, 0
+	st.lastFail = time.Time{}
+	st.Unlock()
+}
+
+// score is used to order servers by latency, failing servers go last.
+// Servers not dialed yet score 0, so they are tried and measured.
+func (st *serverStat) score() time.Duration {
+	st.Lock()
+	defer st.Unlock()
+	latency := st.latency
+	if latency == 0 && st.fails > 0 {
+		latency = balanceFailLatency
+	}
+	return latency * time.Duration(1+st.fails)
+}
+
+func (st *serverStat) failedRecently() bool {
+	st.Lock()
+	defer st.Unlock()
+	return !st.lastFail.IsZero() && time.Since(st.lastFail) < balanceFailDemote
+}
+
+var balance struct {
+	sync.Mutex
+	mode     string // configured
+	strategy string // in use, differs from mode when mode is auto
+	// Servers in this region are tried first. If configured to auto, it's
+	// the region whose servers have the lowest average latency.
+	autoRegion bool
+	region     string
+}
+
+func checkBalance(mode string) error {
+	switch mode {
+	case "", balanceRoundRobin, balanceLatency, balanceRandom, balanceAuto:
+		return nil
+	}
+	return fmt.Errorf("unsupported balance strategy %s", mode)
+}
+
+func setBalance(mode string) {
+	if mode == "" {
+		mode = balanceRoundRobin
+	}
+	balance.Lock()
+	if mode != balance.mode {
+		balance.mode = mode
+		balance.strategy = mode
+		if mode == balanceAuto {
+			balance.strategy = balanceRoundRobin
+		}
+	}
+	balance.Unlock()
+}
+
+func setRegion(region string) {
+	balance.Lock()
+	balance.autoRegion = region == regionAuto
+	if !balance.autoRegion {
+		balance.region = region
+	}
+	balance.Unlock()
+}
+
+func balanceStrategy() (strategy, region string) {
+	balance.Lock()
+	defer balance.Unlock()
+	return balance.strategy, balance.region
+}
+
+// orderServers returns servers in the order to try connecting.
+func orderServers(srvenc []*ServerEnctbl) []*ServerEnctbl {
+	n := len(srvenc)
+	order := make([]*ServerEnctbl, n)
+	id := servers.idx
+	servers.idx++ // it's ok for concurrent update
+	for i := 0; i < n; i++ {
+		order[i] = srvenc[(int(id)+i)%n]
+	}
+	strategy, region := balanceStrategy()
+	switch strategy {
+	case balanceLatency:
+		// stable sort keeps round robin order among servers without samples
+		score := make(map[*ServerEnctbl]time.Duration, n)
+		failed := make(map[*ServerEnctbl]bool, n)
+		for _, se := range order {
+			score[se] = se.stat.score()
+			failed[se] = se.stat.failedRecently()
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			if failed[order[i]] != failed[order[j]] {
+				return !failed[order[i]]
+			}
+			return score[order[i]] < score[order[j]]
+		})
+	case balanceRandom:
+		rand.Shuffle(n, func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+	if region != "" {
+		// servers in other regions are kept as fallback
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].region == region && order[j].region != region
+		})
+	}
+	return order
+}
+
+// nearestRegion returns the region whose servers have the lowest average
+// latency.
+func nearestRegion(srvenc []*ServerEnctbl) string {
+	sum := map[string]time.Duration{}
+	cnt := map[string]int{}
+	for _, se := range srvenc {
+		if se.region == "" {
+			continue
+		}
+		se.stat.Lock()
+		if se.stat.latency != 0 {
+			sum[se.region] += se.stat.latency
+			cnt[se.region]++
+		}
+		se.stat.Unlock()
+	}
+	nearest := ""
+	var min time.Duration
+	for region, total := range sum {
+		avg := total / time.Duration(cnt[region])
+		if nearest == "" || avg < min {
+			nearest, min = region, avg
+		}
+	}
+	return nearest
+}
+
+// decideBalance chooses strategy with statistics in the last interval, the
+// counters are reset for the next interval.
+func decideBalance(srvenc []*ServerEnctbl) (strategy, reason string) {
+	var fastest, slowest *ServerEnctbl
+	var fastLat, slowLat time.Duration
+	var fastErr float64
+	total := 0
+	for _, se := range srvenc {
+		st := &se.stat
+		st.Lock()
+		total += st.dials
+		if st.latency != 0 {
+			if fastest == nil || st.latency < fastLat {
+				fastest, fastLat = se, st.latency
+				fastErr = 0
+				if st.dials != 0 {
+					fastErr = float64(st.fails) / float64(st.dials)
+				}
+			}
+			if slowest == nil || st.latency > slowLat {
+				slowest, slowLat = se, st.latency
+			}
+		}
+		st.dials, st.fails = 0, 0
+		st.Unlock()
+	}
+	if total < balanceMinDials || fastest == nil || fastest == slowest {
+		return "", ""
+	}
+	reason = fmt.Sprintf("fastest %s %v error rate %.0f%%, slowest %s %v",
+		fastest.server, fastLat, fastErr*100, slowest.server, slowLat)
+	if float64(slowLat) > float64(fastLat)*balanceLatencyRatio && fastErr <= balanceMaxErrRate {
+		return balanceLatency, reason
+	}
+	return balanceRoundRobin, reason
+}
+
+// probing tells whether servers need to be probed for latency, which is
+// used by latency strategy and auto region.
+func probing() bool {
+	balance.Lock()
+	defer balance.Unlock()
+	return balance.mode == balanceLatency || balance.mode == balanceAuto || balance.autoRegion
+}
+
+// probeServers measures TCP connecting latency of servers, so that servers
+// not used recently also have fresh statistics. Probes are not waited, a
+// server still being probed, e.g. blackholed, is skipped.
+func probeServers(srvenc []*ServerEnctbl) {
+	for _, se := range srvenc {
+		if se.plugin != nil {
+			// it's latency to the local plugin
+			continue
+		}
+		se.stat.Lock()
+		if se.stat.probing {
+			se.stat.Unlock()
+			continue
+		}
+		se.stat.probing = true
+		se.stat.Unlock()
+		go func(se *ServerEnctbl) {
+			start := time.Now()
+			conn, err := se.dial(se.dialAddrs()[0])
+			se.stat.record(time.Since(start), err)
+			if err == nil {
+				conn.Close()
+			} else {
+				debug.Printf("probing server %s: %v\n", se.server, err)
+			}
+			se.stat.Lock()
+			se.stat.probing = false
+			se.stat.Unlock()
+		}(se)
+	}
+}
+
+// autoBalance periodically probes servers, switches strategy if balance mode
+// is auto, and region if it's auto.
+func autoBalance() {
+	for {
+		if probing() {
+			probeServers(getServers(""))
+		}
+		idleSleep(balanceInterval)
+		srvenc := getServers("")
+		region := nearestRegion(srvenc)
+		strategy, reason := decideBalance(srvenc)
+		balance.Lock()
+		if balance.autoRegion && region != "" && region != balance.region {
+			log.Printf("region: switch from %q to nearest region %s\n", balance.region, region)
+			balance.region = region
+		}
+		if strategy == "" {
+			balance.Unlock()
+			continue
+		}
+		if balance.mode == balanceAuto && strategy != balance.strategy {
+			log.Printf("balance: switch from %s to %s, %s\n", balance.strategy, strategy, reason)
+			balance.strategy = strategy
+		} else {
+			debug.Printf("balance: keep %s, %s\n", balance.strategy, reason)
+		}
+		balance.Unlock()
+	}
+}
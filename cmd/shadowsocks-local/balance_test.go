@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServerStatScore(t *testing.T) {
+	var fast, slow, failing, untried serverStat
+	fast.record(20*time.Millisecond, nil)
+	slow.record(2*time.Second, nil)
+	slow.record(0, errors.New("timeout"))
+	// never connected
+	failing.record(0, errors.New("connection refused"))
+
+	if !(untried.score() < fast.score() && fast.score() < slow.score() && slow.score() < failing.score()) {
+		t.Errorf("scores untried %v, fast %v, slow %v, failing %v", untried.score(), fast.score(), slow.score(), failing.score())
+	}
+}
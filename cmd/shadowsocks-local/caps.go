@@ -0,0 +1,64 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+)
+
+// With negotiate enabled, servers are asked for their capabilities after
+// switching profile, and their settings are followed where client config
+// differs: port hopping is enabled, disabled or changed to match server, and
+// UDP relay avoids servers not relaying UDP. Servers not supporting
+// negotiation are used as configured.
+
+// negotiate queries capabilities of servers concurrently.
+func negotiate(srvenc []*ServerEnctbl) {
+	for _, se := range srvenc {
+		go func(se *ServerEnctbl) {
+			cn, err := se.dial(se.dialAddrs()[0])
+			if err != nil {
+				debug.Printf("negotiating with server %s: %v\n", se.server, err)
+				return
+			}
+			caps, err := ss.QueryCaps(cn, se.enctbl)
+			if err != nil {
+				debug.Printf("negotiating with server %s: %v\n", se.server, err)
+				return
+			}
+			se.setCaps(caps)
+		}(se)
+	}
+}
+
+func (se *ServerEnctbl) setCaps(caps *ss.Capabilities) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.caps = caps
+	debug.Printf("server %s capabilities %+v\n", se.server, *caps)
+	if se.plugin != nil {
+		// hopping ports bypass plugin
+		return
+	}
+	hop, err := ss.NewPortHop(caps.PortHop, caps.PortHopInterval)
+	if err != nil {
+		log.Printf("server %s: %v\n", se.server, err)
+		return
+	}
+	switch {
+	case hop == nil && se.hop != nil:
+		log.Printf("server %s doesn't hop ports, disable port hopping\n", se.server)
+	case hop != nil && se.hop == nil:
+		log.Printf("server %s hops ports in %s, enable port hopping\n", se.server, caps.PortHop)
+	case hop != nil && *hop != *se.hop:
+		log.Printf("server %s hops ports in %s every %ds, follow it\n",
+			se.server, caps.PortHop, caps.PortHopInterval)
+	}
+	se.hop = hop
+}
+
+// relaysUDP tells whether server relays UDP, true if not negotiated.
+func (se *ServerEnctbl) relaysUDP() bool {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.caps == nil || se.caps.UDP
+}
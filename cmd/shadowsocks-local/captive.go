@@ -0,0 +1,176 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Captive portals of public Wi-Fi intercept traffic until the user logs in,
+// which can't be done through the proxy. The client probes a URL returning
+// 204 directly. If the response is anything else, it's in a captive portal,
+// and connections to the portal and connectivity check hosts are made
+// directly, until the probe succeeds again.
+
+const defaultCaptiveProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+const (
+	captiveCheckInterval = 30 * time.Second
+	// check more often in portal to restore proxying soon after login
+	captivePortalInterval = 5 * time.Second
+)
+
+// connectivity check hosts of operating systems and browsers, so their
+// portal login pages work
+var captiveCheckHosts = []string{
+	"connectivitycheck.gstatic.com",
+	"clients3.google.com",
+	"captive.apple.com",
+	"www.msftconnecttest.com",
+	"detectportal.firefox.com",
+	"nmcheck.gnome.org",
+}
+
+var captive struct {
+	sync.RWMutex
+	enabled  bool
+	inPortal bool
+	bypass   map[string]bool // hosts to connect directly while in portal
+	recheck  chan struct{}   // probe immediately
+}
+
+func captiveEnabled() bool {
+	captive.RLock()
+	defer captive.RUnlock()
+	return captive.enabled
+}
+
+// captiveBypass tells whether addr, in the form of host:port, should be
+// connected directly.
+func captiveBypass(addr string) bool {
+	captive.RLock()
+	defer captive.RUnlock()
+	if !captive.inPortal {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && captive.bypass[host]
+}
+
+var probeClient = &http.Client{
+	// probe directly even if proxy is set in environment
+	Transport: &http.Transport{Proxy: nil},
+	Timeout:   5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// probeCaptive returns whether in portal, and the host of portal if it
+// redirects.
+func probeCaptive(probeURL string) (inPortal bool, portal string, err error) {
+	resp, err := probeClient.Get(probeURL)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return false, "", nil
+	}
+	if loc, err := resp.Location(); err == nil {
+		portal = loc.Hostname()
+	}
+	return true, portal, nil
+}
+
+func setInPortal(inPortal bool, hosts []string) {
+	captive.Lock()
+	defer captive.Unlock()
+	if inPortal == captive.inPortal {
+		return
+	}
+	captive.inPortal = inPortal
+	if !inPortal {
+		captive.bypass = nil
+		log.Println("internet access confirmed, captive portal bypass ended")
+		return
+	}
+	captive.bypass = map[string]bool{}
+	for _, h := range hosts {
+		captive.bypass[h] = true
+	}
+	log.Println("captive portal detected, connecting directly to", hosts)
+}
+
+func startCaptiveCheck(probeURL string) error {
+	u, err := url.Parse(probeURL)
+	if err != nil {
+		return err
+	}
+	captive.Lock()
+	captive.enabled = true
+	captive.recheck = make(chan struct{}, 1)
+	captive.Unlock()
+	go checkCaptive(probeURL, u.Hostname())
+	return nil
+}
+
+func checkCaptive(probeURL, probeHost string) {
+	for {
+		inPortal, portal, err := probeCaptive(probeURL)
+		if err != nil {
+			// network unavailable, keep current state
+			debug.Println("captive portal probe:", err)
+		} else {
+			hosts := append([]string{probeHost}, captiveCheckHosts...)
+			if portal != "" {
+				hosts = append(hosts, portal)
+			}
+			setInPortal(inPortal, hosts)
+		}
+		captive.RLock()
+		inPortal = captive.inPortal
+		captive.RUnlock()
+		interval := captiveCheckInterval
+		if inPortal {
+			interval = captivePortalInterval
+		}
+		select {
+		case <-idleAfter(interval):
+		case <-captive.recheck:
+		}
+	}
+}
+
+// recheckCaptive makes captive portal probed immediately, e.g. after network
+// may have changed.
+func recheckCaptive() {
+	captive.RLock()
+	defer captive.RUnlock()
+	if !captive.enabled {
+		return
+	}
+	select {
+	case captive.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// relayDirect connects to addr directly and relays data with conn.
+func relayDirect(conn net.Conn, addr string) {
+	debug.Printf("connecting %s directly\n", addr)
+	remote, err := ss.DialTCP(addr)
+	if err != nil {
+		debug.Println("direct connect:", err)
+		return
+	}
+	defer remote.Close()
+	c := make(chan byte, 2)
+	go ss.Pipe(conn, remote, c)
+	go ss.Pipe(remote, conn, c)
+	<-c
+}
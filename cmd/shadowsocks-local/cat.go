@@ -0,0 +1,41 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io"
+	"os"
+)
+
+// "shadowsocks-local cat host:port" makes one connection to the destination
+// through a server of the profile and relays stdin and stdout to it, like
+// nc, for debugging and scripts. No local port is listened. Like nc without
+// -N, the connection is kept after stdin ends, until the destination closes
+// it.
+
+func runCat(profile, target string) error {
+	if err := ss.ValidateAddr(target); err != nil {
+		return ss.NewStartupError(ss.ExitConfig, err)
+	}
+	config, srvenc, group, err := loadProfile(profile)
+	if err != nil {
+		return err
+	}
+	ss.ApplyGlobals(config)
+	servers.Lock()
+	servers.srvenc = srvenc
+	servers.group = group
+	servers.Unlock()
+
+	rawaddr, err := ss.RawAddr(target)
+	if err != nil {
+		return ss.NewStartupError(ss.ExitConfig, err)
+	}
+	remote, err := createServerConn(rawaddr, target, "")
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	go io.Copy(remote, os.Stdin)
+	_, err = io.Copy(os.Stdout, remote)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With server_discovery set to a domain, servers are the targets of SRV
+// records of _shadowsocks._tcp.<domain>, and TXT record "method=<method>" of
+// the domain gives encryption method if it's not configured or is table. SRV
+// priority and weight are ignored, servers are used as if listed in config.
+// Records are looked up again every discoveryInterval and servers are
+// replaced if they changed, so fleet changes don't need config updates.
+// Password is the same for all discovered servers.
+
+const discoveryInterval = 5 * time.Minute
+
+const txtMethodPrefix = "method="
+
+var discovered struct {
+	sync.Mutex
+	result string // servers and method last applied
+}
+
+func discoverServers(domain string) (servers []string, method string, err error) {
+	_, srvs, err := net.LookupSRV("shadowsocks", "tcp", domain)
+	if err != nil {
+		return
+	}
+	for _, srv := range srvs {
+		// "." means the service is not available
+		if host := strings.TrimSuffix(srv.Target, "."); host != "" {
+			servers = append(servers, ss.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, "", errors.New("no server in SRV records")
+	}
+	// order randomized by weight shouldn't look like changes
+	sort.Strings(servers)
+	// TXT record is optional
+	txts, _ := net.LookupTXT(domain)
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, txtMethodPrefix) {
+			method = txt[len(txtMethodPrefix):]
+		}
+	}
+	return
+}
+
+// applyDiscovery returns config with discovered servers, or config itself if
+// discovery is not enabled. Servers in config are used if discovery fails.
+func applyDiscovery(config *ss.Config) (*ss.Config, error) {
+	domain := config.ServerDiscovery
+	if domain == "" {
+		return config, nil
+	}
+	servers, method, err := discoverServers(domain)
+	if err != nil {
+		err = fmt.Errorf("discovering servers of %s: %v", domain, err)
+		if config.Server == nil {
+			return nil, err
+		}
+		log.Printf("%v, use configured servers\n", err)
+		return config, nil
+	}
+	discovered.Lock()
+	discovered.result = fmt.Sprint(servers, method)
+	discovered.Unlock()
+
+	c := *config
+	arr := make([]interface{}, len(servers))
+	for i, s := range servers {
+		arr[i] = s
+	}
+	c.Server = arr
+	if method != "" {
+		// don't let spoofed DNS downgrade encryption, table is the default
+		// and the weakest
+		if c.Method == "" || c.Method == "table" {
+			c.Method = method
+		} else if c.Method != method {
+			log.Printf("ignore method %s in TXT record of %s, using configured method %s\n",
+				method, domain, c.Method)
+		}
+	}
+	return &c, nil
+}
+
+// watchDiscovery looks up servers of the active profile periodically, and
+// switches to them if they changed.
+func watchDiscovery() {
+	for {
+		idleSleep(discoveryInterval)
+		local.Lock()
+		profile, base := local.profile, local.baseConfig
+		local.Unlock()
+		config, err := base.GetProfile(profile)
+		if err != nil || config.ServerDiscovery == "" {
+			continue
+		}
+		domain := config.ServerDiscovery
+		servers, method, err := discoverServers(domain)
+		if err != nil {
+			log.Printf("discovering servers of %s: %v\n", domain, err)
+			continue
+		}
+		discovered.Lock()
+		changed := fmt.Sprint(servers, method) != discovered.result
+		discovered.Unlock()
+		if !changed {
+			continue
+		}
+		log.Printf("servers of %s changed\n", domain)
+		if err = switchProfile(profile); err != nil {
+			log.Println("applying discovered servers:", err)
+		}
+	}
+}
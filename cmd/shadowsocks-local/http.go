@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// With local_http_port set, client also serves as HTTP proxy for
+// applications not speaking socks. CONNECT requests are tunneled as is. Plain
+// HTTP requests with absolute URI are rewritten to origin form and sent to the
+// destination, the connection to which is kept for following requests to the
+// same host.
+
+// hop-by-hop headers meant for the proxy, not forwarded to destination
+var proxyHeaders = []string{"Proxy-Connection", "Proxy-Authorization", "Proxy-Authenticate"}
+
+// bufferedConn reads data buffered when parsing requests before reading conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connectServer connects to addr through a server in group, or directly if
+// acl says so.
+func connectServer(addr, group string) (net.Conn, error) {
+	switch aclAction(addr) {
+	case ss.ACLReject:
+		return nil, errACLRejected
+	case ss.ACLDirect:
+		return ss.DialTCP(addr)
+	}
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := createServerConn(rawaddr, addr, group)
+	if err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
+
+// connectError replies the error connecting to destination.
+func connectError(conn net.Conn, err error) {
+	if err == errACLRejected {
+		httpError(conn, http.StatusForbidden)
+		return
+	}
+	httpError(conn, http.StatusBadGateway)
+}
+
+func httpError(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+		code, http.StatusText(code))
+}
+
+func handleHTTPConnection(conn net.Conn, group string) {
+	if debug {
+		debug.Printf("http connect from %s\n", conn.RemoteAddr().String())
+	}
+	defer conn.Close()
+	defer ss.RecoverPanic(conn)
+	activityStart()
+	defer activityEnd()
+
+	br := bufio.NewReader(conn)
+	var remote net.Conn
+	var remoteBr *bufio.Reader
+	var remoteAddr string
+	defer func() {
+		if remote != nil {
+			remote.Close()
+		}
+	}()
+	for {
+		// also the idle timeout of keep-alive connections
+		ss.SetHandshakeDeadline(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				debug.Println("http proxy reading request:", err)
+			}
+			return
+		}
+		ss.ClearDeadline(conn)
+		if req.Method == "CONNECT" {
+			if remote != nil {
+				remote.Close()
+				remote = nil
+			}
+			handleHTTPConnect(&bufferedConn{conn, br}, req.Host, group)
+			return
+		}
+		if req.URL.Host == "" {
+			// not a proxy request
+			httpError(conn, http.StatusBadRequest)
+			return
+		}
+		addr := req.URL.Host
+		if !ss.HasPort(addr) {
+			addr = ss.JoinHostPort(strings.Trim(addr, "[]"), "80")
+		}
+		if remote != nil && addr != remoteAddr {
+			remote.Close()
+			remote = nil
+		}
+		if remote == nil {
+			ss.Audit(conn.RemoteAddr().String(), addr)
+			if remote, err = connectServer(addr, group); err != nil {
+				remote = nil
+				connectError(conn, err)
+				return
+			}
+			remoteBr = bufio.NewReader(remote)
+			remoteAddr = addr
+		}
+		for _, h := range proxyHeaders {
+			req.Header.Del(h)
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// keep Request.Write from adding its own
+			req.Header["User-Agent"] = []string{""}
+		}
+		// Request.Write sends URL in origin form
+		if err = req.Write(remote); err != nil {
+			debug.Println("http proxy sending request:", err)
+			return
+		}
+		ss.SetHandshakeDeadline(remote)
+		resp, err := http.ReadResponse(remoteBr, req)
+		if err != nil {
+			debug.Println("http proxy reading response:", err)
+			httpError(conn, http.StatusBadGateway)
+			return
+		}
+		ss.ClearDeadline(remote)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			debug.Println("http proxy sending response:", err)
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// e.g. websocket, relay the rest as is
+			c := make(chan byte, 2)
+			go ss.Pipe(&bufferedConn{conn, br}, remote, c)
+			go ss.Pipe(&bufferedConn{remote, remoteBr}, conn, c)
+			<-c
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+func handleHTTPConnect(conn net.Conn, addr, group string) {
+	ss.Audit(conn.RemoteAddr().String(), addr)
+	// reply after connecting to server, so that failures are reported to
+	// client as HTTP error
+	remote, err := connectServer(addr, group)
+	if err != nil {
+		connectError(conn, err)
+		return
+	}
+	defer remote.Close()
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		debug.Println("http proxy sending connect response:", err)
+		return
+	}
+	c := make(chan byte, 2)
+	go ss.Pipe(conn, remote, c)
+	go ss.Pipe(remote, conn, c)
+	<-c
+}
+
+// runHTTP accepts HTTP proxy connections on ln, which are served by the
+// given server group.
+func runHTTP(ln net.Listener, group string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("accept:", err)
+				continue
+			}
+			debug.Println("accept:", err)
+			return
+		}
+		go handleHTTPConnection(conn, group)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// On laptops and phones the client runs all the time, and its periodic
+// probes and syncs keep waking the device. With power_save, once no
+// connection has been active for idleDelay, these timers are stretched by
+// idleSlowdown, and they run again as soon as a connection starts. Keepalive
+// is only sent on open connections, so it stops by itself when idle.
+
+const (
+	idleDelay    = time.Minute
+	idleSlowdown = 10
+)
+
+var activity struct {
+	sync.Mutex
+	powerSave bool
+	active    int
+	last      time.Time     // when the last connection ended
+	wake      chan struct{} // closed when a connection starts, nil if none waits
+	idle      bool          // logged to be idle
+}
+
+func init() {
+	activity.last = time.Now()
+}
+
+func setPowerSave(enabled bool) {
+	activity.Lock()
+	defer activity.Unlock()
+	activity.powerSave = enabled
+	if !enabled && activity.wake != nil {
+		close(activity.wake)
+		activity.wake = nil
+	}
+}
+
+// activityStart and activityEnd are called when a connection from
+// applications starts and ends.
+func activityStart() {
+	activity.Lock()
+	defer activity.Unlock()
+	activity.active++
+	if activity.wake != nil {
+		close(activity.wake)
+		activity.wake = nil
+	}
+	if activity.idle {
+		activity.idle = false
+		debug.Println("power save: active")
+	}
+}
+
+func activityEnd() {
+	activity.Lock()
+	defer activity.Unlock()
+	activity.active--
+	activity.last = time.Now()
+}
+
+// idleWake returns a channel closed when a connection starts, or nil if the
+// client isn't idle in power save mode.
+func idleWake() <-chan struct{} {
+	activity.Lock()
+	defer activity.Unlock()
+	if !activity.powerSave || activity.active > 0 || time.Since(activity.last) < idleDelay {
+		return nil
+	}
+	if !activity.idle {
+		activity.idle = true
+		log.Println("power save: idle, slowing down periodic checks")
+	}
+	if activity.wake == nil {
+		activity.wake = make(chan struct{})
+	}
+	return activity.wake
+}
+
+// idleAfter is like time.After, but waits longer while idle, until a
+// connection starts after d has passed.
+func idleAfter(d time.Duration) <-chan struct{} {
+	c := make(chan struct{})
+	go func() {
+		time.Sleep(d)
+		if wake := idleWake(); wake != nil {
+			select {
+			case <-wake:
+			case <-time.After(d * (idleSlowdown - 1)):
+			}
+		}
+		close(c)
+	}()
+	return c
+}
+
+// idleSleep is like time.Sleep with the wait of idleAfter.
+func idleSleep(d time.Duration) {
+	<-idleAfter(d)
+}
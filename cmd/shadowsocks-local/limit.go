@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// When all servers reached their maximum connections, a request waits at most
+// this long for a connection to close.
+const maxConnQueueTime = time.Second
+
+// newSlots returns the semaphore limiting connections to a server, nil if
+// there's no limit.
+func newSlots(max int) chan struct{} {
+	if max <= 0 {
+		return nil
+	}
+	return make(chan struct{}, max)
+}
+
+// acquire takes a connection slot of the server, waiting at most wait if all
+// slots are in use.
+func (se *ServerEnctbl) acquire(wait time.Duration) bool {
+	if se.slots == nil {
+		return true
+	}
+	select {
+	case se.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait == 0 {
+		return false
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case se.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (se *ServerEnctbl) release() {
+	if se.slots != nil {
+		<-se.slots
+	}
+}
+
+// limitedConn releases its slot of the server when closed.
+type limitedConn struct {
+	net.Conn
+	se   *ServerEnctbl
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.se.release)
+	return c.Conn.Close()
+}
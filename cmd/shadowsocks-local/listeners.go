@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Listeners in the listeners option can be added and removed at runtime from
+// admin interface. Changes are kept when switching profile and reloading
+// config, and written to the top level listeners of config file if asked to,
+// otherwise they are lost on restart.
+
+var listenerTypes = map[string]bool{"socks": true, "http": true, "tunnel": true}
+
+// checkListeners checks local listeners don't share ports and listeners
+// option is complete.
+func checkListeners(config *ss.Config) error {
+	used := map[int]string{}
+	use := func(option string, port int) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("%s: invalid port %d", option, port)
+		}
+		if other, ok := used[port]; ok {
+			return fmt.Errorf("%s: port %d is also used by %s", option, port, other)
+		}
+		used[port] = option
+		return nil
+	}
+	if config.LocalPort != 0 {
+		use("local_port", config.LocalPort)
+	}
+	for port := range config.LocalPorts {
+		n, _ := strconv.Atoi(port)
+		if err := use("local_ports", n); err != nil {
+			return err
+		}
+	}
+	if config.LocalHTTPPort != 0 {
+		if err := use("local_http_port", config.LocalHTTPPort); err != nil {
+			return err
+		}
+	}
+	if config.LocalRedirPort != 0 {
+		if err := use("local_redir_port", config.LocalRedirPort); err != nil {
+			return err
+		}
+	}
+	for _, l := range config.Listeners {
+		if !listenerTypes[l.Type] {
+			return fmt.Errorf("listeners: port %d has unknown type %q, should be socks, http or tunnel", l.Port, l.Type)
+		}
+		if l.Type == "tunnel" && !ss.HasPort(l.Target) {
+			return fmt.Errorf("listeners: tunnel at port %d needs target in the form of host:port", l.Port)
+		}
+		if l.Type != "tunnel" && l.Target != "" {
+			return fmt.Errorf("listeners: target is only used by tunnel, port %d is %s", l.Port, l.Type)
+		}
+		if err := use("listeners", l.Port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withAddedListeners returns a copy of config with listeners changed by
+// admin API. local must be locked.
+func withAddedListeners(config *ss.Config) *ss.Config {
+	if len(local.added) == 0 {
+		return config
+	}
+	c := *config
+	c.Listeners = nil
+	for _, l := range config.Listeners {
+		if _, ok := local.added[l.Port]; !ok {
+			c.Listeners = append(c.Listeners, l)
+		}
+	}
+	for _, l := range local.added {
+		if l != nil {
+			c.Listeners = append(c.Listeners, *l)
+		}
+	}
+	sort.Slice(c.Listeners, func(i, j int) bool { return c.Listeners[i].Port < c.Listeners[j].Port })
+	return &c
+}
+
+// changeListener adds l, or removes listener at port if l is nil, and applies
+// it to the active profile.
+func changeListener(port int, l *ss.ListenerConfig, persist bool) error {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	local.Lock()
+	old, hadOld := local.added[port]
+	if local.added == nil {
+		local.added = map[int]*ss.ListenerConfig{}
+	}
+	local.added[port] = l
+	profile := local.profile
+	local.Unlock()
+	if err := applyProfile(profile); err != nil {
+		local.Lock()
+		if hadOld {
+			local.added[port] = old
+		} else {
+			delete(local.added, port)
+		}
+		local.Unlock()
+		// restore listeners replaced
+		if err := applyProfile(profile); err != nil {
+			log.Println("restoring listeners:", err)
+		}
+		return err
+	}
+	if persist {
+		return persistListener(local.configFile, port, l)
+	}
+	return nil
+}
+
+// persistListener writes the change to listeners option of config file.
+// Only the value of listeners is rewritten, other options are kept as they
+// are, and the file is replaced at once, so it's never seen half written.
+func persistListener(file string, port int, l *ss.ListenerConfig) error {
+	file, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	start, end, err := topLevelValue(data, "listeners")
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	var old []json.RawMessage
+	if start >= 0 {
+		if err = json.Unmarshal(data[start:end], &old); err != nil {
+			return fmt.Errorf("%s: listeners: %v", file, err)
+		}
+	}
+	listeners := []json.RawMessage{}
+	for _, v := range old {
+		var o struct{ Port int }
+		if json.Unmarshal(v, &o) == nil && o.Port == port {
+			continue
+		}
+		listeners = append(listeners, v)
+	}
+	if l != nil {
+		v, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, v)
+	}
+	value, err := json.MarshalIndent(listeners, "\t", "\t")
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	if start >= 0 {
+		out = append(append(append(out, data[:start]...), value...), data[end:]...)
+	} else {
+		// add as the last option
+		close := bytes.LastIndexByte(data, '}')
+		head := bytes.TrimRight(data[:close], " \t\r\n")
+		out = append(out, head...)
+		if head[len(head)-1] != '{' {
+			out = append(out, ',')
+		}
+		out = append(out, "\n\t\"listeners\": "...)
+		out = append(append(append(out, value...), '\n'), data[close:]...)
+	}
+	return replaceFile(file, out)
+}
+
+// topLevelValue returns where the value of key is in JSON object data, start
+// is -1 if there's no such key.
+func topLevelValue(data []byte, key string) (start, end int, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return 0, 0, errors.New("config should be a JSON object")
+	}
+	start = -1
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return 0, 0, err
+		}
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return 0, 0, err
+		}
+		// the last one is used if given more than once
+		if t == key {
+			end = int(dec.InputOffset())
+			start = end - len(raw)
+		}
+	}
+	return start, end, nil
+}
+
+// replaceFile writes data to a temporary file in the same directory then
+// renames it to file, keeping permission of file.
+func replaceFile(file string, data []byte) error {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// activeListeners returns listeners serving now, ordered by port.
+func activeListeners() []ss.ListenerConfig {
+	local.Lock()
+	defer local.Unlock()
+	var list []ss.ListenerConfig
+	for port, ll := range local.listener {
+		n, _ := strconv.Atoi(port)
+		list = append(list, ss.ListenerConfig{Port: n, Type: ll.kind, Group: ll.group, Target: ll.target})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list
+}
+
+// GET returns active listeners in JSON. POST with action add and port, type,
+// group and target of the listener adds it, with action remove and port
+// removes listener at the port. With persist set to true, config file is
+// updated.
+func handleListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if err := postListener(r); err != nil {
+			log.Println("change listeners:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activeListeners())
+}
+
+func postListener(r *http.Request) error {
+	port, err := strconv.Atoi(r.FormValue("port"))
+	if err != nil {
+		return errors.New("port should be a number")
+	}
+	persist := r.FormValue("persist") == "true"
+	switch r.FormValue("action") {
+	case "add":
+		local.Lock()
+		_, used := local.listener[strconv.Itoa(port)]
+		local.Unlock()
+		if used {
+			return fmt.Errorf("port %d is already listened", port)
+		}
+		l := &ss.ListenerConfig{
+			Port:   port,
+			Type:   r.FormValue("type"),
+			Group:  r.FormValue("group"),
+			Target: r.FormValue("target"),
+		}
+		if l.Type == "" {
+			l.Type = "socks"
+		}
+		return changeListener(port, l, persist)
+	case "remove":
+		if !isListenersPort(port) {
+			return fmt.Errorf("port %d is not in listeners", port)
+		}
+		return changeListener(port, nil, persist)
+	}
+	return errors.New("action should be add or remove")
+}
+
+// isListenersPort tells whether port is served by listeners option of the
+// active profile, other local ports can't be removed.
+func isListenersPort(port int) bool {
+	local.Lock()
+	base, profile := local.baseConfig, local.profile
+	local.Unlock()
+	config, err := base.GetProfile(profile)
+	if err != nil {
+		return false
+	}
+	local.Lock()
+	defer local.Unlock()
+	if l, ok := local.added[port]; ok {
+		return l != nil
+	}
+	for _, l := range config.Listeners {
+		if l.Port == port {
+			return true
+		}
+	}
+	return false
+}
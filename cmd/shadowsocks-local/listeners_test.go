@@ -0,0 +1,119 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPersistListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.json")
+	const head = `{
+	"server": "example.com",
+	"method": "aes-256-gcm",
+	"unknown_option": {"z": 1, "a": 2},
+	"local_port": 1080`
+	if err = ioutil.WriteFile(file, []byte(head+"\n}\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = persistListener(file, 1081, &ss.ListenerConfig{Port: 1081, Type: "http"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = persistListener(file, 1082, &ss.ListenerConfig{Port: 1082, Type: "tunnel", Target: "example.org:53"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = persistListener(file, 1081, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), head+",\n") {
+		t.Errorf("other options should be kept as they are, got\n%s", data)
+	}
+	config, err := ss.ParseConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Listeners) != 1 || config.Listeners[0].Port != 1082 || config.Listeners[0].Target != "example.org:53" {
+		t.Errorf("got listeners %v, should only have tunnel at 1082", config.Listeners)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("permission of config file should be kept, got %v %v", fi.Mode(), err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary files left in %s", dir)
+	}
+}
+
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestUpdateListenersKeepsOld(t *testing.T) {
+	local.listener = map[string]*localListener{}
+	defer func() {
+		for _, ll := range local.listener {
+			ll.ln.Close()
+		}
+		local.listener = nil
+	}()
+	socks, tunnel := freePort(t), freePort(t)
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+
+	if err = updateListeners("127.0.0.1", map[string]listenerSpec{
+		socks:  {kind: "socks"},
+		tunnel: {kind: "tunnel", target: "example.org:53"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	old := local.listener[socks]
+
+	tests := []map[string]listenerSpec{
+		// new port can't be listened on
+		{socks: {kind: "socks"}, busyPort: {kind: "http"}},
+		// port replaced on the same address is restored
+		{socks: {kind: "http"}, busyPort: {kind: "http"}},
+	}
+	for i, specs := range tests {
+		if err = updateListeners("127.0.0.1", specs); err == nil {
+			t.Fatalf("%d: listening on busy port should fail", i)
+		}
+		if len(local.listener) != 2 || local.listener[socks].kind != "socks" || local.listener[tunnel] == nil {
+			t.Errorf("%d: listeners should be kept, got %v", i, local.listener)
+		}
+		if i == 0 && local.listener[socks] != old {
+			t.Errorf("unchanged listener should not be reopened")
+		}
+		for port := range local.listener {
+			c, err := net.Dial("tcp", "127.0.0.1:"+port)
+			if err != nil {
+				t.Errorf("%d: listener at %s should be open: %v", i, port, err)
+				continue
+			}
+			c.Close()
+		}
+	}
+}
@@ -1,207 +1,281 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"flag"
+	"fmt"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
-	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var debug ss.DebugLog
 
-var (
-	errAddrType      = errors.New("socks addr type not supported")
-	errVer           = errors.New("socks version not supported")
-	errMethod        = errors.New("socks only support 1 method now")
-	errAuthExtraData = errors.New("socks authentication get extra data")
-	errReqExtraData  = errors.New("socks request get extra data")
-	errCmd           = errors.New("socks command not supported")
-)
+// Clients can choose server group by passing "exit=group" as socks username,
+// password is ignored.
+const exitHintPrefix = "exit="
+
+// socksGSSAPI authenticates socks clients if not nil.
+var socksGSSAPI ss.GSSAPIProvider
+
+// handShake returns the server group given in socks username as routing
+// hint, if the client uses username/password authentication.
+//
+// If socks_gssapi is set, clients must authenticate with GSSAPI, and the
+// returned conn encapsulates data in GSSAPI messages.
+func handShake(conn net.Conn) (c net.Conn, hint string, err error) {
+	c, err = ss.SocksHandShakeGSSAPI(conn, func(user string) error {
+		if !strings.HasPrefix(user, exitHintPrefix) {
+			return nil
+		}
+		hint = user[len(exitHintPrefix):]
+		if len(getServers(hint)) == 0 {
+			return fmt.Errorf("no server group named %s", hint)
+		}
+		return nil
+	}, socksGSSAPI)
+	return
+}
 
-const (
-	socksVer5       = 5
-	socksCmdConnect = 1
-)
+type ServerEnctbl struct {
+	server string
+	enctbl *ss.EncryptTable
+	stat   serverStat
+	slots  chan struct{} // limits concurrent connections, nil if unlimited
+	region string
 
-func handShake(conn net.Conn) (err error) {
-	const (
-		idVer     = 0
-		idNmethod = 1
-	)
-	// version identification and method selection message in theory can have
-	// at most 256 methods, plus version and nmethod field in total 258 bytes
-	// the current rfc defines only 3 authentication methods (plus 2 reserved),
-	// so it won't be such long in practice
-
-	buf := make([]byte, 258, 258)
-
-	var n int
-	// make sure we get the nmethod field
-	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
-		return
+	password string // hopping port is derived from password
+
+	mu   sync.Mutex       // protects hop and caps updated by negotiation
+	hop  *ss.PortHop      // nil if port hopping is disabled
+	caps *ss.Capabilities // nil if not negotiated
+
+	// addresses to connect to server in preference order, e.g. of different
+	// ISPs, empty to use server address
+	addrs []string
+
+	plugin *ss.Plugin  // connections go through plugin if not nil
+	tls    *tls.Config // connections are inside TLS if not nil
+}
+
+// dialAddrs returns addresses to connect to server in preference order.
+func (se *ServerEnctbl) dialAddrs() []string {
+	if se.plugin != nil {
+		return []string{se.plugin.LocalAddr()}
 	}
-	if buf[idVer] != socksVer5 {
-		return errVer
+	if len(se.addrs) == 0 {
+		return []string{se.server}
 	}
-	nmethod := int(buf[idNmethod])
-	msgLen := nmethod + 2
-	if n == msgLen { // handshake done, common case
-		// do nothing, jump directly to send confirmation
-	} else if n < msgLen { // has more methods to read, rare case
-		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
-			return
-		}
-	} else { // error, should not get extra data
-		return errAuthExtraData
+	return se.addrs
+}
+
+// udpAddr returns the address UDP relay sends datagrams to, which doesn't go
+// through plugin.
+func (se *ServerEnctbl) udpAddr() string {
+	if len(se.addrs) == 0 {
+		return se.server
 	}
-	// send confirmation: version 5, no authentication required
-	_, err = conn.Write([]byte{socksVer5, 0})
-	return
+	return se.addrs[0]
 }
 
-func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
-	const (
-		idVer   = 0
-		idCmd   = 1
-		idType  = 3 // address type index
-		idIP0   = 4 // ip addres start index
-		idDmLen = 4 // domain address length index
-		idDm0   = 5 // domain address start index
-
-		typeIP = 1 // type is ip address
-		typeDm = 3 // type is domain address
-
-		lenIP     = 3 + 1 + 4 + 2 // 3(ver+cmd+rsv) + 1addrType + 4ip + 2port
-		lenDmBase = 3 + 1 + 1 + 2 // 3 + 1addrType + 1addrLen + 2port, plus addrLen
-	)
-	// refer to getRequest in server.go for why set buffer size to 263
-	buf := make([]byte, 263, 263)
-	var n int
-	// read till we get possible domain length field
-	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
-		return
+// hopAddr returns addr with port replaced by the hopping port of current time
+// slot if port hopping is enabled.
+func (se *ServerEnctbl) hopAddr(addr string) string {
+	se.mu.Lock()
+	hop := se.hop
+	se.mu.Unlock()
+	if hop == nil || se.plugin != nil {
+		return addr
 	}
-	// check version and cmd
-	if buf[idVer] != socksVer5 {
-		err = errVer
-		return
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	hp := hop.Port(se.password, p, hop.Slot(time.Now()))
+	return ss.JoinHostPort(host, strconv.Itoa(hp))
+}
+
+// dial connects to one address of server.
+func (se *ServerEnctbl) dial(addr string) (net.Conn, error) {
+	hop := se.hopAddr(addr)
+	conn, err := ss.DialMarked(hop)
+	if err != nil && hop != addr {
+		// hopping port may be blocked or the clock skewed
+		debug.Printf("hopping port %s: %v, try %s\n", hop, err, addr)
+		conn, err = ss.DialMarked(addr)
 	}
-	if buf[idCmd] != socksCmdConnect {
-		err = errCmd
-		return
+	if err == nil && se.tls != nil {
+		conn, err = ss.ClientTLSConn(conn, se.tls)
 	}
+	return conn, err
+}
 
-	reqLen := lenIP
-	if buf[idType] == typeDm {
-		reqLen = int(buf[idDmLen]) + lenDmBase
-	} else if buf[idType] != typeIP {
-		err = errAddrType
+var servers struct {
+	sync.RWMutex // protects srvenc and group, which are replaced when switching profile
+	srvenc       []*ServerEnctbl
+	group        map[string][]*ServerEnctbl
+	idx          uint8
+}
+
+func parseServers(config *ss.Config) (srvenc []*ServerEnctbl, group map[string][]*ServerEnctbl, err error) {
+	hop, err := ss.NewPortHop(config.PortHop, config.PortHopInterval)
+	if err != nil {
 		return
 	}
+	// the same servers as ss.Client
+	list, err := ss.ClientServers(config)
+	if err != nil {
+		return
+	}
+	srvenc = make([]*ServerEnctbl, len(list))
+	for i, s := range list {
+		srvenc[i] = &ServerEnctbl{server: s.Addr, enctbl: s.EncTbl, hop: hop, password: s.Password}
+	}
 
-	if n == reqLen {
-		// common case, do nothing
-	} else if n < reqLen { // rare case
-		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+	byAddr := make(map[string]*ServerEnctbl, len(srvenc))
+	for _, se := range srvenc {
+		byAddr[se.server] = se
+	}
+	for s, max := range config.ServerMaxConn {
+		se, ok := byAddr[s]
+		if !ok {
+			err = fmt.Errorf("server_max_conn: %s is not a configured server", s)
 			return
 		}
-	} else {
-		err = errReqExtraData
-		return
+		se.slots = newSlots(max)
 	}
-
-	rawaddr = buf[idType:reqLen]
-
-	if debug {
-		if buf[idType] == typeDm {
-			host = string(buf[idDm0 : idDm0+buf[idDmLen]])
-		} else if buf[idType] == typeIP {
-			addrIp := make(net.IP, 4)
-			copy(addrIp, buf[idIP0:idIP0+4])
-			host = addrIp.String()
+	for s, addrs := range config.ServerAddrs {
+		se, ok := byAddr[s]
+		if !ok {
+			err = fmt.Errorf("server_addrs: %s is not a configured server", s)
+			return
+		}
+		_, port, _ := net.SplitHostPort(se.server)
+		for _, a := range addrs {
+			host, p, err := ss.SplitHostPortDefault(a, port)
+			if err != nil {
+				return nil, nil, err
+			}
+			se.addrs = append(se.addrs, ss.JoinHostPort(host, p))
 		}
-		var port int16
-		sb := bytes.NewBuffer(buf[reqLen-2 : reqLen])
-		binary.Read(sb, binary.BigEndian, &port)
-		host += ":" + strconv.Itoa(int(port))
 	}
-
-	return
-}
-
-type ServerEnctbl struct {
-	server string
-	enctbl *ss.EncryptTable
-}
-
-var servers struct {
-	srvenc []*ServerEnctbl
-	idx    uint8
-}
-
-func initServers(config *ss.Config) {
-	if len(config.ServerPassword) == 0 {
-		// only one encryption table
-		enctbl := ss.GetTable(config.Password)
-		srvPort := strconv.Itoa(config.ServerPort)
-		srvArr := config.GetServerArray()
-		n := len(srvArr)
-		servers.srvenc = make([]*ServerEnctbl, n, n)
-
-		for i, s := range srvArr {
-			if ss.HasPort(s) {
-				log.Println("ignore server_port option for server", s)
-				servers.srvenc[i] = &ServerEnctbl{s, enctbl}
-			} else {
-				servers.srvenc[i] = &ServerEnctbl{s + ":" + srvPort, enctbl}
+	for s, region := range config.ServerRegion {
+		se, ok := byAddr[s]
+		if !ok {
+			err = fmt.Errorf("server_region: %s is not a configured server", s)
+			return
+		}
+		se.region = region
+	}
+	if config.TLS {
+		if config.Plugin != "" {
+			err = errors.New("tls can't be used with plugin")
+			return
+		}
+		for _, se := range srvenc {
+			if se.tls, err = ss.ClientTLSConfig(se.server, config.TLSSNI, config.TLSFingerprint); err != nil {
+				return
 			}
 		}
-	} else {
-		n := len(config.ServerPassword)
-		servers.srvenc = make([]*ServerEnctbl, n, n)
-
-		tblCache := make(map[string]*ss.EncryptTable)
-		i := 0
-		for s, passwd := range config.ServerPassword {
-			if !ss.HasPort(s) {
-				log.Fatal("no port for server %s, please specify port in the form of %s:port", s, s)
+	}
+	if config.Plugin != "" {
+		for _, se := range srvenc {
+			if se.plugin, err = serverPlugin(se.server, config.Plugin, config.PluginOpts); err != nil {
+				return
 			}
-			tbl, ok := tblCache[passwd]
+		}
+	}
+	group = make(map[string][]*ServerEnctbl, len(config.ServerGroup))
+	for name, members := range config.ServerGroup {
+		for _, s := range members {
+			se, ok := byAddr[s]
 			if !ok {
-				tbl = ss.GetTable(passwd)
-				tblCache[passwd] = tbl
+				err = fmt.Errorf("server %s in group %s is not a configured server", s, name)
+				return
 			}
-			servers.srvenc[i] = &ServerEnctbl{s, tbl}
-			i++
+			group[name] = append(group[name], se)
 		}
 	}
-	for _, se := range servers.srvenc {
-		log.Println("available remote server", se.server)
+	// local ports may also refer to a single server by its address
+	for port, spec := range listenerSpecs(config) {
+		name := spec.group
+		if _, ok := group[name]; ok || name == "" {
+			continue
+		}
+		se, ok := byAddr[name]
+		if !ok {
+			err = fmt.Errorf("local port %s: no server or server group named %s", port, name)
+			return
+		}
+		group[name] = []*ServerEnctbl{se}
 	}
 	return
 }
 
-// select one server to connect in round robin order
-func createServerConn(rawaddr []byte, addr string) (remote *ss.Conn, err error) {
-	n := len(servers.srvenc)
-	if n == 1 {
-		se := servers.srvenc[0]
-		debug.Printf("connecting to %s via %s\n", addr, se.server)
-		return ss.DialWithRawAddr(rawaddr, se.server, se.enctbl)
+// getServers returns servers in the named group, or all servers if name is
+// empty.
+func getServers(name string) []*ServerEnctbl {
+	servers.RLock()
+	defer servers.RUnlock()
+	if name == "" {
+		return servers.srvenc
+	}
+	return servers.group[name]
+}
+
+func dialServer(se *ServerEnctbl, rawaddr []byte) (*ss.Conn, error) {
+	var conn net.Conn
+	var err error
+	var rtt time.Duration
+	for _, addr := range se.dialAddrs() {
+		start := time.Now()
+		conn, err = se.dial(addr)
+		rtt = time.Since(start)
+		if err == nil {
+			break
+		}
+		if len(se.addrs) > 1 {
+			debug.Printf("server %s: %v\n", se.server, err)
+		}
+	}
+	se.stat.record(rtt, err)
+	if err != nil {
+		se.release()
+		return nil, err
+	}
+	// connecting time is close to RTT, it may also include DNS lookup
+	ss.TuneConn(conn, rtt)
+	if se.slots != nil {
+		conn = &limitedConn{Conn: conn, se: se}
+	}
+	return ss.NewConnWithRawAddr(conn, rawaddr, se.enctbl), nil
+}
+
+// select one server in the group to connect, in the order decided by balance
+// strategy. Servers reached maximum connections are skipped, if all are
+// skipped, wait briefly for the first one.
+func createServerConn(rawaddr []byte, addr, group string) (remote *ss.Conn, err error) {
+	srvenc := getServers(group)
+	if len(srvenc) == 0 {
+		return nil, fmt.Errorf("no server in group %s", group)
 	}
 
-	id := servers.idx
-	servers.idx++ // it's ok for concurrent update
-	for i := 0; i < n; i++ {
-		se := servers.srvenc[(int(id)+i)%n]
-		remote, err = ss.DialWithRawAddr(rawaddr, se.server, se.enctbl)
+	var full *ServerEnctbl
+	for _, se := range orderServers(srvenc) {
+		if !se.acquire(0) {
+			debug.Printf("server %s reached max connections\n", se.server)
+			if full == nil {
+				full = se
+			}
+			continue
+		}
+		remote, err = dialServer(se, rawaddr)
 		if err == nil {
 			debug.Printf("connected to %s via %s\n", addr, se.server)
 			return
@@ -209,25 +283,61 @@ func createServerConn(rawaddr []byte, addr string) (remote *ss.Conn, err error)
 			log.Println("error connecting to shadowsocks server:", err)
 		}
 	}
+	if full == nil {
+		return
+	}
+	if !full.acquire(maxConnQueueTime) {
+		err = fmt.Errorf("server %s reached max connections", full.server)
+		log.Println(err)
+		return
+	}
+	if remote, err = dialServer(full, rawaddr); err == nil {
+		debug.Printf("connected to %s via %s\n", addr, full.server)
+	} else {
+		log.Println("error connecting to shadowsocks server:", err)
+	}
 	return
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, group string) {
 	if debug {
 		debug.Printf("socks connect from %s\n", conn.RemoteAddr().String())
 	}
 	defer conn.Close()
+	defer ss.RecoverPanic(conn)
+	activityStart()
+	defer activityEnd()
 
-	var err error = nil
-	if err = handShake(conn); err != nil {
+	// socks clients should not take long to send request
+	ss.SetHandshakeDeadline(conn)
+	c, hint, err := handShake(conn)
+	if err != nil {
 		log.Println("socks handshake:", err)
 		return
 	}
-	rawaddr, addr, err := getRequest(conn)
+	if c != conn {
+		defer c.Close()
+		conn = c
+	}
+	if hint != "" {
+		debug.Printf("use server group %s given by client\n", hint)
+		group = hint
+	}
+	cmd, rawaddr, addr, err := ss.ReadSocksRequest(conn)
 	if err != nil {
 		log.Println("error getting request:", err)
 		return
 	}
+	ss.ClearDeadline(conn)
+	if cmd == ss.SocksCmdUDPAssociate {
+		if socksGSSAPI != nil {
+			// datagrams would have to be encapsulated too
+			log.Println("socks UDP associate is not supported with GSSAPI")
+			return
+		}
+		handleUDPAssociate(conn, group)
+		return
+	}
 	// Sending connection established message immediately to client.
 	// This some round trip time for creating socks connection with the client.
 	// But if connection failed, the client will get connection reset error.
@@ -236,63 +346,455 @@ func handleConnection(conn net.Conn) {
 		debug.Println("send connection confirmation:", err)
 		return
 	}
+	relayConn(conn, rawaddr, addr, group)
+}
+
+// relayConn relays conn, whose request to addr has been read, through a
+// server in group.
+func relayConn(conn net.Conn, rawaddr []byte, addr, group string) {
+	ss.Audit(conn.RemoteAddr().String(), addr)
+	if captiveBypass(addr) {
+		relayDirect(conn, addr)
+		return
+	}
+	switch aclAction(addr) {
+	case ss.ACLReject:
+		return
+	case ss.ACLDirect:
+		relayDirect(conn, addr)
+		return
+	}
+	if ss.CaptureTarget(addr) {
+		conn = ss.NewCaptureConn(conn, conn.RemoteAddr().String(), addr, true)
+	}
+	if ttfbEnabled {
+		conn = newTTFBConn(conn, addr)
+	}
 
-	remote, err := createServerConn(rawaddr, addr)
+	remote, err := createServerConn(rawaddr, addr, group)
 	if err != nil {
-		if len(servers.srvenc) > 1 {
+		if len(getServers(group)) > 1 {
 			log.Println("Failed connect to all avaiable shadowsocks server")
 		}
 		return
 	}
-	defer remote.Close()
-
 	c := make(chan byte, 2)
-	go ss.Pipe(conn, remote, c)
-	go ss.Pipe(remote, conn, c)
+	if retryEnabled() {
+		relay := &replayRelay{remote: remote}
+		defer func() {
+			relay.getRemote().Close()
+		}()
+		go relay.up(conn, c)
+		go relay.down(conn, rawaddr, addr, group, c)
+	} else {
+		defer remote.Close()
+		go ss.Pipe(conn, remote, c)
+		go ss.Pipe(remote, conn, c)
+	}
 	<-c // close the other connection whenever one connection is closed
 	debug.Println("closing")
 }
 
-func run(port string) {
-	ln, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Printf("starting local socks5 server at port %v ...\n", port)
+// run accepts connections on ln, which are served by the given server group.
+func run(ln net.Listener, group string) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("accept:", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("accept:", err)
+				continue
+			}
+			// listener closed when switching profile
+			debug.Println("accept:", err)
+			return
 		}
-		go handleConnection(conn)
+		go handleConnection(conn, group)
 	}
 }
 
 func enoughOptions(config *ss.Config) bool {
-	return config.Server != nil && config.ServerPort != 0 &&
-		config.LocalPort != 0 && config.Password != ""
+	// discovered servers have their ports
+	return config.Server != nil && (config.ServerPort != 0 || config.ServerDiscovery != "") &&
+		config.Password != ""
+}
+
+func checkConfig(config *ss.Config) error {
+	if err := ss.CheckMethod(config.Method); err != nil {
+		return ss.NewStartupError(ss.ExitCrypto, err)
+	}
+	if err := ss.SelfTest(config.Method); err != nil {
+		return ss.NewStartupError(ss.ExitCrypto, err)
+	}
+	if err := checkBalance(config.Balance); err != nil {
+		return err
+	}
+	if err := ss.CheckStrict(config, false); err != nil {
+		return ss.NewStartupError(ss.ExitConfig, err)
+	}
+	// profiles may change options checked when parsing
+	if err := ss.CheckGlobals(config); err != nil {
+		return ss.NewStartupError(ss.ExitConfig, err)
+	}
+	if config.LocalRedirPort != 0 && !redirSupported {
+		return errors.New("local_redir_port is only supported on Linux")
+	}
+	if err := checkListeners(config); err != nil {
+		return err
+	}
+	for _, addrs := range config.ServerAddrs {
+		for _, a := range addrs {
+			if err := ss.CheckPlainMethod(config.Method, a); err != nil {
+				return ss.NewStartupError(ss.ExitCrypto, err)
+			}
+		}
+	}
+	if len(config.ServerPassword) == 0 {
+		if !enoughOptions(config) {
+			return errors.New("must specify server address, password and server port")
+		}
+		for _, s := range config.GetServerArray() {
+			if err := ss.CheckPlainMethod(config.Method, s); err != nil {
+				return ss.NewStartupError(ss.ExitCrypto, err)
+			}
+		}
+		return nil
+	}
+	if config.Password != "" || config.ServerPort != 0 || config.GetServerArray() != nil {
+		log.Println("given server_password, ignore server, server_port and password option:", config)
+	}
+	for s, _ := range config.ServerPassword {
+		if !ss.HasPort(s) {
+			return fmt.Errorf("no port for server %s, please specify port in the form of %s:port", s, s)
+		}
+		if err := ss.ValidateAddr(s); err != nil {
+			return err
+		}
+		if err := ss.CheckPlainMethod(config.Method, s); err != nil {
+			return ss.NewStartupError(ss.ExitCrypto, err)
+		}
+	}
+	return nil
+}
+
+// The active profile and the listeners serving it, keyed by port. Switching
+// to a profile with different local ports replaces the listeners, connections
+// already established are not affected.
+type listenerSpec struct {
+	kind   string // socks, http, redir or tunnel
+	group  string // server group serving the listener, all servers if empty
+	target string // destination of tunnel
+}
+
+type localListener struct {
+	ln   net.Listener
+	addr string
+	listenerSpec
+}
+
+var local struct {
+	sync.Mutex
+	configFile string
+	baseConfig *ss.Config
+	cmdConfig  *ss.Config
+	profile    string
+	listener   map[string]*localListener
+	// listeners added by admin API keyed by port, nil if removed
+	added map[int]*ss.ListenerConfig
+}
+
+// listenerSpecs returns the listeners config asks for, keyed by port.
+func listenerSpecs(config *ss.Config) map[string]listenerSpec {
+	specs := map[string]listenerSpec{strconv.Itoa(config.LocalPort): {kind: "socks"}}
+	for port, name := range config.LocalPorts {
+		specs[port] = listenerSpec{kind: "socks", group: name}
+	}
+	if config.LocalHTTPPort != 0 {
+		specs[strconv.Itoa(config.LocalHTTPPort)] = listenerSpec{kind: "http"}
+	}
+	if config.LocalRedirPort != 0 {
+		specs[strconv.Itoa(config.LocalRedirPort)] = listenerSpec{kind: "redir"}
+	}
+	for _, l := range config.Listeners {
+		specs[strconv.Itoa(l.Port)] = listenerSpec{l.Type, l.Group, l.Target}
+	}
+	return specs
+}
+
+// updateListeners makes local listeners on addr match specs. New listeners
+// are opened before old ones are closed, except those on the same address
+// and port, which are closed first to free the port and opened again if
+// updating fails. So the running listeners are kept if any port can't be
+// listened on.
+func updateListeners(addr string, specs map[string]listenerSpec) error {
+	started := map[string]*localListener{}
+	closed := map[string]*localListener{}
+	fail := func(err error) error {
+		for _, ll := range started {
+			ll.ln.Close()
+		}
+		for port, old := range closed {
+			ln, lerr := listenLocal(old.addr, port, old.kind)
+			if lerr != nil {
+				log.Printf("restoring listener at port %v: %v\n", port, lerr)
+				delete(local.listener, port)
+				continue
+			}
+			ll := &localListener{ln, old.addr, old.listenerSpec}
+			local.listener[port] = ll
+			serveLocal(port, ll)
+		}
+		return err
+	}
+	for port, spec := range specs {
+		old, ok := local.listener[port]
+		if ok && old.addr == addr && old.listenerSpec == spec {
+			continue
+		}
+		if ok && old.addr == addr {
+			old.ln.Close()
+			closed[port] = old
+		}
+		ln, err := listenLocal(addr, port, spec.kind)
+		if err != nil && ok && closed[port] == nil {
+			// old address may overlap, e.g. 0.0.0.0 and 127.0.0.1
+			old.ln.Close()
+			closed[port] = old
+			ln, err = listenLocal(addr, port, spec.kind)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		started[port] = &localListener{ln, addr, spec}
+	}
+	for port, ll := range local.listener {
+		if _, ok := specs[port]; !ok {
+			ll.ln.Close()
+			delete(local.listener, port)
+		} else if started[port] != nil && closed[port] == nil {
+			ll.ln.Close()
+		}
+	}
+	for port, ll := range started {
+		local.listener[port] = ll
+		serveLocal(port, ll)
+	}
+	return nil
+}
+
+func listenLocal(addr, port, kind string) (net.Listener, error) {
+	if kind == "redir" {
+		return listenRedir(ss.JoinHostPort(addr, port))
+	}
+	return net.Listen("tcp", ss.JoinHostPort(addr, port))
+}
+
+// serveLocal starts serving listener ll at port.
+func serveLocal(port string, ll *localListener) {
+	var via string
+	if ll.group != "" {
+		via = " for " + ll.group
+	}
+	switch ll.kind {
+	case "http":
+		log.Printf("starting local http proxy at port %v%s ...\n", port, via)
+		go runHTTP(ll.ln, ll.group)
+	case "redir":
+		log.Printf("starting local transparent proxy at port %v ...\n", port)
+		go runRedir(ll.ln)
+	case "tunnel":
+		log.Printf("starting local tunnel at port %v to %s%s ...\n", port, ll.target, via)
+		go runTunnel(ll.ln, ll.target, ll.group)
+	default:
+		log.Printf("starting local socks5 server at port %v%s ...\n", port, via)
+		go run(ll.ln, ll.group)
+	}
+}
+
+// loadProfile returns the named profile applied to base config and command
+// line options, with its servers discovered, checked and parsed.
+func loadProfile(name string) (config *ss.Config, srvenc []*ServerEnctbl, group map[string][]*ServerEnctbl, err error) {
+	local.Lock()
+	base := local.baseConfig
+	local.Unlock()
+	if config, err = base.GetProfile(name); err != nil {
+		return nil, nil, nil, ss.NewStartupError(ss.ExitConfig, err)
+	}
+	ss.UpdateConfig(config, local.cmdConfig)
+	local.Lock()
+	config = withAddedListeners(config)
+	local.Unlock()
+	if config, err = ss.ExpandServerURIs(config); err != nil {
+		return nil, nil, nil, ss.NewStartupError(ss.ExitConfig, err)
+	}
+	if config, err = applyDiscovery(config); err != nil {
+		return nil, nil, nil, ss.NewStartupError(ss.ExitConfig, err)
+	}
+	if config, err = applyServerList(config); err != nil {
+		return nil, nil, nil, ss.NewStartupError(ss.ExitConfig, err)
+	}
+	if err = checkConfig(config); err != nil {
+		return nil, nil, nil, ss.NewStartupError(ss.ExitConfig, err)
+	}
+
+	srvenc, group, err = parseServers(config)
+	if err != nil {
+		return nil, nil, nil, ss.NewStartupError(ss.ExitConfig, err)
+	}
+	return
+}
+
+// held while switching profile, so that configs are applied in the order they
+// are loaded, and while changing listeners, which switches profile again on
+// failure
+var profileMu sync.Mutex
+
+// switchProfile returns StartupError, so that the cause of failure can be told
+// when starting.
+func switchProfile(name string) error {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	return applyProfile(name)
+}
+
+// applyProfile switches to profile like switchProfile, profileMu must be held.
+func applyProfile(name string) error {
+	config, srvenc, group, err := loadProfile(name)
+	if err != nil {
+		return err
+	}
+	if config.LocalPort == 0 {
+		return ss.NewStartupError(ss.ExitConfig, errors.New("must specify local port"))
+	}
+	rules, err := loadACL(config.ACL, config.ACLGeoIP)
+	if err != nil {
+		return ss.NewStartupError(ss.ExitConfig, err)
+	}
+	direct, err := loadRoutes(config.DirectRoutes, config.ACLGeoIP, config.DirectCountries)
+	if err != nil {
+		return ss.NewStartupError(ss.ExitConfig, err)
+	}
+	var gssapi ss.GSSAPIProvider
+	if config.SocksGSSAPI != "" {
+		if gssapi, err = ss.GetGSSAPIProvider(config.SocksGSSAPI); err != nil {
+			return ss.NewStartupError(ss.ExitConfig, err)
+		}
+	}
+
+	local.Lock()
+	defer local.Unlock()
+	if err = updateListeners(config.BindAddress, listenerSpecs(config)); err != nil {
+		return ss.NewStartupError(ss.ExitBind, err)
+	}
+	for _, se := range srvenc {
+		log.Println("available remote server", se.server)
+	}
+	servers.Lock()
+	servers.srvenc = srvenc
+	servers.group = group
+	servers.Unlock()
+	stopUnusedPlugins(srvenc)
+	if config.Negotiate {
+		go negotiate(srvenc)
+	}
+	setRetryBeforeResponse(config.RetryBeforeResponse)
+	ss.ApplyGlobals(config)
+	socksGSSAPI = gssapi
+	setBalance(config.Balance)
+	setRegion(config.Region)
+	setPowerSave(config.PowerSave)
+	setACL(rules)
+	setRoutes(direct, config.DirectRoutes, config.ACLGeoIP, config.DirectCountries)
+	local.profile = name
+	if name != "" {
+		log.Printf("using profile %s\n", name)
+	}
+	return nil
+}
+
+// GET returns the active profile, POST with "name" switches to another.
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if err := switchProfile(r.FormValue("name")); err != nil {
+			log.Println("switch profile:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	local.Lock()
+	fmt.Fprintln(w, local.profile)
+	local.Unlock()
 }
 
 func main() {
-	var configFile, cmdServer string
+	var configFile, cmdServer, profile string
 	var cmdConfig ss.Config
-	var printVer bool
+	var printVer, printVerJSON, jsonErrors, lintProbe bool
+	var migrateConfig string
 
 	flag.BoolVar(&printVer, "version", false, "print version")
+	flag.BoolVar(&printVerJSON, "version-json", false, "print version and build info as JSON object")
 	flag.StringVar(&configFile, "c", "config.json", "specify config file")
-	flag.StringVar(&cmdServer, "s", "", "server address")
+	flag.StringVar(&cmdServer, "s", "", "server address, or ss:// URI with method and password")
 	flag.StringVar(&cmdConfig.Password, "k", "", "password")
+	flag.StringVar(&cmdConfig.Method, "m", "", "encryption method, table or plain (testing only)")
 	flag.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
 	flag.IntVar(&cmdConfig.LocalPort, "l", 0, "local socks5 proxy port")
+	flag.IntVar(&cmdConfig.LocalHTTPPort, "http-port", 0, "local http proxy port")
+	flag.IntVar(&cmdConfig.LocalRedirPort, "redir-port", 0, "local transparent proxy port, Linux only")
+	flag.StringVar(&cmdConfig.BindAddress, "b", "", "address to bind, defaults to all addresses")
+	flag.IntVar(&cmdConfig.Timeout, "t", 0, "connection timeout (in seconds)")
+	flag.StringVar(&profile, "profile", "", "use the named profile in config file")
+	flag.StringVar(&cmdConfig.AdminAddr, "admin", "", "admin interface address, e.g. 127.0.0.1:1090")
 	flag.BoolVar((*bool)(&debug), "d", false, "print debug message")
+	flag.BoolVar(&jsonErrors, "json-errors", false, "print startup error as JSON object")
+	flag.StringVar(&migrateConfig, "migrate-config", "", "write config file with deprecated options migrated to this file and exit")
+	flag.BoolVar(&lintProbe, "lint-probe", false, "also report servers that can't be connected by lint-config command")
 
 	flag.Parse()
+	ss.SetJSONErrors(jsonErrors)
 
 	if printVer {
 		ss.PrintVersion()
 		os.Exit(0)
 	}
+	if printVerJSON {
+		ss.PrintVersionJSON()
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "update" {
+		if flag.NArg() != 1 {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, errors.New("update takes no arguments")))
+		}
+		if err := ss.Update("shadowsocks-local"); err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitUpdate, err))
+		}
+		os.Exit(0)
+	}
+
+	if migrateConfig != "" {
+		if err := ss.MigrateConfigFile(configFile, migrateConfig); err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "lint-config" {
+		if flag.NArg() != 1 {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, errors.New("lint-config takes no arguments")))
+		}
+		issues, err := ss.LintConfigFile(configFile, false, lintProbe)
+		if err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+		}
+		for _, i := range issues {
+			fmt.Println(i)
+		}
+		if len(issues) != 0 {
+			os.Exit(ss.ExitConfig)
+		}
+		fmt.Printf("%s: no issues found\n", configFile)
+		os.Exit(0)
+	}
 
 	cmdConfig.Server = cmdServer
 	ss.SetDebug(debug)
@@ -309,32 +811,66 @@ func main() {
 
 	config, err := ss.ParseConfig(configFile)
 	if err != nil {
-		config = &cmdConfig
+		// copied as cmdConfig overrides profiles
+		c := cmdConfig
+		config = &c
+		ss.SetDefaults(config)
 		if os.IsNotExist(err) {
 			log.Println("config file not found, using all options from command line")
 		} else {
-			log.Printf("error reading config file: %v\n", err)
-			os.Exit(1)
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig,
+				fmt.Errorf("error reading config file: %v", err)))
 		}
-	} else {
-		ss.UpdateConfig(config, &cmdConfig)
 	}
-
-	if len(config.ServerPassword) == 0 {
-		if !enoughOptions(config) {
-			log.Println("must specify server address, password and both server/local port")
-			os.Exit(1)
-		}
-	} else {
-		if config.Password != "" || config.ServerPort != 0 || config.GetServerArray() != nil {
-			log.Println("given server_password, ignore server, server_port and password option:", config)
+	if profile == "" {
+		profile = config.Profile
+	}
+	if cmdConfig.AdminAddr != "" {
+		config.AdminAddr = cmdConfig.AdminAddr
+	}
+	local.configFile = configFile
+	local.baseConfig = config
+	local.cmdConfig = &cmdConfig
+	local.listener = map[string]*localListener{}
+
+	if flag.NArg() != 0 {
+		if flag.Arg(0) != "cat" || flag.NArg() != 2 {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, errors.New("unknown arguments, commands are update, lint-config and cat host:port")))
 		}
-		if config.LocalPort == 0 {
-			log.Fatal("must specify local port")
+		if err = runCat(profile, flag.Arg(1)); err != nil {
+			ss.Fatal(err)
 		}
+		os.Exit(0)
 	}
 
-	initServers(config)
+	// read by handlers once listeners start
+	ttfbEnabled = config.AdminAddr != ""
+	if err = switchProfile(profile); err != nil {
+		ss.Fatal(err)
+	}
 
-	run(strconv.Itoa(config.LocalPort))
+	go autoBalance()
+	go watchResume()
+	go watchDiscovery()
+	go watchServerList()
+	if config.CaptivePortal {
+		probeURL := config.CaptivePortalURL
+		if probeURL == "" {
+			probeURL = defaultCaptiveProbeURL
+		}
+		if err = startCaptiveCheck(probeURL); err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+		}
+	}
+
+	if config.AdminAddr != "" {
+		ss.HandleAdmin("/profile", handleProfile)
+		ss.HandleAdmin("/slow", handleSlow)
+		ss.HandleAdmin("/listeners", handleListeners)
+		ss.HandleAdmin("/routes", handleRoutes)
+		if err = ss.ServeAdmin(config); err != nil {
+			ss.Fatal(err)
+		}
+	}
+	waitSignal()
 }
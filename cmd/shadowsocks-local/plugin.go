@@ -0,0 +1,57 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"sync"
+)
+
+// With plugin set, each server has a plugin process of its own, which is kept
+// running across profile switches as long as the server, plugin and options
+// are the same. UDP relay doesn't go through plugin.
+
+var plugins struct {
+	sync.Mutex
+	running map[string]*ss.Plugin // keyed by server, plugin and options
+}
+
+// serverPlugin returns the plugin running for server, starting it if there's
+// none.
+func serverPlugin(server, name, opts string) (*ss.Plugin, error) {
+	key := server + "\x00" + name + "\x00" + opts
+	plugins.Lock()
+	defer plugins.Unlock()
+	if p, ok := plugins.running[key]; ok {
+		return p, nil
+	}
+	local, err := ss.LocalPluginAddr()
+	if err != nil {
+		return nil, err
+	}
+	p, err := ss.StartPlugin(name, opts, server, local)
+	if err != nil {
+		return nil, err
+	}
+	if plugins.running == nil {
+		plugins.running = map[string]*ss.Plugin{}
+	}
+	plugins.running[key] = p
+	return p, nil
+}
+
+// stopUnusedPlugins stops plugins not used by servers in srvenc.
+func stopUnusedPlugins(srvenc []*ServerEnctbl) {
+	used := map[*ss.Plugin]bool{}
+	for _, se := range srvenc {
+		if se.plugin != nil {
+			used[se.plugin] = true
+		}
+	}
+	plugins.Lock()
+	defer plugins.Unlock()
+	for key, p := range plugins.running {
+		if !used[p] {
+			p.Stop()
+			delete(plugins.running, key)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"strconv"
+)
+
+// With local_redir_port set on Linux, client also serves as transparent
+// proxy. Connections redirected to the port by iptables REDIRECT or TPROXY
+// target are relayed to their original destination, which is recovered from
+// connection tracking with SO_ORIGINAL_DST, or is the local address of the
+// connection with TPROXY. Connections of the client itself to servers must be
+// excluded from redirection.
+
+func runRedir(ln net.Listener) {
+	port := ln.Addr().(*net.TCPAddr).Port
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("accept:", err)
+				continue
+			}
+			debug.Println("accept:", err)
+			return
+		}
+		go handleRedirConnection(conn, port)
+	}
+}
+
+func handleRedirConnection(conn net.Conn, port int) {
+	if debug {
+		debug.Printf("redirected connection from %s\n", conn.RemoteAddr().String())
+	}
+	defer conn.Close()
+	defer ss.RecoverPanic(conn)
+	activityStart()
+	defer activityEnd()
+
+	dst, err := originalDst(conn.(*net.TCPConn))
+	if err != nil {
+		log.Println("redir: original destination:", err)
+		return
+	}
+	if dst.Port == port && dst.IP.Equal(conn.LocalAddr().(*net.TCPAddr).IP) {
+		// connected to the port directly, relaying would loop back here
+		log.Printf("redir: connection from %s is not redirected\n", conn.RemoteAddr())
+		return
+	}
+	addr := ss.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port))
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		log.Println("redir:", err)
+		return
+	}
+	relayConn(conn, rawaddr, addr, "")
+}
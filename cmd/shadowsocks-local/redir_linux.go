@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// not defined in syscall package
+const (
+	soOriginalDst   = 80
+	ipv6Transparent = 75
+)
+
+const redirSupported = true
+
+// listenRedir listens with IP_TRANSPARENT set if possible, which is needed to
+// accept TPROXY connections and requires CAP_NET_ADMIN. REDIRECT works
+// without it.
+func listenRedir(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+			if network == "tcp6" {
+				level, opt = syscall.SOL_IPV6, ipv6Transparent
+			}
+			if err := syscall.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+				debug.Println("set IP_TRANSPARENT, TPROXY won't work:", err)
+			}
+		})
+	}}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination of conn before REDIRECT, or the local
+// address if it's not translated, as with TPROXY.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in fits in ipv6_mreq: family, port, address
+			var mreq *syscall.IPv6Mreq
+			if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); serr == nil {
+				b := mreq.Multiaddr
+				dst = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+			}
+			return
+		}
+		// sockaddr_in6 fits in ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); serr == nil {
+			// port is in network byte order
+			p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(p[0])<<8 | int(p[1])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr == syscall.ENOENT {
+		return local, nil
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return dst, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const redirSupported = false
+
+var errRedirUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+func listenRedir(addr string) (net.Listener, error) {
+	return nil, errRedirUnsupported
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errRedirUnsupported
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// On SIGHUP, config file is parsed again and the active profile is applied
+// like switching to it, so listeners of changed local ports are replaced and
+// servers are updated, connections already established are not affected.
+
+func reloadConfig() {
+	log.Println("reloading config")
+	config, err := ss.ParseConfig(local.configFile)
+	if err != nil {
+		log.Printf("error parsing config file %s to reload: %v\n", local.configFile, err)
+		return
+	}
+	if local.cmdConfig.AdminAddr != "" {
+		config.AdminAddr = local.cmdConfig.AdminAddr
+	}
+	local.Lock()
+	old, profile := local.baseConfig, local.profile
+	local.baseConfig = config
+	local.Unlock()
+	if err = switchProfile(profile); err != nil {
+		log.Println("reloading config:", err)
+		local.Lock()
+		local.baseConfig = old
+		local.Unlock()
+		return
+	}
+	for _, opt := range restartOptionsChanged(old, config) {
+		log.Printf("%s changed, restart to apply\n", opt)
+	}
+	log.Println("config reloaded")
+}
+
+// restartOptionsChanged returns options used only when starting which differ
+// between old and new config.
+func restartOptionsChanged(old, new *ss.Config) (changed []string) {
+	for opt, v := range map[string][2]interface{}{
+		"admin_addr":         {old.AdminAddr, new.AdminAddr},
+		"captive_portal":     {old.CaptivePortal, new.CaptivePortal},
+		"captive_portal_url": {old.CaptivePortalURL, new.CaptivePortalURL},
+	} {
+		if v[0] != v[1] {
+			changed = append(changed, opt)
+		}
+	}
+	sort.Strings(changed)
+	return
+}
+
+func waitSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		reloadConfig()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Monotonic clock stops while the system is sleeping, but wall clock does
+// not. Resume from sleep is detected by wall clock advancing more than the
+// monotonic one. Statistics and network state collected before sleep may be
+// outdated after resume, e.g. when moving to another network.
+
+const (
+	resumeCheckInterval = 5 * time.Second
+	resumeMinSleep      = 10 * time.Second
+)
+
+func watchResume() {
+	last := time.Now()
+	for {
+		idleSleep(resumeCheckInterval)
+		now := time.Now()
+		// Round(0) strips monotonic clock reading
+		slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if slept < resumeMinSleep {
+			continue
+		}
+		log.Printf("resumed from sleep of %v, reset server statistics\n", slept.Round(time.Second))
+		for _, se := range getServers("") {
+			se.stat.reset()
+		}
+		recheckCaptive()
+	}
+}
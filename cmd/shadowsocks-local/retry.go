@@ -0,0 +1,148 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Data sent before the first response byte is buffered up to this size to be
+// replayed. Retry is given up for requests larger than this.
+const maxReplayBuf = 64 * 1024
+
+// retry_before_response, accessed atomically as profiles switch while
+// connections are handled
+var retryBeforeResponse int32
+
+func setRetryBeforeResponse(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&retryBeforeResponse, v)
+}
+
+func retryEnabled() bool {
+	return atomic.LoadInt32(&retryBeforeResponse) != 0
+}
+
+// replayRelay relays data between the socks client and remote like Pipe. If
+// remote fails before any response is received, it redials through another
+// server and replays the request data already sent. This is only safe for
+// idempotent protocols, so it must be enabled explicitly.
+type replayRelay struct {
+	sync.Mutex
+	remote    *ss.Conn
+	buf       []byte
+	responded bool // response received or buf overflowed, no more retry
+}
+
+func (r *replayRelay) getRemote() *ss.Conn {
+	r.Lock()
+	defer r.Unlock()
+	return r.remote
+}
+
+// up relays data from socks client to remote.
+func (r *replayRelay) up(conn net.Conn, end chan byte) {
+	defer func() {
+		end <- 1
+	}()
+	defer ss.RecoverPanic(conn)
+
+	rb := ss.NewRelayBuffer()
+	defer rb.Release()
+	for {
+		buf := rb.Bytes()
+		ss.SetReadTimeout(conn)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			r.Lock()
+			if !r.responded {
+				if len(r.buf)+n > maxReplayBuf {
+					r.responded = true
+					r.buf = nil
+				} else {
+					r.buf = append(r.buf, buf[0:n]...)
+				}
+			}
+			// Written outside the lock not to block retry. If remote is
+			// replaced meanwhile, the data is replayed from buf.
+			remote, canRetry := r.remote, !r.responded
+			r.Unlock()
+			_, werr := remote.Write(buf[0:n])
+			// write error before response is handled by retry in down
+			if werr != nil && !canRetry {
+				debug.Println("write:", werr)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				debug.Println("read:", err)
+			}
+			return
+		}
+		rb.Tune(n)
+	}
+}
+
+// down relays data from remote to socks client, retrying once if remote fails
+// before response.
+func (r *replayRelay) down(conn net.Conn, rawaddr []byte, addr, group string, end chan byte) {
+	defer func() {
+		end <- 1
+	}()
+	defer ss.RecoverPanic(conn)
+
+	rb := ss.NewRelayBuffer()
+	defer rb.Release()
+	retried := false
+	for {
+		buf := rb.Bytes()
+		remote := r.getRemote()
+		ss.SetReadTimeout(remote)
+		n, err := remote.Read(buf)
+		if n > 0 {
+			r.Lock()
+			r.responded = true
+			r.buf = nil
+			r.Unlock()
+			if _, err = conn.Write(buf[0:n]); err != nil {
+				debug.Println("write:", err)
+				return
+			}
+			rb.Tune(n)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		r.Lock()
+		if r.responded || retried {
+			r.Unlock()
+			if err != io.EOF {
+				debug.Println("read:", err)
+			}
+			return
+		}
+		retried = true
+		log.Printf("connection via %s failed before response, retry: %v\n",
+			remote.RemoteAddr(), err)
+		nr, err := createServerConn(rawaddr, addr, group)
+		if err == nil {
+			_, err = nr.Write(r.buf)
+		}
+		if err != nil {
+			r.Unlock()
+			log.Println("retry:", err)
+			return
+		}
+		r.remote.Close()
+		r.remote = nr
+		r.Unlock()
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With direct_routes or direct_countries set, destinations whose IP is in
+// the CIDRs of direct_routes, or in countries of direct_countries according
+// to acl_geoip, are connected directly, like chnroutes. Unlike acl rules,
+// domains are resolved locally to be matched, and are proxied if resolving
+// fails. Rules of acl take precedence. Route files are loaded again when
+// reloading config, or on POST to /routes of admin interface.
+
+const (
+	routeResolveTimeout = 2 * time.Second
+	routeCacheTTL       = time.Minute
+	routeCacheSize      = 1024
+)
+
+type directRoutes struct {
+	cidrs     *ss.GeoIP // nil if direct_routes isn't set
+	geoip     *ss.GeoIP // nil if direct_countries isn't set
+	countries map[string]bool
+}
+
+var routes struct {
+	sync.RWMutex
+	current   *directRoutes // nil if disabled
+	file      string
+	geoipFile string
+	countries []string
+}
+
+var resolved struct {
+	sync.Mutex
+	cache map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// loadRoutes loads route files, it returns nil if direct routing is not
+// configured.
+func loadRoutes(file, geoipFile string, countries []string) (*directRoutes, error) {
+	if file == "" && len(countries) == 0 {
+		return nil, nil
+	}
+	r := &directRoutes{}
+	var err error
+	if file != "" {
+		if r.cidrs, err = ss.LoadGeoIP(file); err != nil {
+			return nil, err
+		}
+	}
+	if len(countries) != 0 {
+		if geoipFile == "" {
+			return nil, fmt.Errorf("direct_countries needs acl_geoip")
+		}
+		if r.geoip, err = ss.LoadGeoIP(geoipFile); err != nil {
+			return nil, err
+		}
+		r.countries = map[string]bool{}
+		for _, c := range countries {
+			r.countries[strings.ToUpper(c)] = true
+		}
+	}
+	return r, nil
+}
+
+func setRoutes(r *directRoutes, file, geoipFile string, countries []string) {
+	routes.Lock()
+	routes.current = r
+	routes.file, routes.geoipFile, routes.countries = file, geoipFile, countries
+	routes.Unlock()
+}
+
+func (r *directRoutes) direct(ip net.IP) bool {
+	if r.cidrs != nil {
+		if _, ok := r.cidrs.Lookup(ip); ok {
+			return true
+		}
+	}
+	return r.geoip != nil && r.countries[r.geoip.Country(ip)]
+}
+
+// directRoute tells whether host, a domain or IP literal, should be
+// connected directly by routes.
+func directRoute(host string) bool {
+	routes.RLock()
+	r := routes.current
+	routes.RUnlock()
+	if r == nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return r.direct(ip)
+	}
+	ips := resolveHost(host)
+	for _, ip := range ips {
+		if !r.direct(ip) {
+			// may be served from elsewhere
+			return false
+		}
+	}
+	return len(ips) != 0
+}
+
+// resolveHost returns IPs of host, cached for a short while.
+func resolveHost(host string) []net.IP {
+	resolved.Lock()
+	if h, ok := resolved.cache[host]; ok && time.Now().Before(h.expires) {
+		resolved.Unlock()
+		return h.ips
+	}
+	resolved.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), routeResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		debug.Printf("routes: resolving %s: %v\n", host, err)
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	resolved.Lock()
+	if resolved.cache == nil || len(resolved.cache) >= routeCacheSize {
+		resolved.cache = map[string]resolvedHost{}
+	}
+	resolved.cache[host] = resolvedHost{ips, time.Now().Add(routeCacheTTL)}
+	resolved.Unlock()
+	return ips
+}
+
+// GET returns the number of ranges loaded, POST loads route files again.
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		routes.RLock()
+		file, geoipFile, countries := routes.file, routes.geoipFile, routes.countries
+		routes.RUnlock()
+		dr, err := loadRoutes(file, geoipFile, countries)
+		if err != nil {
+			log.Println("reloading routes:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setRoutes(dr, file, geoipFile, countries)
+		log.Println("routes reloaded")
+	}
+	routes.RLock()
+	defer routes.RUnlock()
+	if routes.current == nil {
+		fmt.Fprintln(w, "disabled")
+		return
+	}
+	if routes.current.cidrs != nil {
+		fmt.Fprintf(w, "direct_routes: %d ranges\n", routes.current.cidrs.Len())
+	}
+	if routes.current.geoip != nil {
+		fmt.Fprintf(w, "direct_countries: %s in %d ranges\n", strings.Join(routes.countries, ","),
+			routes.current.geoip.Len())
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"sync"
+	"time"
+)
+
+// With server_list_url set, servers are synced from the signed server list
+// published by a coordinator, replacing servers in config. The list is fetched
+// again every serverListInterval and applied if its version increased. If the
+// coordinator can't be reached, the last list applied is used until it
+// expires, then servers in config.
+
+const serverListInterval = 5 * time.Minute
+
+var synced struct {
+	sync.Mutex
+	list    *ss.ServerList // list in use, nil if using configured servers
+	version int64          // highest version applied, to reject old lists
+}
+
+func fetchServerList(config *ss.Config) (*ss.ServerList, error) {
+	list, err := ss.FetchServerList(config.ServerListURL, config.ServerListToken, config.ServerListKey)
+	if err != nil {
+		return nil, err
+	}
+	synced.Lock()
+	defer synced.Unlock()
+	if list.Version < synced.version {
+		return nil, fmt.Errorf("server list version %d is older than %d applied",
+			list.Version, synced.version)
+	}
+	return list, nil
+}
+
+func listExpired(list *ss.ServerList) bool {
+	return list.Expires != 0 && time.Now().Unix() > list.Expires
+}
+
+// applyServerList returns config with servers in the synced list, or config
+// itself if syncing is not enabled or no list is available.
+func applyServerList(config *ss.Config) (*ss.Config, error) {
+	if config.ServerListURL == "" {
+		return config, nil
+	}
+	list, err := fetchServerList(config)
+	synced.Lock()
+	if err == nil {
+		synced.version = list.Version
+	} else {
+		log.Printf("fetching server list from %s: %v\n", config.ServerListURL, err)
+		if list = synced.list; list != nil && listExpired(list) {
+			list = nil
+		}
+	}
+	synced.list = list
+	synced.Unlock()
+	if list == nil {
+		if config.Server == nil && len(config.ServerPassword) == 0 {
+			return nil, fmt.Errorf("no server list from %s", config.ServerListURL)
+		}
+		log.Println("no server list available, use configured servers")
+		return config, nil
+	}
+
+	c := *config
+	c.ServerPassword = map[string]string{}
+	for s, passwd := range list.Servers {
+		if passwd == "" {
+			if passwd = config.Password; passwd == "" {
+				return nil, fmt.Errorf("no password for server %s in server list", s)
+			}
+		}
+		c.ServerPassword[s] = passwd
+	}
+	c.Server, c.ServerPort, c.Password = nil, 0, ""
+	// the list is signed, so its method is trusted unlike DNS discovery
+	if list.Method != "" {
+		c.Method = list.Method
+	}
+	return &c, nil
+}
+
+// watchServerList fetches server list of the active profile periodically, and
+// switches to it if it's newer.
+func watchServerList() {
+	for {
+		idleSleep(serverListInterval)
+		local.Lock()
+		profile, base := local.profile, local.baseConfig
+		local.Unlock()
+		config, err := base.GetProfile(profile)
+		if err != nil || config.ServerListURL == "" {
+			continue
+		}
+		list, err := fetchServerList(config)
+		synced.Lock()
+		inUse := synced.list
+		synced.Unlock()
+		if err != nil {
+			log.Printf("fetching server list from %s: %v\n", config.ServerListURL, err)
+			// fall back to configured servers once the list in use expires
+			if inUse == nil || !listExpired(inUse) {
+				continue
+			}
+		} else if inUse != nil && list.Version == inUse.Version {
+			continue
+		} else {
+			log.Printf("server list version %d from %s\n", list.Version, config.ServerListURL)
+		}
+		if err = switchProfile(profile); err != nil {
+			log.Println("applying server list:", err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Time to first byte of each destination, from the socks request to the first
+// response byte, is kept in a histogram. The report of slowest destinations
+// helps to decide which sites need another server. It's only recorded when
+// admin interface is enabled.
+
+// set before listeners start, not changed afterwards
+var ttfbEnabled bool
+
+// upper bounds of histogram buckets, the last bucket has no upper bound
+var ttfbBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// destinations not seen recently are evicted when there are more than this
+const maxTTFBDests = 1000
+
+type ttfbHist struct {
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+	buckets []int64
+	last    time.Time // last sample time
+}
+
+var ttfbStat = struct {
+	sync.Mutex
+	dest map[string]*ttfbHist
+}{dest: map[string]*ttfbHist{}}
+
+func recordTTFB(dest string, d time.Duration) {
+	ttfbStat.Lock()
+	defer ttfbStat.Unlock()
+	h, ok := ttfbStat.dest[dest]
+	if !ok {
+		if len(ttfbStat.dest) >= maxTTFBDests {
+			evictTTFB()
+		}
+		h = &ttfbHist{buckets: make([]int64, len(ttfbBuckets)+1)}
+		ttfbStat.dest[dest] = h
+	}
+	i := sort.Search(len(ttfbBuckets), func(i int) bool { return d <= ttfbBuckets[i] })
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+	h.last = time.Now()
+}
+
+// evictTTFB removes the least recently seen destination. Caller must hold
+// ttfbStat.
+func evictTTFB() {
+	var oldest string
+	var t time.Time
+	for dest, h := range ttfbStat.dest {
+		if oldest == "" || h.last.Before(t) {
+			oldest, t = dest, h.last
+		}
+	}
+	delete(ttfbStat.dest, oldest)
+}
+
+// quantile returns the upper bound of the bucket containing quantile q, or max
+// for the last bucket.
+func (h *ttfbHist) quantile(q float64) time.Duration {
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, c := range h.buckets[:len(ttfbBuckets)] {
+		if n += c; n >= rank {
+			return ttfbBuckets[i]
+		}
+	}
+	return h.max
+}
+
+// ttfbConn records time to first byte written to the socks client.
+type ttfbConn struct {
+	net.Conn
+	dest  string
+	start time.Time
+	once  sync.Once
+}
+
+func newTTFBConn(conn net.Conn, addr string) *ttfbConn {
+	dest, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		dest = addr
+	}
+	return &ttfbConn{Conn: conn, dest: dest, start: time.Now()}
+}
+
+func (c *ttfbConn) Write(b []byte) (int, error) {
+	c.once.Do(func() {
+		recordTTFB(c.dest, time.Since(c.start))
+	})
+	return c.Conn.Write(b)
+}
+
+type slowDest struct {
+	Dest  string  `json:"dest"`
+	Count int64   `json:"count"`
+	Avg   float64 `json:"avg_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// slowestDests returns at most n destinations with at least min samples,
+// sorted by median time to first byte.
+func slowestDests(n int, min int64) []slowDest {
+	ttfbStat.Lock()
+	res := make([]slowDest, 0, len(ttfbStat.dest))
+	for dest, h := range ttfbStat.dest {
+		if h.count < min {
+			continue
+		}
+		res = append(res, slowDest{
+			Dest:  dest,
+			Count: h.count,
+			Avg:   ms(h.sum / time.Duration(h.count)),
+			P50:   ms(h.quantile(0.5)),
+			P90:   ms(h.quantile(0.9)),
+			Max:   ms(h.max),
+		})
+	}
+	ttfbStat.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].P50 != res[j].P50 {
+			return res[i].P50 > res[j].P50
+		}
+		return res[i].Avg > res[j].Avg
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// GET returns slowest destinations, "n" limits the number of destinations
+// and "min" the number of samples required.
+func handleSlow(w http.ResponseWriter, r *http.Request) {
+	n, min := 20, int64(3)
+	var err error
+	q := r.URL.Query()
+	if s := q.Get("n"); s != "" {
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			http.Error(w, "n should be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("min"); s != "" {
+		if min, err = strconv.ParseInt(s, 10, 64); err != nil || min < 1 {
+			http.Error(w, "min should be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slowestDests(n, min))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+)
+
+// A tunnel listener forwards every connection to its fixed target through
+// servers, for applications which can't use a proxy, e.g. a DNS resolver
+// over TCP.
+
+func runTunnel(ln net.Listener, target, group string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("accept:", err)
+				continue
+			}
+			debug.Println("accept:", err)
+			return
+		}
+		go handleTunnelConnection(conn, target, group)
+	}
+}
+
+func handleTunnelConnection(conn net.Conn, target, group string) {
+	if debug {
+		debug.Printf("tunnel connect from %s\n", conn.RemoteAddr().String())
+	}
+	defer conn.Close()
+	defer ss.RecoverPanic(conn)
+	activityStart()
+	defer activityEnd()
+
+	rawaddr, err := ss.RawAddr(target)
+	if err != nil {
+		log.Println("tunnel:", err)
+		return
+	}
+	relayConn(conn, rawaddr, target, group)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+)
+
+// UDP ASSOCIATE (rfc1928) relays datagrams of the socks client through the
+// server chosen for the association. Each association has its own UDP
+// sockets and lasts until the socks connection is closed. Fragmented
+// datagrams are not supported.
+
+// length of RSV and FRAG fields before address in socks UDP datagrams
+const socksUDPHeaderLen = 3
+
+type udpAssoc struct {
+	local    net.PacketConn // receives datagrams of socks client
+	remote   net.Conn       // connected to server
+	enctbl   *ss.EncryptTable
+	clientIP net.IP
+
+	sync.Mutex
+	client net.Addr // replies are sent to the source of client datagrams
+	dests  map[string]bool
+}
+
+func handleUDPAssociate(conn net.Conn, group string) {
+	srvenc := getServers(group)
+	if len(srvenc) == 0 {
+		log.Printf("no server in group %s\n", group)
+		return
+	}
+	var se *ServerEnctbl
+	for _, s := range orderServers(srvenc) {
+		if s.relaysUDP() {
+			se = s
+			break
+		}
+	}
+	if se == nil {
+		log.Printf("no server in group %s relays UDP\n", group)
+		return
+	}
+	remote, err := net.Dial("udp", se.udpAddr())
+	if err != nil {
+		log.Println("udp associate:", err)
+		return
+	}
+	ss.MarkConn(remote)
+	defer remote.Close()
+	// listen on the address the socks client connected to
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	local, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Println("udp associate:", err)
+		return
+	}
+	defer local.Close()
+
+	reply := append([]byte{ss.SocksVer5, 0x00, 0x00}, ss.PacketAddr(local.LocalAddr().(*net.UDPAddr))...)
+	if _, err = conn.Write(reply); err != nil {
+		debug.Println("send udp associate reply:", err)
+		return
+	}
+	a := &udpAssoc{
+		local:    local,
+		remote:   remote,
+		enctbl:   se.enctbl,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		dests:    map[string]bool{},
+	}
+	debug.Printf("udp associate %s via %s\n", local.LocalAddr(), se.server)
+	go func() {
+		defer ss.RecoverPanic(conn)
+		a.up()
+	}()
+	go func() {
+		defer ss.RecoverPanic(conn)
+		a.down()
+	}()
+	// association ends when socks connection is closed
+	io.Copy(ioutil.Discard, conn)
+	debug.Printf("udp associate %s closed\n", local.LocalAddr())
+}
+
+// up relays datagrams from socks client to server.
+func (a *udpAssoc) up() {
+	buf := ss.GetBuf(ss.MaxPacketSize)
+	defer ss.PutBuf(buf)
+	var out []byte // reused for encrypted packets
+	for {
+		n, src, err := a.local.ReadFrom(buf)
+		if err != nil {
+			// closed with the association
+			debug.Println("udp read:", err)
+			return
+		}
+		// only accept datagrams from the socks client
+		if !src.(*net.UDPAddr).IP.Equal(a.clientIP) {
+			debug.Printf("udp datagram from %s dropped\n", src)
+			continue
+		}
+		if n < socksUDPHeaderLen || buf[2] != 0 {
+			debug.Println("udp datagram fragmented or too short, dropped")
+			continue
+		}
+		pkt := buf[socksUDPHeaderLen:n]
+		dest, _, err := ss.ParsePacketAddr(pkt)
+		if err != nil {
+			debug.Println("udp datagram:", err)
+			continue
+		}
+		a.Lock()
+		a.client = src
+		if ss.AuditEnabled() && !a.dests[dest] {
+			a.dests[dest] = true
+			ss.Audit(src.String(), dest)
+		}
+		a.Unlock()
+		out = ss.EncryptPacket(a.enctbl, out[:0], pkt)
+		if _, err = a.remote.Write(out); err != nil {
+			debug.Println("udp write:", err)
+		}
+	}
+}
+
+// down relays datagrams from server to socks client.
+func (a *udpAssoc) down() {
+	buf := ss.GetBuf(ss.MaxPacketSize)
+	defer ss.PutBuf(buf)
+	for {
+		n, err := a.remote.Read(buf[socksUDPHeaderLen:])
+		if err != nil {
+			debug.Println("udp read:", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. refused by server without UDP relay
+			continue
+		}
+		pkt, err := ss.DecryptPacket(a.enctbl, buf[socksUDPHeaderLen:socksUDPHeaderLen+n])
+		if err == nil {
+			_, _, err = ss.ParsePacketAddr(pkt)
+		}
+		if err != nil {
+			debug.Println("udp datagram from server:", err)
+			continue
+		}
+		// plain packet may start after salt
+		n = copy(buf[socksUDPHeaderLen:], pkt)
+		a.Lock()
+		client := a.client
+		a.Unlock()
+		if client == nil {
+			continue
+		}
+		buf[0], buf[1], buf[2] = 0, 0, 0
+		if _, err = a.local.WriteTo(buf[:socksUDPHeaderLen+n], client); err != nil {
+			debug.Println("udp write:", err)
+		}
+	}
+}
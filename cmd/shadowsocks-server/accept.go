@@ -0,0 +1,93 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Each port can be served by multiple listeners sharing the port with
+// SO_REUSEPORT, each with its own accepting goroutine. The kernel distributes
+// new connections among them, which scales accepting on many-core servers.
+
+// number of listeners of each port
+var acceptShards = 1
+
+// Set on platforms supporting SO_REUSEPORT.
+var reusePort func(network, address string, c syscall.RawConn) error
+
+// listenShards returns listeners of port. If some shards can't be created,
+// e.g. the inherited listener doesn't have SO_REUSEPORT, fewer listeners are
+// returned.
+func listenShards(port string) ([]net.Listener, error) {
+	shared := acceptShards > 1
+	ln, err := listen(port, shared)
+	if err != nil {
+		return nil, err
+	}
+	lns := []net.Listener{ln}
+	for i := 1; i < acceptShards; i++ {
+		ln, err := listen(port, shared)
+		if err != nil {
+			log.Printf("port %s: listener shard %d: %v\n", port, i, err)
+			break
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// listenPort returns TCP listeners of port, and UDP socket if UDP relay is
+// enabled.
+func listenPort(port string) (lns []net.Listener, udp net.PacketConn, err error) {
+	if lns, err = listenShards(port); err != nil {
+		return
+	}
+	if !udpRelay {
+		return
+	}
+	if udp, err = listenUDP(port); err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, nil, err
+	}
+	return
+}
+
+func serve(port, password string, lns []net.Listener, udp net.PacketConn) {
+	pl := passwdManager.add(port, password, lns, udp)
+	encTbl := getTable(port, password)
+	atomic.AddInt32(&table.getCnt, 1)
+	if atomic.LoadInt32(&draining) != 0 {
+		// port added while draining is opened when drain ends
+		pl.close()
+		return
+	}
+	log.Printf("server listening port %v ...\n", port)
+	if udp != nil {
+		go serveUDP(port, udp, encTbl)
+	}
+	for _, ln := range lns[1:] {
+		go accept(port, ln, encTbl)
+	}
+	accept(port, lns[0], encTbl)
+}
+
+func accept(port string, ln net.Listener, encTbl *ss.EncryptTable) {
+	for {
+		// listeners of hopping ports share the rate of their port
+		waitAccept(basePort(port))
+		conn, err := ln.Accept()
+		if err != nil {
+			// listener maybe closed to update password
+			debug.Printf("accept error: %v\n", err)
+			return
+		}
+		ss.TuneConn(conn, 0)
+		hc := newHandshakeConn(conn)
+		go handleConnection(ss.NewConn(serverTLSConn(hc), encTbl), hc, basePort(port))
+	}
+}
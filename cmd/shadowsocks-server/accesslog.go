@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recent access records are kept in memory so that panels can fetch them
+// from the admin interface without access to the server's file system.
+// Destinations are recorded according to the audit privacy mode, nothing is
+// recorded if audit is off. Country and AS of destinations are recorded if
+// their databases are loaded.
+
+type accessRecord struct {
+	Seq     uint64    `json:"seq"` // used as pagination cursor
+	Time    time.Time `json:"time"`
+	Port    string    `json:"port"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Client  string    `json:"client"`
+	Dest    string    `json:"dest"`
+	Country string    `json:"country,omitempty"` // of dest, with dest_geoip
+	ASN     string    `json:"asn,omitempty"`     // of dest, with dest_asn
+}
+
+var accessLog struct {
+	sync.Mutex
+	records []accessRecord // ring buffer
+	next    uint64         // sequence of next record
+	key     []byte         // to sign exported records
+}
+
+const (
+	maxExportLimit     = 1000
+	defaultExportLimit = 100
+	// each client can make this many export requests per second, with bursts
+	// up to exportBurst
+	exportRate  = 1
+	exportBurst = 5
+)
+
+func initAccessLog(size int, key string) {
+	accessLog.Lock()
+	if size != len(accessLog.records) {
+		accessLog.records = make([]accessRecord, size)
+		accessLog.next = 0
+	}
+	accessLog.key = []byte(key)
+	accessLog.Unlock()
+}
+
+func recordAccess(conn net.Conn, t *tenant, dest, country, asn string) {
+	if !ss.AuditEnabled() {
+		return
+	}
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	r := accessRecord{Time: time.Now(), Port: port, Client: ss.NormalizeAddr(conn.RemoteAddr().String()), Dest: ss.AuditDest(dest),
+		Country: country, ASN: asn}
+	if t != nil {
+		r.Tenant = t.name
+	}
+	accessLog.Lock()
+	if n := uint64(len(accessLog.records)); n != 0 {
+		r.Seq = accessLog.next
+		accessLog.records[r.Seq%n] = r
+		accessLog.next++
+	}
+	accessLog.Unlock()
+}
+
+// queryAccessLog returns records after the cursor matching the filter.
+func queryAccessLog(after uint64, limit int, match func(*accessRecord) bool) []accessRecord {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	n := uint64(len(accessLog.records))
+	first := uint64(0)
+	if accessLog.next > n {
+		first = accessLog.next - n
+	}
+	if after+1 > first {
+		first = after + 1
+	}
+	var res []accessRecord
+	for seq := first; seq < accessLog.next && len(res) < limit; seq++ {
+		r := &accessLog.records[seq%n]
+		if match(r) {
+			res = append(res, *r)
+		}
+	}
+	return res
+}
+
+// token bucket of each client address
+var exportLimiter struct {
+	sync.Mutex
+	tokens map[string]float64
+	last   map[string]time.Time
+}
+
+func allowExport(client string) bool {
+	exportLimiter.Lock()
+	defer exportLimiter.Unlock()
+	if exportLimiter.tokens == nil {
+		exportLimiter.tokens = map[string]float64{}
+		exportLimiter.last = map[string]time.Time{}
+	}
+	now := time.Now()
+	tokens, ok := exportLimiter.tokens[client]
+	if !ok {
+		tokens = exportBurst
+	} else {
+		tokens += now.Sub(exportLimiter.last[client]).Seconds() * exportRate
+		if tokens > exportBurst {
+			tokens = exportBurst
+		}
+	}
+	exportLimiter.last[client] = now
+	if tokens < 1 {
+		exportLimiter.tokens[client] = tokens
+		return false
+	}
+	exportLimiter.tokens[client] = tokens - 1
+	return true
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// handleLogs exports recent access records as NDJSON. Records can be filtered
+// by port, tenant and time range given by since and until in RFC 3339 form.
+// Pass the seq of the last record received as "after" to get the next page.
+// If signing key is configured, header X-Signature is the hex encoded
+// HMAC-SHA256 of the response body.
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !allowExport(ss.NormalizeHost(host)) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	q := r.URL.Query()
+	since, err := parseTime(q.Get("since"))
+	if err != nil {
+		http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTime(q.Get("until"))
+	if err != nil {
+		http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	after := ^uint64(0) // from the oldest record
+	if s := q.Get("after"); s != "" {
+		if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "after: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultExportLimit
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxExportLimit {
+			http.Error(w, "limit should be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	port, tenantName := q.Get("port"), q.Get("tenant")
+	country, asn := q.Get("country"), q.Get("asn")
+
+	records := queryAccessLog(after, limit, func(rec *accessRecord) bool {
+		return (port == "" || rec.Port == port) &&
+			(tenantName == "" || rec.Tenant == tenantName) &&
+			(country == "" || strings.EqualFold(rec.Country, country)) &&
+			(asn == "" || strings.EqualFold(rec.ASN, asn)) &&
+			(since.IsZero() || !rec.Time.Before(since)) &&
+			(until.IsZero() || rec.Time.Before(until))
+	})
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for i := range records {
+		enc.Encode(&records[i])
+	}
+	accessLog.Lock()
+	key := accessLog.key
+	accessLog.Unlock()
+	if len(key) != 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body.Bytes())
+		w.Header().Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// HAProxy agent-check responder. HAProxy connects to the agent port and reads
+// one line telling the server state and weight, so backends can be weighted
+// by load. Refer to "agent-check" in HAProxy manual.
+
+// agentStatus reports drain when draining, so HAProxy stops sending new
+// connections. Otherwise it reports weight decreasing as active connections approach
+// capacity. Weight is never 0 as HAProxy treats it as drain.
+func agentStatus(active, capacity int) string {
+	if atomic.LoadInt32(&draining) != 0 {
+		return "drain\n"
+	}
+	if capacity <= 0 {
+		return "up 100%\n"
+	}
+	weight := 100 - active*100/capacity
+	if weight < 1 {
+		weight = 1
+	}
+	return fmt.Sprintf("up %d%%\n", weight)
+}
+
+func serveAgent(addr string, capacity int) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Println("agent-check:", err)
+		return
+	}
+	log.Println("agent-check listening at", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("agent-check accept:", err)
+			return
+		}
+		conn.Write([]byte(agentStatus(int(atomic.LoadInt32(&activeConn)), capacity)))
+		conn.Close()
+	}
+}
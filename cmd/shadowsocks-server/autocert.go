@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// With tls_autocert, the certificate of the hosts is obtained from Let's
+// Encrypt with the TLS-ALPN-01 challenge, which is answered on the server
+// ports themselves, so the CA must reach one of them at port 443. The
+// account key and the certificate are cached in tls_autocert_dir, and the
+// certificate is renewed autocertRenewBefore it expires. Until a certificate
+// is obtained, TLS handshakes fail.
+
+const (
+	autocertAccountFile = "acme-account.pem"
+	autocertCertFile    = "tls-cert.pem" // key and certificate chain
+	autocertRenewBefore = 30 * 24 * time.Hour
+	autocertInterval    = 12 * time.Hour
+	autocertRetry       = time.Hour
+	autocertTimeout     = 5 * time.Minute
+)
+
+var autocert struct {
+	sync.Mutex
+	hosts      []string
+	dir        string
+	stop       chan struct{} // nil if not running
+	renew      chan struct{} // check again now
+	cert       *tls.Certificate
+	challenges map[string]*tls.Certificate // by host being validated
+}
+
+// initAutocert applies hosts and cache dir, creating it if not exist. The
+// certificate is obtained in background.
+func initAutocert(hosts []string, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("tls_autocert_dir: %v", err)
+	}
+	autocert.Lock()
+	defer autocert.Unlock()
+	changed := autocert.dir != dir || !reflect.DeepEqual(autocert.hosts, hosts)
+	autocert.hosts, autocert.dir = hosts, dir
+	if autocert.stop == nil {
+		autocert.stop = make(chan struct{})
+		autocert.renew = make(chan struct{}, 1)
+		autocert.challenges = map[string]*tls.Certificate{}
+		go runAutocert(autocert.stop, autocert.renew)
+	} else if changed {
+		select {
+		case autocert.renew <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// stopAutocert stops renewing when tls or tls_autocert is removed on reload.
+func stopAutocert() {
+	autocert.Lock()
+	defer autocert.Unlock()
+	if autocert.stop != nil {
+		close(autocert.stop)
+		autocert.stop = nil
+		autocert.hosts, autocert.dir, autocert.cert = nil, "", nil
+	}
+}
+
+func runAutocert(stop, renew chan struct{}) {
+	for {
+		wait := checkAutocert()
+		select {
+		case <-time.After(wait):
+		case <-renew:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkAutocert loads the cached certificate, or obtains one if it doesn't
+// cover the hosts or expires soon. It returns when to check again.
+func checkAutocert() time.Duration {
+	autocert.Lock()
+	hosts, dir, cert := autocert.hosts, autocert.dir, autocert.cert
+	autocert.Unlock()
+	certPath := filepath.Join(dir, autocertCertFile)
+	if !certCovers(cert, hosts) {
+		if c, err := tls.LoadX509KeyPair(certPath, certPath); err == nil && setLeaf(&c) == nil && certCovers(&c, hosts) {
+			cert = &c
+			setAutocert(cert)
+		}
+	}
+	if certCovers(cert, hosts) && time.Until(cert.Leaf.NotAfter) > autocertRenewBefore {
+		return autocertInterval
+	}
+	c, data, err := obtainCert(hosts, dir)
+	if err != nil {
+		log.Printf("tls_autocert: obtaining certificate: %v\n", err)
+		return autocertRetry
+	}
+	setAutocert(c)
+	if err = writeFile(certPath, data); err != nil {
+		log.Printf("tls_autocert: saving certificate: %v\n", err)
+	}
+	log.Printf("tls_autocert: certificate obtained, expires at %s\n", c.Leaf.NotAfter.Format(time.RFC3339))
+	return autocertInterval
+}
+
+func setAutocert(cert *tls.Certificate) {
+	autocert.Lock()
+	autocert.cert = cert
+	autocert.Unlock()
+}
+
+// setLeaf parses the leaf certificate of cert, as only newer versions of Go
+// parse it when loading certificates.
+func setLeaf(cert *tls.Certificate) (err error) {
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return
+}
+
+func certCovers(cert *tls.Certificate, hosts []string) bool {
+	if cert == nil || cert.Leaf == nil {
+		return false
+	}
+	for _, h := range hosts {
+		if cert.Leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// getAutocert is used as GetCertificate of TLS config.
+func getAutocert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	autocert.Lock()
+	defer autocert.Unlock()
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		if c := autocert.challenges[hello.ServerName]; c != nil {
+			return c, nil
+		}
+		return nil, fmt.Errorf("no challenge for %s", hello.ServerName)
+	}
+	if autocert.cert == nil {
+		return nil, errors.New("certificate not obtained yet")
+	}
+	return autocert.cert, nil
+}
+
+// obtainCert gets certificate of hosts, returning it also encoded as key
+// and certificate chain in PEM.
+func obtainCert(hosts []string, dir string) (*tls.Certificate, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), autocertTimeout)
+	defer cancel()
+	accountKey, err := loadAccountKey(filepath.Join(dir, autocertAccountFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: acme.LetsEncryptURL}
+	if _, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(hosts...))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		autocert.Lock()
+		autocert.challenges = map[string]*tls.Certificate{}
+		autocert.Unlock()
+	}()
+	for _, url := range order.AuthzURLs {
+		if err = authorize(ctx, client, url); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: hosts}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = setLeaf(&cert); err != nil {
+		return nil, nil, err
+	}
+	return &cert, data, nil
+}
+
+// authorize answers the TLS-ALPN-01 challenge of authorization at url.
+func authorize(ctx context.Context, client *acme.Client, url string) error {
+	z, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "tls-alpn-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no tls-alpn-01 challenge for %s", z.Identifier.Value)
+	}
+	cert, err := client.TLSALPN01ChallengeCert(chal.Token, z.Identifier.Value)
+	if err != nil {
+		return err
+	}
+	autocert.Lock()
+	autocert.challenges[z.Identifier.Value] = &cert
+	autocert.Unlock()
+	if _, err = client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// loadAccountKey loads ACME account key, creating one if not exist.
+func loadAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// When draining, listeners are closed so that new connections are refused and
+// clients can try other servers immediately, existing connections are not
+// affected. Set to 1 when draining.
+var draining int32
+
+var drainMu sync.Mutex // serializes drain state changes
+
+func setDrain(on bool) {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if on == (atomic.LoadInt32(&draining) != 0) {
+		return
+	}
+	passwdManager.Lock()
+	defer passwdManager.Unlock()
+	if on {
+		atomic.StoreInt32(&draining, 1)
+		log.Println("draining, stop accepting connections")
+		for _, pl := range passwdManager.portListener {
+			pl.close()
+		}
+		return
+	}
+	atomic.StoreInt32(&draining, 0)
+	log.Println("drain ended, accepting connections")
+	for port, pl := range passwdManager.portListener {
+		// run updates passwdManager, so it must be started after unlock
+		go run(port, pl.password)
+	}
+}
+
+// GET returns drain state and number of active connections, POST with
+// "enable" set to true or false starts or ends draining.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		on, err := strconv.ParseBool(r.FormValue("enable"))
+		if err != nil {
+			http.Error(w, "enable should be true or false", http.StatusBadRequest)
+			return
+		}
+		setDrain(on)
+	}
+	state := "serving"
+	if atomic.LoadInt32(&draining) != 0 {
+		state = "draining"
+	}
+	fmt.Fprintf(w, "%s %d\n", state, atomic.LoadInt32(&activeConn))
+}
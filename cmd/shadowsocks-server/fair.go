@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/heap"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With fair_bandwidth set, data sent to clients is paced at that rate and
+// shared per client address with start-time fair queuing, instead of per
+// connection by TCP, so a client opening many connections can't starve
+// others. Clients not using their share leave it to others. The rate should
+// be a little lower than the real uplink, so that the queue builds up in
+// server instead of the network where it can't be scheduled.
+//
+// Clients are spread by address over one queue per CPU, so writes aren't all
+// scheduled by one goroutine. Each queue schedules its clients fairly, and
+// queues take turns in the rate shared by all of them.
+
+const (
+	// Sleeping may take longer than asked, pacing catches up by sending
+	// without sleeping until being behind by more than this.
+	fairMaxLag = time.Millisecond
+	// clients idle are forgotten after this many writes scheduled
+	fairPruneInterval = 1024
+)
+
+type fairRequest struct {
+	n     int
+	start float64 // virtual time to start sending
+	seq   uint64  // keeps requests of the same start in order
+	c     *fairClient
+	done  chan struct{}
+}
+
+type fairClient struct {
+	finish  float64 // virtual time last request of client finishes
+	pending int
+}
+
+// fairQueue is a heap of requests in the order of start time.
+type fairQueue []*fairRequest
+
+func (q fairQueue) Len() int { return len(q) }
+func (q fairQueue) Less(i, j int) bool {
+	return q[i].start < q[j].start || q[i].start == q[j].start && q[i].seq < q[j].seq
+}
+func (q fairQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *fairQueue) Push(x interface{}) { *q = append(*q, x.(*fairRequest)) }
+func (q *fairQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+var fairRate int64 // bytes per second, 0 if disabled
+
+var fair struct {
+	sync.Mutex
+	shards []*fairShard // created when first enabled, never changed
+	next   time.Time    // when next bytes can be sent, shared by shards
+}
+
+type fairShard struct {
+	sync.Mutex
+	cond    *sync.Cond
+	clients map[string]*fairClient
+	queue   fairQueue
+	vtime   float64 // start of the request last scheduled
+	seq     uint64
+}
+
+func newFairShard() *fairShard {
+	s := &fairShard{clients: map[string]*fairClient{}}
+	s.cond = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// setFairBandwidth sets rate in Mbit/s, 0 to disable.
+func setFairBandwidth(mbps int) {
+	fair.Lock()
+	defer fair.Unlock()
+	if fair.shards == nil {
+		if mbps <= 0 {
+			return
+		}
+		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+			s := newFairShard()
+			fair.shards = append(fair.shards, s)
+			go s.run()
+		}
+	}
+	// requests waiting are released at once if disabled
+	var rate int64
+	if mbps > 0 {
+		rate = int64(mbps) * 1000 * 1000 / 8
+	}
+	atomic.StoreInt64(&fairRate, rate)
+}
+
+func fairEnabled() bool {
+	return atomic.LoadInt64(&fairRate) > 0
+}
+
+// fairWait blocks until n bytes can be sent to client at addr.
+func fairWait(addr string, n int) {
+	if atomic.LoadInt64(&fairRate) == 0 {
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	s := fair.shards[h.Sum32()%uint32(len(fair.shards))]
+	<-s.push(addr, n).done
+}
+
+// push queues sending n bytes to client at addr.
+func (s *fairShard) push(addr string, n int) *fairRequest {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.clients[addr]
+	if !ok {
+		c = &fairClient{}
+		s.clients[addr] = c
+	}
+	start := s.vtime
+	if c.finish > start {
+		start = c.finish
+	}
+	c.finish = start + float64(n)
+	c.pending++
+	s.seq++
+	r := &fairRequest{n, start, s.seq, c, make(chan struct{})}
+	heap.Push(&s.queue, r)
+	s.cond.Signal()
+	return r
+}
+
+// popLocked takes the request to send next. Caller must hold s.
+func (s *fairShard) popLocked() *fairRequest {
+	r := heap.Pop(&s.queue).(*fairRequest)
+	s.vtime = r.start
+	r.c.pending--
+	return r
+}
+
+// fairReserve returns how long to wait until next bytes can be sent, and
+// reserves time to send n bytes after that, if n isn't 0.
+func fairReserve(n int) time.Duration {
+	fair.Lock()
+	defer fair.Unlock()
+	rate := atomic.LoadInt64(&fairRate)
+	if rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	if fair.next.Before(now.Add(-fairMaxLag)) {
+		// idle
+		fair.next = now
+	}
+	d := fair.next.Sub(now)
+	fair.next = fair.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return d
+}
+
+func (s *fairShard) run() {
+	for scheduled := 1; ; scheduled++ {
+		s.Lock()
+		for s.queue.Len() == 0 {
+			s.cond.Wait()
+		}
+		s.Unlock()
+		// wait before choosing the request, so that clients sending again
+		// meanwhile are considered. Only this goroutine takes requests.
+		if d := fairReserve(0); d > 0 {
+			time.Sleep(d)
+		}
+		s.Lock()
+		r := s.popLocked()
+		if scheduled%fairPruneInterval == 0 {
+			for addr, c := range s.clients {
+				if c.pending == 0 && c.finish <= s.vtime {
+					delete(s.clients, addr)
+				}
+			}
+		}
+		s.Unlock()
+		// other queues may have taken the time meanwhile
+		if d := fairReserve(r.n); d > 0 {
+			time.Sleep(d)
+		}
+		close(r.done)
+	}
+}
+
+// fairConn schedules writes to client.
+type fairConn struct {
+	net.Conn
+	addr string
+}
+
+func newFairConn(conn net.Conn) fairConn {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return fairConn{conn, ss.NormalizeHost(host)}
+}
+
+func (c fairConn) Write(b []byte) (int, error) {
+	fairWait(c.addr, len(b))
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFairOrder(t *testing.T) {
+	s := newFairShard()
+	pop := func() string {
+		r := s.popLocked()
+		for addr, c := range s.clients {
+			if c == r.c {
+				return addr
+			}
+		}
+		return "?"
+	}
+	tests := []struct {
+		push  string // a client per write of 1000 bytes
+		order string
+	}{
+		// many writes queued by a don't delay b
+		{"aaaabb", "ababaa"},
+		// a was served ahead of b, so b goes first though queued later
+		{"ab", "ba"},
+		// a new client starts at the current virtual time, before the
+		// backlog of a
+		{"aaac", "caaa"},
+	}
+	for _, tt := range tests {
+		for _, addr := range tt.push {
+			s.push(string(addr), 1000)
+		}
+		var got []string
+		for s.queue.Len() != 0 {
+			got = append(got, pop())
+		}
+		if order := strings.Join(got, ""); order != tt.order {
+			t.Errorf("pushing %s: got order %s, expected %s", tt.push, order, tt.order)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Under connection floods the server accepts connections at a limited rate,
+// others wait in the listen queue of kernel, which drops or answers with SYN
+// cookies when the queue is full. This keeps the server responsive to
+// connections already accepted. Each port has its own rate, so a flood on one
+// port doesn't hold back connections of others.
+
+var acceptLimit struct {
+	sync.Mutex
+	interval time.Duration // 0 for no limit
+	burst    time.Duration
+	next     map[string]time.Time // when next connection of port can be accepted
+}
+
+func setAcceptRate(rate int) {
+	acceptLimit.Lock()
+	defer acceptLimit.Unlock()
+	if rate <= 0 {
+		acceptLimit.interval = 0
+		acceptLimit.next = nil
+		return
+	}
+	acceptLimit.interval = time.Second / time.Duration(rate)
+	// allow connections of one second to be accepted at once
+	acceptLimit.burst = time.Second
+	if acceptLimit.next == nil {
+		acceptLimit.next = map[string]time.Time{}
+	}
+	// forget ports not limited now, including those closed
+	min := time.Now().Add(-acceptLimit.burst)
+	for port, t := range acceptLimit.next {
+		if t.Before(min) {
+			delete(acceptLimit.next, port)
+		}
+	}
+}
+
+// waitAccept blocks until accepting another connection on port is allowed.
+func waitAccept(port string) {
+	acceptLimit.Lock()
+	if acceptLimit.interval == 0 {
+		acceptLimit.Unlock()
+		return
+	}
+	now := time.Now()
+	t := acceptLimit.next[port]
+	if min := now.Add(-acceptLimit.burst); t.Before(min) {
+		t = min
+	}
+	acceptLimit.next[port] = t.Add(acceptLimit.interval)
+	acceptLimit.Unlock()
+	if d := t.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+var listenBacklog int // 0 to use default of Go
+
+// Set on platforms supporting them.
+var (
+	setBacklog    func(ln net.Listener, backlog int) error
+	watchOverflow func()
+)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const overflowCheckInterval = 10 * time.Second
+
+func init() {
+	setBacklog = setListenBacklog
+	watchOverflow = watchListenOverflow
+}
+
+// setListenBacklog changes backlog by calling listen again on the listening
+// socket, which Linux allows. The value is capped by net.core.somaxconn.
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	err = rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return lerr
+}
+
+// counters in /proc/net/netstat reported when increased
+var overflowCounters = []string{
+	"ListenOverflows",      // accept queue full
+	"ListenDrops",          // SYNs dropped by listening sockets
+	"TCPReqQFullDoCookies", // SYN cookies sent as SYN queue is full
+	"TCPReqQFullDrop",      // SYNs dropped as SYN queue is full
+}
+
+// readTCPExt returns the TcpExt counters in /proc/net/netstat.
+func readTCPExt() (map[string]int64, error) {
+	f, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "TcpExt:" {
+			continue
+		}
+		// first line has names, second values
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		counters := map[string]int64{}
+		for i, v := range fields[1:] {
+			if i < len(names) {
+				counters[names[i]], _ = strconv.ParseInt(v, 10, 64)
+			}
+		}
+		return counters, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func watchListenOverflow() {
+	if b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_syncookies"); err == nil &&
+		strings.TrimSpace(string(b)) == "0" {
+		log.Println("SYN cookies are disabled (net.ipv4.tcp_syncookies), SYN floods may exhaust the SYN queue")
+	}
+	last, err := readTCPExt()
+	if err != nil {
+		log.Println("watching listen queue overflow:", err)
+		return
+	}
+	for {
+		time.Sleep(overflowCheckInterval)
+		cur, err := readTCPExt()
+		if err != nil {
+			debug.Println("read TcpExt counters:", err)
+			continue
+		}
+		var report []string
+		for _, name := range overflowCounters {
+			if n := cur[name] - last[name]; n > 0 {
+				report = append(report, name+" "+strconv.FormatInt(n, 10))
+			}
+		}
+		if len(report) != 0 {
+			log.Printf("kernel reported listen queue overflow in last %v: %s\n",
+				overflowCheckInterval, strings.Join(report, ", "))
+		}
+		last = cur
+	}
+}
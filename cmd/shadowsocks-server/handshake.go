@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Until the request is parsed, a connection is unauthenticated and may come
+// from anyone. Such connections must send the request within
+// handshake_timeout and in at most handshake_max_bytes, otherwise they are
+// closed and counted, so that slow or garbage sending connections can't hold
+// server resources for long. Counters are exported at /debug/vars of admin
+// interface.
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	// enough for salt and the largest AEAD chunk
+	defaultHandshakeMaxBytes = 32 * 1024
+)
+
+var handshakeLimit struct {
+	timeout  int64 // time.Duration
+	maxBytes int64
+}
+
+var handshakeStat struct {
+	timeouts expvar.Int
+	oversize expvar.Int
+}
+
+func init() {
+	m := expvar.NewMap("handshake")
+	m.Set("timeouts", &handshakeStat.timeouts)
+	m.Set("oversize", &handshakeStat.oversize)
+}
+
+var errHandshakeTooLarge = errors.New("request exceeds handshake_max_bytes")
+
+// setHandshakeLimit applies limits in seconds and bytes, 0 for the default.
+func setHandshakeLimit(timeout, maxBytes int) {
+	d := defaultHandshakeTimeout
+	if timeout > 0 {
+		d = time.Duration(timeout) * time.Second
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultHandshakeMaxBytes
+	}
+	atomic.StoreInt64(&handshakeLimit.timeout, int64(d))
+	atomic.StoreInt64(&handshakeLimit.maxBytes, int64(maxBytes))
+}
+
+// handshakeConn enforces handshake limits on reads until handshakeDone is
+// called. It's only read by the goroutine handling the connection before
+// that.
+type handshakeConn struct {
+	net.Conn
+	deadline time.Time
+	left     int64
+	done     bool
+}
+
+func newHandshakeConn(conn net.Conn) *handshakeConn {
+	timeout := time.Duration(atomic.LoadInt64(&handshakeLimit.timeout))
+	c := &handshakeConn{
+		Conn:     conn,
+		deadline: time.Now().Add(timeout),
+		left:     atomic.LoadInt64(&handshakeLimit.maxBytes),
+	}
+	conn.SetReadDeadline(c.deadline)
+	return c
+}
+
+func (c *handshakeConn) Read(b []byte) (n int, err error) {
+	if c.done {
+		return c.Conn.Read(b)
+	}
+	if c.left <= 0 {
+		return 0, errHandshakeTooLarge
+	}
+	if int64(len(b)) > c.left {
+		b = b[:c.left]
+	}
+	n, err = c.Conn.Read(b)
+	c.left -= int64(n)
+	return
+}
+
+// SetReadDeadline doesn't extend the deadline beyond that of handshake.
+func (c *handshakeConn) SetReadDeadline(t time.Time) error {
+	if !c.done && (t.IsZero() || t.After(c.deadline)) {
+		t = c.deadline
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *handshakeConn) handshakeDone() {
+	c.done = true
+	c.Conn.SetReadDeadline(time.Time{})
+}
+
+// handshakeViolated counts err if it's caused by handshake limits, and
+// tells whether it is.
+func handshakeViolated(err error) bool {
+	if err == errHandshakeTooLarge {
+		handshakeStat.oversize.Add(1)
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		handshakeStat.timeouts.Add(1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeConnMaxBytes(t *testing.T) {
+	setHandshakeLimit(0, 10)
+	defer setHandshakeLimit(0, 0)
+
+	tests := []struct {
+		size int
+		err  error
+	}{
+		{5, nil},
+		{10, nil},
+		{11, errHandshakeTooLarge},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		go func() {
+			c2.Write(make([]byte, tt.size))
+			// payload after handshake isn't limited
+			c2.Write(make([]byte, 100))
+			c2.Close()
+		}()
+		hc := newHandshakeConn(c1)
+		_, err := io.ReadFull(hc, make([]byte, tt.size))
+		if err != tt.err {
+			t.Errorf("reading %d bytes: got error %v, expected %v", tt.size, err, tt.err)
+		}
+		if err == nil {
+			hc.handshakeDone()
+			if _, err = io.ReadFull(hc, make([]byte, 100)); err != nil {
+				t.Errorf("reading after handshake: %v", err)
+			}
+		} else if !handshakeViolated(err) {
+			t.Errorf("%v should be counted as violating handshake limits", err)
+		}
+		c1.Close()
+	}
+}
+
+func TestHandshakeConnDeadline(t *testing.T) {
+	setHandshakeLimit(0, 0)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	hc := newHandshakeConn(c1)
+	defer hc.Close()
+	hc.deadline = time.Now().Add(50 * time.Millisecond)
+	// extending the deadline is limited to that of handshake
+	hc.SetReadDeadline(time.Now().Add(time.Hour))
+	if _, err := hc.Read(make([]byte, 1)); !handshakeViolated(err) {
+		t.Errorf("got error %v, expected timeout", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With port hopping, hopping ports of each configured port are opened and
+// closed as time slot changes. Ports of the previous and next slots are also
+// open to tolerate clock skew between client and server. Hopping ports are
+// served like configured ports through passwdManager, so draining and soft
+// restart apply to them too.
+
+var portHop *ss.PortHop // nil if port hopping is disabled
+
+// receives port passwords after config is reloaded, nil to stop hopping
+var hopPasswords = make(chan map[string]string, 1)
+
+// hopOpened maps opened hopping ports to their passwords, only accessed when
+// updating hopping ports.
+var hopOpened = map[string]string{}
+
+// hopBase maps hopping ports to their configured ports.
+var hopBase struct {
+	sync.RWMutex
+	port map[string]string
+}
+
+// basePort returns the configured port served by port.
+func basePort(port string) string {
+	hopBase.RLock()
+	defer hopBase.RUnlock()
+	if base, ok := hopBase.port[port]; ok {
+		return base
+	}
+	return port
+}
+
+func copyPasswords(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for port, password := range m {
+		c[port] = password
+	}
+	return c
+}
+
+// startPortHop opens hopping ports of current slot before returning, so that
+// listeners inherited on soft restart are taken over.
+func startPortHop(passwords map[string]string) {
+	passwords = copyPasswords(passwords)
+	slot := updateHopPorts(passwords)
+	go func() {
+		for {
+			select {
+			case <-time.After(time.Until(portHop.SlotStart(slot + 1))):
+			case passwords = <-hopPasswords:
+				if passwords == nil {
+					return
+				}
+			}
+			slot = updateHopPorts(passwords)
+		}
+	}()
+}
+
+// reloadHopPorts makes hopping ports follow the reloaded port passwords.
+func reloadHopPorts(passwords map[string]string) {
+	sendHopPasswords(copyPasswords(passwords))
+}
+
+// stopPortHop stops opening new hopping ports, as the old process does after
+// soft restart.
+func stopPortHop() {
+	sendHopPasswords(nil)
+}
+
+func sendHopPasswords(passwords map[string]string) {
+	if portHop == nil {
+		return
+	}
+	select {
+	case <-hopPasswords: // replaced by the newer one
+	default:
+	}
+	hopPasswords <- passwords
+}
+
+// updateHopPorts opens hopping ports around current slot and closes others,
+// returns current slot.
+func updateHopPorts(passwords map[string]string) int64 {
+	slot := portHop.Slot(time.Now())
+	want := map[string]string{} // hopping port to configured port
+	for s := slot - 1; s <= slot+1; s++ {
+		for port, password := range passwords {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				continue
+			}
+			hp := strconv.Itoa(portHop.Port(password, p, s))
+			if _, ok := passwords[hp]; ok {
+				continue // configured port
+			}
+			if base, ok := want[hp]; ok && base != port {
+				debug.Printf("hopping port %s of port %s is taken by port %s\n", hp, port, base)
+				continue
+			}
+			want[hp] = port
+		}
+	}
+
+	hopBase.Lock()
+	hopBase.port = want
+	hopBase.Unlock()
+	for hp, password := range hopOpened {
+		if base, ok := want[hp]; ok && passwords[base] == password {
+			continue
+		}
+		delete(hopOpened, hp)
+		if _, ok := passwords[hp]; ok {
+			continue // now a configured port
+		}
+		debug.Printf("closing hopping port %s\n", hp)
+		passwdManager.del(hp)
+	}
+	for hp, base := range want {
+		if _, ok := hopOpened[hp]; ok {
+			continue
+		}
+		lns, udp, err := listenPort(hp)
+		if err != nil {
+			log.Printf("listening hopping port %s of port %s: %v\n", hp, base, err)
+			continue
+		}
+		debug.Printf("opened hopping port %s of port %s\n", hp, base)
+		hopOpened[hp] = passwords[base]
+		go serve(hp, passwords[base], lns, udp)
+	}
+	return slot
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The ss-manager API of shadowsocks-libev lets management panels add and
+// remove ports and read their traffic while the server is running. Each
+// command is a datagram sent to manager_addr, which is a UDP address or a
+// unix socket path, and replied to the sender:
+//
+//	add: {"server_port": 8001, "password": "...", "method": "..."}  ok or err
+//	remove: {"server_port": 8001}                                    ok or err
+//	list                                                             ports in JSON
+//	ping                                                             stat: {"8001": bytes, ...}
+//
+// add also takes "quota" in MB per month, like port_quota. Quota events are
+// sent to the last sender as "quota: {...}", see quota.go.
+// The API has no authentication, it should only be bound to loopback address
+// or a unix socket. Ports added by the API are kept on SIGHUP, but not on
+// restart, so the manager should add them again.
+
+const managerMaxCmdLen = 4096
+
+type managedPort struct {
+	password string
+	method   string // empty to use method
+	quota    int    // MB, 0 for none
+}
+
+var managed struct {
+	sync.Mutex
+	ports map[string]managedPort
+}
+
+// events like quota warnings are sent to the last sender of commands
+var managerPeer struct {
+	sync.Mutex
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func sendManagerEvent(msg []byte) {
+	managerPeer.Lock()
+	pc, addr := managerPeer.pc, managerPeer.addr
+	managerPeer.Unlock()
+	if addr == nil {
+		return
+	}
+	if _, err := pc.WriteTo(msg, addr); err != nil {
+		debug.Println("manager API event:", err)
+	}
+}
+
+type managerPort struct {
+	ServerPort json.RawMessage `json:"server_port"` // number or string
+	Password   string          `json:"password,omitempty"`
+	Method     string          `json:"method,omitempty"`
+	Quota      int             `json:"quota,omitempty"` // MB per month
+}
+
+func (mp *managerPort) port() (string, error) {
+	port := strings.Trim(string(mp.ServerPort), `"`)
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid server_port %s", mp.ServerPort)
+	}
+	return port, nil
+}
+
+// serveManager serves the API at addr, which has no authentication, so
+// addresses reachable from other hosts are refused unless remote is set.
+func serveManager(addr string, remote bool) error {
+	if ss.ExposedManager(addr) {
+		if !remote {
+			return fmt.Errorf("manager API at %s would be reachable from other hosts without authentication, bind it to a loopback address or set manager_remote", addr)
+		}
+		log.Printf("warning: manager API at %s can be reached from other hosts without authentication\n", addr)
+	}
+	network := "udp"
+	if strings.Contains(addr, "/") {
+		network = "unixgram"
+		// left by previous run
+		os.Remove(addr)
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("manager API listening at %s\n", addr)
+	go func() {
+		buf := make([]byte, managerMaxCmdLen)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				log.Println("manager API:", err)
+				return
+			}
+			reply := handleManagerCmd(string(buf[:n]))
+			if from == nil {
+				// unix socket of sender is not bound
+				continue
+			}
+			managerPeer.Lock()
+			managerPeer.pc, managerPeer.addr = pc, from
+			managerPeer.Unlock()
+			if _, err = pc.WriteTo(reply, from); err != nil {
+				debug.Println("manager API reply:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func handleManagerCmd(cmd string) []byte {
+	cmd = strings.TrimSpace(cmd)
+	name, arg := cmd, ""
+	if i := strings.Index(cmd, ":"); i >= 0 {
+		name, arg = cmd[:i], strings.TrimSpace(cmd[i+1:])
+	}
+	var err error
+	switch name {
+	case "ping":
+		return managerStat()
+	case "list":
+		return managerList()
+	case "add", "remove":
+		var mp managerPort
+		if err = json.Unmarshal([]byte(arg), &mp); err != nil {
+			break
+		}
+		var port string
+		if port, err = mp.port(); err != nil {
+			break
+		}
+		if name == "add" {
+			err = managerAdd(port, managedPort{mp.Password, mp.Method, mp.Quota})
+		} else {
+			err = managerRemove(port)
+		}
+	default:
+		err = errors.New("unknown command")
+	}
+	if err != nil {
+		log.Printf("manager API %s: %v\n", name, err)
+		return []byte("err")
+	}
+	return []byte("ok")
+}
+
+// updateConfig replaces config with a copy changed by update, if it passes
+// the checks when starting.
+func updateConfig(update func(c *ss.Config)) error {
+	newconfig := *config
+	newconfig.PortPassword = copyPasswords(config.PortPassword)
+	newconfig.PortMethod = copyPasswords(config.PortMethod)
+	newconfig.PortQuota = make(map[string]int, len(config.PortQuota))
+	for port, mb := range config.PortQuota {
+		newconfig.PortQuota[port] = mb
+	}
+	update(&newconfig)
+	if err := checkMethod(&newconfig); err != nil {
+		return err
+	}
+	if err := ss.CheckStrict(&newconfig, true); err != nil {
+		return err
+	}
+	oldconfig := config
+	config = &newconfig
+	publishConfig(config)
+	applyPorts(oldconfig)
+	initQuota(config)
+	if err := initUsageReport(config); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+func managerAdd(port string, mp managedPort) error {
+	if mp.password == "" {
+		return errors.New("password is empty")
+	}
+	if mp.quota < 0 {
+		return errors.New("quota is negative")
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	managed.Lock()
+	prev, wasManaged := managed.ports[port]
+	managed.Unlock()
+	err := updateConfig(func(c *ss.Config) {
+		c.PortPassword[port] = mp.password
+		delete(c.PortMethod, port)
+		if mp.method != "" {
+			c.PortMethod[port] = mp.method
+		}
+		if mp.quota > 0 {
+			c.PortQuota[port] = mp.quota
+		} else if wasManaged && prev.quota > 0 {
+			// quota given by the previous add
+			delete(c.PortQuota, port)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	managed.Lock()
+	if managed.ports == nil {
+		managed.ports = map[string]managedPort{}
+	}
+	managed.ports[port] = mp
+	managed.Unlock()
+	return nil
+}
+
+func managerRemove(port string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if _, ok := config.PortPassword[port]; !ok {
+		return fmt.Errorf("port %s is not served", port)
+	}
+	managed.Lock()
+	mp, wasManaged := managed.ports[port]
+	managed.Unlock()
+	err := updateConfig(func(c *ss.Config) {
+		delete(c.PortPassword, port)
+		delete(c.PortMethod, port)
+		if wasManaged && mp.quota > 0 {
+			delete(c.PortQuota, port)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	managed.Lock()
+	delete(managed.ports, port)
+	managed.Unlock()
+	return nil
+}
+
+// addManagedPorts adds ports added by manager API to config reloaded.
+func addManagedPorts(c *ss.Config) {
+	managed.Lock()
+	defer managed.Unlock()
+	for port, mp := range managed.ports {
+		c.PortPassword[port] = mp.password
+		if mp.method != "" {
+			if c.PortMethod == nil {
+				c.PortMethod = map[string]string{}
+			}
+			c.PortMethod[port] = mp.method
+		}
+		if mp.quota > 0 {
+			if c.PortQuota == nil {
+				c.PortQuota = map[string]int{}
+			}
+			c.PortQuota[port] = mp.quota
+		}
+	}
+}
+
+func managerList() []byte {
+	configMu.Lock()
+	passwords := config.PortPassword
+	configMu.Unlock()
+	var ports []string
+	for port := range passwords {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	list := []managerPort{}
+	for _, port := range ports {
+		list = append(list, managerPort{
+			ServerPort: json.RawMessage(strconv.Quote(port)),
+			Password:   passwords[port],
+			Method:     methodOf(port),
+		})
+	}
+	b, _ := json.Marshal(list)
+	return b
+}
+
+// managerStat returns bytes transferred of each port in both directions.
+func managerStat() []byte {
+	configMu.Lock()
+	passwords := config.PortPassword
+	configMu.Unlock()
+	stat := map[string]int64{}
+	for port, t := range ss.TrafficTotals(false) {
+		if _, ok := passwords[port]; ok {
+			stat[port] = t.Upload + t.Download
+		}
+	}
+	b, _ := json.Marshal(stat)
+	return append([]byte("stat: "), b...)
+}
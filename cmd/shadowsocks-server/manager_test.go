@@ -0,0 +1,64 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"net"
+	"strings"
+	"testing"
+)
+
+// initTestConfig sets config without ports, returning a free port to add.
+func initTestConfig(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	config = &ss.Config{
+		Method:       "aes-256-gcm",
+		BindAddress:  "127.0.0.1",
+		PortPassword: map[string]string{},
+		PortMethod:   map[string]string{},
+	}
+	publishConfig(config)
+	return port
+}
+
+func TestManagerCmd(t *testing.T) {
+	port := initTestConfig(t)
+	defer func() {
+		passwdManager.del(port)
+		managed.ports = nil
+		quotas.ports = nil
+	}()
+
+	tests := []struct {
+		cmd, reply string
+	}{
+		{`list`, `[]`},
+		{`add: {"server_port": PORT, "password": "pw"}`, `ok`},
+		{`list`, `[{"server_port":"PORT","password":"pw","method":"aes-256-gcm"}]`},
+		{`add: {"server_port": "PORT", "password": "pw2", "method": "chacha20-ietf-poly1305", "quota": 10}`, `ok`},
+		{`list`, `[{"server_port":"PORT","password":"pw2","method":"chacha20-ietf-poly1305"}]`},
+		{`remove: {"server_port": PORT}`, `ok`},
+		{`list`, `[]`},
+		{`remove: {"server_port": PORT}`, `err`},
+		{`add: {"server_port": PORT}`, `err`},
+		{`add: {"server_port": 0, "password": "pw"}`, `err`},
+		{`add: {"server_port": PORT, "password": "pw", "method": "rot13"}`, `err`},
+		{`list`, `[]`},
+		{`stop`, `err`},
+	}
+	for _, tt := range tests {
+		cmd := strings.Replace(tt.cmd, "PORT", port, -1)
+		reply := strings.Replace(tt.reply, "PORT", port, -1)
+		if got := string(handleManagerCmd(cmd)); got != reply {
+			t.Errorf("%s: got reply %s, expected %s", cmd, got, reply)
+		}
+	}
+	if len(config.PortQuota) != 0 {
+		t.Errorf("quota of removed port should be removed, got %v", config.PortQuota)
+	}
+}
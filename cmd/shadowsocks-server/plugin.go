@@ -0,0 +1,68 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"net"
+	"sync"
+)
+
+// With plugin set, each configured port is listened by a plugin process,
+// which connects to shadowsocks listening on a loopback port. Hopping ports
+// and UDP relay don't go through plugin. Soft restart is not supported, as
+// plugin processes can't be passed to the new process.
+
+var pluginName, pluginOpts string
+
+var portPlugins struct {
+	sync.Mutex
+	byPort map[string]*ss.Plugin
+}
+
+// listenAddr returns the address to listen for port, which is the local
+// address of its plugin if there's one.
+func listenAddr(port string) string {
+	portPlugins.Lock()
+	defer portPlugins.Unlock()
+	if p, ok := portPlugins.byPort[port]; ok {
+		return p.LocalAddr()
+	}
+	return net.JoinHostPort(currentConfig().BindAddress, port)
+}
+
+// updatePlugins starts plugins for ports without one, and stops plugins of
+// ports removed.
+func updatePlugins(ports map[string]string) error {
+	if pluginName == "" {
+		return nil
+	}
+	portPlugins.Lock()
+	defer portPlugins.Unlock()
+	if portPlugins.byPort == nil {
+		portPlugins.byPort = map[string]*ss.Plugin{}
+	}
+	for port, p := range portPlugins.byPort {
+		if _, ok := ports[port]; !ok {
+			p.Stop()
+			delete(portPlugins.byPort, port)
+		}
+	}
+	host := config.BindAddress
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	for port := range ports {
+		if _, ok := portPlugins.byPort[port]; ok {
+			continue
+		}
+		local, err := ss.LocalPluginAddr()
+		if err != nil {
+			return err
+		}
+		p, err := ss.StartPlugin(pluginName, pluginOpts, net.JoinHostPort(host, port), local)
+		if err != nil {
+			return err
+		}
+		portPlugins.byPort[port] = p
+	}
+	return nil
+}
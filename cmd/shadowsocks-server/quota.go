@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With port_quota, traffic of each port in a month is limited, counted as
+// usage of the month for usage reports. When usage reaches 80% and 95% of
+// quota, warning events are sent so operators can notify customers before
+// service stops. At 100%, connections of the port are closed and new ones
+// refused until next month or quota is raised, or throttled to
+// quota_throttle Mbit/s if set. Events are POSTed as JSON to quota_webhook,
+// and sent to the last peer of manager API as "quota: {...}". Usage is
+// updated every usageInterval, so a port may exceed its quota by the
+// traffic of one interval. UDP packets are dropped or paced like connections.
+
+var quotaWarnLevels = []int{80, 95}
+
+const quotaFull = 100
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+type portQuota struct {
+	limit int64 // bytes, 0 for no quota
+	level int32 // percentage of quota reached, one of warn levels or full
+
+	// protected by quotas lock
+	notified int // highest level sent as event in the month
+
+	pace struct {
+		sync.Mutex
+		next time.Time // when next bytes can be relayed
+	}
+}
+
+var quotas struct {
+	sync.Mutex
+	ports    map[string]*portQuota
+	webhook  string
+	throttle int64 // bytes per second when over quota, 0 to block
+}
+
+type quotaEvent struct {
+	Port   string `json:"server_port"`
+	Tenant string `json:"tenant,omitempty"`
+	Month  string `json:"month"`
+	Level  int    `json:"level"` // percentage of quota reached
+	Used   int64  `json:"used"`  // bytes
+	Quota  int64  `json:"quota"`
+	Action string `json:"action"` // warn, block or throttle
+}
+
+// initQuota applies quotas in config, levels reached are kept.
+func initQuota(config *ss.Config) {
+	quotas.Lock()
+	defer quotas.Unlock()
+	if quotas.ports == nil {
+		quotas.ports = map[string]*portQuota{}
+	}
+	for port, q := range quotas.ports {
+		if _, ok := config.PortQuota[port]; !ok {
+			atomic.StoreInt64(&q.limit, 0)
+			atomic.StoreInt32(&q.level, 0)
+			// warned again if quota is added back
+			q.notified = 0
+		}
+	}
+	for port, mb := range config.PortQuota {
+		q := quotas.ports[port]
+		if q == nil {
+			q = &portQuota{}
+			quotas.ports[port] = q
+		}
+		atomic.StoreInt64(&q.limit, int64(mb)*1000*1000)
+	}
+	quotas.webhook = config.QuotaWebhook
+	atomic.StoreInt64(&quotas.throttle, int64(config.QuotaThrottle)*1000*1000/8)
+}
+
+func quotaOf(port string) *portQuota {
+	quotas.Lock()
+	defer quotas.Unlock()
+	return quotas.ports[port]
+}
+
+func quotaLevel(used, limit int64) int {
+	if used >= limit {
+		return quotaFull
+	}
+	level := 0
+	for _, l := range quotaWarnLevels {
+		if used*100 >= limit*int64(l) {
+			level = l
+		}
+	}
+	return level
+}
+
+// checkQuotas updates levels of ports by usage of month, returning events of
+// levels newly reached. With silent, levels are taken as notified, e.g. for
+// usage restored after restarting. It's called with usage locked.
+func checkQuotas(month string, ports map[string]*ss.PortTraffic, silent bool) []quotaEvent {
+	quotas.Lock()
+	defer quotas.Unlock()
+	var events []quotaEvent
+	for port, q := range quotas.ports {
+		limit := atomic.LoadInt64(&q.limit)
+		if limit == 0 {
+			continue
+		}
+		var used int64
+		if u := ports[port]; u != nil {
+			used = u.Upload + u.Download
+		}
+		level := quotaLevel(used, limit)
+		atomic.StoreInt32(&q.level, int32(level))
+		if level <= q.notified || silent {
+			// quota raised or new month
+			q.notified = level
+			continue
+		}
+		q.notified = level
+		e := quotaEvent{Port: port, Month: month, Level: level, Used: used, Quota: limit, Action: "warn"}
+		if level == quotaFull {
+			e.Action = "block"
+			if atomic.LoadInt64(&quotas.throttle) > 0 {
+				e.Action = "throttle"
+			}
+		}
+		if t := tenantOf(port); t != nil {
+			e.Tenant = t.name
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func sendQuotaEvents(events []quotaEvent) {
+	quotas.Lock()
+	webhook := quotas.webhook
+	quotas.Unlock()
+	for _, e := range events {
+		log.Printf("port %s reached %d%% of traffic quota, %s\n", e.Port, e.Level, e.Action)
+		data, _ := json.Marshal(e)
+		sendManagerEvent(append([]byte("quota: "), data...))
+		if webhook == "" {
+			continue
+		}
+		client := http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(webhook, "application/json", bytes.NewReader(data))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = errors.New(resp.Status)
+			}
+		}
+		if err != nil {
+			log.Printf("quota webhook for port %s: %v\n", e.Port, err)
+		}
+	}
+}
+
+// check returns error if connections should be closed.
+func (q *portQuota) check() error {
+	if atomic.LoadInt32(&q.level) >= quotaFull && atomic.LoadInt64(&quotas.throttle) == 0 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// wait paces n bytes if over quota and throttled. Connections of the port
+// share the rate.
+func (q *portQuota) wait(n int) {
+	rate := atomic.LoadInt64(&quotas.throttle)
+	if n <= 0 || rate == 0 || atomic.LoadInt32(&q.level) < quotaFull {
+		return
+	}
+	q.pace.Lock()
+	now := time.Now()
+	if q.pace.next.Before(now) {
+		q.pace.next = now
+	}
+	d := q.pace.next.Sub(now)
+	q.pace.next = q.pace.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	q.pace.Unlock()
+	time.Sleep(d)
+}
+
+// Conn wraps connection to destination to enforce quota on relaying.
+func (q *portQuota) Conn(remote net.Conn) net.Conn {
+	return quotaConn{remote, q}
+}
+
+type quotaConn struct {
+	net.Conn
+	q *portQuota
+}
+
+func (c quotaConn) Read(b []byte) (n int, err error) {
+	if err = c.q.check(); err != nil {
+		return
+	}
+	n, err = c.Conn.Read(b)
+	c.q.wait(n)
+	return
+}
+
+func (c quotaConn) Write(b []byte) (n int, err error) {
+	if err = c.q.check(); err != nil {
+		return
+	}
+	c.q.wait(len(b))
+	return c.Conn.Write(b)
+}
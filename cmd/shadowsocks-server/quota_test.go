@@ -0,0 +1,67 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"testing"
+)
+
+func TestQuotaLevel(t *testing.T) {
+	tests := []struct {
+		used  int64
+		level int
+	}{
+		{0, 0},
+		{799, 0},
+		{800, 80},
+		{949, 80},
+		{950, 95},
+		{999, 95},
+		{1000, quotaFull},
+		{1500, quotaFull},
+	}
+	for _, tt := range tests {
+		if level := quotaLevel(tt.used, 1000); level != tt.level {
+			t.Errorf("used %d of 1000: got level %d, expected %d", tt.used, level, tt.level)
+		}
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	defer func() { quotas.ports = nil }()
+	initQuota(&ss.Config{PortQuota: map[string]int{"8388": 1}})
+	q := quotaOf("8388")
+
+	tests := []struct {
+		used   int64
+		silent bool
+		event  int // level of event sent, 0 for none
+	}{
+		{500 * 1000, false, 0},
+		{850 * 1000, false, 80},
+		{900 * 1000, false, 0}, // already warned
+		{960 * 1000, false, 95},
+		{1000 * 1000, false, quotaFull},
+		// new month
+		{0, false, 0},
+		// usage restored after restarting is taken as notified
+		{820 * 1000, true, 0},
+		{830 * 1000, false, 0},
+		{950 * 1000, false, 95},
+	}
+	for i, tt := range tests {
+		ports := map[string]*ss.PortTraffic{"8388": {Upload: tt.used / 2, Download: tt.used - tt.used/2}}
+		events := checkQuotas("2026-10", ports, tt.silent)
+		var level int
+		if len(events) == 1 {
+			level = events[0].Level
+		} else if len(events) > 1 {
+			t.Errorf("%d: got %d events, expected at most one", i, len(events))
+		}
+		if level != tt.event {
+			t.Errorf("%d: used %d, got event of level %d, expected %d", i, tt.used, level, tt.event)
+		}
+		if blocked := q.check() != nil; blocked != (tt.used >= 1000*1000) {
+			t.Errorf("%d: used %d, blocked is %v", i, tt.used, blocked)
+		}
+	}
+}
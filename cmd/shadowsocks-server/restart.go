@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Soft restart works like nginx's binary upgrade: on restartSignal the server
+// starts a new process of the (possibly replaced) binary, passing all
+// listening sockets to it. Once the new process tells it has opened all
+// ports, the old process stops accepting and exits after all its connections
+// are finished, so no connection is dropped. If the new process fails to
+// start, the old one keeps serving.
+
+// Environment variable telling the new process which ports are passed to it,
+// in the same order of the inherited file descriptors starting from 3. UDP
+// sockets are marked with udpFdPrefix.
+const listenFdsEnv = "SS_LISTEN_FDS"
+
+const udpFdPrefix = "udp:"
+
+// Environment variable telling the new process the file descriptor of a pipe,
+// which it writes to when ready.
+const readyFdEnv = "SS_READY_FD"
+
+// the new process is killed if it's not ready within this time
+const restartReadyTimeout = time.Minute
+
+var restartSignal os.Signal // nil if soft restart is not supported
+
+var activeConn int32
+
+var inherited struct {
+	sync.Mutex
+	listener   map[string]net.Listener
+	packetConn map[string]net.PacketConn
+}
+
+// readyPipe is written to when ports are open, nil if not started by soft
+// restart.
+var readyPipe *os.File
+
+func initInheritedListener() {
+	if fd, err := strconv.Atoi(os.Getenv(readyFdEnv)); err == nil {
+		readyPipe = os.NewFile(uintptr(fd), "ready")
+		os.Unsetenv(readyFdEnv)
+	}
+	env := os.Getenv(listenFdsEnv)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(listenFdsEnv)
+	inherited.listener = map[string]net.Listener{}
+	inherited.packetConn = map[string]net.PacketConn{}
+	for i, port := range strings.Split(env, ",") {
+		f := os.NewFile(uintptr(3+i), "listener-"+port)
+		if strings.HasPrefix(port, udpFdPrefix) {
+			port = strings.TrimPrefix(port, udpFdPrefix)
+			pc, err := net.FilePacketConn(f)
+			f.Close()
+			if err != nil {
+				log.Printf("error inheriting UDP socket for port %s: %v\n", port, err)
+				continue
+			}
+			inherited.packetConn[port] = pc
+			continue
+		}
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("error inheriting listener for port %s: %v\n", port, err)
+			continue
+		}
+		inherited.listener[port] = ln
+	}
+	log.Println("inherited listeners for port", env)
+}
+
+// listen returns the listener inherited from the old process if there's one.
+// If shared, the port can be listened by multiple listeners.
+func listen(port string, shared bool) (net.Listener, error) {
+	inherited.Lock()
+	ln, ok := inherited.listener[port]
+	delete(inherited.listener, port)
+	inherited.Unlock()
+	if !ok {
+		addr := listenAddr(port)
+		var err error
+		if shared && reusePort != nil {
+			lc := net.ListenConfig{Control: reusePort}
+			ln, err = lc.Listen(context.Background(), "tcp", addr)
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if listenBacklog > 0 {
+		if err := setBacklog(ln, listenBacklog); err != nil {
+			log.Printf("port %s: set listen backlog: %v\n", port, err)
+		}
+	}
+	return ln, nil
+}
+
+// listenUDP returns the UDP socket inherited from the old process if there's
+// one.
+func listenUDP(port string) (net.PacketConn, error) {
+	inherited.Lock()
+	pc, ok := inherited.packetConn[port]
+	delete(inherited.packetConn, port)
+	inherited.Unlock()
+	if ok {
+		return pc, nil
+	}
+	return net.ListenPacket("udp", net.JoinHostPort(currentConfig().BindAddress, port))
+}
+
+// closeInheritedListener closes inherited listeners for ports removed from
+// config.
+func closeInheritedListener() {
+	inherited.Lock()
+	for port, ln := range inherited.listener {
+		log.Printf("closing inherited listener for port %s as it's deleted\n", port)
+		ln.Close()
+	}
+	for _, pc := range inherited.packetConn {
+		pc.Close()
+	}
+	inherited.listener = nil
+	inherited.packetConn = nil
+	inherited.Unlock()
+}
+
+// notifyReady tells the old process that all ports are open.
+func notifyReady() {
+	if readyPipe == nil {
+		return
+	}
+	if _, err := readyPipe.Write([]byte{1}); err != nil {
+		log.Println("notifying old process:", err)
+	}
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// waitReady waits for the new process p to be ready, it returns false if p
+// exits or times out.
+func waitReady(p *os.Process, ready *os.File) bool {
+	done := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := ready.Read(b)
+		// EOF if p exits without writing
+		done <- n == 1
+	}()
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(restartReadyTimeout):
+		p.Kill()
+		return false
+	}
+}
+
+func softRestart() {
+	if pluginName != "" {
+		log.Println("soft restart is not supported with plugin")
+		return
+	}
+	passwdManager.Lock()
+	ports := make([]string, 0, len(passwdManager.portListener))
+	files := make([]*os.File, 0, len(passwdManager.portListener))
+	for port, pl := range passwdManager.portListener {
+		// listeners of other shards are created by the new process
+		tl, ok := pl.listeners[0].(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			log.Printf("error getting listener file for port %s: %v\n", port, err)
+			continue
+		}
+		ports = append(ports, port)
+		files = append(files, f)
+		if uc, ok := pl.udp.(*net.UDPConn); ok {
+			if f, err = uc.File(); err != nil {
+				log.Printf("error getting UDP socket file for port %s: %v\n", port, err)
+				continue
+			}
+			ports = append(ports, udpFdPrefix+port)
+			files = append(files, f)
+		}
+	}
+	passwdManager.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Println("soft restart:", err)
+		return
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		log.Println("soft restart:", err)
+		return
+	}
+	defer ready.Close()
+	env := append(os.Environ(), listenFdsEnv+"="+strings.Join(ports, ","),
+		readyFdEnv+"="+strconv.Itoa(3+len(files)))
+	attr := &os.ProcAttr{
+		Env:   env,
+		Files: append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), readyW),
+	}
+	p, err := os.StartProcess(exe, os.Args, attr)
+	// only the new process keeps the write end, so reading gets EOF if it exits
+	readyW.Close()
+	if err != nil {
+		log.Println("soft restart:", err)
+		return
+	}
+	log.Printf("started new process %d, waiting for it to be ready\n", p.Pid)
+	if !waitReady(p, ready) {
+		log.Printf("new process %d failed to start, keep serving\n", p.Pid)
+		go p.Wait()
+		return
+	}
+	log.Println("new process is ready, stop accepting connections")
+	p.Release()
+	stopPortHop()
+
+	passwdManager.Lock()
+	for _, pl := range passwdManager.portListener {
+		pl.close()
+	}
+	passwdManager.Unlock()
+	for {
+		n := atomic.LoadInt32(&activeConn)
+		if n == 0 {
+			break
+		}
+		debug.Printf("waiting %d connections to finish\n", n)
+		time.Sleep(time.Second)
+	}
+	log.Println("all connections finished, exit")
+	os.Exit(0)
+}
@@ -0,0 +1,26 @@
+//go:build linux && (386 || amd64 || arm || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 ppc64 ppc64le riscv64 s390x
+
+package main
+
+import (
+	"syscall"
+)
+
+// SO_REUSEPORT is not defined in syscall package, it has this value on the
+// architectures above.
+const soReusePort = 0xf
+
+func init() {
+	reusePort = func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"encoding/gob"
 	"errors"
 	"flag"
+	"fmt"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -31,11 +33,13 @@ func getRequest(conn *ss.Conn) (host string, extra []byte, err error) {
 		idDmLen = 1 // domain address length index
 		idDm0   = 2 // domain address start index
 
-		typeIP = 1 // type is ip address
-		typeDm = 3 // type is domain address
+		typeIP   = 1 // type is ip address
+		typeDm   = 3 // type is domain address
+		typeIPv6 = 4 // type is ipv6 address
 
-		lenIP     = 1 + 4 + 2 // 1addrType + 4ip + 2port
-		lenDmBase = 1 + 1 + 2 // 1addrType + 1addrLen + 2port, plus addrLen
+		lenIP     = 1 + 4 + 2  // 1addrType + 4ip + 2port
+		lenIPv6   = 1 + 16 + 2 // 1addrType + 16ipv6 + 2port
+		lenDmBase = 1 + 1 + 2  // 1addrType + 1addrLen + 2port, plus addrLen
 	)
 
 	// buf size should at least have the same size with the largest possible
@@ -49,10 +53,15 @@ func getRequest(conn *ss.Conn) (host string, extra []byte, err error) {
 		return
 	}
 
-	reqLen := lenIP
-	if buf[idType] == typeDm {
+	var reqLen int
+	switch buf[idType] {
+	case typeIP:
+		reqLen = lenIP
+	case typeIPv6:
+		reqLen = lenIPv6
+	case typeDm:
 		reqLen = int(buf[idDmLen]) + lenDmBase
-	} else if buf[idType] != typeIP {
+	default:
 		err = errAddrType
 		return
 	}
@@ -67,38 +76,109 @@ func getRequest(conn *ss.Conn) (host string, extra []byte, err error) {
 		extra = buf[reqLen:n]
 	}
 
-	// TODO add ipv6 support
-	if buf[idType] == typeDm {
+	switch buf[idType] {
+	case typeDm:
 		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
-	} else if buf[idType] == typeIP {
-		addrIp := make(net.IP, 4)
-		copy(addrIp, buf[idIP0:idIP0+4])
-		host = addrIp.String()
+	case typeIP:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
 	}
 	// parse port
-	var port int16
+	var port uint16
 	sb := bytes.NewBuffer(buf[reqLen-2 : reqLen])
 	binary.Read(sb, binary.BigEndian, &port)
 
-	host += ":" + strconv.Itoa(int(port))
+	host = ss.JoinHostPort(host, strconv.Itoa(int(port)))
 	return
 }
 
-func handleConnection(conn *ss.Conn) {
+// Resolving destinations is cached if dns_prefetch is enabled.
+var dnsCache *ss.DNSCache
+
+const dnsCacheTTL = time.Minute
+
+// replied to clients asking what the server supports
+var serverCaps ss.Capabilities
+
+func dial(host string) (net.Conn, error) {
+	if dnsCache != nil {
+		return dnsCache.Dial(host)
+	}
+	return ss.DialMarked(host)
+}
+
+// destIP returns IP of host, or the address remote connected to if host is a
+// domain. It's nil if dialing failed.
+func destIP(host string, remote net.Conn) net.IP {
+	if remote != nil {
+		if addr, ok := remote.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+	h, _, _ := net.SplitHostPort(host)
+	return net.ParseIP(h)
+}
+
+// hc enforces handshake limits on the underlying connection of conn, port is
+// the configured port accepting it.
+func handleConnection(conn *ss.Conn, hc *handshakeConn, port string) {
 	if debug {
 		// function arguments are always evaluated, so surround debug
 		// statement with if statement
 		debug.Printf("socks connect from %s\n", conn.RemoteAddr().String())
 	}
+	atomic.AddInt32(&activeConn, 1)
+	defer atomic.AddInt32(&activeConn, -1)
 	defer conn.Close()
+	defer ss.RecoverPanic(conn)
+	t := tenantOf(port)
+	if t != nil {
+		if !t.acquire() {
+			debug.Printf("tenant %s reached max connections\n", t.name)
+			return
+		}
+		defer t.release()
+	}
 
+	if err := tlsHandshake(conn); err != nil {
+		handshakeViolated(err)
+		debug.Printf("tls handshake with %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
 	host, extra, err := getRequest(conn)
-	if err != nil {
+	if err == io.EOF {
+		// closed without sending anything, e.g. latency probe of client
+		debug.Println("connection closed before request")
+		return
+	} else if handshakeViolated(err) {
+		debug.Printf("closing %s violating handshake limits: %v\n", conn.RemoteAddr(), err)
+		return
+	} else if err != nil {
 		log.Println("error getting request:", err)
 		return
 	}
+	hc.handshakeDone()
+	if ss.IsCapsRequest(host) {
+		if err = ss.WriteCaps(conn, serverCaps); err != nil {
+			debug.Println("writing capabilities:", err)
+		}
+		return
+	}
+	q := quotaOf(port)
+	if q != nil && q.check() != nil {
+		debug.Printf("port %s is over traffic quota\n", port)
+		return
+	}
+	if t != nil {
+		t.logf("%s %s\n", conn.RemoteAddr(), host)
+	}
 	debug.Println("connecting", host)
-	remote, err := net.Dial("tcp", host)
+	remote, err := dial(host)
+	// recorded after dialing to annotate the address resolved
+	country, asn := ss.DestGeo(destIP(host, remote))
+	ss.AuditGeo(conn.RemoteAddr().String(), host, country, asn)
+	recordAccess(conn, t, host, country, asn)
 	if err != nil {
 		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
 			// log too many open file error
@@ -110,7 +190,19 @@ func handleConnection(conn *ss.Conn) {
 		return
 	}
 	defer remote.Close()
-	// write extra bytes read from 
+	remote = ss.Traffic(port).Conn(remote)
+	remote = ss.ClassifyConn(remote, host)
+	remote = ss.GeoConn(remote, ss.CountDestGeo(country, asn))
+	if q != nil {
+		remote = q.Conn(remote)
+	}
+	if t != nil {
+		remote = tenantConn{remote, t}
+	}
+	if ss.CaptureTarget(host) {
+		remote = ss.NewCaptureConn(remote, conn.RemoteAddr().String(), remote.RemoteAddr().String(), false)
+	}
+	// write extra bytes read from
 	if extra != nil {
 		debug.Println("getRequest read extra data, writing to remote, len", len(extra))
 		if _, err = remote.Write(extra); err != nil {
@@ -120,8 +212,12 @@ func handleConnection(conn *ss.Conn) {
 	}
 	debug.Println("piping", host)
 	c := make(chan byte, 2)
+	var client net.Conn = conn
+	if fairEnabled() {
+		client = newFairConn(conn)
+	}
 	go ss.Pipe(conn, remote, c)
-	go ss.Pipe(remote, conn, c)
+	go ss.Pipe(remote, client, c)
 	<-c // close the other connection whenever one connection is closed
 	debug.Println("closing", host)
 	return
@@ -169,7 +265,7 @@ emptyCache:
 }
 
 func storeTableCache(config *ss.Config) {
-	if !config.CacheEncTable || table.getCnt == table.hitCnt {
+	if !config.CacheEncTable || atomic.LoadInt32(&table.getCnt) == atomic.LoadInt32(&table.hitCnt) {
 		return
 	}
 
@@ -198,7 +294,21 @@ func storeTableCache(config *ss.Config) {
 	debug.Println("table cache saved")
 }
 
-func getTable(password string) (tbl *ss.EncryptTable) {
+// methodOf returns encryption method of port, which can be a hopping port.
+func methodOf(port string) string {
+	c := currentConfig()
+	if m, ok := c.PortMethod[basePort(port)]; ok {
+		return m
+	}
+	return c.Method
+}
+
+func getTable(port, password string) (tbl *ss.EncryptTable) {
+	if method := methodOf(port); method != "" && method != "table" {
+		// only table method is expensive to create
+		tbl, _ = ss.NewTable(method, password)
+		return
+	}
 	if table.cache != nil {
 		var ok bool
 		tbl, ok = table.cache[password]
@@ -216,8 +326,19 @@ func getTable(password string) (tbl *ss.EncryptTable) {
 }
 
 type PortListener struct {
-	password string
-	listener net.Listener
+	password  string
+	method    string
+	listeners []net.Listener
+	udp       net.PacketConn // nil if UDP relay is disabled
+}
+
+func (pl *PortListener) close() {
+	for _, ln := range pl.listeners {
+		ln.Close()
+	}
+	if pl.udp != nil {
+		pl.udp.Close()
+	}
 }
 
 type PasswdManager struct {
@@ -225,10 +346,12 @@ type PasswdManager struct {
 	portListener map[string]*PortListener
 }
 
-func (pm *PasswdManager) add(port, password string, listener net.Listener) {
+func (pm *PasswdManager) add(port, password string, listeners []net.Listener, udp net.PacketConn) *PortListener {
+	pl := &PortListener{password, methodOf(port), listeners, udp}
 	pm.Lock()
-	pm.portListener[port] = &PortListener{password, listener}
+	pm.portListener[port] = pl
 	pm.Unlock()
+	return pl
 }
 
 func (pm *PasswdManager) get(port string) (pl *PortListener, ok bool) {
@@ -243,7 +366,7 @@ func (pm *PasswdManager) del(port string) {
 	if !ok {
 		return
 	}
-	pl.listener.Close()
+	pl.close()
 	pm.Lock()
 	delete(pm.portListener, port)
 	pm.Unlock()
@@ -254,11 +377,11 @@ func (pm *PasswdManager) updatePortPasswd(port, password string) {
 	if !ok {
 		log.Printf("new port %s added\n", port)
 	} else {
-		if pl.password == password {
+		if pl.password == password && pl.method == methodOf(port) {
 			return
 		}
-		log.Printf("closing port %s to update password\n", port)
-		pl.listener.Close()
+		log.Printf("closing port %s to update password or method\n", port)
+		pl.close()
 	}
 	// run will add the new port listener to passwdManager.
 	// So there maybe concurrent access to passwdManager and we need lock to protect it.
@@ -267,39 +390,124 @@ func (pm *PasswdManager) updatePortPasswd(port, password string) {
 
 var passwdManager = PasswdManager{portListener: map[string]*PortListener{}}
 
-func updatePasswd() {
-	log.Println("updating password")
+// reloadConfig applies config file changed while running. Ports are opened,
+// closed or reopened to update password, connections already established
+// are not affected. Options only used when starting are logged if changed.
+func reloadConfig() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	log.Println("reloading config")
 	newconfig, err := ss.ParseConfig(configFile)
 	if err != nil {
-		log.Printf("error parsing config file %s to update password: %v\n", configFile, err)
+		log.Printf("error parsing config file %s to reload: %v\n", configFile, err)
+		return
+	}
+	ss.UpdateConfig(newconfig, &cmdConfig)
+	if err = unifyPortPassword(newconfig); err != nil {
+		log.Println(err)
+		return
+	}
+	addManagedPorts(newconfig)
+	if err = checkMethod(newconfig); err != nil {
+		log.Println(err)
+		return
+	}
+	if err = ss.CheckStrict(newconfig, true); err != nil {
+		log.Println(err)
+		return
+	}
+	if err = initTenants(newconfig); err != nil {
+		log.Println(err)
+		return
+	}
+	if err = initTLS(newconfig); err != nil {
+		log.Println(err)
 		return
 	}
+	if err = initServerList(newconfig); err != nil {
+		log.Println(err)
+	}
+	initQuota(newconfig)
+	if err = initUsageReport(newconfig); err != nil {
+		log.Println(err)
+	}
+	if err = ss.LoadDestGeo(newconfig.DestGeoIP, newconfig.DestGeoIPLocations, newconfig.DestASN); err != nil {
+		log.Println(err)
+	}
+	// applied only when the new config is valid
+	ss.ApplyGlobals(newconfig)
 	oldconfig := config
 	config = newconfig
+	publishConfig(config)
+	for _, opt := range restartOptionsChanged(oldconfig, config) {
+		log.Printf("%s changed, restart to apply\n", opt)
+	}
+	initAccessLog(config.AccessLogSize, config.AccessLogKey)
+	setAcceptRate(config.AcceptRate)
+	setHandshakeLimit(config.HandshakeTimeout, config.HandshakeMaxBytes)
+	setFairBandwidth(config.FairBandwidth)
 
-	if err = unifyPortPassword(config); err != nil {
-		return
+	applyPorts(oldconfig)
+	log.Println("config reloaded")
+}
+
+// applyPorts opens, reopens or closes ports to match config, which replaced
+// oldconfig.
+func applyPorts(oldconfig *ss.Config) {
+	if err := updatePlugins(config.PortPassword); err != nil {
+		log.Println("starting plugin:", err)
 	}
 	for port, passwd := range config.PortPassword {
 		passwdManager.updatePortPasswd(port, passwd)
-		if oldconfig.PortPassword != nil {
-			delete(oldconfig.PortPassword, port)
+	}
+	for port := range oldconfig.PortPassword {
+		if _, ok := config.PortPassword[port]; !ok {
+			log.Printf("closing port %s as it's deleted\n", port)
+			passwdManager.del(port)
 		}
 	}
-	// port password still left in the old config should be closed
-	for port, _ := range oldconfig.PortPassword {
-		log.Printf("closing port %s as it's deleted\n", port)
-		passwdManager.del(port)
+	reloadHopPorts(config.PortPassword)
+}
+
+// restartOptionsChanged returns options used only when starting which differ
+// between old and new config.
+func restartOptionsChanged(old, new *ss.Config) (changed []string) {
+	for opt, v := range map[string][2]interface{}{
+		"admin_addr":          {old.AdminAddr, new.AdminAddr},
+		"agent_addr":          {old.AgentAddr, new.AgentAddr},
+		"manager_addr":        {old.ManagerAddr, new.ManagerAddr},
+		"manager_remote":      {old.ManagerRemote, new.ManagerRemote},
+		"bind_address":        {old.BindAddress, new.BindAddress},
+		"udp":                 {old.UDP, new.UDP},
+		"accept_shards":       {old.AcceptShards, new.AcceptShards},
+		"listen_backlog":      {old.ListenBacklog, new.ListenBacklog},
+		"log_listen_overflow": {old.LogListenOverflow, new.LogListenOverflow},
+		"dns_prefetch":        {old.DNSPrefetch, new.DNSPrefetch},
+		"plugin":              {old.Plugin, new.Plugin},
+		"plugin_opts":         {old.PluginOpts, new.PluginOpts},
+		"port_hop":            {old.PortHop, new.PortHop},
+		"port_hop_interval":   {old.PortHopInterval, new.PortHopInterval},
+	} {
+		if v[0] != v[1] {
+			changed = append(changed, opt)
+		}
 	}
-	log.Println("password updated")
+	sort.Strings(changed)
+	return
 }
 
 func waitSignal() {
 	var sigChan = make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
+	if restartSignal != nil {
+		signal.Notify(sigChan, restartSignal)
+	}
 	for sig := range sigChan {
 		if sig == syscall.SIGHUP {
-			updatePasswd()
+			reloadConfig()
+		} else if sig == restartSignal {
+			log.Println("soft restart")
+			softRestart()
 		} else {
 			// is this going to happen?
 			log.Printf("caught signal %v, exit", sig)
@@ -309,24 +517,12 @@ func waitSignal() {
 }
 
 func run(port, password string) {
-	ln, err := net.Listen("tcp", ":"+port)
+	lns, udp, err := listenPort(port)
 	if err != nil {
 		log.Printf("try listening port %v: %v\n", port, err)
 		return
 	}
-	passwdManager.add(port, password, ln)
-	encTbl := getTable(password)
-	atomic.AddInt32(&table.getCnt, 1)
-	log.Printf("server listening port %v ...\n", port)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			// listener maybe closed to update password
-			debug.Printf("accept error: %v\n", err)
-			return
-		}
-		go handleConnection(ss.NewConn(conn, encTbl))
-	}
+	serve(port, password, lns, udp)
 }
 
 func enoughOptions(config *ss.Config) bool {
@@ -336,8 +532,7 @@ func enoughOptions(config *ss.Config) bool {
 func unifyPortPassword(config *ss.Config) (err error) {
 	if len(config.PortPassword) == 0 { // this handles both nil PortPassword and empty one
 		if !enoughOptions(config) {
-			log.Println("must specify both port and password")
-			return errors.New("not enough options")
+			return errors.New("must specify both port and password")
 		}
 		port := strconv.Itoa(config.ServerPort)
 		config.PortPassword = map[string]string{port: config.Password}
@@ -346,29 +541,118 @@ func unifyPortPassword(config *ss.Config) (err error) {
 			log.Println("given port_password, ignore server_port and password option")
 		}
 	}
+	for port := range config.PortMethod {
+		if _, ok := config.PortPassword[port]; !ok {
+			return fmt.Errorf("port_method: port %s is not in port_password", port)
+		}
+	}
 	return
 }
 
+func checkMethod(config *ss.Config) error {
+	methods := []string{config.Method}
+	for _, m := range config.PortMethod {
+		methods = append(methods, m)
+	}
+	for _, m := range methods {
+		if err := ss.CheckMethod(m); err != nil {
+			return err
+		}
+		if err := ss.SelfTest(m); err != nil {
+			return err
+		}
+		if err := ss.CheckPlainMethod(m, config.BindAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var configFile string
 var config *ss.Config
 
+// held when replacing config by reloading or manager commands
+var configMu sync.Mutex
+
+// liveConfig is config published to goroutines serving ports, which read it
+// without holding configMu.
+var liveConfig atomic.Value
+
+// publishConfig makes c, which is not changed afterwards, seen by
+// currentConfig.
+func publishConfig(c *ss.Config) {
+	liveConfig.Store(c)
+}
+
+func currentConfig() *ss.Config {
+	return liveConfig.Load().(*ss.Config)
+}
+
+// options given on command line override those in config file
+var cmdConfig ss.Config
+
 func main() {
-	var cmdConfig ss.Config
-	var printVer bool
+	var printVer, printVerJSON, jsonErrors bool
+	var migrateConfig string
 
 	flag.BoolVar(&printVer, "version", false, "print version")
+	flag.BoolVar(&printVerJSON, "version-json", false, "print version and build info as JSON object")
 	flag.StringVar(&configFile, "c", "config.json", "specify config file")
 	flag.StringVar(&cmdConfig.Password, "k", "", "password")
+	flag.StringVar(&cmdConfig.Method, "m", "", "encryption method, table or plain (testing only)")
+	flag.StringVar(&cmdConfig.BindAddress, "b", "", "address to bind, defaults to all addresses")
 	flag.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
-	flag.IntVar(&cmdConfig.Timeout, "t", 60, "connection timeout (in seconds)")
+	flag.IntVar(&cmdConfig.Timeout, "t", 0, "connection timeout (in seconds)")
+	flag.StringVar(&cmdConfig.AdminAddr, "admin", "", "admin interface address, e.g. 127.0.0.1:8390")
+	flag.StringVar(&cmdConfig.ManagerAddr, "manager-address", "", "ss-manager API address, UDP address or unix socket path")
 	flag.BoolVar((*bool)(&debug), "d", false, "print debug message")
+	flag.BoolVar(&jsonErrors, "json-errors", false, "print startup error as JSON object")
+	flag.StringVar(&migrateConfig, "migrate-config", "", "write config file with deprecated options migrated to this file and exit")
 
 	flag.Parse()
+	ss.SetJSONErrors(jsonErrors)
 
 	if printVer {
 		ss.PrintVersion()
 		os.Exit(0)
 	}
+	if printVerJSON {
+		ss.PrintVersionJSON()
+		os.Exit(0)
+	}
+	if flag.NArg() != 0 {
+		if (flag.Arg(0) != "update" && flag.Arg(0) != "lint-config") || flag.NArg() != 1 {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, errors.New("unknown arguments, commands are update and lint-config")))
+		}
+	}
+	if flag.Arg(0) == "update" {
+		if err := ss.Update("shadowsocks-server"); err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitUpdate, err))
+		}
+		os.Exit(0)
+	}
+
+	if migrateConfig != "" {
+		if err := ss.MigrateConfigFile(configFile, migrateConfig); err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "lint-config" {
+		issues, err := ss.LintConfigFile(configFile, true, false)
+		if err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+		}
+		for _, i := range issues {
+			fmt.Println(i)
+		}
+		if len(issues) != 0 {
+			os.Exit(ss.ExitConfig)
+		}
+		fmt.Printf("%s: no issues found\n", configFile)
+		os.Exit(0)
+	}
 
 	ss.SetDebug(debug)
 
@@ -378,29 +662,124 @@ func main() {
 		if os.IsNotExist(err) {
 			log.Println("config file not found, using all options from command line")
 		} else {
-			log.Printf("error reading %s: %v\n", configFile, err)
-			os.Exit(1)
+			ss.Fatal(ss.NewStartupError(ss.ExitConfig,
+				fmt.Errorf("error reading %s: %v", configFile, err)))
 		}
-		config = &cmdConfig
+		// copied as cmdConfig overrides the config file on reload
+		c := cmdConfig
+		config = &c
+		ss.SetDefaults(config)
 	} else {
 		ss.UpdateConfig(config, &cmdConfig)
 	}
 
 	if err = unifyPortPassword(config); err != nil {
-		os.Exit(1)
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	publishConfig(config)
+	if err = checkMethod(config); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitCrypto, err))
+	}
+	if err = ss.CheckStrict(config, true); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	if err = initTenants(config); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	initAccessLog(config.AccessLogSize, config.AccessLogKey)
+	if err = initServerList(config); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
 	}
+	if err = ss.LoadDestGeo(config.DestGeoIP, config.DestGeoIPLocations, config.DestASN); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	initQuota(config)
+	if err = initUsageReport(config); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	if err = initTLS(config); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	ss.ApplyGlobals(config)
 
+	if config.AdminAddr != "" {
+		ss.HandleAdmin("/drain", handleDrain)
+		ss.HandleAdminNoAuth("/tenant", handleTenant)
+		ss.HandleAdmin("/logs", handleLogs)
+		ss.HandleAdmin("/server-list", handleServerList)
+		ss.HandleAdmin("/traffic", ss.ServeTraffic)
+		ss.HandleAdmin("/usage", handleUsage)
+		if err = ss.ServeAdmin(config); err != nil {
+			ss.Fatal(err)
+		}
+	}
+	if config.AgentAddr != "" {
+		go serveAgent(config.AgentAddr, config.AgentCapacity)
+	}
+	if config.DNSPrefetch > 0 {
+		dnsCache = ss.NewDNSCache(config.DNSPrefetch, dnsCacheTTL)
+		go dnsCache.RunPrefetch()
+	}
+	if config.AcceptShards > 1 {
+		if reusePort == nil {
+			log.Println("accept_shards is not supported on this platform")
+		} else {
+			acceptShards = config.AcceptShards
+		}
+	}
+	if config.ListenBacklog > 0 {
+		if setBacklog == nil {
+			log.Println("listen_backlog is not supported on this platform")
+		} else {
+			listenBacklog = config.ListenBacklog
+		}
+	}
+	setAcceptRate(config.AcceptRate)
+	setHandshakeLimit(config.HandshakeTimeout, config.HandshakeMaxBytes)
+	setFairBandwidth(config.FairBandwidth)
+	if config.LogListenOverflow {
+		if watchOverflow == nil {
+			log.Println("log_listen_overflow is not supported on this platform")
+		} else {
+			go watchOverflow()
+		}
+	}
+	udpRelay = config.UDP
+	if portHop, err = ss.NewPortHop(config.PortHop, config.PortHopInterval); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, err))
+	}
+	serverCaps = ss.Capabilities{UDP: udpRelay, PortHop: config.PortHop, PortHopInterval: config.PortHopInterval}
+	pluginName, pluginOpts = config.Plugin, config.PluginOpts
+	if err = updatePlugins(config.PortPassword); err != nil {
+		ss.Fatal(ss.NewStartupError(ss.ExitConfig, fmt.Errorf("starting plugin: %v", err)))
+	}
+	initInheritedListener()
 	initTableCache(config)
 	for port, password := range config.PortPassword {
-		go run(port, password)
+		lns, udp, err := listenPort(port)
+		if err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitBind,
+				fmt.Errorf("listening port %v: %v", port, err)))
+		}
+		go serve(port, password, lns, udp)
 	}
 	// Wait all ports have get it's encryption table
-	for int(table.getCnt) != len(config.PortPassword) {
+	for int(atomic.LoadInt32(&table.getCnt)) != len(config.PortPassword) {
 		time.Sleep(1 * time.Second)
 	}
 	storeTableCache(config)
+	if portHop != nil {
+		startPortHop(config.PortPassword)
+	}
+	closeInheritedListener()
 	log.Println("all ports ready")
+	notifyReady()
 
 	table.cache = nil // release memory
+	if config.ManagerAddr != "" {
+		if err = serveManager(config.ManagerAddr, config.ManagerRemote); err != nil {
+			ss.Fatal(ss.NewStartupError(ss.ExitBind, err))
+		}
+	}
 	waitSignal()
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/ed25519"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Server list for clients to sync servers of the fleet, see
+// ss.ServerList. The file is read on each request, so editing it publishes
+// the new list without restarting.
+var serverList struct {
+	sync.RWMutex
+	file string
+	key  ed25519.PrivateKey
+}
+
+func initServerList(config *ss.Config) error {
+	var key ed25519.PrivateKey
+	if config.ServerListFile != "" {
+		var err error
+		if key, err = ss.ParseServerListKey(config.ServerListSignKey); err != nil {
+			return err
+		}
+	}
+	serverList.Lock()
+	serverList.file, serverList.key = config.ServerListFile, key
+	serverList.Unlock()
+	return nil
+}
+
+func handleServerList(w http.ResponseWriter, r *http.Request) {
+	serverList.RLock()
+	file, key := serverList.file, serverList.key
+	serverList.RUnlock()
+	if file == "" {
+		http.Error(w, "server list not available", http.StatusNotFound)
+		return
+	}
+	list, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Println("reading server list:", err)
+		http.Error(w, "server list not available", http.StatusInternalServerError)
+		return
+	}
+	doc, err := ss.SignServerList(list, key)
+	if err != nil {
+		log.Printf("%s: %v\n", file, err)
+		http.Error(w, "server list not available", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+func init() {
+	restartSignal = syscall.SIGUSR2
+}
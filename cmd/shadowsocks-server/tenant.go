@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A tenant groups ports of one customer, sharing a connection quota, with its
+// own connection log and token to query its status and manage its ports.
+type tenant struct {
+	name   string
+	active int32
+	bytes  int64 // transferred in both directions
+
+	// following fields are protected by tenants lock
+	maxConn int32
+	ports   []string
+	token   string
+	logFile string
+	logOut  *os.File
+	logger  *log.Logger
+}
+
+var tenants struct {
+	sync.RWMutex
+	byName map[string]*tenant
+	byPort map[string]*tenant
+}
+
+// initTenants applies tenants config, counters of existing tenants are kept.
+// Log files of removed tenants and replaced log files are closed.
+func initTenants(config *ss.Config) error {
+	tenants.Lock()
+	defer tenants.Unlock()
+	byName := map[string]*tenant{}
+	byPort := map[string]*tenant{}
+	// log files opened for this config, closed if it's invalid
+	opened := map[string]*os.File{}
+	closeOpened := func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+	for name, tc := range config.Tenants {
+		t, ok := tenants.byName[name]
+		if !ok {
+			t = &tenant{name: name}
+		}
+		for _, port := range tc.Ports {
+			if o, ok := byPort[port]; ok {
+				closeOpened()
+				return fmt.Errorf("port %s belongs to both tenant %s and %s", port, o.name, name)
+			}
+			if _, ok := config.PortPassword[port]; !ok {
+				log.Printf("tenant %s: port %s is not in port_password\n", name, port)
+			}
+			byPort[port] = t
+		}
+		if tc.LogFile != t.logFile && tc.LogFile != "" {
+			f, err := os.OpenFile(tc.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				closeOpened()
+				return fmt.Errorf("tenant %s: %v", name, err)
+			}
+			opened[name] = f
+		}
+		byName[name] = t
+	}
+
+	for name, t := range tenants.byName {
+		if _, ok := byName[name]; !ok && t.logOut != nil {
+			t.logOut.Close()
+			t.logOut, t.logger = nil, nil
+		}
+	}
+	for name, t := range byName {
+		tc := config.Tenants[name]
+		if tc.LogFile != t.logFile {
+			if t.logOut != nil {
+				t.logOut.Close()
+			}
+			t.logOut, t.logger = nil, nil
+			if f := opened[name]; f != nil {
+				t.logOut, t.logger = f, log.New(f, "", log.LstdFlags)
+			}
+		}
+		atomic.StoreInt32(&t.maxConn, int32(tc.MaxConn))
+		t.ports, t.token, t.logFile = tc.Ports, tc.Token, tc.LogFile
+	}
+	tenants.byName, tenants.byPort = byName, byPort
+	return nil
+}
+
+func tenantOf(port string) *tenant {
+	tenants.RLock()
+	defer tenants.RUnlock()
+	return tenants.byPort[port]
+}
+
+// acquire counts a new connection, returns false if reaching quota.
+func (t *tenant) acquire() bool {
+	n := atomic.AddInt32(&t.active, 1)
+	if max := atomic.LoadInt32(&t.maxConn); max > 0 && n > max {
+		atomic.AddInt32(&t.active, -1)
+		return false
+	}
+	return true
+}
+
+func (t *tenant) release() {
+	atomic.AddInt32(&t.active, -1)
+}
+
+func (t *tenant) logf(format string, v ...interface{}) {
+	// lock is held while writing, so the log file isn't closed meanwhile
+	tenants.RLock()
+	defer tenants.RUnlock()
+	if t.logger != nil {
+		t.logger.Printf(format, v...)
+	}
+}
+
+// tenantConn counts bytes transferred for tenant.
+type tenantConn struct {
+	net.Conn
+	t *tenant
+}
+
+func (c tenantConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.t.bytes, int64(n))
+	return
+}
+
+func (c tenantConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.t.bytes, int64(n))
+	return
+}
+
+// handleTenant serves the tenant given by bearer token. GET returns its
+// status, POST with server_port, password and optional method sets password
+// of one of its ports, and DELETE with server_port stops serving the port.
+// Ports are changed like by manager API, so quotas are kept and changes are
+// kept on SIGHUP.
+func handleTenant(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var t *tenant
+	tenants.RLock()
+	for _, tt := range tenants.byName {
+		if token != "" && subtle.ConstantTimeCompare([]byte(tt.token), []byte(token)) == 1 {
+			t = tt
+			break
+		}
+	}
+	if t == nil {
+		tenants.RUnlock()
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "POST" || r.Method == "DELETE" {
+		ports := t.ports
+		tenants.RUnlock()
+		manageTenantPort(w, r, ports)
+		return
+	}
+	status := struct {
+		Name    string   `json:"name"`
+		Ports   []string `json:"ports"`
+		Active  int32    `json:"active"`
+		MaxConn int32    `json:"max_conn"`
+		Bytes   int64    `json:"bytes"`
+	}{t.name, t.ports, atomic.LoadInt32(&t.active), atomic.LoadInt32(&t.maxConn), atomic.LoadInt64(&t.bytes)}
+	tenants.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// manageTenantPort updates or removes port in request, which must be one of
+// ports.
+func manageTenantPort(w http.ResponseWriter, r *http.Request, ports []string) {
+	port := r.FormValue("server_port")
+	owned := false
+	for _, p := range ports {
+		owned = owned || p == port
+	}
+	if !owned {
+		http.Error(w, "server_port is not a port of the tenant", http.StatusForbidden)
+		return
+	}
+	var err error
+	if r.Method == "DELETE" {
+		err = managerRemove(port)
+	} else {
+		managed.Lock()
+		quota := managed.ports[port].quota
+		managed.Unlock()
+		err = managerAdd(port, managedPort{r.FormValue("password"), r.FormValue("method"), quota})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
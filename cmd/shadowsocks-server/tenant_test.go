@@ -0,0 +1,92 @@
+package main
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInitTenants(t *testing.T) {
+	defer func() { tenants.byName, tenants.byPort = nil, nil }()
+	tests := []struct {
+		tenants map[string]*ss.TenantConfig
+		ok      bool
+	}{
+		{map[string]*ss.TenantConfig{
+			"a": {Ports: []string{"8388", "8389"}},
+			"b": {Ports: []string{"8390"}},
+		}, true},
+		{map[string]*ss.TenantConfig{
+			"a": {Ports: []string{"8388", "8389"}},
+			"b": {Ports: []string{"8389"}},
+		}, false},
+		{map[string]*ss.TenantConfig{
+			"a": {Ports: []string{"8388", "8388"}},
+		}, false},
+	}
+	for i, tt := range tests {
+		config := &ss.Config{Tenants: tt.tenants, PortPassword: map[string]string{"8388": "a", "8389": "a", "8390": "b"}}
+		err := initTenants(config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: got error %v", i, err)
+		}
+		// tenants of the first config are kept
+		if tn := tenantOf("8390"); tn == nil || tn.name != "b" {
+			t.Errorf("%d: port 8390 should belong to tenant b, got %v", i, tn)
+		}
+	}
+}
+
+func TestTenantManagePorts(t *testing.T) {
+	port := initTestConfig(t)
+	defer func() {
+		passwdManager.del(port)
+		managed.ports = nil
+		quotas.ports = nil
+		tenants.byName, tenants.byPort = nil, nil
+	}()
+	err := initTenants(&ss.Config{Tenants: map[string]*ss.TenantConfig{
+		"a": {Ports: []string{port}, Token: "a-token"},
+		"b": {Ports: []string{"1"}, Token: "b-token"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, token, query, password string
+		code                           int
+	}{
+		{"POST", "", port, "pw", http.StatusUnauthorized},
+		{"POST", "b-token", port, "pw", http.StatusForbidden},
+		{"POST", "a-token", "1", "pw", http.StatusForbidden},
+		{"POST", "a-token", port, "", http.StatusBadRequest},
+		{"POST", "a-token", port, "pw", http.StatusOK},
+		{"GET", "a-token", "", "pw", http.StatusOK},
+		{"DELETE", "b-token", port, "", http.StatusForbidden},
+		{"DELETE", "a-token", port, "", http.StatusOK},
+		{"DELETE", "a-token", port, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := "server_port=" + tt.query + "&password=" + tt.password
+		r := httptest.NewRequest(tt.method, "/tenant?server_port="+tt.query, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handleTenant(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s port %s with token %q: got status %d, expected %d", tt.method, tt.query, tt.token, w.Code, tt.code)
+		}
+		if tt.code != http.StatusOK || tt.method == "GET" {
+			continue
+		}
+		configMu.Lock()
+		_, served := config.PortPassword[port]
+		configMu.Unlock()
+		if served != (tt.method == "POST") {
+			t.Errorf("%s port %s: served is %v", tt.method, port, served)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/crypto/acme"
+	"net"
+	"sync"
+)
+
+// With tls, connections are relayed inside TLS, so they look like HTTPS to
+// observers without external plugins. The certificate is loaded from
+// tls_cert and tls_key, which are read again on SIGHUP after renewal, or
+// obtained automatically for tls_autocert hosts. Handshake limits also apply
+// to the TLS handshake. UDP relay is not covered.
+
+var serverTLS struct {
+	sync.Mutex
+	config *tls.Config // nil if tls is disabled
+}
+
+func initTLS(config *ss.Config) error {
+	var tc *tls.Config
+	if config.TLS {
+		if config.Plugin != "" {
+			return errors.New("tls can't be used with plugin")
+		}
+		// HTTP/1.1 is offered like HTTPS servers, clients never speak it
+		tc = &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}}
+		switch {
+		case len(config.TLSAutocert) != 0:
+			if config.TLSCert != "" {
+				return errors.New("tls_autocert can't be used with tls_cert")
+			}
+			if config.TLSAutocertDir == "" {
+				return errors.New("tls_autocert requires tls_autocert_dir to cache certificates")
+			}
+			if err := initAutocert(config.TLSAutocert, config.TLSAutocertDir); err != nil {
+				return err
+			}
+			tc.GetCertificate = getAutocert
+			tc.NextProtos = append(tc.NextProtos, acme.ALPNProto)
+		case config.TLSCert != "":
+			cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+			if err != nil {
+				return fmt.Errorf("tls_cert: %v", err)
+			}
+			tc.Certificates = []tls.Certificate{cert}
+		default:
+			return errors.New("tls requires tls_cert and tls_key, or tls_autocert")
+		}
+	}
+	if tc == nil || tc.GetCertificate == nil {
+		stopAutocert()
+	}
+	serverTLS.Lock()
+	serverTLS.config = tc
+	serverTLS.Unlock()
+	return nil
+}
+
+// serverTLSConn wraps conn accepted with TLS if enabled. The handshake is
+// done by the goroutine handling it, see tlsHandshake.
+func serverTLSConn(conn net.Conn) net.Conn {
+	serverTLS.Lock()
+	tc := serverTLS.config
+	serverTLS.Unlock()
+	if tc == nil {
+		return conn
+	}
+	return tls.Server(conn, tc)
+}
+
+// tlsHandshake completes TLS handshake of conn if it's inside TLS, so that
+// failures, mostly of scanners, are not logged as bad requests.
+func tlsHandshake(conn *ss.Conn) error {
+	tc, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return tc.Handshake()
+}
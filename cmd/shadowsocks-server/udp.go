@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With UDP relay enabled, each port also receives shadowsocks UDP packets.
+// Packets from each client address are sent to targets through a socket of
+// its own, so replies can be sent back to the client. The mapping is removed
+// if there's no packet in either direction for udpTimeout.
+
+var udpRelay bool
+
+const udpTimeout = time.Minute
+
+// room before reply payload for the address of target, IPv6 at most
+const udpHeaderRoom = 1 + net.IPv6len + 2
+
+// targets tracked for each client, flows beyond the limit are counted
+// together as others, and audited targets are forgotten
+const maxNATFlows = 256
+
+// packets to domains resolved at once for each client, packets beyond are
+// dropped, as a client could otherwise start a goroutine per packet
+const maxNATResolving = 16
+
+type udpNAT struct {
+	sync.Mutex
+	conns   map[string]*natConn // keyed by client address
+	port    string              // base port, for quota
+	traffic *ss.PortTraffic
+}
+
+type natConn struct {
+	net.PacketConn
+	sync.Mutex
+	dests     map[string]bool // targets audited
+	port      string
+	traffic   *ss.PortTraffic
+	flows     map[string]*udpFlow // keyed by resolved target address
+	resolving chan struct{}       // semaphore of packets being resolved
+}
+
+type udpFlow struct {
+	class *ss.TrafficClass
+	geo   *ss.GeoTraffic
+}
+
+func (f *udpFlow) AddBytes(n int) {
+	f.class.AddBytes(n)
+	f.geo.AddBytes(n)
+}
+
+func serveUDP(port string, pc net.PacketConn, encTbl *ss.EncryptTable) {
+	defer ss.RecoverPacketPanic(pc.LocalAddr())
+	nat := &udpNAT{conns: map[string]*natConn{}, port: basePort(port), traffic: ss.Traffic(basePort(port))}
+	defer nat.closeAll()
+	buf := ss.GetBuf(ss.MaxPacketSize)
+	defer ss.PutBuf(buf)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// closed to delete port or update password
+				debug.Printf("udp port %s closed\n", port)
+				return
+			}
+			debug.Println("udp read:", err)
+			continue
+		}
+		pkt, err := ss.DecryptPacket(encTbl, buf[:n])
+		if err != nil {
+			debug.Printf("udp packet from %s: %v\n", client, err)
+			continue
+		}
+		dest, hl, err := ss.ParsePacketAddr(pkt)
+		if err != nil {
+			debug.Printf("udp packet from %s: %v\n", client, err)
+			continue
+		}
+		if !udpQuota(nat.port, len(pkt)) {
+			continue
+		}
+		nc, err := nat.get(pc, client, encTbl)
+		if err != nil {
+			log.Println("udp relay:", err)
+			continue
+		}
+		if ss.AuditEnabled() {
+			nc.Lock()
+			if !nc.dests[dest] {
+				if len(nc.dests) >= maxNATFlows {
+					nc.dests = map[string]bool{}
+				}
+				nc.dests[dest] = true
+				// domains are resolved later, only IPs are annotated
+				host, _, _ := net.SplitHostPort(dest)
+				country, asn := ss.DestGeo(net.ParseIP(host))
+				ss.AuditGeo(client.String(), dest, country, asn)
+			}
+			nc.Unlock()
+		}
+		host, _, _ := net.SplitHostPort(dest)
+		if net.ParseIP(host) != nil {
+			nc.send(dest, pkt[hl:])
+		} else {
+			// don't block other packets while resolving
+			select {
+			case nc.resolving <- struct{}{}:
+				go func(payload []byte) {
+					defer ss.RecoverPacketPanic(client)
+					defer func() { <-nc.resolving }()
+					nc.send(dest, payload)
+				}(append([]byte(nil), pkt[hl:]...))
+			default:
+				debug.Printf("udp packet from %s to %s dropped, too many being resolved\n", client, dest)
+			}
+		}
+	}
+}
+
+// get returns the socket of client, creating it if there's none.
+func (nat *udpNAT) get(pc net.PacketConn, client net.Addr, encTbl *ss.EncryptTable) (*natConn, error) {
+	key := client.String()
+	nat.Lock()
+	defer nat.Unlock()
+	if nc, ok := nat.conns[key]; ok {
+		return nc, nil
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	// socket to targets of the client
+	ss.MarkConn(conn)
+	nc := &natConn{PacketConn: conn, dests: map[string]bool{}, port: nat.port, traffic: nat.traffic,
+		flows: map[string]*udpFlow{}, resolving: make(chan struct{}, maxNATResolving)}
+	nc.SetReadDeadline(time.Now().Add(udpTimeout))
+	nat.conns[key] = nc
+	go func() {
+		defer ss.RecoverPacketPanic(client)
+		defer func() {
+			nat.Lock()
+			delete(nat.conns, key)
+			nat.Unlock()
+			nc.Close()
+		}()
+		nc.relayReplies(pc, client, encTbl)
+	}()
+	return nc, nil
+}
+
+// udpQuota tells whether a packet of n bytes of port can be relayed, pacing
+// it if throttled over quota.
+func udpQuota(port string, n int) bool {
+	q := quotaOf(port)
+	if q == nil {
+		return true
+	}
+	if q.check() != nil {
+		return false
+	}
+	q.wait(n)
+	return true
+}
+
+func (nat *udpNAT) closeAll() {
+	nat.Lock()
+	for _, nc := range nat.conns {
+		nc.Close()
+	}
+	nat.Unlock()
+}
+
+func resolveUDP(dest string) (*net.UDPAddr, error) {
+	if dnsCache == nil {
+		return net.ResolveUDPAddr("udp", dest)
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	if host, err = dnsCache.Resolve(host); err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+}
+
+func (nc *natConn) send(dest string, payload []byte) {
+	addr, err := resolveUDP(dest)
+	if err != nil {
+		debug.Println("udp resolve:", err)
+		return
+	}
+	if _, err = nc.WriteTo(payload, addr); err != nil {
+		debug.Println("udp write:", err)
+		return
+	}
+	nc.traffic.AddUpload(len(payload))
+	nc.flow(addr, payload).AddBytes(len(payload))
+	nc.SetReadDeadline(time.Now().Add(udpTimeout))
+}
+
+// flow returns counters of packets to and from target addr, classifying it
+// by payload of the first packet.
+func (nc *natConn) flow(addr *net.UDPAddr, payload []byte) *udpFlow {
+	key := addr.String()
+	nc.Lock()
+	defer nc.Unlock()
+	f := nc.flows[key]
+	if f == nil && len(nc.flows) >= maxNATFlows {
+		if f = nc.flows["others"]; f == nil {
+			f = &udpFlow{class: ss.Classify(ss.ProtoOther, "others")}
+			nc.flows["others"] = f
+		}
+	}
+	if f == nil {
+		// payload is nil for replies from targets never sent to
+		f = &udpFlow{class: ss.Classify(ss.SniffProtocol(payload, true), strconv.Itoa(addr.Port))}
+		f.geo = ss.CountDestGeo(ss.DestGeo(addr.IP))
+		nc.flows[key] = f
+	}
+	return f
+}
+
+// relayReplies sends packets from targets back to client, until timeout or
+// the socket is closed.
+func (nc *natConn) relayReplies(pc net.PacketConn, client net.Addr, encTbl *ss.EncryptTable) {
+	buf := ss.GetBuf(udpHeaderRoom + ss.MaxPacketSize)
+	defer ss.PutBuf(buf)
+	var out []byte // reused for encrypted packets
+	for {
+		n, src, err := nc.ReadFrom(buf[udpHeaderRoom:])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				debug.Printf("udp mapping of %s timed out\n", client)
+			} else if !errors.Is(err, net.ErrClosed) {
+				debug.Println("udp read:", err)
+				continue
+			}
+			return
+		}
+		nc.SetReadDeadline(time.Now().Add(udpTimeout))
+		if !udpQuota(nc.port, n) {
+			continue
+		}
+		nc.traffic.AddDownload(n)
+		nc.flow(src.(*net.UDPAddr), nil).AddBytes(n)
+		header := ss.PacketAddr(src.(*net.UDPAddr))
+		start := udpHeaderRoom - len(header)
+		copy(buf[start:], header)
+		pkt := buf[start : udpHeaderRoom+n]
+		out = ss.EncryptPacket(encTbl, out[:0], pkt)
+		if _, err = pc.WriteTo(out, client); err != nil {
+			debug.Println("udp write:", err)
+		}
+	}
+}
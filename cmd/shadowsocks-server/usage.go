@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Traffic of each port is rolled up into monthly usage reports for billing
+// pipelines. Every usageInterval, traffic counted since the last rollup is
+// added to the usage of the current month in UTC, which is saved in
+// usageStateFile of the report directory to survive restarts. When the month
+// ends, its report is written to the directory and POSTed to the URL. Reports
+// failed to POST are retried at later rollups.
+
+const (
+	usageInterval  = time.Minute
+	usageStateFile = "usage-state.json"
+	maxUsagePosts  = 12 // reports kept for retrying POST
+)
+
+type usageRecord struct {
+	Port     string `json:"port"`
+	Tenant   string `json:"tenant,omitempty"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+}
+
+type usageReport struct {
+	Month string        `json:"month"` // e.g. 2026-10
+	Ports []usageRecord `json:"ports"`
+}
+
+var usage struct {
+	sync.Mutex
+	dir, url, token, format string
+
+	started bool
+	month   string
+	ports   map[string]*ss.PortTraffic // usage of the month
+	last    map[string]ss.PortTraffic  // counters at the last rollup
+	posts   []*usageReport             // failed to POST
+}
+
+// initUsageReport applies report options, usage of the month is kept.
+func initUsageReport(config *ss.Config) error {
+	format := config.UsageReportFormat
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("usage_report_format should be json or csv, not %s", format)
+	}
+	if config.UsageReportDir != "" {
+		if fi, err := os.Stat(config.UsageReportDir); err != nil {
+			return fmt.Errorf("usage_report_dir: %v", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("usage_report_dir: %s is not a directory", config.UsageReportDir)
+		}
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	usage.dir, usage.url, usage.token, usage.format = config.UsageReportDir, config.UsageReportURL,
+		config.UsageReportToken, format
+	// quotas are checked against usage of the month
+	if usage.started || (usage.dir == "" && usage.url == "" && len(config.PortQuota) == 0) {
+		return nil
+	}
+	usage.started = true
+	usage.month = usageMonth(time.Now())
+	usage.ports = map[string]*ss.PortTraffic{}
+	usage.last = map[string]ss.PortTraffic{}
+	if usage.dir != "" {
+		if err := loadUsageState(); err != nil {
+			log.Println("usage report:", err)
+		}
+	}
+	go runUsageReport()
+	return nil
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// loadUsageState restores usage saved before restarting. Usage of a month
+// already ended is reported now.
+func loadUsageState() error {
+	data, err := ioutil.ReadFile(filepath.Join(usage.dir, usageStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state usageReport
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", usageStateFile, err)
+	}
+	ports := map[string]*ss.PortTraffic{}
+	for _, r := range state.Ports {
+		ports[r.Port] = &ss.PortTraffic{Upload: r.Upload, Download: r.Download}
+	}
+	if state.Month == usage.month {
+		usage.ports = ports
+		checkQuotas(usage.month, ports, true)
+	} else {
+		report := usageReportOf(state.Month, ports)
+		writeUsageReport(report)
+		usage.posts = append(usage.posts, report)
+	}
+	return nil
+}
+
+func runUsageReport() {
+	for {
+		// roll up right at the end of month
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		d := next.Sub(now)
+		if d > usageInterval {
+			d = usageInterval
+		}
+		time.Sleep(d)
+		rollupUsage(time.Now())
+	}
+}
+
+// rollupUsage adds traffic since the last rollup to usage of the month,
+// reporting the month if it has ended by now.
+func rollupUsage(now time.Time) {
+	// not affected by reset of POST /traffic
+	totals := ss.TrafficSinceStart()
+	usage.Lock()
+	for port, t := range totals {
+		prev := usage.last[port]
+		u := usage.ports[port]
+		if u == nil {
+			u = &ss.PortTraffic{}
+			usage.ports[port] = u
+		}
+		u.Upload += t.Upload - prev.Upload
+		u.Download += t.Download - prev.Download
+	}
+	usage.last = totals
+	events := checkQuotas(usage.month, usage.ports, false)
+
+	var report *usageReport
+	if month := usageMonth(now); month != usage.month {
+		report = usageReportOf(usage.month, usage.ports)
+		usage.month = month
+		usage.ports = map[string]*ss.PortTraffic{}
+		// quotas start over
+		checkQuotas(usage.month, usage.ports, true)
+		writeUsageReport(report)
+		usage.posts = append(usage.posts, report)
+		if len(usage.posts) > maxUsagePosts {
+			log.Printf("usage report: giving up posting report of %s\n", usage.posts[0].Month)
+			usage.posts = usage.posts[1:]
+		}
+	}
+	if usage.dir != "" {
+		if err := saveUsageState(); err != nil {
+			log.Println("usage report: saving state:", err)
+		}
+	}
+	posts, url, token, format := usage.posts, usage.url, usage.token, usage.format
+	usage.posts = nil
+	usage.Unlock()
+
+	sendQuotaEvents(events)
+	if url == "" {
+		return
+	}
+	var failed []*usageReport
+	for _, r := range posts {
+		if err := postUsageReport(url, token, format, r); err != nil {
+			log.Printf("usage report: posting report of %s: %v\n", r.Month, err)
+			failed = append(failed, r)
+		} else {
+			log.Printf("usage report of %s posted\n", r.Month)
+		}
+	}
+	if len(failed) != 0 {
+		usage.Lock()
+		usage.posts = append(failed, usage.posts...)
+		usage.Unlock()
+	}
+}
+
+func usageReportOf(month string, ports map[string]*ss.PortTraffic) *usageReport {
+	report := &usageReport{Month: month, Ports: []usageRecord{}}
+	for port, u := range ports {
+		if u.Upload == 0 && u.Download == 0 {
+			continue
+		}
+		r := usageRecord{Port: port, Upload: u.Upload, Download: u.Download}
+		if t := tenantOf(port); t != nil {
+			r.Tenant = t.name
+		}
+		report.Ports = append(report.Ports, r)
+	}
+	sort.Slice(report.Ports, func(i, j int) bool {
+		return report.Ports[i].Port < report.Ports[j].Port
+	})
+	return report
+}
+
+func encodeUsageReport(format string, r *usageReport) ([]byte, error) {
+	if format == "json" {
+		return json.MarshalIndent(r, "", "\t")
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"month", "port", "tenant", "upload", "download"})
+	for _, p := range r.Ports {
+		w.Write([]string{r.Month, p.Port, p.Tenant,
+			strconv.FormatInt(p.Upload, 10), strconv.FormatInt(p.Download, 10)})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// writeFile replaces file with data, so readers never see it partially
+// written.
+func writeFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// writeUsageReport writes report to the directory, if configured. It's
+// called with usage locked.
+func writeUsageReport(r *usageReport) {
+	if usage.dir == "" {
+		return
+	}
+	data, err := encodeUsageReport(usage.format, r)
+	if err == nil {
+		path := filepath.Join(usage.dir, "usage-"+r.Month+"."+usage.format)
+		if err = writeFile(path, data); err == nil {
+			log.Printf("usage report of %s written to %s\n", r.Month, path)
+			return
+		}
+	}
+	log.Printf("usage report: writing report of %s: %v\n", r.Month, err)
+}
+
+// saveUsageState is called with usage locked.
+func saveUsageState() error {
+	data, err := json.Marshal(usageReportOf(usage.month, usage.ports))
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(usage.dir, usageStateFile), data)
+}
+
+func postUsageReport(url, token, format string, r *usageReport) error {
+	data, err := encodeUsageReport(format, r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/csv")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// handleUsage returns usage of the current month so far, as of the last
+// rollup.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	usage.Lock()
+	if !usage.started {
+		usage.Unlock()
+		http.Error(w, "usage report not enabled", http.StatusNotFound)
+		return
+	}
+	report := usageReportOf(usage.month, usage.ports)
+	usage.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,353 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// An ACL decides per destination whether client proxies the connection,
+// connects directly or rejects it. The rule file has one rule per line, in
+// the form of "action type value", and the first matching rule applies:
+//
+//	# comment
+//	direct suffix cn
+//	direct geoip CN
+//	reject keyword adservice
+//	direct cidr 192.168.0.0/16
+//	proxy domain www.example.com
+//	default proxy
+//
+// Actions are proxy, direct and reject. Types are domain for the exact host,
+// suffix for the domain and its subdomains, keyword for hosts containing it,
+// cidr and geoip for IP destinations. Domains are not resolved to match cidr
+// and geoip rules, which would leak them to local DNS. Destinations matching
+// no rule are proxied unless default says otherwise.
+//
+// Countries of geoip rules are looked up in the file given by acl_geoip,
+// which has a CIDR and its country code per line, separated by space or
+// comma, e.g. converted from GeoLite2 Country CSV. Ranges may be nested, the
+// most specific one applies.
+
+type ACLAction int
+
+const (
+	ACLProxy ACLAction = iota
+	ACLDirect
+	ACLReject
+)
+
+var aclActions = map[string]ACLAction{"proxy": ACLProxy, "direct": ACLDirect, "reject": ACLReject}
+
+func (a ACLAction) String() string {
+	for name, v := range aclActions {
+		if v == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+type aclRule struct {
+	action ACLAction
+	kind   string
+	value  string
+	ipnet  *net.IPNet
+	line   int
+}
+
+type ACL struct {
+	rules  []aclRule
+	dflt   ACLAction
+	geoip  *GeoIP
+	hasGeo bool
+}
+
+// ParseACL parses rules read from r.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == "default" {
+			action, ok := aclActions[f[1]]
+			if !ok {
+				return nil, fmt.Errorf("acl line %d: unknown action %s", n, f[1])
+			}
+			acl.dflt = action
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("acl line %d: should be action, type and value", n)
+		}
+		action, ok := aclActions[f[0]]
+		if !ok {
+			return nil, fmt.Errorf("acl line %d: unknown action %s", n, f[0])
+		}
+		rule := aclRule{action: action, kind: f[1], value: strings.ToLower(f[2]), line: n}
+		switch rule.kind {
+		case "domain", "suffix", "keyword":
+			rule.value = strings.TrimPrefix(rule.value, ".")
+		case "cidr":
+			_, ipnet, err := net.ParseCIDR(f[2])
+			if err != nil {
+				return nil, fmt.Errorf("acl line %d: %v", n, err)
+			}
+			rule.ipnet = ipnet
+		case "geoip":
+			rule.value = strings.ToUpper(f[2])
+			acl.hasGeo = true
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown type %s", n, f[1])
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// LoadACL reads rule file, and GeoIP file if it's not empty.
+func LoadACL(path, geoipPath string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	acl, err := ParseACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if geoipPath != "" {
+		if acl.geoip, err = LoadGeoIP(geoipPath); err != nil {
+			return nil, err
+		}
+	} else if acl.hasGeo {
+		return nil, fmt.Errorf("%s: geoip rules need acl_geoip", path)
+	}
+	return acl, nil
+}
+
+// Match returns the action for host, which is a domain or IP literal.
+func (acl *ACL) Match(host string) ACLAction {
+	if action, ok := acl.MatchRule(host); ok {
+		return action
+	}
+	return acl.dflt
+}
+
+// Default returns the action for hosts matching no rule.
+func (acl *ACL) Default() ACLAction {
+	return acl.dflt
+}
+
+// MatchRule returns the action of the first rule matching host, and false
+// if none matches.
+func (acl *ACL) MatchRule(host string) (ACLAction, bool) {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	ip := net.ParseIP(host)
+	var country string
+	for _, r := range acl.rules {
+		switch r.kind {
+		case "domain":
+			if ip == nil && host == r.value {
+				return r.action, true
+			}
+		case "suffix":
+			if ip == nil && (host == r.value || strings.HasSuffix(host, "."+r.value)) {
+				return r.action, true
+			}
+		case "keyword":
+			if ip == nil && strings.Contains(host, r.value) {
+				return r.action, true
+			}
+		case "cidr":
+			if ip != nil && r.ipnet.Contains(ip) {
+				return r.action, true
+			}
+		case "geoip":
+			if ip == nil || acl.geoip == nil {
+				continue
+			}
+			if country == "" {
+				country = acl.geoip.Country(ip)
+			}
+			if country == r.value {
+				return r.action, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Shadowed returns a description of each rule that never applies because
+// every destination it matches is matched by an earlier rule.
+func (acl *ACL) Shadowed() []string {
+	var shadowed []string
+	for j, r := range acl.rules {
+		for _, e := range acl.rules[:j] {
+			if e.covers(r) {
+				shadowed = append(shadowed, fmt.Sprintf("line %d: %s never applies, shadowed by line %d: %s",
+					r.line, r, e.line, e))
+				break
+			}
+		}
+	}
+	return shadowed
+}
+
+// covers tells whether r matches every destination o matches.
+func (r aclRule) covers(o aclRule) bool {
+	switch r.kind {
+	case "domain":
+		return o.kind == "domain" && o.value == r.value
+	case "suffix":
+		return (o.kind == "domain" || o.kind == "suffix") &&
+			(o.value == r.value || strings.HasSuffix(o.value, "."+r.value))
+	case "keyword":
+		return o.kind != "cidr" && o.kind != "geoip" && strings.Contains(o.value, r.value)
+	case "cidr":
+		if o.kind != "cidr" {
+			return false
+		}
+		ones, bits := r.ipnet.Mask.Size()
+		oones, obits := o.ipnet.Mask.Size()
+		return bits == obits && ones <= oones && r.ipnet.Contains(o.ipnet.IP)
+	case "geoip":
+		return o.kind == "geoip" && o.value == r.value
+	}
+	return false
+}
+
+func (r aclRule) String() string {
+	return r.action.String() + " " + r.kind + " " + r.value
+}
+
+// GeoIP maps IP ranges to country codes.
+type GeoIP struct {
+	ranges []geoRange // sorted by start
+}
+
+type geoRange struct {
+	start, end [16]byte
+	country    string
+	parent     int // index of the enclosing range, -1 if none
+}
+
+func ip16(ip net.IP) (b [16]byte) {
+	copy(b[:], ip.To16())
+	return
+}
+
+// ParseGeoIP parses lines of CIDR and country code. Country may be omitted,
+// as in chnroutes, to only tell whether an IP is in the ranges.
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	g := &GeoIP{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(f) == 0 {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(f[0])
+		if err != nil {
+			if n == 1 {
+				// CSV header
+				continue
+			}
+			return nil, fmt.Errorf("geoip line %d: %v", n, err)
+		}
+		start := ip16(ipnet.IP)
+		end := start
+		mask := ipnet.Mask
+		off := 16 - len(mask)
+		for i := range mask {
+			end[off+i] |= ^mask[i]
+		}
+		var country string
+		if len(f) > 1 {
+			country = strings.ToUpper(f[1])
+		}
+		g.ranges = append(g.ranges, geoRange{start: start, end: end, country: country})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	// enclosing ranges first
+	sort.SliceStable(g.ranges, func(i, j int) bool {
+		if c := bytes.Compare(g.ranges[i].start[:], g.ranges[j].start[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(g.ranges[i].end[:], g.ranges[j].end[:]) > 0
+	})
+	// CIDRs are either nested or disjoint, ranges still open enclose the next
+	var open []int
+	for i := range g.ranges {
+		r := &g.ranges[i]
+		for len(open) > 0 && bytes.Compare(g.ranges[open[len(open)-1]].end[:], r.start[:]) < 0 {
+			open = open[:len(open)-1]
+		}
+		r.parent = -1
+		if len(open) > 0 {
+			r.parent = open[len(open)-1]
+		}
+		open = append(open, i)
+	}
+	return g, nil
+}
+
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g, err := ParseGeoIP(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return g, nil
+}
+
+// Country returns country code of ip, or empty string if unknown.
+func (g *GeoIP) Country(ip net.IP) string {
+	country, _ := g.Lookup(ip)
+	return country
+}
+
+// Lookup returns country code of the range containing ip, which may be empty
+// for lines without country, and whether there's such range.
+func (g *GeoIP) Lookup(ip net.IP) (country string, ok bool) {
+	b := ip16(ip)
+	// the last range starting at or before ip, or the innermost range
+	// enclosing it that contains ip
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].start[:], b[:]) > 0
+	}) - 1
+	for i >= 0 && bytes.Compare(b[:], g.ranges[i].end[:]) > 0 {
+		i = g.ranges[i].parent
+	}
+	if i < 0 {
+		return "", false
+	}
+	return g.ranges[i].country, true
+}
+
+// Len returns the number of ranges.
+func (g *GeoIP) Len() int {
+	return len(g.ranges)
+}
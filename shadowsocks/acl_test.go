@@ -0,0 +1,161 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	rules := `
+# comment
+reject keyword adservice
+proxy domain blocked.example.cn
+direct suffix .cn
+direct cidr 192.168.0.0/16
+direct cidr fd00::/8
+direct geoip JP
+default proxy
+`
+	acl, err := ParseACL(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl.geoip, err = ParseGeoIP(strings.NewReader("network,country\n203.0.113.0/24,jp\n2001:db8::/32 JP\n198.51.100.0/24,US\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host   string
+		action ACLAction
+	}{
+		{"www.adservice.google.com", ACLReject},
+		{"blocked.example.cn", ACLProxy},
+		{"example.cn", ACLDirect},
+		{"WWW.Example.CN.", ACLDirect},
+		{"example.com", ACLProxy},
+		{"notcn", ACLProxy},
+		{"192.168.1.1", ACLDirect},
+		{"fd00::1", ACLDirect},
+		{"[fd00::1]", ACLDirect},
+		{"203.0.113.9", ACLDirect},
+		{"2001:db8::1", ACLDirect},
+		{"198.51.100.1", ACLProxy},
+		{"8.8.8.8", ACLProxy},
+	}
+	for _, tt := range tests {
+		if action := acl.Match(tt.host); action != tt.action {
+			t.Errorf("%s: got %v, should be %v", tt.host, action, tt.action)
+		}
+	}
+
+	acl, err = ParseACL(strings.NewReader("default direct\nproxy suffix example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Match("other.org") != ACLDirect || acl.Match("a.example.com") != ACLProxy {
+		t.Error("default action not applied")
+	}
+
+	for _, rules := range []string{
+		"direct suffix",
+		"allow suffix cn",
+		"direct regex .*",
+		"direct cidr 10.0.0.0/33",
+		"default allow",
+	} {
+		if _, err = ParseACL(strings.NewReader(rules)); err == nil {
+			t.Errorf("%q should be rejected", rules)
+		}
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	// nested ranges, the most specific one applies
+	g, err := ParseGeoIP(strings.NewReader("10.0.0.0/8 AA\n10.1.0.0/16 BB\n10.1.2.0/24 DD\n1.0.0.0/24 CC\n, ,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip, country string
+	}{
+		{"1.0.0.255", "CC"},
+		{"1.0.1.0", ""},
+		{"10.0.0.1", "AA"},
+		{"10.1.2.3", "DD"},
+		{"10.1.3.0", "BB"},
+		{"10.2.0.0", "AA"},
+		{"10.255.255.255", "AA"},
+		{"11.0.0.0", ""},
+		{"0.0.0.1", ""},
+		{"::1", ""},
+	}
+	for _, tt := range tests {
+		if c := g.Country(net.ParseIP(tt.ip)); c != tt.country {
+			t.Errorf("%s: got %q, should be %q", tt.ip, c, tt.country)
+		}
+	}
+	if _, err = ParseGeoIP(strings.NewReader("1.0.0.0/24 CC\nbad line\n")); err == nil {
+		t.Error("malformed line should be rejected")
+	}
+}
+
+func TestACLMatchRule(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader("proxy suffix example.cn\ndefault direct\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action, ok := acl.MatchRule("www.example.cn"); !ok || action != ACLProxy {
+		t.Errorf("got %v %v, should match proxy rule", action, ok)
+	}
+	if _, ok := acl.MatchRule("example.org"); ok {
+		t.Error("example.org should match no rule")
+	}
+	if acl.Default() != ACLDirect {
+		t.Error("default should be direct")
+	}
+}
+
+func TestACLShadowed(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`proxy suffix example.com
+direct domain www.example.com
+reject keyword ads
+direct suffix ads.example.org
+proxy cidr 10.0.0.0/8
+direct cidr 10.1.0.0/16
+direct cidr 192.168.0.0/16
+proxy suffix example.org
+proxy domain example.net
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowed := acl.Shadowed()
+	if len(shadowed) != 3 {
+		t.Fatalf("got %q, should have 3 shadowed rules", shadowed)
+	}
+	for i, prefix := range []string{"line 2:", "line 4:", "line 6:"} {
+		if !strings.HasPrefix(shadowed[i], prefix) {
+			t.Errorf("got %q, should start with %q", shadowed[i], prefix)
+		}
+	}
+	if !strings.Contains(shadowed[2], "shadowed by line 5: proxy cidr 10.0.0.0/8") {
+		t.Errorf("got %q, should name the shadowing rule", shadowed[2])
+	}
+}
+
+func TestGeoIPWithoutCountry(t *testing.T) {
+	// chnroutes has CIDR only
+	g, err := ParseGeoIP(strings.NewReader("1.0.1.0/24\n1.0.2.0/23\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, in := range map[string]bool{"1.0.1.1": true, "1.0.3.255": true, "1.0.4.0": false, "1.0.0.1": false} {
+		if _, ok := g.Lookup(net.ParseIP(ip)); ok != in {
+			t.Errorf("%s: got %v, should be %v", ip, ok, in)
+		}
+	}
+	if g.Len() != 2 {
+		t.Errorf("got %d ranges, should be 2", g.Len())
+	}
+}
@@ -0,0 +1,76 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Addresses are in the form of host:port. IPv6 literal must be enclosed in
+// square brackets when port is given, e.g. [::1]:8388.
+
+// SplitHostPortDefault splits addr into host and port. If addr has no port,
+// defaultPort is returned as port. Bare IPv6 literal without brackets is
+// taken as a host without port.
+func SplitHostPortDefault(addr, defaultPort string) (host, port string, err error) {
+	if !HasPort(addr) {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if host == "" {
+			return "", "", fmt.Errorf("shadowsocks: missing host in address %s", addr)
+		}
+		return host, defaultPort, nil
+	}
+	return net.SplitHostPort(addr)
+}
+
+// JoinHostPort combines host and port into an address, adding brackets to
+// IPv6 literal. IP literal host is normalized.
+func JoinHostPort(host, port string) string {
+	return net.JoinHostPort(NormalizeHost(host), port)
+}
+
+// NormalizeHost returns IP literal in canonical form, so that the same
+// address is always written the same way when compared, counted or logged,
+// e.g. IPv4-mapped IPv6 address ::ffff:1.2.3.4 from dual-stack sockets
+// becomes 1.2.3.4. Other hosts are returned as is.
+func NormalizeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// NormalizeAddr normalizes host of addr, which may have no port.
+func NormalizeAddr(addr string) string {
+	if !HasPort(addr) {
+		return NormalizeHost(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return JoinHostPort(host, port)
+}
+
+// ValidateAddr checks that addr has both host and a valid port.
+func ValidateAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("shadowsocks: malformed address %s", addr)
+	}
+	if host == "" {
+		return fmt.Errorf("shadowsocks: missing host in address %s", addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 0xffff {
+		return fmt.Errorf("shadowsocks: invalid port in address %s", addr)
+	}
+	return nil
+}
+
+// HasPort tells whether s is in the form of host:port. Bare IPv6 literal
+// like ::1 has no port.
+func HasPort(s string) bool {
+	_, port, err := net.SplitHostPort(s)
+	return err == nil && port != ""
+}
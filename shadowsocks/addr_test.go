@@ -0,0 +1,100 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSplitHostPortDefault(t *testing.T) {
+	tests := []struct {
+		addr, host, port string
+	}{
+		{"example.com", "example.com", "8388"},
+		{"example.com:80", "example.com", "80"},
+		{"127.0.0.1", "127.0.0.1", "8388"},
+		{"127.0.0.1:80", "127.0.0.1", "80"},
+		{"::1", "::1", "8388"},
+		{"[::1]", "::1", "8388"},
+		{"[::1]:80", "::1", "80"},
+		{"2001:db8::1", "2001:db8::1", "8388"},
+	}
+	for _, tt := range tests {
+		host, port, err := SplitHostPortDefault(tt.addr, "8388")
+		if err != nil {
+			t.Errorf("%s: %v", tt.addr, err)
+			continue
+		}
+		if host != tt.host || port != tt.port {
+			t.Errorf("%s: got host %s port %s, should be %s %s", tt.addr, host, port, tt.host, tt.port)
+		}
+	}
+	if _, _, err := SplitHostPortDefault("", "8388"); err == nil {
+		t.Error("empty address should be rejected")
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		addr, normalized string
+	}{
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"[::ffff:1.2.3.4]", "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:80", "1.2.3.4:80"},
+		{"[2001:DB8:0::1]:80", "[2001:db8::1]:80"},
+		{"1.2.3.4:80", "1.2.3.4:80"},
+		{"Example.com:80", "Example.com:80"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeAddr(tt.addr); got != tt.normalized {
+			t.Errorf("%s: got %s, should be %s", tt.addr, got, tt.normalized)
+		}
+	}
+	if got := JoinHostPort("::ffff:1.2.3.4", "80"); got != "1.2.3.4:80" {
+		t.Errorf("joining IPv4-mapped address: got %s", got)
+	}
+}
+
+func TestHasPort(t *testing.T) {
+	for _, s := range []string{"example.com:80", "127.0.0.1:80", "[::1]:80"} {
+		if !HasPort(s) {
+			t.Errorf("%s should have port", s)
+		}
+	}
+	for _, s := range []string{"example.com", "127.0.0.1", "::1", "2001:db8::1", "[::1]"} {
+		if HasPort(s) {
+			t.Errorf("%s should not have port", s)
+		}
+	}
+}
+
+func TestValidateAddr(t *testing.T) {
+	for _, s := range []string{"example.com:80", "[::1]:8388"} {
+		if err := ValidateAddr(s); err != nil {
+			t.Errorf("%s should be valid: %v", s, err)
+		}
+	}
+	for _, s := range []string{"example.com", ":80", "example.com:0", "example.com:65536", "example.com:http", "::1"} {
+		if err := ValidateAddr(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestRawAddr(t *testing.T) {
+	for _, s := range []string{"example.com:80", "192.0.2.1:80", "[2001:db8::1]:80"} {
+		buf, err := RawAddr(s)
+		if err != nil {
+			t.Fatalf("error encoding %s: %v", s, err)
+		}
+		if parsed, n, err := ParsePacketAddr(buf); err != nil || parsed != s || n != len(buf) {
+			t.Errorf("%s encoded as %v", s, buf)
+		}
+	}
+	buf, _ := RawAddr("[::1]:80")
+	if buf[0] != addrTypeIPv6 || len(buf) != 1+net.IPv6len+2 {
+		t.Errorf("IPv6 literal should use address type 4, got %v", buf)
+	}
+	if _, err := RawAddr("example.com"); err == nil {
+		t.Error("address without port should be rejected")
+	}
+}
@@ -0,0 +1,184 @@
+package shadowsocks
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+)
+
+// The admin interface is a plain HTTP server which should only be bound to
+// loopback address, unless protected with tokens and TLS. Commands register
+// their handlers before serving it.
+var adminMux = http.NewServeMux()
+
+// patterns of handlers doing authentication themselves
+var adminNoAuth = map[string]bool{}
+
+// AdminToken grants access to admin interface. Token with read scope can
+// only use GET requests.
+type AdminToken struct {
+	Token string `json:"token"`
+	Scope string `json:"scope"` // read or admin
+}
+
+const (
+	adminScopeRead  = "read"
+	adminScopeAdmin = "admin"
+)
+
+// keyed by token name, access is not restricted if empty
+var adminTokens map[string]*AdminToken
+
+func init() {
+	// counters of each subsystem and recovered panics
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	// no cmdline, it would show passwords given by -k
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	adminMux.HandleFunc("/version", handleVersion)
+}
+
+func HandleAdmin(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	adminMux.HandleFunc(pattern, handler)
+}
+
+// HandleAdminNoAuth registers handler which is not protected by admin tokens,
+// the handler should do authentication itself.
+func HandleAdminNoAuth(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	adminMux.HandleFunc(pattern, handler)
+	adminNoAuth[pattern] = true
+}
+
+// adminUser returns name of the token in request, or empty string if token is
+// invalid.
+func adminUser(r *http.Request) (name, scope string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return
+	}
+	for n, t := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return n, t.Scope
+		}
+	}
+	return
+}
+
+func serveAdminHTTP(w http.ResponseWriter, r *http.Request) {
+	readOnly := r.Method == "GET" || r.Method == "HEAD"
+	var user []string // for logging management actions
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		user = append(user, "cert "+r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	if _, pattern := adminMux.Handler(r); !adminNoAuth[pattern] && len(adminTokens) != 0 {
+		name, scope := adminUser(r)
+		if name == "" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !readOnly && scope != adminScopeAdmin {
+			http.Error(w, "token is read only", http.StatusForbidden)
+			return
+		}
+		user = append(user, "token "+name)
+	}
+	if !readOnly {
+		if len(user) == 0 {
+			user = append(user, "anonymous")
+		}
+		// only log parameter names, values may be passwords or server URIs
+		r.ParseForm()
+		params := make([]string, 0, len(r.Form))
+		for k := range r.Form {
+			params = append(params, k)
+		}
+		sort.Strings(params)
+		log.Printf("admin: %s %s [%s] by %s from %s\n", r.Method, r.URL.Path,
+			strings.Join(params, " "), strings.Join(user, ", "), r.RemoteAddr)
+	}
+	adminMux.ServeHTTP(w, r)
+}
+
+func adminTLSConfig(config *Config) (*tls.Config, error) {
+	if config.AdminTLSCert == "" {
+		if config.AdminTLSClientCA != "" {
+			return nil, errors.New("admin_tls_client_ca requires admin_tls_cert")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.AdminTLSCert, config.AdminTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.AdminTLSClientCA != "" {
+		pem, err := ioutil.ReadFile(config.AdminTLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", config.AdminTLSClientCA)
+		}
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// exposedAdmin reports whether admin interface would be reachable from other
+// hosts without tokens or client certificates.
+func exposedAdmin(config *Config) bool {
+	return config.AdminAddr != "" && !isLoopbackAddr(config.AdminAddr) &&
+		len(config.AdminTokens) == 0 && config.AdminTLSClientCA == ""
+}
+
+// ServeAdmin starts admin interface at config.AdminAddr. Errors are returned
+// as StartupError.
+func ServeAdmin(config *Config) error {
+	for name, t := range config.AdminTokens {
+		if t.Token == "" || (t.Scope != adminScopeRead && t.Scope != adminScopeAdmin) {
+			return NewStartupError(ExitConfig,
+				fmt.Errorf("admin token %s: token must be set with scope read or admin", name))
+		}
+	}
+	tc, err := adminTLSConfig(config)
+	if err != nil {
+		return NewStartupError(ExitConfig, fmt.Errorf("admin interface: %v", err))
+	}
+	if exposedAdmin(config) {
+		if !config.AdminRemote {
+			return NewStartupError(ExitConfig, fmt.Errorf("admin interface at %s would be reachable from other hosts without authentication, set admin_tokens, bind it to a loopback address or set admin_remote", config.AdminAddr))
+		}
+		log.Printf("warning: admin interface at %s can be reached from other hosts without authentication\n", config.AdminAddr)
+	} else if len(config.AdminTokens) != 0 && tc == nil && !isLoopbackAddr(config.AdminAddr) {
+		log.Printf("warning: admin tokens are sent to %s in clear text, set admin_tls_cert\n", config.AdminAddr)
+	}
+	adminTokens = config.AdminTokens
+
+	ln, err := net.Listen("tcp", config.AdminAddr)
+	if err != nil {
+		return NewStartupError(ExitBind, fmt.Errorf("admin interface: %v", err))
+	}
+	if tc != nil {
+		ln = tls.NewListener(ln, tc)
+	}
+	log.Printf("admin interface listening at %s ...\n", config.AdminAddr)
+	go func() {
+		if err := http.Serve(ln, http.HandlerFunc(serveAdminHTTP)); err != nil {
+			log.Println("admin interface:", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,99 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// handlers can't be registered again with -count
+var registerTestAction sync.Once
+
+func TestAdminTokens(t *testing.T) {
+	defer func() { adminTokens = nil }()
+	adminTokens = map[string]*AdminToken{
+		"monitor": {"r-token", adminScopeRead},
+		"ops":     {"a-token", adminScopeAdmin},
+	}
+	registerTestAction.Do(func() {
+		HandleAdmin("/test-action", func(w http.ResponseWriter, r *http.Request) {})
+	})
+
+	tests := []struct {
+		method, token string
+		code          int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "bad-token", http.StatusUnauthorized},
+		{"GET", "r-token", http.StatusOK},
+		{"POST", "r-token", http.StatusForbidden},
+		{"POST", "a-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/test-action", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		serveAdminHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s with token %q: got status %d, expected %d", tt.method, tt.token, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAdminVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveAdminHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	var info VersionInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.GoVersion == "" {
+		t.Errorf("version info %+v", info)
+	}
+	found := false
+	for _, m := range info.Methods {
+		found = found || m == "aes-256-gcm"
+	}
+	if !found {
+		t.Errorf("aes-256-gcm not in methods %v", info.Methods)
+	}
+}
+
+func TestAdminNoCmdline(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveAdminHTTP(w, httptest.NewRequest("GET", "/debug/pprof/cmdline", nil))
+	if w.Code == http.StatusOK || strings.Contains(w.Body.String(), os.Args[0]) {
+		t.Errorf("command line with passwords should not be served, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestServeAdminExposed(t *testing.T) {
+	tests := []struct {
+		addr   string
+		tokens bool
+		remote bool
+		ok     bool
+	}{
+		{"0.0.0.0:0", false, false, false},
+		{"0.0.0.0:0", false, true, true},
+		{"0.0.0.0:0", true, false, true},
+		{"127.0.0.1:0", false, false, true},
+	}
+	defer func() { adminTokens = nil }()
+	for _, tt := range tests {
+		config := &Config{AdminAddr: tt.addr, AdminRemote: tt.remote}
+		if tt.tokens {
+			config.AdminTokens = map[string]*AdminToken{"ops": {"a-token", adminScopeAdmin}}
+		}
+		err := ServeAdmin(config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s tokens %v admin_remote %v: got error %v", tt.addr, tt.tokens, tt.remote, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// AEAD methods follow SIP004. Each direction of a connection starts with a
+// random salt, from which a subkey is derived with HKDF-SHA1. The stream is
+// then sent in chunks of encrypted 2-byte length and encrypted payload, each
+// with its own tag. Nonce is a little-endian counter starting from 0, and is
+// incremented after each encryption or decryption. Each UDP packet is the
+// salt followed by the encrypted packet with nonce 0.
+
+// payload of a chunk is at most this size
+const maxChunkSize = 0x3FFF
+
+const chunkLenSize = 2
+
+// tag size of all the AEAD methods
+const aeadTagSize = 16
+
+var errChunkSize = errors.New("shadowsocks: invalid chunk size")
+var errPacketSize = errors.New("shadowsocks: packet too short")
+
+type aeadMethod struct {
+	keySize  int
+	saltSize int
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+var aeadMethods = map[string]*aeadMethod{
+	"aes-256-gcm":            {32, 32, newGCM},
+	"chacha20-ietf-poly1305": {32, 32, chacha20poly1305.New},
+}
+
+func init() {
+	for name, m := range aeadMethods {
+		methods[name] = newAEADTable(m)
+	}
+}
+
+// aeadCipher is the cipher of a password.
+type aeadCipher struct {
+	*aeadMethod
+	key []byte // master key
+}
+
+// evpBytesToKey derives master key from password as OpenSSL's EVP_BytesToKey
+// with MD5, which all shadowsocks implementations use.
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+func newAEADTable(m *aeadMethod) func(key string) *EncryptTable {
+	return func(key string) *EncryptTable {
+		return &EncryptTable{aead: &aeadCipher{m, evpBytesToKey(key, m.keySize)}}
+	}
+}
+
+func (c *aeadCipher) newSalt() []byte {
+	salt := make([]byte, c.saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		panic("shadowsocks: can't generate salt: " + err.Error())
+	}
+	return salt
+}
+
+// stream returns the encryption state for the direction starting with salt.
+func (c *aeadCipher) stream(salt []byte) *aeadStream {
+	subkey := make([]byte, c.keySize)
+	r := hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		panic("shadowsocks: hkdf: " + err.Error())
+	}
+	aead, err := c.newAEAD(subkey)
+	if err != nil {
+		// key size is decided by method and always valid
+		panic("shadowsocks: " + err.Error())
+	}
+	return &aeadStream{AEAD: aead, nonce: make([]byte, aead.NonceSize())}
+}
+
+type aeadStream struct {
+	cipher.AEAD
+	nonce  []byte
+	lenBuf [chunkLenSize]byte
+}
+
+func (s *aeadStream) incNonce() {
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// seal appends chunks of b to dst.
+func (s *aeadStream) seal(dst, b []byte) []byte {
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxChunkSize {
+			n = maxChunkSize
+		}
+		s.lenBuf[0], s.lenBuf[1] = byte(n>>8), byte(n)
+		dst = s.Seal(dst, s.nonce, s.lenBuf[:], nil)
+		s.incNonce()
+		dst = s.Seal(dst, s.nonce, b[:n], nil)
+		s.incNonce()
+		b = b[n:]
+	}
+	return dst
+}
+
+// readChunk reads and decrypts a chunk from r, buf is reused if it's large
+// enough.
+func (s *aeadStream) readChunk(r io.Reader, buf []byte) ([]byte, error) {
+	overhead := s.Overhead()
+	if cap(buf) < maxChunkSize+overhead {
+		buf = make([]byte, maxChunkSize+overhead)
+	}
+	buf = buf[:chunkLenSize+overhead]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	lenBuf, err := s.Open(buf[:0], s.nonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.incNonce()
+	n := int(lenBuf[0])<<8 | int(lenBuf[1])
+	if n == 0 || n > maxChunkSize {
+		return nil, errChunkSize
+	}
+	buf = buf[:n+overhead]
+	if _, err = io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	payload, err := s.Open(buf[:0], s.nonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.incNonce()
+	return payload, nil
+}
+
+// sealPacket appends salt and encrypted packet b to dst.
+func (c *aeadCipher) sealPacket(dst, b []byte) []byte {
+	salt := c.newSalt()
+	s := c.stream(salt)
+	return s.Seal(append(dst, salt...), s.nonce, b, nil)
+}
+
+// openPacket decrypts packet b in place and returns the plain packet.
+func (c *aeadCipher) openPacket(b []byte) ([]byte, error) {
+	if len(b) < c.saltSize {
+		return nil, errPacketSize
+	}
+	s := c.stream(b[:c.saltSize])
+	if len(b) < c.saltSize+s.Overhead() {
+		return nil, errPacketSize
+	}
+	return s.Open(b[c.saltSize:c.saltSize], s.nonce, b[c.saltSize:], nil)
+}
@@ -0,0 +1,124 @@
+package shadowsocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit records which client requested which destination. How much of the
+// destination is recorded depends on the privacy mode, so operators of
+// shared gateways can choose between accountability and user privacy.
+const (
+	auditOff    = "off"
+	auditFull   = "full"   // host and port
+	auditDomain = "domain" // host only
+	auditHashed = "hashed" // hash of host and port
+)
+
+// protected by audit lock, as they're replaced on reload
+var auditMode = auditOff
+var auditFile string // log to stderr if empty
+
+var audit struct {
+	sync.Mutex
+	f *os.File
+}
+
+// setAudit replaces privacy mode and audit file, empty mode turns audit off.
+// The open audit file is closed if audit is turned off or the file changes.
+func setAudit(mode, file string) {
+	if mode == "" {
+		mode = auditOff
+	}
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.f != nil && (mode == auditOff || file != auditFile) {
+		audit.f.Close()
+		audit.f = nil
+	}
+	auditMode, auditFile = mode, file
+}
+
+func getAuditMode() string {
+	audit.Lock()
+	defer audit.Unlock()
+	return auditMode
+}
+
+func checkAuditMode(mode string) error {
+	switch mode {
+	case "", auditOff, auditFull, auditDomain, auditHashed:
+		return nil
+	}
+	return fmt.Errorf("unsupported audit mode %s", mode)
+}
+
+func AuditEnabled() bool {
+	return getAuditMode() != auditOff
+}
+
+// AuditDest returns destination to record according to the privacy mode.
+func AuditDest(dest string) string {
+	dest = NormalizeAddr(dest)
+	switch getAuditMode() {
+	case auditDomain:
+		if h, _, err := SplitHostPortDefault(dest, ""); err == nil {
+			return h
+		}
+	case auditHashed:
+		// Hash only prevents casual reading, it can be checked against
+		// known destinations.
+		sum := sha256.Sum256([]byte(dest))
+		return hex.EncodeToString(sum[:8])
+	}
+	return dest
+}
+
+// Audit records a request from client to dest, in the form of host:port.
+func Audit(client, dest string) {
+	AuditGeo(client, dest, "", "")
+}
+
+// AuditGeo records a request like Audit, annotated with country and AS of
+// the destination returned by DestGeo, if not empty.
+func AuditGeo(client, dest, country, asn string) {
+	if !AuditEnabled() {
+		return
+	}
+	client, dest = NormalizeAddr(client), AuditDest(dest)
+	if country != "" || asn != "" {
+		dest = fmt.Sprintf("%s %s %s", dest, geoField(country), geoField(asn))
+	}
+	audit.Lock()
+	defer audit.Unlock()
+	if auditMode == auditOff {
+		// turned off meanwhile
+		return
+	}
+	if auditFile == "" {
+		log.Printf("audit: %s %s\n", client, dest)
+		return
+	}
+	if audit.f == nil {
+		f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Println("open audit file:", err)
+			return
+		}
+		audit.f = f
+	}
+	fmt.Fprintf(audit.f, "%s %s %s\n", time.Now().Format(time.RFC3339), client, dest)
+}
+
+// geoField keeps columns of audit records when a database is not loaded.
+func geoField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditDest(t *testing.T) {
+	defer func() { auditMode = auditOff }()
+
+	tests := []struct {
+		mode, dest, expected string
+	}{
+		{auditFull, "example.com:443", "example.com:443"},
+		{auditDomain, "example.com:443", "example.com"},
+		{auditDomain, "[::1]:80", "::1"},
+	}
+	for _, tt := range tests {
+		auditMode = tt.mode
+		if d := AuditDest(tt.dest); d != tt.expected {
+			t.Errorf("%s mode: got %s, expected %s", tt.mode, d, tt.expected)
+		}
+	}
+
+	auditMode = auditHashed
+	h := AuditDest("example.com:443")
+	if len(h) != 16 || h != AuditDest("example.com:443") {
+		t.Error("hashed mode should give stable hash, got", h)
+	}
+	if h == AuditDest("example.com:80") {
+		t.Error("hashed mode should hash port")
+	}
+
+	if err := checkAuditMode("domain-only"); err == nil {
+		t.Error("should reject unknown audit mode")
+	}
+}
+
+func TestSetAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setAudit("", "")
+	file := filepath.Join(dir, "audit.log")
+
+	setAudit(auditFull, file)
+	Audit("1.2.3.4:5678", "example.com:443")
+	// turned off on reload without audit option
+	setAudit("", file)
+	if AuditEnabled() {
+		t.Fatal("audit should be off")
+	}
+	Audit("1.2.3.4:5678", "example.org:443")
+	if audit.f != nil {
+		t.Error("audit file should be closed")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "example.com:443") || strings.Contains(string(data), "example.org") {
+		t.Errorf("got %q, should only have request before audit is off", data)
+	}
+}
@@ -0,0 +1,76 @@
+package shadowsocks
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func BenchmarkGetTable(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		GetTable("foobar!")
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	tbl := GetTable("foobar!")
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encrypt2(tbl.EncTbl, buf, buf)
+	}
+}
+
+func benchmarkAEAD(b *testing.B, method string) {
+	tbl, _ := NewTable(method, "foobar!")
+	s := tbl.aead.stream(tbl.aead.newSalt())
+	buf := make([]byte, 4096)
+	dst := make([]byte, 0, len(buf)+64)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.seal(dst, buf)
+	}
+}
+
+func BenchmarkAES256GCM(b *testing.B) {
+	benchmarkAEAD(b, "aes-256-gcm")
+}
+
+func BenchmarkChacha20Poly1305(b *testing.B) {
+	benchmarkAEAD(b, "chacha20-ietf-poly1305")
+}
+
+// BenchmarkPipe measures relaying data through an encrypted connection with
+// Pipe, which is what both local and server do for each connection.
+func BenchmarkPipe(b *testing.B) {
+	tbl := GetTable("foobar!")
+	c1, c2 := net.Pipe()
+	enc, dec := NewConn(c1, tbl), NewConn(c2, tbl)
+	in, out := net.Pipe()
+
+	end := make(chan byte, 1)
+	go Pipe(dec, out, end)
+	go func() {
+		io.Copy(ioutil.Discard, in)
+	}()
+
+	buf := make([]byte, 16*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := enc.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	enc.Close()
+	<-end
+	in.Close()
+	out.Close()
+}
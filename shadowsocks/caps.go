@@ -0,0 +1,69 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Clients can ask server what it supports by requesting CapsAddr, which is
+// never a real destination. Server replies with Capabilities encoded in JSON
+// and closes the connection. As the request is encrypted like any other,
+// only clients knowing the password can query. Servers not supporting
+// negotiation fail to connect to the address and close the connection, which
+// tells client to keep its configuration.
+const CapsAddr = "capabilities.shadowsocks.invalid:1"
+
+// reply larger than this is not from a server supporting negotiation
+const maxCapsLen = 4096
+
+const capsTimeout = 5 * time.Second
+
+type Capabilities struct {
+	UDP             bool     `json:"udp"`
+	PortHop         string   `json:"port_hop,omitempty"`
+	PortHopInterval int      `json:"port_hop_interval,omitempty"`
+	Features        []string `json:"features"`
+}
+
+var errCapsNotSupported = errors.New("capability negotiation not supported by server")
+
+// IsCapsRequest tells whether the requested address is CapsAddr.
+func IsCapsRequest(addr string) bool {
+	return addr == CapsAddr
+}
+
+// WriteCaps replies capabilities to client. Features are filled with
+// protocol features of this build.
+func WriteCaps(conn net.Conn, caps Capabilities) error {
+	caps.Features = protocolFeatures
+	b, err := json.Marshal(&caps)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// QueryCaps asks server connected by cn for its capabilities.
+func QueryCaps(cn net.Conn, encTbl *EncryptTable) (*Capabilities, error) {
+	rawaddr, _ := RawAddr(CapsAddr)
+	conn := NewConnWithRawAddr(cn, rawaddr, encTbl)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(capsTimeout))
+	b, err := io.ReadAll(io.LimitReader(conn, maxCapsLen+1))
+	if err != nil {
+		return nil, err
+	}
+	// closed without reply
+	if len(b) == 0 || len(b) > maxCapsLen {
+		return nil, errCapsNotSupported
+	}
+	var caps Capabilities
+	if err = json.Unmarshal(b, &caps); err != nil {
+		return nil, errCapsNotSupported
+	}
+	return &caps, nil
+}
@@ -0,0 +1,63 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// serveCaps reads the request header on ln, and replies capabilities if
+// reply is true, otherwise closes the connection like old servers.
+func serveCaps(t *testing.T, ln net.Listener, tbl *EncryptTable, reply bool) {
+	c, err := ln.Accept()
+	if err != nil {
+		t.Error("accept:", err)
+		return
+	}
+	defer c.Close()
+	conn := NewConn(c, tbl)
+	rawaddr, _ := RawAddr(CapsAddr)
+	buf := make([]byte, len(rawaddr))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Error("read:", err)
+		return
+	}
+	addr, _, err := ParsePacketAddr(buf)
+	if err != nil || !IsCapsRequest(addr) {
+		t.Errorf("request %s is not for capabilities", addr)
+		return
+	}
+	if reply {
+		WriteCaps(conn, Capabilities{UDP: true, PortHop: "20000-20009"})
+	}
+}
+
+func TestQueryCaps(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tbl, _ := NewTable("aes-256-gcm", "foobar!")
+
+	go serveCaps(t, ln, tbl, true)
+	cn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps, err := QueryCaps(cn, tbl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caps.UDP || caps.PortHop != "20000-20009" || len(caps.Features) == 0 {
+		t.Errorf("capabilities %+v", caps)
+	}
+
+	go serveCaps(t, ln, tbl, false)
+	if cn, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = QueryCaps(cn, tbl); err != errCapsNotSupported {
+		t.Errorf("server closing connection: got %v, should be %v", err, errCapsNotSupported)
+	}
+}
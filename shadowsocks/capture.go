@@ -0,0 +1,265 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Decrypted traffic of connections to the capture targets is written to a
+// pcapng file for debugging. Data is wrapped in synthesized IPv4/TCP packets
+// so tools like Wireshark can follow the stream and dissect the protocol
+// inside the tunnel. Addresses which are not IPv4 are replaced with fake ones,
+// ports are kept.
+
+const defaultCaptureFile = "capture.pcapng"
+
+// protected by capture lock, as they're replaced on reload
+var captureTargets []string
+var captureFile = defaultCaptureFile
+
+var capture struct {
+	sync.Mutex
+	f *os.File
+}
+
+// setCapture replaces capture targets and file, empty file for the default.
+// The open capture file is closed if capture is turned off or the file
+// changes.
+func setCapture(targets []string, file string) {
+	if file == "" {
+		file = defaultCaptureFile
+	}
+	capture.Lock()
+	defer capture.Unlock()
+	if capture.f != nil && (len(targets) == 0 || file != captureFile) {
+		capture.f.Close()
+		capture.f = nil
+	}
+	captureTargets, captureFile = targets, file
+}
+
+var (
+	fakeClientIP = net.IPv4(10, 0, 0, 1).To4()
+	fakeDestIP   = net.IPv4(10, 0, 0, 2).To4()
+)
+
+func CaptureEnabled() bool {
+	capture.Lock()
+	defer capture.Unlock()
+	return len(captureTargets) != 0
+}
+
+// CaptureTarget tells whether connections to host, in the form of host:port,
+// should be captured. Targets may be given either with or without port.
+func CaptureTarget(host string) bool {
+	if !CaptureEnabled() {
+		return false
+	}
+	host = NormalizeAddr(host)
+	h, _, err := SplitHostPortDefault(host, "")
+	if err != nil {
+		return false
+	}
+	capture.Lock()
+	defer capture.Unlock()
+	for _, t := range captureTargets {
+		if t == host || t == h {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterfaceDesc  = 1
+	pcapngEnhancedPacket = 6
+	linkTypeRaw          = 101 // raw IP packets
+)
+
+func writeBlock(f *os.File, blockType uint32, body []byte) error {
+	pad := (4 - len(body)%4) % 4
+	total := uint32(12 + len(body) + pad)
+	buf := make([]byte, total)
+	binary.LittleEndian.PutUint32(buf[0:], blockType)
+	binary.LittleEndian.PutUint32(buf[4:], total)
+	copy(buf[8:], body)
+	binary.LittleEndian.PutUint32(buf[total-4:], total)
+	_, err := f.Write(buf)
+	return err
+}
+
+// openCapture opens capture file and writes the pcapng header if not done
+// yet. Caller must hold capture lock.
+func openCapture() error {
+	if capture.f != nil {
+		return nil
+	}
+	f, err := os.Create(captureFile)
+	if err != nil {
+		return err
+	}
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1A2B3C4D) // byte order magic
+	binary.LittleEndian.PutUint16(shb[4:], 1)          // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0)          // minor version
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0)) // section length not specified
+	if err = writeBlock(f, pcapngSectionHeader, shb); err != nil {
+		f.Close()
+		return err
+	}
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	if err = writeBlock(f, pcapngInterfaceDesc, idb); err != nil {
+		f.Close()
+		return err
+	}
+	capture.f = f
+	log.Println("capturing traffic to", captureFile)
+	return nil
+}
+
+func writePacket(pkt []byte) {
+	capture.Lock()
+	defer capture.Unlock()
+	if len(captureTargets) == 0 {
+		// turned off after the connection started
+		return
+	}
+	if err := openCapture(); err != nil {
+		log.Println("capture:", err)
+		return
+	}
+	ts := uint64(time.Now().UnixNano() / 1000) // microseconds
+	body := make([]byte, 20+len(pkt))
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	copy(body[20:], pkt)
+	if err := writeBlock(capture.f, pcapngEnhancedPacket, body); err != nil {
+		log.Println("capture:", err)
+	}
+}
+
+func captureEndpoint(addr string, fake net.IP) (net.IP, uint16) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fake, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ip = fake
+	}
+	return ip, uint16(port)
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// captureStream keeps TCP sequence numbers of one captured connection.
+type captureStream struct {
+	sync.Mutex
+	ip   [2]net.IP // client, destination
+	port [2]uint16
+	seq  [2]uint32
+	ipID uint16
+}
+
+// maximum payload in one synthesized packet, IPv4 total length is 16 bits
+const maxCapturePayload = 65535 - 40
+
+// record writes data sent from client (toDest is true) or destination as
+// TCP packets.
+func (s *captureStream) record(toDest bool, data []byte) {
+	src, dst := 0, 1
+	if !toDest {
+		src, dst = 1, 0
+	}
+	s.Lock()
+	defer s.Unlock()
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxCapturePayload {
+			n = maxCapturePayload
+		}
+		pkt := make([]byte, 40+n)
+		ip, tcp := pkt[0:20], pkt[20:40]
+		ip[0] = 0x45 // version 4, header length 20
+		binary.BigEndian.PutUint16(ip[2:], uint16(40+n))
+		s.ipID++
+		binary.BigEndian.PutUint16(ip[4:], s.ipID)
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64                                 // ttl
+		ip[9] = 6                                  // tcp
+		copy(ip[12:16], s.ip[src])
+		copy(ip[16:20], s.ip[dst])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+		binary.BigEndian.PutUint16(tcp[0:], s.port[src])
+		binary.BigEndian.PutUint16(tcp[2:], s.port[dst])
+		binary.BigEndian.PutUint32(tcp[4:], s.seq[src])
+		binary.BigEndian.PutUint32(tcp[8:], s.seq[dst])
+		tcp[12] = 5 << 4 // data offset
+		tcp[13] = 0x18   // PSH, ACK
+		binary.BigEndian.PutUint16(tcp[14:], 65535)
+		// tcp checksum is left as 0, Wireshark doesn't verify it by default
+
+		copy(pkt[40:], data[:n])
+		s.seq[src] += uint32(n)
+		data = data[n:]
+		writePacket(pkt)
+	}
+}
+
+type captureConn struct {
+	net.Conn
+	s          *captureStream
+	clientSide bool
+}
+
+// NewCaptureConn returns conn which records data through it. client and dest
+// are addresses used in the synthesized packets. If clientSide is true, conn
+// faces the client and data read from it is sent to destination; otherwise
+// conn faces the destination.
+func NewCaptureConn(conn net.Conn, client, dest string, clientSide bool) net.Conn {
+	s := &captureStream{}
+	s.ip[0], s.port[0] = captureEndpoint(client, fakeClientIP)
+	s.ip[1], s.port[1] = captureEndpoint(dest, fakeDestIP)
+	s.seq = [2]uint32{1, 1}
+	return &captureConn{conn, s, clientSide}
+}
+
+func (c *captureConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.s.record(c.clientSide, b[:n])
+	}
+	return
+}
+
+func (c *captureConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.s.record(!c.clientSide, b[:n])
+	}
+	return
+}
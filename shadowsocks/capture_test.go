@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureTarget(t *testing.T) {
+	setCapture([]string{"example.com", "127.0.0.1:8080", "10.0.0.3"}, "")
+	defer setCapture(nil, "")
+
+	match := []string{"example.com:80", "example.com:443", "127.0.0.1:8080",
+		"[::ffff:127.0.0.1]:8080", "[::ffff:10.0.0.3]:443"}
+	for _, host := range match {
+		if !CaptureTarget(host) {
+			t.Errorf("%s should be captured", host)
+		}
+	}
+	notMatch := []string{"www.example.com:80", "127.0.0.1:80"}
+	for _, host := range notMatch {
+		if CaptureTarget(host) {
+			t.Errorf("%s should not be captured", host)
+		}
+	}
+}
+
+func TestCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test.pcapng")
+	setCapture([]string{"example.com"}, file)
+	defer setCapture(nil, "")
+
+	s := NewCaptureConn(nil, "192.168.1.2:5000", "example.com:80", true).(*captureConn).s
+	s.record(true, []byte("request"))
+	s.record(false, []byte("response"))
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []uint32
+	var payloads []string
+	for len(data) >= 12 {
+		typ := binary.LittleEndian.Uint32(data)
+		l := binary.LittleEndian.Uint32(data[4:])
+		if int(l) > len(data) || binary.LittleEndian.Uint32(data[l-4:]) != l {
+			t.Fatal("malformed block")
+		}
+		blocks = append(blocks, typ)
+		if typ == pcapngEnhancedPacket {
+			capLen := binary.LittleEndian.Uint32(data[20:])
+			pkt := data[28 : 28+capLen]
+			payloads = append(payloads, string(pkt[40:]))
+		}
+		data = data[l:]
+	}
+	if len(blocks) != 4 || blocks[0] != pcapngSectionHeader || blocks[1] != pcapngInterfaceDesc {
+		t.Fatal("wrong blocks in capture file:", blocks)
+	}
+	if payloads[0] != "request" || payloads[1] != "response" {
+		t.Error("wrong packet payload:", payloads)
+	}
+}
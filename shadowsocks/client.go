@@ -0,0 +1,181 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Client connects to destinations through shadowsocks servers, for programs
+// embedding shadowsocks client. Servers are tried in order until one is
+// connected, so the others act as fallback. shadowsocks-local builds server
+// groups, load balancing and other features on top of the same servers of
+// config, socks handling and relaying.
+type Client struct {
+	servers []ClientServer
+}
+
+// ClientServer is a server given in client config.
+type ClientServer struct {
+	Addr     string
+	Password string
+	EncTbl   *EncryptTable
+}
+
+// ClientServers returns servers in config, which are given either by server,
+// server_port and password, or by server_password. Servers in
+// server_password are in order of their addresses.
+func ClientServers(config *Config) ([]ClientServer, error) {
+	var servers []ClientServer
+	if len(config.ServerPassword) == 0 {
+		encTbl, _ := NewTable(config.Method, config.Password)
+		srvPort := strconv.Itoa(config.ServerPort)
+		for _, s := range config.GetServerArray() {
+			if HasPort(s) && config.ServerPort != 0 {
+				log.Println("ignore server_port option for server", s)
+			}
+			host, port, err := SplitHostPortDefault(s, srvPort)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, ClientServer{JoinHostPort(host, port), config.Password, encTbl})
+		}
+		return servers, nil
+	}
+	tblCache := make(map[string]*EncryptTable)
+	for s, passwd := range config.ServerPassword {
+		encTbl, ok := tblCache[passwd]
+		if !ok {
+			encTbl, _ = NewTable(config.Method, passwd)
+			tblCache[passwd] = encTbl
+		}
+		servers = append(servers, ClientServer{s, passwd, encTbl})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Addr < servers[j].Addr
+	})
+	return servers, nil
+}
+
+// NewClient returns client using servers in config, given in the same way as
+// for shadowsocks-local, see ClientServers.
+func NewClient(config *Config) (*Client, error) {
+	if err := CheckMethod(config.Method); err != nil {
+		return nil, err
+	}
+	if len(config.ServerPassword) == 0 && config.Password == "" {
+		return nil, errors.New("shadowsocks: missing password")
+	}
+	servers, err := ClientServers(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("shadowsocks: no server")
+	}
+	for _, s := range servers {
+		if err := ValidateAddr(s.Addr); err != nil {
+			return nil, err
+		}
+		if err := CheckPlainMethod(config.Method, s.Addr); err != nil {
+			return nil, err
+		}
+	}
+	return &Client{servers}, nil
+}
+
+// Dial connects to addr, which is in the form of host:port, through the first
+// server reachable. Only TCP is supported.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("shadowsocks: network %s not supported", network)
+	}
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.dialRawAddr(rawaddr)
+}
+
+func (c *Client) dialRawAddr(rawaddr []byte) (conn *Conn, err error) {
+	for _, s := range c.servers {
+		start := time.Now()
+		var cn net.Conn
+		if cn, err = DialMarked(s.Addr); err != nil {
+			Debug.Printf("connecting to server %s: %v\n", s.Addr, err)
+			continue
+		}
+		TuneConn(cn, time.Since(start))
+		return NewConnWithRawAddr(cn, rawaddr, s.EncTbl), nil
+	}
+	return nil, err
+}
+
+// ListenAndServe accepts socks5 connections on addr, and relays them through
+// servers. Only CONNECT command is supported.
+func (c *Client) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(ln)
+}
+
+// Serve accepts socks5 connections on ln until it's closed.
+func (c *Client) Serve(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				Debug.Println("accept:", err)
+				continue
+			}
+			return err
+		}
+		go c.handleConnection(conn)
+	}
+}
+
+func (c *Client) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	defer RecoverPanic(conn)
+
+	if err := SocksHandShake(conn, nil); err != nil {
+		Debug.Println("socks handshake:", err)
+		return
+	}
+	cmd, rawaddr, addr, err := ReadSocksRequest(conn)
+	if err != nil {
+		Debug.Println("error getting request:", err)
+		return
+	}
+	if cmd != SocksCmdConnect {
+		conn.Write(socksReply(socksRepCmdUnsupported))
+		return
+	}
+	// unlike shadowsocks-local, reply after connecting to server so that
+	// socks client can tell whether it's connected
+	remote, err := c.dialRawAddr(rawaddr)
+	if err != nil {
+		Debug.Printf("connecting to %s: %v\n", addr, err)
+		conn.Write(socksReply(socksRepGeneralFailure))
+		return
+	}
+	defer remote.Close()
+	if _, err = conn.Write(socksReply(socksRepSucceeded)); err != nil {
+		Debug.Println("send connection confirmation:", err)
+		return
+	}
+	Debug.Printf("connected to %s via %s\n", addr, remote.RemoteAddr())
+	ch := make(chan byte, 2)
+	go Pipe(conn, remote, ch)
+	go Pipe(remote, conn, ch)
+	<-ch // close the other connection whenever one connection is closed
+}
@@ -0,0 +1,110 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// serveEcho accepts one shadowsocks connection on ln, and writes back the
+// request header and data received.
+func serveEcho(t *testing.T, ln net.Listener, tbl *EncryptTable, n int) {
+	c, err := ln.Accept()
+	if err != nil {
+		t.Error("accept:", err)
+		return
+	}
+	defer c.Close()
+	conn := NewConn(c, tbl)
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Error("read:", err)
+		return
+	}
+	conn.Write(buf)
+}
+
+func TestClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// nothing listens on the closed port, client should fall back to ln
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	client, err := NewClient(&Config{
+		Method:         "aes-256-gcm",
+		ServerPassword: map[string]string{dead.Addr().String(): "foobar!", ln.Addr().String(): "foobar!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead.Addr().String() > ln.Addr().String() {
+		// make sure the dead server is tried first
+		client.servers[0], client.servers[1] = client.servers[1], client.servers[0]
+	}
+	tbl := client.servers[1].EncTbl
+
+	rawaddr, _ := RawAddr("example.com:80")
+	msg := "hello"
+	go serveEcho(t, ln, tbl, len(rawaddr)+len(msg))
+	conn, err := client.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	conn.Write([]byte(msg))
+	got := make([]byte, len(rawaddr)+len(msg))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal("read:", err)
+	}
+	if string(got) != string(rawaddr)+msg {
+		t.Errorf("got %q", got)
+	}
+	conn.Close()
+
+	// the same through socks
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve(socks)
+	defer socks.Close()
+	go serveEcho(t, ln, tbl, len(rawaddr)+len(msg))
+	sc, err := net.Dial("tcp", socks.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	sc.Write([]byte{SocksVer5, 1, socksMethodNoAuth})
+	reply := make([]byte, len(socksReply(0)))
+	if _, err = io.ReadFull(sc, reply[:2]); err != nil || reply[1] != socksMethodNoAuth {
+		t.Fatalf("socks method reply %v, %v", reply[:2], err)
+	}
+	sc.Write(append([]byte{SocksVer5, SocksCmdConnect, 0}, rawaddr...))
+	if _, err = io.ReadFull(sc, reply); err != nil || reply[1] != socksRepSucceeded {
+		t.Fatalf("socks reply %v, %v", reply, err)
+	}
+	sc.Write([]byte(msg))
+	if _, err = io.ReadFull(sc, got); err != nil {
+		t.Fatal("read:", err)
+	}
+	if string(got) != string(rawaddr)+msg {
+		t.Errorf("got %q through socks", got)
+	}
+
+	if _, err = client.Dial("udp", "example.com:53"); err == nil {
+		t.Error("udp should not be supported")
+	}
+	for _, config := range []*Config{
+		{Server: "127.0.0.1", ServerPort: 8388},
+		{Server: "127.0.0.1", Password: "foobar!"},
+		{Server: "127.0.0.1", ServerPort: 8388, Password: "foobar!", Method: "rot13"},
+		{Password: "foobar!", ServerPort: 8388},
+	} {
+		if _, err = NewClient(config); err == nil {
+			t.Errorf("config %+v should be invalid", config)
+		}
+	}
+}
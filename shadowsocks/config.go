@@ -9,6 +9,7 @@ package shadowsocks
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -22,17 +23,171 @@ type Config struct {
 	ServerPort int         `json:"server_port"`
 	LocalPort  int         `json:"local_port"`
 	Password   string      `json:"password"`
+	Method     string      `json:"method"` // encryption method, defaults to table
+	AdminAddr  string      `json:"admin_addr"`
+	Strict     bool        `json:"strict"` // refuse weak configurations
+
+	// protect admin interface with tokens keyed by name, TLS and client
+	// certificates
+	AdminTokens      map[string]*AdminToken `json:"admin_tokens"`
+	AdminTLSCert     string                 `json:"admin_tls_cert"`
+	AdminTLSKey      string                 `json:"admin_tls_key"`
+	AdminTLSClientCA string                 `json:"admin_tls_client_ca"`
+	AdminRemote      bool                   `json:"admin_remote"` // allow admin_addr on non-loopback address without authentication
+
+	// coalesce small writes for at most this many milliseconds, 0 to disable
+	WriteCoalesce  int  `json:"write_coalesce"`
+	BufferSize     int  `json:"buffer_size"`
+	BufferAutoTune bool `json:"buffer_auto_tune"`
+	// free buffers of each size kept for reuse, 32 by default
+	BufferPoolCount int `json:"buffer_pool_count"`
+
+	// size socket buffers between client and server to bandwidth-delay
+	// product with this expected bandwidth in Mbit/s, or to given sizes
+	Bandwidth    int `json:"bandwidth"`
+	SocketSndBuf int `json:"socket_sndbuf"`
+	SocketRcvBuf int `json:"socket_rcvbuf"`
+	// Linux only, used for connections between client and server
+	TCPCongestion   string `json:"tcp_congestion"`
+	TCPNotSentLowat int    `json:"tcp_notsent_lowat"`
+	// Linux only, mark packets to servers on client, and to destinations on
+	// server, with DSCP of 0 to 63 or a name like EF, AF41 or CS1
+	DSCP interface{} `json:"dscp"`
+	// TCP keepalive between client and server keeps idle connections alive
+	// in NAT and detects dead peers, interval in seconds between probes and
+	// number of unanswered probes before closing connection
+	KeepAlive      int `json:"keepalive"`
+	KeepAliveCount int `json:"keepalive_count"`
+
+	// write decrypted traffic to these destinations to capture file
+	Capture     []string `json:"capture"`
+	CaptureFile string   `json:"capture_file"`
+
+	Audit     string `json:"audit"` // off, full, domain or hashed
+	AuditFile string `json:"audit_file"`
+
+	// NAT64 prefix in the form of 64:ff9b::/96, or auto to detect with DNS64
+	NAT64 string `json:"nat64"`
+
+	// also serve or connect to a port in this range like 20000-29999, which
+	// changes every port_hop_interval seconds
+	PortHop         string `json:"port_hop"`
+	PortHopInterval int    `json:"port_hop_interval"`
+
+	// SIP003 plugin program and its options, e.g. v2ray-plugin
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+
+	// relay over TLS between client and server. Server uses certificate
+	// tls_cert with key tls_key, or gets certificates of tls_autocert hosts
+	// from Let's Encrypt, cached in tls_autocert_dir. Client verifies server
+	// by name tls_sni, which defaults to server host, or by SHA-256
+	// fingerprint of its certificate.
+	TLS            bool     `json:"tls"`
+	TLSCert        string   `json:"tls_cert"`
+	TLSKey         string   `json:"tls_key"`
+	TLSAutocert    []string `json:"tls_autocert"`
+	TLSAutocertDir string   `json:"tls_autocert_dir"`
+	TLSSNI         string   `json:"tls_sni"`
+	TLSFingerprint string   `json:"tls_fingerprint"`
 
 	// following options are only used by server
-	PortPassword  map[string]string `json:"port_password"`
-	Timeout       int               `json:"timeout"`
-	CacheEncTable bool              `json:"cache_enctable"`
+	BindAddress   string                   `json:"bind_address"`
+	PortPassword  map[string]string        `json:"port_password"`
+	PortMethod    map[string]string        `json:"port_method"` // encryption method of ports not using method
+	Timeout       int                      `json:"timeout"`
+	CacheEncTable bool                     `json:"cache_enctable"`
+	DNSPrefetch   int                      `json:"dns_prefetch"`   // number of popular hosts to keep resolved
+	AgentAddr     string                   `json:"agent_addr"`     // HAProxy agent-check address
+	AgentCapacity int                      `json:"agent_capacity"` // connections considered full load
+	ManagerAddr   string                   `json:"manager_addr"`   // ss-manager API, UDP address or unix socket path
+	ManagerRemote bool                     `json:"manager_remote"` // allow manager_addr on non-loopback address
+	Tenants       map[string]*TenantConfig `json:"tenants"`
+	AcceptShards  int                      `json:"accept_shards"`   // listeners of each port, Linux only
+	AccessLogSize int                      `json:"access_log_size"` // recent audit records kept for export
+	AccessLogKey  string                   `json:"access_log_key"`  // to sign exported records
+	DestGeoIP     string                   `json:"dest_geoip"`      // CIDR and country per line, to annotate destinations
+	DestASN       string                   `json:"dest_asn"`        // CIDR and AS number per line, to annotate destinations
+	UDP           bool                     `json:"udp"`             // relay UDP on the same ports
+	// GeoLite2 Country Locations CSV, if dest_geoip is its Blocks CSV
+	DestGeoIPLocations string `json:"dest_geoip_locations"`
+	// degrade gracefully under connection floods, Linux only except accept_rate
+	ListenBacklog     int  `json:"listen_backlog"`
+	AcceptRate        int  `json:"accept_rate"` // max connections accepted per second per port
+	LogListenOverflow bool `json:"log_listen_overflow"`
+	// share this many Mbit/s of sending to clients fairly per client address
+	FairBandwidth int `json:"fair_bandwidth"`
+	// close connections not sending request within this many seconds or
+	// bytes, 0 for the default
+	HandshakeTimeout  int `json:"handshake_timeout"`
+	HandshakeMaxBytes int `json:"handshake_max_bytes"`
+	// publish server list in this file on admin interface at /server-list,
+	// signed with base64 encoded ed25519 private key
+	ServerListFile    string `json:"server_list_file"`
+	ServerListSignKey string `json:"server_list_sign_key"`
+	// monthly usage reports of ports, written to directory and POSTed to URL
+	// with bearer token, in json or csv format
+	UsageReportDir    string `json:"usage_report_dir"`
+	UsageReportURL    string `json:"usage_report_url"`
+	UsageReportToken  string `json:"usage_report_token"`
+	UsageReportFormat string `json:"usage_report_format"`
+	// monthly traffic quota of ports in MB, warnings are POSTed to webhook,
+	// ports over quota are throttled to this many Mbit/s if set, or blocked
+	PortQuota     map[string]int `json:"port_quota"`
+	QuotaWebhook  string         `json:"quota_webhook"`
+	QuotaThrottle int            `json:"quota_throttle"`
 
 	// following options are only used by client
-	ServerPassword map[string]string `json:"server_password"`
+	ServerPassword      map[string]string   `json:"server_password"`
+	ServerGroup         map[string][]string `json:"server_group"`
+	ServerMaxConn       map[string]int      `json:"server_max_conn"`
+	ServerRegion        map[string]string   `json:"server_region"`
+	ServerAddrs         map[string][]string `json:"server_addrs"`      // addresses to connect to a server in preference order
+	ServerDiscovery     string              `json:"server_discovery"`  // domain to discover servers with SRV and TXT records
+	ServerListURL       string              `json:"server_list_url"`   // sync servers from signed server list
+	ServerListKey       string              `json:"server_list_key"`   // base64 encoded ed25519 public key of the list
+	ServerListToken     string              `json:"server_list_token"` // admin token to fetch the list
+	Region              string              `json:"region"`            // prefer servers in this region, or auto
+	LocalPorts          map[string]string   `json:"local_ports"`
+	LocalHTTPPort       int                 `json:"local_http_port"`  // HTTP proxy port, serving CONNECT and plain HTTP requests
+	LocalRedirPort      int                 `json:"local_redir_port"` // transparent proxy port for iptables REDIRECT or TPROXY, Linux only
+	Listeners           []ListenerConfig    `json:"listeners"`        // more local listeners, may be added by admin API
+	RetryBeforeResponse bool                `json:"retry_before_response"`
+	Negotiate           bool                `json:"negotiate"`          // ask servers for capabilities and adapt to them
+	Balance             string              `json:"balance"`            // round_robin, latency or auto
+	CaptivePortal       bool                `json:"captive_portal"`     // detect and bypass captive portal
+	CaptivePortalURL    string              `json:"captive_portal_url"` // probe URL which returns 204
+	ACL                 string              `json:"acl"`                // rule file deciding to proxy, connect directly or reject destinations
+	ACLGeoIP            string              `json:"acl_geoip"`          // CIDR and country per line for geoip rules
+	DirectRoutes        string              `json:"direct_routes"`      // connect directly to IPs in these CIDRs, e.g. chnroutes
+	DirectCountries     []string            `json:"direct_countries"`   // connect directly to IPs of these countries in acl_geoip
+	PowerSave           bool                `json:"power_save"`         // slow down periodic checks when idle
+	SocksGSSAPI         string              `json:"socks_gssapi"`       // require socks clients to authenticate with this GSSAPI provider, e.g. kerberos
+
+	// named profiles with options overriding those above, profile selects
+	// the one to use
+	Profile  string                     `json:"profile"`
+	Profiles map[string]json.RawMessage `json:"profiles"`
 }
 
-var readTimeout time.Duration
+// ListenerConfig is a local listener of client besides local_port.
+type ListenerConfig struct {
+	Port   int    `json:"port"`
+	Type   string `json:"type"`             // socks, http or tunnel
+	Group  string `json:"group,omitempty"`  // server or server group to use, all servers if empty
+	Target string `json:"target,omitempty"` // destination of tunnel
+}
+
+// TenantConfig groups server ports of a customer when reselling.
+type TenantConfig struct {
+	Ports   []string `json:"ports"`
+	MaxConn int      `json:"max_conn"` // shared by all ports, 0 for no limit
+	LogFile string   `json:"log_file"` // connections to tenant's ports are logged here
+	Token   string   `json:"token"`    // to query tenant status from admin interface
+}
+
+// time.Duration, accessed atomically as it's updated on reload
+var readTimeout int64
 
 func (config *Config) GetServerArray() []string {
 	// Specifying multiple servers in the "server" options is deprecated.
@@ -46,10 +201,6 @@ func (config *Config) GetServerArray() []string {
 	}
 	arr, ok := config.Server.([]interface{})
 	if ok {
-		if len(arr) > 1 {
-			log.Println("Multiple servers in \"server\" option is deprecated. " +
-				"Please use \"server_password\" instead.")
-		}
 		serverArr := make([]string, len(arr), len(arr))
 		for i, s := range arr {
 			serverArr[i], ok = s.(string)
@@ -79,10 +230,114 @@ func ParseConfig(path string) (config *Config, err error) {
 	if err = json.Unmarshal(data, config); err != nil {
 		return nil, err
 	}
-	readTimeout = time.Duration(config.Timeout) * time.Second
+	for _, w := range configWarnings(data) {
+		log.Printf("%s: %s\n", path, w)
+	}
+	SetDefaults(config)
+	if err = CheckGlobals(config); err != nil {
+		return nil, err
+	}
+	if _, err = NewPortHop(config.PortHop, config.PortHopInterval); err != nil {
+		return nil, err
+	}
+	for name := range config.Profiles {
+		if _, err = config.GetProfile(name); err != nil {
+			return nil, err
+		}
+	}
 	return
 }
 
+// CheckGlobals validates options applied by ApplyGlobals. ParseConfig checks
+// them too, but options may be changed afterwards, e.g. by profiles.
+func CheckGlobals(config *Config) error {
+	if config.KeepAlive < 0 || config.KeepAliveCount < 0 {
+		return errors.New("keepalive and keepalive_count should not be negative")
+	}
+	mark, err := ParseDSCP(config.DSCP)
+	if err != nil {
+		return err
+	}
+	if err = checkTCPOptions(config, mark); err != nil {
+		return err
+	}
+	if err = checkAuditMode(config.Audit); err != nil {
+		return err
+	}
+	return checkNAT64(config.NAT64)
+}
+
+// ApplyGlobals applies options kept by this package for all connections,
+// like timeout, buffers, socket options, audit, capture and NAT64. Programs
+// should call it only after the whole config is validated, including
+// CheckGlobals, so that an invalid config being reloaded doesn't change
+// running relays. Connections established keep some of the options, like
+// write coalescing.
+func ApplyGlobals(config *Config) {
+	SetTimeout(config.Timeout)
+	setWriteCoalesce(time.Duration(config.WriteCoalesce) * time.Millisecond)
+	SetBufPoolCount(config.BufferPoolCount)
+	setRelayBuf(config.BufferSize, config.BufferAutoTune)
+	setSocketOptions(socketOptions{
+		bandwidth:      int64(config.Bandwidth) * 1000 * 1000 / 8,
+		sndBuf:         config.SocketSndBuf,
+		rcvBuf:         config.SocketRcvBuf,
+		congestion:     config.TCPCongestion,
+		notSentLowat:   config.TCPNotSentLowat,
+		keepAlive:      time.Duration(config.KeepAlive) * time.Second,
+		keepAliveCount: config.KeepAliveCount,
+	})
+	// validated by CheckGlobals
+	mark, _ := ParseDSCP(config.DSCP)
+	setDSCP(mark)
+	var targets []string
+	for _, t := range config.Capture {
+		targets = append(targets, NormalizeAddr(t))
+	}
+	setCapture(targets, config.CaptureFile)
+	setAudit(config.Audit, config.AuditFile)
+	setNAT64(config.NAT64)
+}
+
+// GetProfile returns the configuration of the named profile. Options given in
+// the profile override those at the top level of the config file, including
+// false and 0. Empty name returns a copy of the config itself.
+func (config *Config) GetProfile(name string) (*Config, error) {
+	if name == "" {
+		c := *config
+		return &c, nil
+	}
+	p, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("shadowsocks: no profile named %s", name)
+	}
+	// merge JSON objects, as zero values can't be told from options not given
+	// after unmarshaling
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var options, override map[string]json.RawMessage
+	if err = json.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(p, &override); err != nil {
+		return nil, fmt.Errorf("shadowsocks: profile %s: %v", name, err)
+	}
+	for k, v := range override {
+		options[k] = v
+	}
+	if data, err = json.Marshal(options); err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("shadowsocks: profile %s: %v", name, err)
+	}
+	c.Profile = name
+	return c, nil
+}
+
 func SetDebug(d DebugLog) {
 	Debug = d
 }
@@ -113,6 +368,19 @@ func UpdateConfig(old, new *Config) {
 			if i != 0 {
 				oldField.SetInt(i)
 			}
+		case reflect.Bool:
+			if newField.Bool() {
+				oldField.SetBool(true)
+			}
+		case reflect.Map, reflect.Slice:
+			if !newField.IsNil() {
+				oldField.Set(newField)
+			}
+		case reflect.Interface:
+			// ignore empty string set from command line
+			if !newField.IsNil() && newField.Elem().Interface() != "" {
+				oldField.Set(newField)
+			}
 		}
 	}
 }
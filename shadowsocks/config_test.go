@@ -1,7 +1,13 @@
 package shadowsocks
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigJson(t *testing.T) {
@@ -13,8 +19,8 @@ func TestConfigJson(t *testing.T) {
 	if config.Password != "barfoo!" {
 		t.Error("wrong password from config")
 	}
-	if config.Timeout != 0 {
-		t.Error("tiemout should default to 0")
+	if config.Timeout != 60 {
+		t.Error("timeout should default to 60")
 	}
 	srvArr := config.GetServerArray()
 	if len(srvArr) != 1 || srvArr[0] != "127.0.0.1" {
@@ -58,10 +64,48 @@ func TestDeprecatedClientMultiServerArray(t *testing.T) {
 		t.Error("server option is not set correctly")
 	}
 	if srvArr[0] != "127.0.0.1" {
-		t.Error("1st server wrong, got %v", srvArr[0])
+		t.Errorf("1st server wrong, got %v", srvArr[0])
 	}
 	if srvArr[1] != "127.0.1.1" {
-		t.Error("2nd server wrong, got %v", srvArr[0])
+		t.Errorf("2nd server wrong, got %v", srvArr[1])
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/deprecated-client-multi-server.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := configWarnings(data); len(w) != 2 {
+		t.Error("should warn about server array and table method, got", w)
+	}
+	migrated, warnings, err := MigrateConfig(data)
+	if err != nil {
+		t.Fatal("error migrating config:", err)
+	}
+	if len(warnings) != 1 {
+		t.Error("only table method should be left to migrate manually, got", warnings)
+	}
+
+	w := configWarnings([]byte(`{"method": "aes-256-gcm", "port_method": {"8389": "table", "8388": "table", "8387": "aes-256-gcm"}}`))
+	if len(w) != 1 || !strings.HasPrefix(w[0], "port_method 8388, 8389: ") || !strings.HasSuffix(w[0], "use aes-256-gcm or chacha20-ietf-poly1305") {
+		t.Error("should warn about ports using table method and name the replacement, got", w)
+	}
+
+	config := &Config{}
+	if err = json.Unmarshal(migrated, config); err != nil {
+		t.Fatal("error parsing migrated config:", err)
+	}
+	if config.Server != nil || config.Password != "" || config.ServerPort != 0 {
+		t.Error("deprecated options should be removed")
+	}
+	if len(config.ServerPassword) != 2 ||
+		config.ServerPassword["127.0.0.1:8388"] != "barfoo!" ||
+		config.ServerPassword["127.0.1.1:8388"] != "barfoo!" {
+		t.Error("wrong migrated server_password:", config.ServerPassword)
+	}
+	if config.LocalPort != 1081 || config.Timeout != 60 {
+		t.Error("other options should be kept")
 	}
 }
 
@@ -89,3 +133,97 @@ func TestParseConfigEmpty(t *testing.T) {
 		t.Error("GetServerArray should return nil if no server option is given")
 	}
 }
+
+func TestProfile(t *testing.T) {
+	config, err := ParseConfig("testdata/profiles.json")
+	if err != nil {
+		t.Fatal("error parsing profiles.json:", err)
+	}
+	if config.Profile != "home" {
+		t.Error("default profile not set correctly")
+	}
+
+	home, err := config.GetProfile("home")
+	if err != nil {
+		t.Fatal("error getting profile home:", err)
+	}
+	srvArr := home.GetServerArray()
+	if len(srvArr) != 1 || srvArr[0] != "127.0.1.1" {
+		t.Error("profile should override server option")
+	}
+	if home.ServerPort != 8388 || home.Password != "barfoo!" {
+		t.Error("profile should inherit top level options")
+	}
+
+	work, err := config.GetProfile("work")
+	if err != nil {
+		t.Fatal("error getting profile work:", err)
+	}
+	if work.LocalPort != 1082 || work.ServerPassword["127.0.0.1:8387"] != "foobar" {
+		t.Error("work profile not applied correctly")
+	}
+	if work.PowerSave || work.KeepAlive != 0 || !home.PowerSave || home.KeepAlive != 30 {
+		t.Error("profile should be able to set options to false and 0")
+	}
+	base, err := config.GetProfile("")
+	if err != nil || base == config {
+		t.Error("empty profile name should return a copy of config")
+	}
+	if config.LocalPort != 1081 || config.ServerPassword != nil {
+		t.Error("getting profile should not modify top level config")
+	}
+
+	if _, err = config.GetProfile("travel"); err == nil {
+		t.Error("should return error for non-existing profile")
+	}
+}
+
+func TestLocalPorts(t *testing.T) {
+	config, err := ParseConfig("testdata/client-port-per-exit.json")
+	if err != nil {
+		t.Fatal("error parsing client-port-per-exit.json:", err)
+	}
+
+	us := config.ServerGroup["us-server"]
+	if len(us) != 2 || us[0] != "127.0.0.1:8388" || us[1] != "127.0.1.1:8388" {
+		t.Error("server_group parse error")
+	}
+	if config.LocalPorts["1081"] != "us-server" || config.LocalPorts["1082"] != "127.0.0.1:8387" {
+		t.Error("local_ports parse error")
+	}
+}
+
+func TestApplyGlobals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.json")
+	data := `{"timeout": 42, "write_coalesce": 5, "buffer_size": 16384, "keepalive": 30, "capture": ["example.com"]}`
+	if err = ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer ApplyGlobals(&Config{})
+
+	config, err := ParseConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// parsing a config that may turn out invalid leaves relays unchanged
+	if timeout() == 42*time.Second || maxRelayBufSize() == 16384 || CaptureEnabled() {
+		t.Fatal("ParseConfig should not apply options")
+	}
+	ApplyGlobals(config)
+	if timeout() != 42*time.Second || maxRelayBufSize() != 16384 || !CaptureEnabled() ||
+		getSocketOptions().keepAlive != 30*time.Second || NewConn(nil, nil).coalesce != 5*time.Millisecond {
+		t.Error("options not applied")
+	}
+
+	if err = CheckGlobals(&Config{KeepAlive: -1}); err == nil {
+		t.Error("negative keepalive should be invalid")
+	}
+	if err = CheckGlobals(&Config{NAT64: "10.0.0.0/8"}); err == nil {
+		t.Error("invalid nat64 prefix should be rejected")
+	}
+}
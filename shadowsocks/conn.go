@@ -1,39 +1,80 @@
 package shadowsocks
 
 import (
-	"errors"
-	"fmt"
+	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Small writes are coalesced for at most this duration if it's not 0. This
+// reduces packet overhead for interactive protocols like ssh. It's a
+// time.Duration accessed atomically, connections keep the value they are
+// created with.
+var writeCoalesce int64
+
+func setWriteCoalesce(d time.Duration) {
+	atomic.StoreInt64(&writeCoalesce, int64(d))
+}
+
+// Buffered writes are flushed immediately once reaching this size.
+const coalesceSize = 1400
+
 type Conn struct {
 	net.Conn
 	*EncryptTable
+
+	// The request header is sent together with the first write to save a
+	// packet. For protocols in which server speaks first, it's sent alone
+	// on the first read.
+	headerPending int32 // accessed atomically, 1 if header is not sent yet
+
+	wmu    sync.Mutex  // protects following fields
+	ebuf   []byte      // reused for encrypting data to write
+	header []byte      // request header not sent yet
+	enc    *aeadStream // AEAD encryption state, nil before first write
+
+	// following fields are used for write coalescing
+	coalesce time.Duration // 0 if disabled
+	wbuf     []byte        // not encrypted until flushed
+	timer    *time.Timer
+	werr     error // error from last flush
+
+	// following fields are used for reading with AEAD methods
+	dec   *aeadStream // nil before salt is read
+	rbuf  []byte      // reused for reading chunks
+	rleft []byte      // decrypted data not read yet
 }
 
 func NewConn(cn net.Conn, encTbl *EncryptTable) *Conn {
-	return &Conn{cn, encTbl}
+	return &Conn{Conn: cn, EncryptTable: encTbl, coalesce: time.Duration(atomic.LoadInt64(&writeCoalesce))}
 }
 
-func rawAddr(addr string) (buf []byte, err error) {
-	arr := strings.Split(addr, ":")
-	if len(arr) != 2 {
-		return nil, errors.New(
-			fmt.Sprintf("shadowsocks: malformed address %s", addr))
+// RawAddr returns the shadowsocks request header of addr, which is in the
+// form of host:port.
+func RawAddr(addr string) (buf []byte, err error) {
+	if err = ValidateAddr(addr); err != nil {
+		return
 	}
-	host, portStr := arr[0], arr[1]
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, errors.New(
-			fmt.Sprintf("shadowsocks: invalid port %s", addr))
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	if ip := net.ParseIP(host); ip != nil {
+		// IP literals are sent as is, so server needn't parse them again
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{addrTypeIPv4}, ip4...)
+		} else {
+			buf = append([]byte{addrTypeIPv6}, ip...)
+		}
+		return append(buf, byte(port>>8), byte(port)), nil
 	}
 
 	hostLen := len(host)
 	l := 1 + 1 + hostLen + 2 // addrType + lenByte + address + port
 	buf = make([]byte, l, l)
-	buf[0] = 3             // 3 means the address is domain name
+	buf[0] = addrTypeDomain
 	buf[1] = byte(hostLen) // host address length  followed by host address
 	copy(buf[2:], host)
 	buf[2+hostLen] = byte(port >> 8 & 0xFF) // the next 2 bytes are port
@@ -45,38 +86,180 @@ func rawAddr(addr string) (buf []byte, err error) {
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
 func DialWithRawAddr(rawaddr []byte, server string, encTbl *EncryptTable) (c *Conn, err error) {
-	conn, err := net.Dial("tcp", server)
+	conn, err := DialMarked(server)
 	if err != nil {
 		return
 	}
-	c = NewConn(conn, encTbl)
-	if _, err = c.Write(rawaddr); err != nil {
-		c.Close()
-		return nil, err
-	}
-	return
+	return NewConnWithRawAddr(conn, rawaddr, encTbl), nil
+}
+
+// NewConnWithRawAddr is like DialWithRawAddr, but uses an already established
+// connection to server.
+func NewConnWithRawAddr(cn net.Conn, rawaddr []byte, encTbl *EncryptTable) *Conn {
+	c := NewConn(cn, encTbl)
+	c.header = append([]byte(nil), rawaddr...)
+	c.headerPending = 1
+	return c
 }
 
 // addr should be in the form of host:port
 func Dial(addr, server string, encTbl *EncryptTable) (c *Conn, err error) {
-	ra, err := rawAddr(addr)
+	ra, err := RawAddr(addr)
 	if err != nil {
 		return
 	}
 	return DialWithRawAddr(ra, server, encTbl)
 }
 
-func (c Conn) Read(b []byte) (n int, err error) {
-	buf := make([]byte, len(b), len(b))
-	n, err = c.Conn.Read(buf)
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.headerPending) != 0 {
+		// server can't reply before knowing the destination
+		c.wmu.Lock()
+		err = c.flushLocked()
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	if c.aead != nil {
+		return c.readAEAD(b)
+	}
+	n, err = c.Conn.Read(b)
 	if n > 0 {
-		encrypt2(c.DecTbl, buf[0:n], b[0:n])
+		// table cipher can decrypt in place
+		encrypt2(c.DecTbl, b[0:n], b[0:n])
+		cryptoStat.decryptBytes.Add(int64(n))
 	}
 	return
 }
 
-func (c Conn) Write(b []byte) (n int, err error) {
-	buf := encrypt(c.EncTbl, b)
-	n, err = c.Conn.Write(buf)
+func (c *Conn) readAEAD(b []byte) (n int, err error) {
+	if len(c.rleft) == 0 {
+		if c.dec == nil {
+			salt := make([]byte, c.aead.saltSize)
+			if _, err = io.ReadFull(c.Conn, salt); err != nil {
+				return
+			}
+			c.dec = c.aead.stream(salt)
+		}
+		if c.rbuf == nil {
+			c.rbuf = GetBuf(maxChunkSize + c.dec.Overhead())
+			cryptoStat.allocBytes.Add(int64(len(c.rbuf)))
+		}
+		if c.rleft, err = c.dec.readChunk(c.Conn, c.rbuf); err != nil {
+			// reading ends, release buffer in the reading goroutine, as
+			// Close may be called while reading
+			PutBuf(c.rbuf)
+			c.rbuf = nil
+			return
+		}
+		cryptoStat.decryptBytes.Add(int64(len(c.rleft)))
+	}
+	n = copy(b, c.rleft)
+	c.rleft = c.rleft[n:]
 	return
 }
+
+// sealLocked encrypts header not sent yet and b into c.ebuf. Caller must hold
+// c.wmu.
+func (c *Conn) sealLocked(b []byte) []byte {
+	size := len(c.header) + len(b)
+	if c.aead != nil {
+		// salt, and length and tags of each chunk
+		chunks := (size + maxChunkSize - 1) / maxChunkSize
+		size += c.aead.saltSize + chunks*(chunkLenSize+2*aeadTagSize)
+	}
+	if cap(c.ebuf) < size {
+		PutBuf(c.ebuf)
+		c.ebuf = GetBuf(size)[:0]
+		cryptoStat.allocBytes.Add(int64(size))
+	}
+	buf := c.ebuf[:0]
+	for _, p := range [][]byte{c.header, b} {
+		if c.aead == nil {
+			buf = buf[:len(buf)+len(p)]
+			encrypt2(c.EncTbl, p, buf[len(buf)-len(p):])
+			continue
+		}
+		if c.enc == nil {
+			salt := c.aead.newSalt()
+			buf = append(buf, salt...)
+			c.enc = c.aead.stream(salt)
+		}
+		buf = c.enc.seal(buf, p)
+	}
+	if c.header != nil {
+		c.header = nil
+		atomic.StoreInt32(&c.headerPending, 0)
+	}
+	return buf
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	cryptoStat.encryptBytes.Add(int64(len(b)))
+	if c.coalesce != 0 {
+		return c.coalesceLocked(b)
+	}
+
+	// header not sent yet is sent with payload in one write
+	if _, err = c.Conn.Write(c.sealLocked(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) coalesceLocked(b []byte) (n int, err error) {
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	if cap(c.wbuf)-len(c.wbuf) < len(b) {
+		cryptoStat.allocBytes.Add(int64(len(c.wbuf) + len(b)))
+	}
+	c.wbuf = append(c.wbuf, b...)
+	if len(c.wbuf) >= coalesceSize {
+		if err = c.flushLocked(); err != nil {
+			return 0, err
+		}
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.coalesce, c.flush)
+	}
+	return len(b), nil
+}
+
+// flushLocked writes out pending header and coalesced data. Caller must hold
+// c.wmu.
+func (c *Conn) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.werr != nil {
+		return c.werr
+	}
+	if c.header != nil || len(c.wbuf) != 0 {
+		_, c.werr = c.Conn.Write(c.sealLocked(c.wbuf))
+		c.wbuf = c.wbuf[:0]
+	}
+	return c.werr
+}
+
+func (c *Conn) flush() {
+	c.wmu.Lock()
+	if err := c.flushLocked(); err != nil {
+		Debug.Println("flush:", err)
+	}
+	c.wmu.Unlock()
+}
+
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	if err := c.flushLocked(); err != nil {
+		Debug.Println("flush:", err)
+	}
+	PutBuf(c.ebuf)
+	c.ebuf = nil
+	c.wmu.Unlock()
+	return c.Conn.Close()
+}
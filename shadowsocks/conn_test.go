@@ -0,0 +1,143 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteCoalesce(t *testing.T) {
+	setWriteCoalesce(50 * time.Millisecond)
+	defer setWriteCoalesce(0)
+
+	tbl := GetTable("foobar!")
+	c1, c2 := net.Pipe()
+	src, dst := NewConn(c1, tbl), NewConn(c2, tbl)
+	defer dst.Close()
+
+	msg := []byte("small writes should be coalesced")
+	go func() {
+		for i := 0; i < len(msg); i += 4 {
+			end := i + 4
+			if end > len(msg) {
+				end = len(msg)
+			}
+			if _, err := src.Write(msg[i:end]); err != nil {
+				t.Error("write:", err)
+				return
+			}
+		}
+		src.Close()
+	}()
+
+	// all the small writes are within coalesce duration, expect to get them
+	// in one read
+	buf := make([]byte, 1024)
+	n, err := dst.Read(buf)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+	if string(buf[:n]) != string(msg) {
+		t.Errorf("got %q, should be %q", buf[:n], msg)
+	}
+	if _, err = dst.Read(buf); err != io.EOF {
+		t.Error("should get EOF after close, got", err)
+	}
+}
+
+func TestDialSendsHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tbl := GetTable("foobar!")
+	rawaddr, _ := RawAddr("example.com:80")
+	payload := []byte("GET / HTTP/1.0\r\n\r\n")
+	// the 1st connection writes immediately, header should be sent along
+	// with the payload; the 2nd one reads first, as in protocols where
+	// server speaks first, header should be sent without waiting
+	for _, data := range [][]byte{payload, nil} {
+		c, err := DialWithRawAddr(rawaddr, ln.Addr().String(), tbl)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		if data != nil {
+			if _, err = c.Write(data); err != nil {
+				t.Fatal("write:", err)
+			}
+		} else {
+			go c.Read(make([]byte, 1))
+		}
+
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatal("accept:", err)
+		}
+		expect := string(rawaddr) + string(data)
+		buf := make([]byte, len(expect))
+		sc.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = io.ReadFull(NewConn(sc, tbl), buf); err != nil {
+			t.Fatal("read:", err)
+		}
+		if string(buf) != expect {
+			t.Errorf("got %q, should be %q", buf, expect)
+		}
+		sc.Close()
+		c.Close()
+	}
+}
+
+func TestAEADConn(t *testing.T) {
+	for _, method := range []string{"aes-256-gcm", "chacha20-ietf-poly1305"} {
+		tbl, _ := NewTable(method, "foobar!")
+		c1, c2 := net.Pipe()
+		rawaddr, _ := RawAddr("example.com:80")
+		src, dst := NewConnWithRawAddr(c1, rawaddr, tbl), NewConn(c2, tbl)
+
+		// larger than a chunk
+		data := make([]byte, 3*maxChunkSize+100)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		go func() {
+			src.Write(data)
+			src.Close()
+		}()
+		got, err := io.ReadAll(dst)
+		if err != nil {
+			t.Fatalf("%s: read: %v", method, err)
+		}
+		if string(got) != string(rawaddr)+string(data) {
+			t.Errorf("%s: got %d bytes, wrong data", method, len(got))
+		}
+		dst.Close()
+
+		// tampered stream should fail
+		c1, c2 = net.Pipe()
+		src, dst = NewConn(c1, tbl), NewConn(&tamperConn{c2}, tbl)
+		go func() {
+			src.Write([]byte("hello"))
+			src.Close()
+		}()
+		if _, err = io.ReadAll(dst); err == nil {
+			t.Errorf("%s: tampered data should fail", method)
+		}
+		dst.Close()
+	}
+}
+
+// tamperConn flips a bit of the last byte read.
+type tamperConn struct {
+	net.Conn
+}
+
+func (c *tamperConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		b[n-1] ^= 1
+	}
+	return n, err
+}
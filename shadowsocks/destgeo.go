@@ -0,0 +1,242 @@
+package shadowsocks
+
+import (
+	"encoding/csv"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Destinations are annotated with country and autonomous system looked up in
+// local databases, so operators can analyze where traffic goes without
+// querying external services. Both databases are in the GeoIP format of
+// lines of CIDR and value: country code for the country database, and AS
+// number for the ASN database, e.g. GeoLite2 ASN CSV as is. GeoLite2 Country
+// CSV can be used as is with its Locations file, which maps the geoname IDs
+// of the Blocks file to country codes. Connections and
+// bytes are exported by the admin interface at /debug/vars as dest_geo, e.g.
+// dest_geo.country.US and dest_geo.asn.AS15169 are {"conns": 3, "bytes":
+// 5120}. Destinations not found are counted as "unknown", and ASes beyond
+// maxGeoASNs as "others".
+
+const (
+	maxGeoASNs     = 1024
+	unknownDestGeo = "unknown"
+)
+
+var destGeo struct {
+	sync.Mutex
+	country, asn *GeoIP
+	stats        map[string]*expvar.Map // country and asn
+	nasns        int
+}
+
+func init() {
+	m := expvar.NewMap("dest_geo")
+	destGeo.stats = map[string]*expvar.Map{}
+	for _, kind := range []string{"country", "asn"} {
+		s := new(expvar.Map).Init()
+		m.Set(kind, s)
+		destGeo.stats[kind] = s
+	}
+}
+
+// LoadDestGeo loads the country and ASN databases of destinations, either
+// may be empty. With locationsPath, the country database is GeoLite2 Country
+// Blocks CSV. Counters are kept across reloading.
+func LoadDestGeo(countryPath, locationsPath, asnPath string) (err error) {
+	var country, asn *GeoIP
+	if countryPath != "" {
+		if country, err = loadCountries(countryPath, locationsPath); err != nil {
+			return
+		}
+	}
+	if asnPath != "" {
+		if asn, err = LoadGeoIP(asnPath); err != nil {
+			return
+		}
+	}
+	destGeo.Lock()
+	destGeo.country, destGeo.asn = country, asn
+	destGeo.Unlock()
+	return nil
+}
+
+// loadCountries loads country database at path, mapping geoname IDs to
+// country codes by the GeoLite2 Locations CSV at locations if not empty.
+func loadCountries(path, locations string) (*GeoIP, error) {
+	g, err := LoadGeoIP(path)
+	if err != nil {
+		return nil, err
+	}
+	var names map[string]string
+	if locations != "" {
+		if names, err = loadGeoNames(locations); err != nil {
+			return nil, err
+		}
+	}
+	for i := range g.ranges {
+		r := &g.ranges[i]
+		if names != nil {
+			// continents of blocks without country map to empty
+			r.country = names[r.country]
+		}
+		if r.country != "" && !isCountryCode(r.country) {
+			return nil, fmt.Errorf("%s: %s is not a country code, set dest_geoip_locations for GeoLite2 Country CSV", path, r.country)
+		}
+	}
+	return g, nil
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+// loadGeoNames reads geoname IDs and their country codes from GeoLite2
+// Country Locations CSV.
+func loadGeoNames(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	id, code := -1, -1
+	for i, h := range header {
+		switch h {
+		case "geoname_id":
+			id = i
+		case "country_iso_code":
+			code = i
+		}
+	}
+	if id < 0 || code < 0 {
+		return nil, fmt.Errorf("%s: no geoname_id or country_iso_code column", path)
+	}
+	names := map[string]string{}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if id < len(rec) && code < len(rec) {
+			names[rec[id]] = rec[code]
+		}
+	}
+}
+
+// DestGeo returns country code and AS of ip, like US and AS15169. They are
+// empty if the database is not loaded, or unknown if ip is not found.
+func DestGeo(ip net.IP) (country, asn string) {
+	destGeo.Lock()
+	cdb, adb := destGeo.country, destGeo.asn
+	destGeo.Unlock()
+	if cdb != nil {
+		country = unknownDestGeo
+		if ip != nil {
+			if c := cdb.Country(ip); c != "" {
+				country = c
+			}
+		}
+	}
+	if adb != nil {
+		asn = unknownDestGeo
+		if ip != nil {
+			if a := adb.Country(ip); a != "" {
+				asn = "AS" + a
+			}
+		}
+	}
+	return
+}
+
+// GeoTraffic counts traffic to the country and AS of a destination.
+type GeoTraffic struct {
+	country, asn *TrafficClass
+}
+
+// AddBytes counts bytes relayed, g may be nil.
+func (g *GeoTraffic) AddBytes(n int) {
+	if g == nil {
+		return
+	}
+	if g.country != nil {
+		g.country.AddBytes(n)
+	}
+	if g.asn != nil {
+		g.asn.AddBytes(n)
+	}
+}
+
+// CountDestGeo counts a new connection or UDP flow to country and asn
+// returned by DestGeo, and returns counters of its bytes. It returns nil if
+// no database is loaded.
+func CountDestGeo(country, asn string) *GeoTraffic {
+	if country == "" && asn == "" {
+		return nil
+	}
+	destGeo.Lock()
+	defer destGeo.Unlock()
+	g := &GeoTraffic{}
+	if country != "" {
+		g.country = destGeoClass("country", country)
+	}
+	if asn != "" {
+		if destGeo.stats["asn"].Get(asn) == nil {
+			if destGeo.nasns >= maxGeoASNs {
+				asn = "others"
+			} else {
+				destGeo.nasns++
+			}
+		}
+		g.asn = destGeoClass("asn", asn)
+	}
+	return g
+}
+
+// destGeoClass is called with destGeo locked.
+func destGeoClass(kind, key string) *TrafficClass {
+	s := destGeo.stats[kind]
+	c, _ := s.Get(key).(*TrafficClass)
+	if c == nil {
+		c = &TrafficClass{}
+		s.Set(key, c)
+	}
+	c.conns.Add(1)
+	return c
+}
+
+// GeoConn wraps connection to destination, counting its bytes to g.
+func GeoConn(remote net.Conn, g *GeoTraffic) net.Conn {
+	if g == nil {
+		return remote
+	}
+	return &geoConn{remote, g}
+}
+
+type geoConn struct {
+	net.Conn
+	g *GeoTraffic
+}
+
+func (c *geoConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.g.AddBytes(n)
+	return
+}
+
+func (c *geoConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.g.AddBytes(n)
+	return
+}
@@ -0,0 +1,119 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDestGeo(t *testing.T) {
+	// counters are global, reset them for -count
+	destGeo.Lock()
+	for _, stats := range destGeo.stats {
+		stats.Init()
+	}
+	destGeo.nasns = 0
+	destGeo.Unlock()
+
+	dir, err := ioutil.TempDir("", "destgeo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	countryPath := filepath.Join(dir, "country.txt")
+	asnPath := filepath.Join(dir, "asn.csv")
+	ioutil.WriteFile(countryPath, []byte("1.0.0.0/24 au\n2001:db8::/32 jp\n"), 0600)
+	// GeoLite2 ASN CSV
+	ioutil.WriteFile(asnPath, []byte("network,autonomous_system_number,autonomous_system_organization\n"+
+		"1.0.0.0/24,13335,CLOUDFLARENET\n8.8.8.0/24,15169,\"Google, LLC\"\n"), 0600)
+
+	if country, asn := DestGeo(net.ParseIP("1.0.0.1")); country != "" || asn != "" {
+		t.Errorf("got %s %s without databases", country, asn)
+	}
+	if err = LoadDestGeo(countryPath, "", asnPath); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadDestGeo("", "", "")
+	for _, c := range []struct{ ip, country, asn string }{
+		{"1.0.0.1", "AU", "AS13335"},
+		{"8.8.8.8", "unknown", "AS15169"},
+		{"2001:db8::1", "JP", "unknown"},
+		{"", "unknown", "unknown"}, // dialing failed
+	} {
+		country, asn := DestGeo(net.ParseIP(c.ip))
+		if country != c.country || asn != c.asn {
+			t.Errorf("%s: got %s %s, should be %s %s", c.ip, country, asn, c.country, c.asn)
+		}
+	}
+
+	if LoadDestGeo(filepath.Join(dir, "missing"), "", "") == nil {
+		t.Error("loading missing database should fail")
+	}
+	if country, _ := DestGeo(net.ParseIP("1.0.0.1")); country != "AU" {
+		t.Error("databases should be kept if loading fails")
+	}
+
+	g := CountDestGeo(DestGeo(net.ParseIP("1.0.0.1")))
+	client, server := net.Pipe()
+	defer server.Close()
+	remote := GeoConn(client, g)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := server.Read(buf)
+		server.Write(buf[:n])
+	}()
+	remote.Write([]byte("hello"))
+	remote.Read(make([]byte, 64))
+	remote.Close()
+	if g.country.bytes.Value() != 10 || g.asn.bytes.Value() != 10 {
+		t.Errorf("got %d and %d bytes, should be 10", g.country.bytes.Value(), g.asn.bytes.Value())
+	}
+	if s := destGeo.stats["asn"].Get("AS13335"); s == nil {
+		t.Error("AS13335 not exported")
+	}
+	if CountDestGeo("", "") != nil || GeoConn(client, nil) != client {
+		t.Error("nothing should be counted without databases")
+	}
+}
+
+func TestDestGeoLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destgeo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// GeoLite2 Country CSV
+	blocks := filepath.Join(dir, "GeoLite2-Country-Blocks-IPv4.csv")
+	locations := filepath.Join(dir, "GeoLite2-Country-Locations-en.csv")
+	ioutil.WriteFile(blocks, []byte("network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider\n"+
+		"1.0.0.0/24,2077456,2077456,,0,0\n"+
+		"2.16.0.0/13,,6255148,,0,0\n"+
+		"5.61.0.0/24,6255148,6255148,,0,0\n"), 0600)
+	ioutil.WriteFile(locations, []byte("geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union\n"+
+		"2077456,en,OC,Oceania,AU,Australia,0\n"+
+		"6255148,en,EU,Europe,,,0\n"+
+		"1861060,en,AS,Asia,JP,Japan,0\n"), 0600)
+
+	if err = LoadDestGeo(blocks, "", ""); err == nil {
+		t.Error("geoname IDs should be rejected as country codes")
+	}
+	if err = LoadDestGeo(blocks, locations, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadDestGeo("", "", "")
+	for _, c := range []struct{ ip, country string }{
+		{"1.0.0.1", "AU"},
+		{"2.16.0.1", "unknown"}, // only continent
+		{"5.61.0.1", "unknown"},
+		{"8.8.8.8", "unknown"},
+	} {
+		if country, _ := DestGeo(net.ParseIP(c.ip)); country != c.country {
+			t.Errorf("%s: got %s, should be %s", c.ip, country, c.country)
+		}
+	}
+	if LoadDestGeo(blocks, blocks, "") == nil {
+		t.Error("blocks file should be rejected as locations")
+	}
+}
@@ -0,0 +1,154 @@
+package shadowsocks
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DNSCache caches resolved addresses of destinations and keeps the most
+// frequently requested ones fresh by resolving them again in background
+// before they expire, so that popular sites don't wait for DNS lookup.
+//
+// Go's resolver doesn't expose record TTL, so entries expire after a fixed
+// duration.
+type DNSCache struct {
+	sync.Mutex
+	entries  map[string]*dnsEntry
+	ttl      time.Duration
+	prefetch int // number of popular hosts to keep fresh
+	lookup   func(host string) ([]string, error)
+}
+
+type dnsEntry struct {
+	ip     string
+	expire time.Time
+	hits   int // decays each prefetch round, so recent requests weigh more
+}
+
+// Limit memory used by the cache.
+const maxDNSCacheEntries = 4096
+
+func NewDNSCache(prefetch int, ttl time.Duration) *DNSCache {
+	return &DNSCache{
+		entries:  map[string]*dnsEntry{},
+		ttl:      ttl,
+		prefetch: prefetch,
+		lookup:   net.LookupHost,
+	}
+}
+
+// Resolve returns an IP address of host, from cache if possible.
+func (c *DNSCache) Resolve(host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	c.Lock()
+	e, ok := c.entries[host]
+	if ok {
+		e.hits++
+		if time.Now().Before(e.expire) {
+			c.Unlock()
+			return e.ip, nil
+		}
+	}
+	c.Unlock()
+
+	ips, err := c.lookup(host)
+	if err != nil {
+		return "", err
+	}
+	ip := pickIP(ips)
+	c.Lock()
+	if e, ok = c.entries[host]; ok {
+		e.ip = ip
+		e.expire = time.Now().Add(c.ttl)
+	} else if len(c.entries) < maxDNSCacheEntries {
+		c.entries[host] = &dnsEntry{ip, time.Now().Add(c.ttl), 1}
+	}
+	c.Unlock()
+	return ip, nil
+}
+
+// Dial connects to addr in the form of host:port, resolving host with cache.
+// If connecting to cached address fails, it resolves again in case the cached
+// one is stale. As destination of server, it's marked with dscp.
+func (c *DNSCache) Dial(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := c.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := DialMarked(JoinHostPort(ip, port))
+	if err != nil && ip != host {
+		c.Lock()
+		delete(c.entries, host)
+		c.Unlock()
+		return DialMarked(addr)
+	}
+	return conn, err
+}
+
+// popular returns the most requested hosts which will expire before the next
+// prefetch round, and evicts entries neither fresh nor popular.
+func (c *DNSCache) popular(before time.Time) []string {
+	c.Lock()
+	defer c.Unlock()
+	type hostHits struct {
+		host string
+		hits int
+	}
+	all := make([]hostHits, 0, len(c.entries))
+	now := time.Now()
+	for host, e := range c.entries {
+		if e.hits == 0 && now.After(e.expire) {
+			delete(c.entries, host)
+			continue
+		}
+		all = append(all, hostHits{host, e.hits})
+		e.hits /= 2
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].hits > all[j].hits })
+	var hosts []string
+	for i := 0; i < len(all) && i < c.prefetch; i++ {
+		if all[i].hits > 0 && c.entries[all[i].host].expire.Before(before) {
+			hosts = append(hosts, all[i].host)
+		}
+	}
+	return hosts
+}
+
+// refresh resolves host again without counting it as a request.
+func (c *DNSCache) refresh(host string) {
+	ips, err := c.lookup(host)
+	if err != nil {
+		Debug.Println("dns prefetch:", err)
+		return
+	}
+	c.Lock()
+	if e, ok := c.entries[host]; ok {
+		e.ip = pickIP(ips)
+		e.expire = time.Now().Add(c.ttl)
+	}
+	c.Unlock()
+}
+
+// RunPrefetch periodically refreshes popular hosts before they expire. It
+// never returns.
+func (c *DNSCache) RunPrefetch() {
+	interval := c.ttl / 2
+	for {
+		time.Sleep(interval)
+		hosts := c.popular(time.Now().Add(interval))
+		if len(hosts) != 0 {
+			Debug.Println("dns prefetch", hosts)
+		}
+		for _, host := range hosts {
+			c.refresh(host)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	lookups := map[string]int{}
+	c := NewDNSCache(1, time.Minute)
+	c.lookup = func(host string) ([]string, error) {
+		lookups[host]++
+		return []string{"192.0.2.1"}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		ip, err := c.Resolve("popular.example.com")
+		if err != nil || ip != "192.0.2.1" {
+			t.Fatal("resolve error:", ip, err)
+		}
+	}
+	c.Resolve("rare.example.com")
+	if lookups["popular.example.com"] != 1 {
+		t.Error("cached host should be looked up only once, got", lookups["popular.example.com"])
+	}
+	if ip, _ := c.Resolve("127.0.0.1"); ip != "127.0.0.1" || lookups["127.0.0.1"] != 0 {
+		t.Error("IP address should not be looked up")
+	}
+
+	// only the most popular host should be prefetched
+	hosts := c.popular(time.Now().Add(2 * time.Minute))
+	if len(hosts) != 1 || hosts[0] != "popular.example.com" {
+		t.Error("wrong hosts to prefetch:", hosts)
+	}
+	// hosts not expiring soon are not prefetched
+	if hosts = c.popular(time.Now()); len(hosts) != 0 {
+		t.Error("fresh hosts should not be prefetched:", hosts)
+	}
+}
@@ -0,0 +1,87 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Tunnel packets can be marked with DSCP, so that QoS of home routers and
+// enterprise networks can prioritize or deprioritize proxy traffic. Client
+// marks connections and UDP packets to servers, and server marks those to
+// destinations. Connections are marked before connecting, so the SYN is
+// marked too. Only supported on Linux.
+
+// -1 if not marked, accessed atomically as it's updated on reload
+var dscp int32 = -1
+
+func setDSCP(n int) {
+	atomic.StoreInt32(&dscp, int32(n))
+}
+
+var dscpNames = map[string]int{
+	"LE": 1, // lower effort, RFC 8622
+	"EF": 46,
+	"VA": 44,
+}
+
+func init() {
+	for i := 0; i < 8; i++ {
+		dscpNames["CS"+strconv.Itoa(i)] = i * 8
+	}
+	for class := 1; class <= 4; class++ {
+		for drop := 1; drop <= 3; drop++ {
+			dscpNames[fmt.Sprintf("AF%d%d", class, drop)] = class*8 + drop*2
+		}
+	}
+}
+
+// ParseDSCP parses DSCP in config, a number between 0 and 63, or a name like
+// EF, AF41 or CS1. It returns -1 if v is nil.
+func ParseDSCP(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case nil:
+		return -1, nil
+	case float64:
+		if v == float64(int(v)) && v >= 0 && v <= 63 {
+			return int(v), nil
+		}
+	case string:
+		if n, ok := dscpNames[strings.ToUpper(v)]; ok {
+			return n, nil
+		}
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n <= 63 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("dscp should be between 0 and 63, or a name like EF, not %v", v)
+}
+
+// markControl is used as Control of dialers to mark connections.
+func markControl(network, address string, c syscall.RawConn) error {
+	if d := atomic.LoadInt32(&dscp); d >= 0 {
+		c.Control(func(fd uintptr) {
+			setTOS(fd, int(d)<<2)
+		})
+	}
+	return nil
+}
+
+// MarkConn marks packets sent by c, e.g. UDP sockets, with dscp.
+func MarkConn(c interface{}) {
+	sc, ok := c.(syscall.Conn)
+	if !ok || atomic.LoadInt32(&dscp) < 0 {
+		return
+	}
+	if rc, err := sc.SyscallConn(); err == nil {
+		markControl("", "", rc)
+	}
+}
+
+// DialMarked is like DialTCP, but marks the connection with dscp.
+func DialMarked(addr string) (net.Conn, error) {
+	return dialTCP(addr, true)
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package shadowsocks
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tos reads back IP_TOS of c.
+func tos(t *testing.T, c syscall.Conn) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMarkConn(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	defer setDSCP(-1)
+
+	for _, c := range []struct {
+		dscp, tos int
+	}{
+		{-1, 0},
+		{46, 184}, // EF
+		{8, 32},   // CS1
+	} {
+		setDSCP(c.dscp)
+		conn, err := DialMarked(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := tos(t, conn.(*net.TCPConn)); v != c.tos {
+			t.Errorf("dscp %d: TCP got TOS %d, should be %d", c.dscp, v, c.tos)
+		}
+		conn.Close()
+
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		MarkConn(pc)
+		if v := tos(t, pc.(*net.UDPConn)); v != c.tos {
+			t.Errorf("dscp %d: UDP got TOS %d, should be %d", c.dscp, v, c.tos)
+		}
+		pc.Close()
+	}
+
+	// not marked by DialTCP, used for destinations of client
+	setDSCP(46)
+	conn, err := DialTCP(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := tos(t, conn.(*net.TCPConn)); v != 0 {
+		t.Errorf("DialTCP got TOS %d, should not be marked", v)
+	}
+}
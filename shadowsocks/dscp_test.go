@@ -0,0 +1,37 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDSCP(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		dscp   int
+	}{
+		{`{}`, -1},
+		{`{"dscp": 46}`, 46},
+		{`{"dscp": "ef"}`, 46},
+		{`{"dscp": "AF41"}`, 34},
+		{`{"dscp": "CS1"}`, 8},
+		{`{"dscp": "LE"}`, 1},
+		{`{"dscp": "10"}`, 10},
+		{`{"dscp": 0}`, 0},
+	} {
+		var config Config
+		if err := json.Unmarshal([]byte(c.config), &config); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := ParseDSCP(config.DSCP); err != nil || n != c.dscp {
+			t.Errorf("%s: got %d %v, should be %d", c.config, n, err, c.dscp)
+		}
+	}
+	for _, bad := range []string{`{"dscp": 64}`, `{"dscp": -1}`, `{"dscp": 4.5}`, `{"dscp": "AF44"}`, `{"dscp": true}`} {
+		var config Config
+		json.Unmarshal([]byte(bad), &config)
+		if _, err := ParseDSCP(config.DSCP); err == nil {
+			t.Errorf("%s should be invalid", bad)
+		}
+	}
+}
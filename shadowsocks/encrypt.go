@@ -4,19 +4,24 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 )
 
+// EncryptTable is the cipher of a password. Tables are nil for AEAD methods.
 type EncryptTable struct {
 	EncTbl []byte
 	DecTbl []byte
+	aead   *aeadCipher
 }
 
 func GetTable(key string) (tbl *EncryptTable) {
 	const tbl_size = 256
 	tbl = &EncryptTable{
-		make([]byte, tbl_size, tbl_size),
-		make([]byte, tbl_size, tbl_size),
+		EncTbl: make([]byte, tbl_size, tbl_size),
+		DecTbl: make([]byte, tbl_size, tbl_size),
 	}
 	table := make([]uint64, tbl_size, tbl_size)
 
@@ -46,6 +51,135 @@ func GetTable(key string) (tbl *EncryptTable) {
 	return
 }
 
+// "plain" method doesn't encrypt at all. It makes traffic inspectable for
+// end-to-end tests and plugin development, and must only be used over
+// loopback.
+func plainTable(key string) *EncryptTable {
+	tbl := &EncryptTable{EncTbl: make([]byte, 256), DecTbl: make([]byte, 256)}
+	for i := 0; i < 256; i++ {
+		tbl.EncTbl[i] = byte(i)
+		tbl.DecTbl[i] = byte(i)
+	}
+	return tbl
+}
+
+var methods = map[string]func(key string) *EncryptTable{
+	"table": GetTable,
+	"plain": plainTable,
+}
+
+func CheckMethod(method string) error {
+	if method == "" {
+		return nil
+	}
+	if _, ok := methods[method]; !ok {
+		return fmt.Errorf("shadowsocks: unsupported encryption method %s", method)
+	}
+	return nil
+}
+
+// NewTable creates encryption table for method, empty method means table.
+func NewTable(method, key string) (*EncryptTable, error) {
+	if method == "" {
+		method = "table"
+	}
+	newTbl, ok := methods[method]
+	if !ok {
+		return nil, fmt.Errorf("shadowsocks: unsupported encryption method %s", method)
+	}
+	return newTbl(key), nil
+}
+
+// Known answers of encryption methods, checked at startup to fail fast if
+// the implementation gives wrong results on the platform.
+var knownAnswers = map[string]struct {
+	key            string
+	plain, encrypt []byte
+}{
+	"table": {"foobar!", []byte("shadowsocks"),
+		[]byte{0xfb, 0xc7, 0xa7, 0x75, 0x52, 0x05, 0xfb, 0x52, 0x02, 0x20, 0xfb}},
+	"plain": {"foobar!", []byte("shadowsocks"), []byte("shadowsocks")},
+	// chunks of AEAD methods, with salt knownAnswerSalt
+	"aes-256-gcm": {"foobar!", []byte("shadowsocks"),
+		[]byte{
+			0x9e, 0x4e, 0xa9, 0x33, 0xba, 0x6e, 0x8c, 0xfa, 0x78, 0x52, 0xf5, 0x21,
+			0xb2, 0x85, 0x8b, 0x80, 0xce, 0x76, 0xf1, 0x67, 0x29, 0xff, 0x49, 0xc0,
+			0x5d, 0x32, 0xb4, 0x9d, 0x7e, 0x59, 0x7d, 0xa1, 0xea, 0x30, 0x1c, 0xf7,
+			0xb6, 0x5d, 0x22, 0x70, 0x14, 0x5c, 0x12, 0x0c, 0x0c,
+		}},
+	"chacha20-ietf-poly1305": {"foobar!", []byte("shadowsocks"),
+		[]byte{
+			0x59, 0xc4, 0x38, 0x10, 0xe0, 0x44, 0x0b, 0xe4, 0xbf, 0xf7, 0x55, 0x6b,
+			0x9a, 0x55, 0x34, 0xc0, 0x2a, 0xbc, 0xbd, 0xcf, 0x10, 0xbb, 0x49, 0x2f,
+			0x52, 0xce, 0x99, 0xf4, 0x3b, 0xc1, 0xa4, 0xfa, 0x35, 0x22, 0x7c, 0x6e,
+			0xda, 0x73, 0x8d, 0x56, 0xab, 0x0e, 0x6b, 0x95, 0x52,
+		}},
+}
+
+var knownAnswerSalt = []byte{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+}
+
+// SelfTest checks method with known answer, empty method means table.
+func SelfTest(method string) error {
+	if method == "" {
+		method = "table"
+	}
+	return knownAnswerTest(method, methods[method])
+}
+
+func knownAnswerTest(method string, newTbl func(key string) *EncryptTable) error {
+	ka, ok := knownAnswers[method]
+	if !ok || newTbl == nil {
+		return fmt.Errorf("shadowsocks: no known answer for encryption method %s", method)
+	}
+	tbl := newTbl(ka.key)
+	var buf, plain []byte
+	if tbl.aead != nil {
+		buf = tbl.aead.stream(knownAnswerSalt).seal(nil, ka.plain)
+	} else {
+		buf = encrypt(tbl.EncTbl, ka.plain)
+	}
+	if !bytes.Equal(buf, ka.encrypt) {
+		return fmt.Errorf("shadowsocks: %s method gives wrong encryption result on this platform", method)
+	}
+	if tbl.aead != nil {
+		plain, _ = tbl.aead.stream(knownAnswerSalt).readChunk(bytes.NewReader(buf), nil)
+	} else {
+		plain = encrypt(tbl.DecTbl, buf)
+	}
+	if !bytes.Equal(plain, ka.plain) {
+		return fmt.Errorf("shadowsocks: %s method gives wrong decryption result on this platform", method)
+	}
+	return nil
+}
+
+var errPlainMethod = errors.New("shadowsocks: plain method can only be used on loopback address")
+
+// CheckPlainMethod returns error if method is plain but addr, with or
+// without port, is not a loopback address.
+func CheckPlainMethod(method, addr string) error {
+	if method != "plain" || isLoopbackAddr(addr) {
+		return nil
+	}
+	return errPlainMethod
+}
+
+// isLoopbackAddr tells whether addr, with or without port, is a loopback
+// address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := SplitHostPortDefault(addr, "")
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func encrypt2(table []byte, buf, result []byte) {
 	for i := 0; i < len(buf); i++ {
 		result[i] = table[buf[i]]
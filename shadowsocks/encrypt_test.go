@@ -30,3 +30,49 @@ func TestEncrypt2(t *testing.T) {
 	tbl := GetTable("barfoo!")
 	checkTable(t, tbl, enc, dec, "Error for password barfoo!")
 }
+
+func TestSelfTest(t *testing.T) {
+	for method := range methods {
+		if err := SelfTest(method); err != nil {
+			t.Error(err)
+		}
+	}
+	broken := func(key string) *EncryptTable {
+		tbl := GetTable(key)
+		tbl.EncTbl['s'], tbl.EncTbl['h'] = tbl.EncTbl['h'], tbl.EncTbl['s']
+		return tbl
+	}
+	if err := knownAnswerTest("table", broken); err == nil {
+		t.Error("wrong table should fail")
+	}
+}
+
+func TestPlainMethod(t *testing.T) {
+	tbl, err := NewTable("plain", "foobar!")
+	if err != nil {
+		t.Fatal("error creating plain table:", err)
+	}
+	msg := []byte("inspectable")
+	if string(encrypt(tbl.EncTbl, msg)) != string(msg) {
+		t.Error("plain method should not change data")
+	}
+	if _, err = NewTable("no-such-method", "foobar!"); err == nil {
+		t.Error("should return error for unsupported method")
+	}
+}
+
+func TestCheckPlainMethod(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:8388", "[::1]:8388", "localhost:8388"} {
+		if err := CheckPlainMethod("plain", addr); err != nil {
+			t.Errorf("plain method should be allowed on %s", addr)
+		}
+	}
+	for _, addr := range []string{"", "0.0.0.0", "192.168.1.1:8388", "example.com:8388"} {
+		if err := CheckPlainMethod("plain", addr); err == nil {
+			t.Errorf("plain method should be refused on %s", addr)
+		}
+	}
+	if err := CheckPlainMethod("table", "192.168.1.1"); err != nil {
+		t.Error("table method should be allowed on any address")
+	}
+}
@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// Exit codes tell supervisors and installers the cause of startup failure.
+// Usage error of command line flags exits with 2, same as config error.
+const (
+	ExitFailure = 1 // errors not categorized
+	ExitConfig  = 2
+	ExitBind    = 3 // can't listen on port
+	ExitCrypto  = 4 // unsupported or disallowed encryption method
+	ExitUpdate  = 5
+)
+
+var exitCategory = map[int]string{
+	ExitFailure: "failure",
+	ExitConfig:  "config",
+	ExitBind:    "bind",
+	ExitCrypto:  "crypto",
+	ExitUpdate:  "update",
+}
+
+// StartupError carries the exit code to use if the program fails with it.
+type StartupError struct {
+	Code int
+	Err  error
+}
+
+func (e *StartupError) Error() string {
+	return e.Err.Error()
+}
+
+// NewStartupError categorizes err with code, unless it's already a
+// StartupError.
+func NewStartupError(code int, err error) error {
+	if _, ok := err.(*StartupError); ok {
+		return err
+	}
+	return &StartupError{code, err}
+}
+
+var jsonErrors bool
+
+// SetJSONErrors makes Fatal print error as a JSON object to stderr.
+func SetJSONErrors(b bool) {
+	jsonErrors = b
+}
+
+// Fatal prints err and exits with the code of StartupError, or ExitFailure
+// for other errors.
+func Fatal(err error) {
+	code := ExitFailure
+	if se, ok := err.(*StartupError); ok {
+		code = se.Code
+	}
+	if jsonErrors {
+		json.NewEncoder(os.Stderr).Encode(struct {
+			Code     int    `json:"code"`
+			Category string `json:"category"`
+			Error    string `json:"error"`
+		}{code, exitCategory[code], err.Error()})
+	} else {
+		log.Println(err)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,220 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// GSSAPI authentication of socks5 (rfc1961) lets enterprise networks require
+// Kerberos or other GSSAPI mechanisms from applications using the client.
+// Security contexts are accepted by providers registered by name, so that
+// mechanisms needing system libraries are only built when asked to. After
+// authentication, data is encapsulated in GSSAPI messages with integrity or
+// confidentiality protection chosen by the application.
+
+const (
+	socksMethodGSSAPI = 1
+	socksNoMethod     = 0xff
+
+	gssapiVer          = 1
+	gssapiMsgAuth      = 1
+	gssapiMsgProtect   = 2
+	gssapiMsgEncap     = 3
+	gssapiMsgAbort     = 0xff
+	gssapiMaxToken     = 0xffff
+	gssapiMaxPlain     = 32 * 1024 // payload wrapped in a message
+	gssapiIntegrity    = 1
+	gssapiConfidential = 2
+)
+
+// GSSAPIContext is a security context being accepted from one socks client.
+// Once established, Wrap and Unwrap are called from different goroutines,
+// and Close may be called while they run.
+type GSSAPIContext interface {
+	// Accept takes a token from client and returns the token to send back,
+	// which may be empty, and whether the context is established.
+	Accept(token []byte) (out []byte, established bool, err error)
+	// Wrap protects message with integrity, and confidentiality if conf.
+	Wrap(msg []byte, conf bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+	// Peer returns the name of the authenticated client.
+	Peer() string
+	Close() error
+}
+
+// GSSAPIProvider creates security contexts of a mechanism.
+type GSSAPIProvider interface {
+	NewContext() (GSSAPIContext, error)
+}
+
+var gssapiProviders struct {
+	sync.Mutex
+	m map[string]GSSAPIProvider
+}
+
+// RegisterGSSAPIProvider makes provider available by name.
+func RegisterGSSAPIProvider(name string, p GSSAPIProvider) {
+	gssapiProviders.Lock()
+	defer gssapiProviders.Unlock()
+	if gssapiProviders.m == nil {
+		gssapiProviders.m = map[string]GSSAPIProvider{}
+	}
+	gssapiProviders.m[name] = p
+}
+
+// GetGSSAPIProvider returns the provider registered by name.
+func GetGSSAPIProvider(name string) (GSSAPIProvider, error) {
+	gssapiProviders.Lock()
+	defer gssapiProviders.Unlock()
+	if p, ok := gssapiProviders.m[name]; ok {
+		return p, nil
+	}
+	var names []string
+	for n := range gssapiProviders.m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("GSSAPI provider %s is not available, available: %v; kerberos needs building with -tags gssapi", name, names)
+}
+
+var errGSSAPIMsg = errors.New("socks GSSAPI: unexpected message")
+
+func readGSSAPIMsg(r io.Reader, mtyp byte) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != gssapiVer || hdr[1] != mtyp {
+		return nil, errGSSAPIMsg
+	}
+	if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func writeGSSAPIMsg(w io.Writer, mtyp byte, token []byte) error {
+	if len(token) > gssapiMaxToken {
+		return errors.New("socks GSSAPI: token too large")
+	}
+	msg := make([]byte, 4+len(token))
+	msg[0], msg[1] = gssapiVer, mtyp
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	copy(msg[4:], token)
+	_, err := w.Write(msg)
+	return err
+}
+
+// gssapiAuth accepts security context and negotiates protection, returning
+// conn encapsulating data.
+func gssapiAuth(conn net.Conn, p GSSAPIProvider) (net.Conn, error) {
+	ctx, err := p.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token, err := readGSSAPIMsg(conn, gssapiMsgAuth)
+		if err != nil {
+			ctx.Close()
+			return nil, err
+		}
+		out, established, err := ctx.Accept(token)
+		if err != nil {
+			conn.Write([]byte{gssapiVer, gssapiMsgAbort})
+			ctx.Close()
+			return nil, fmt.Errorf("socks GSSAPI: %v", err)
+		}
+		if len(out) != 0 || !established {
+			if err = writeGSSAPIMsg(conn, gssapiMsgAuth, out); err != nil {
+				ctx.Close()
+				return nil, err
+			}
+		}
+		if established {
+			break
+		}
+	}
+
+	// protection level is sent wrapped in one byte
+	token, err := readGSSAPIMsg(conn, gssapiMsgProtect)
+	if err == nil {
+		token, err = ctx.Unwrap(token)
+	}
+	if err == nil && len(token) != 1 {
+		err = errGSSAPIMsg
+	}
+	if err != nil {
+		ctx.Close()
+		return nil, err
+	}
+	level := token[0]
+	if level != gssapiIntegrity {
+		// selective protection is not supported, use confidentiality
+		level = gssapiConfidential
+	}
+	if token, err = ctx.Wrap([]byte{level}, false); err == nil {
+		err = writeGSSAPIMsg(conn, gssapiMsgProtect, token)
+	}
+	if err != nil {
+		ctx.Close()
+		return nil, err
+	}
+	Debug.Printf("socks GSSAPI: %s authenticated, protection level %d\n", ctx.Peer(), level)
+	return &gssapiConn{Conn: conn, ctx: ctx, conf: level == gssapiConfidential}, nil
+}
+
+// gssapiConn encapsulates data in GSSAPI messages.
+type gssapiConn struct {
+	net.Conn
+	ctx  GSSAPIContext
+	conf bool
+	rbuf []byte // unwrapped data not read yet
+}
+
+func (c *gssapiConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		token, err := readGSSAPIMsg(c.Conn, gssapiMsgEncap)
+		if err != nil {
+			return 0, err
+		}
+		if c.rbuf, err = c.ctx.Unwrap(token); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *gssapiConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > gssapiMaxPlain {
+			chunk = chunk[:gssapiMaxPlain]
+		}
+		token, err := c.ctx.Wrap(chunk, c.conf)
+		if err != nil {
+			return n, err
+		}
+		if err = writeGSSAPIMsg(c.Conn, gssapiMsgEncap, token); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *gssapiConn) Close() error {
+	c.ctx.Close()
+	return c.Conn.Close()
+}
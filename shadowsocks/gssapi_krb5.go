@@ -0,0 +1,186 @@
+//go:build gssapi && linux && cgo
+// +build gssapi,linux,cgo
+
+package shadowsocks
+
+// Kerberos provider using the system GSSAPI library of MIT Kerberos. The
+// service key is read from the default keytab, which can be set with
+// KRB5_KTNAME. Only declarations needed are written here, so that headers of
+// the library are not required to build.
+
+/*
+#cgo LDFLAGS: -l:libgssapi_krb5.so.2
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef uint32_t OM_uint32;
+typedef struct gss_buffer_desc_struct {
+	size_t length;
+	void *value;
+} gss_buffer_desc, *gss_buffer_t;
+typedef struct gss_ctx_id_struct *gss_ctx_id_t;
+typedef struct gss_cred_id_struct *gss_cred_id_t;
+typedef struct gss_name_struct *gss_name_t;
+typedef void *gss_OID;
+typedef void *gss_channel_bindings_t;
+
+OM_uint32 gss_accept_sec_context(OM_uint32 *, gss_ctx_id_t *, gss_cred_id_t, gss_buffer_t,
+	gss_channel_bindings_t, gss_name_t *, gss_OID *, gss_buffer_t, OM_uint32 *, OM_uint32 *,
+	gss_cred_id_t *);
+OM_uint32 gss_wrap(OM_uint32 *, gss_ctx_id_t, int, OM_uint32, gss_buffer_t, int *, gss_buffer_t);
+OM_uint32 gss_unwrap(OM_uint32 *, gss_ctx_id_t, gss_buffer_t, gss_buffer_t, int *, OM_uint32 *);
+OM_uint32 gss_display_name(OM_uint32 *, gss_name_t, gss_buffer_t, gss_OID *);
+OM_uint32 gss_display_status(OM_uint32 *, OM_uint32, int, gss_OID, OM_uint32 *, gss_buffer_t);
+OM_uint32 gss_release_buffer(OM_uint32 *, gss_buffer_t);
+OM_uint32 gss_release_name(OM_uint32 *, gss_name_t *);
+OM_uint32 gss_delete_sec_context(OM_uint32 *, gss_ctx_id_t *, gss_buffer_t);
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	gssContinueNeeded = 1
+	gssCMechCode      = 2 // status type of minor status
+	gssCGSSCode       = 1
+)
+
+func gssError(major C.OM_uint32) bool {
+	// calling or routine errors, not supplementary info
+	return major&0xffff0000 != 0
+}
+
+func gssStatus(major, minor C.OM_uint32) error {
+	var msg string
+	for _, s := range []struct {
+		code C.OM_uint32
+		typ  C.int
+	}{{major, gssCGSSCode}, {minor, gssCMechCode}} {
+		var min, ctx C.OM_uint32
+		var buf C.gss_buffer_desc
+		C.gss_display_status(&min, s.code, s.typ, nil, &ctx, &buf)
+		if buf.length != 0 {
+			if msg != "" {
+				msg += ": "
+			}
+			msg += C.GoStringN((*C.char)(buf.value), C.int(buf.length))
+		}
+		C.gss_release_buffer(&min, &buf)
+	}
+	return errors.New("kerberos: " + msg)
+}
+
+func goBytes(buf *C.gss_buffer_desc) []byte {
+	b := C.GoBytes(buf.value, C.int(buf.length))
+	var min C.OM_uint32
+	C.gss_release_buffer(&min, buf)
+	return b
+}
+
+type krb5Provider struct{}
+
+func (krb5Provider) NewContext() (GSSAPIContext, error) {
+	return &krb5Context{}, nil
+}
+
+type krb5Context struct {
+	mu   sync.Mutex // C context must not be used after deleted
+	ctx  C.gss_ctx_id_t
+	peer string
+}
+
+// withCBuffer passes b to f in C memory.
+func withCBuffer(b []byte, f func(in *C.gss_buffer_desc)) {
+	in := C.gss_buffer_desc{length: C.size_t(len(b))}
+	if len(b) != 0 {
+		in.value = C.CBytes(b)
+		defer C.free(in.value)
+	}
+	f(&in)
+}
+
+func (c *krb5Context) Accept(token []byte) (out []byte, established bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var major, minor C.OM_uint32
+	var name C.gss_name_t
+	var outBuf C.gss_buffer_desc
+	withCBuffer(token, func(in *C.gss_buffer_desc) {
+		major = C.gss_accept_sec_context(&minor, &c.ctx, nil, in, nil, &name, nil, &outBuf, nil, nil, nil)
+	})
+	out = goBytes(&outBuf)
+	if gssError(major) {
+		return nil, false, gssStatus(major, minor)
+	}
+	if major&gssContinueNeeded != 0 {
+		return out, false, nil
+	}
+	var nameBuf C.gss_buffer_desc
+	if C.gss_display_name(&minor, name, &nameBuf, nil) == 0 {
+		c.peer = string(goBytes(&nameBuf))
+	}
+	C.gss_release_name(&minor, &name)
+	return out, true, nil
+}
+
+func (c *krb5Context) Wrap(msg []byte, conf bool) (out []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		return nil, errors.New("kerberos: context closed")
+	}
+	var confReq C.int
+	if conf {
+		confReq = 1
+	}
+	var major, minor C.OM_uint32
+	var outBuf C.gss_buffer_desc
+	withCBuffer(msg, func(in *C.gss_buffer_desc) {
+		major = C.gss_wrap(&minor, c.ctx, confReq, 0, in, nil, &outBuf)
+	})
+	out = goBytes(&outBuf)
+	if gssError(major) {
+		return nil, gssStatus(major, minor)
+	}
+	return out, nil
+}
+
+func (c *krb5Context) Unwrap(token []byte) (out []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		return nil, errors.New("kerberos: context closed")
+	}
+	var major, minor C.OM_uint32
+	var outBuf C.gss_buffer_desc
+	withCBuffer(token, func(in *C.gss_buffer_desc) {
+		major = C.gss_unwrap(&minor, c.ctx, in, &outBuf, nil, nil)
+	})
+	out = goBytes(&outBuf)
+	if gssError(major) {
+		return nil, gssStatus(major, minor)
+	}
+	return out, nil
+}
+
+func (c *krb5Context) Peer() string {
+	return c.peer
+}
+
+func (c *krb5Context) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx != nil {
+		var minor C.OM_uint32
+		C.gss_delete_sec_context(&minor, &c.ctx, nil)
+		c.ctx = nil
+	}
+	return nil
+}
+
+func init() {
+	RegisterGSSAPIProvider("kerberos", krb5Provider{})
+}
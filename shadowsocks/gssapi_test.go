@@ -0,0 +1,142 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// xorProvider establishes context after two tokens, and wraps messages by
+// xor with 0x5a if confidential, prefixed by a byte telling that.
+type xorProvider struct{}
+
+func (xorProvider) NewContext() (GSSAPIContext, error) {
+	return &xorContext{}, nil
+}
+
+type xorContext struct {
+	step int
+}
+
+func (c *xorContext) Accept(token []byte) ([]byte, bool, error) {
+	c.step++
+	switch {
+	case c.step == 1 && string(token) == "hello":
+		return []byte("challenge"), false, nil
+	case c.step == 2 && string(token) == "response":
+		return []byte("done"), true, nil
+	}
+	return nil, false, errors.New("bad token")
+}
+
+func xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ 0x5a
+	}
+	return out
+}
+
+func (c *xorContext) Wrap(msg []byte, conf bool) ([]byte, error) {
+	if conf {
+		return append([]byte{1}, xor(msg)...), nil
+	}
+	return append([]byte{0}, msg...), nil
+}
+
+func (c *xorContext) Unwrap(token []byte) ([]byte, error) {
+	if len(token) == 0 {
+		return nil, errors.New("empty token")
+	}
+	if token[0] == 1 {
+		return xor(token[1:]), nil
+	}
+	return token[1:], nil
+}
+
+func (c *xorContext) Peer() string { return "user@EXAMPLE.COM" }
+func (c *xorContext) Close() error { return nil }
+
+func TestSocksHandShakeGSSAPI(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	var conn net.Conn
+	go func() {
+		var err error
+		conn, err = SocksHandShakeGSSAPI(server, nil, xorProvider{})
+		done <- err
+	}()
+
+	expect := func(want []byte) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %v, should be %v", got, want)
+		}
+	}
+	client.Write([]byte{SocksVer5, 2, socksMethodNoAuth, socksMethodGSSAPI})
+	expect([]byte{SocksVer5, socksMethodGSSAPI})
+	writeGSSAPIMsg(client, gssapiMsgAuth, []byte("hello"))
+	expect([]byte("\x01\x01\x00\x09challenge"))
+	writeGSSAPIMsg(client, gssapiMsgAuth, []byte("response"))
+	expect([]byte("\x01\x01\x00\x04done"))
+	// ask for selective protection, which is replaced by confidentiality
+	writeGSSAPIMsg(client, gssapiMsgProtect, []byte{0, 3})
+	expect([]byte{1, gssapiMsgProtect, 0, 2, 0, gssapiConfidential})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	go conn.Write([]byte("data"))
+	expect(append([]byte{1, gssapiMsgEncap, 0, 5, 1}, xor([]byte("data"))...))
+	go writeGSSAPIMsg(client, gssapiMsgEncap, append([]byte{1}, xor([]byte("reply"))...))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("read %q %v, should be reply", buf[:n], err)
+	}
+}
+
+func TestSocksHandShakeGSSAPIRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := SocksHandShakeGSSAPI(server, nil, xorProvider{})
+		done <- err
+	}()
+	client.Write([]byte{SocksVer5, 1, socksMethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socksNoMethod {
+		t.Errorf("client without GSSAPI should be refused, got method %d", reply[1])
+	}
+	if err := <-done; err != errSocksNoGSSAPI {
+		t.Errorf("got error %v", err)
+	}
+
+	// bad token aborts authentication
+	client, server = net.Pipe()
+	defer client.Close()
+	go func() {
+		_, err := SocksHandShakeGSSAPI(server, nil, xorProvider{})
+		done <- err
+	}()
+	client.Write([]byte{SocksVer5, 1, socksMethodGSSAPI})
+	io.ReadFull(client, reply)
+	go writeGSSAPIMsg(client, gssapiMsgAuth, []byte("bad"))
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != gssapiMsgAbort {
+		t.Errorf("got %v %v, should be abort", reply, err)
+	}
+	if err := <-done; err == nil {
+		t.Error("bad token should fail")
+	}
+}
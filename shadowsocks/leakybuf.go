@@ -0,0 +1,119 @@
+package shadowsocks
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffers of relays, AEAD decryption, UDP relay and handshakes are recycled
+// instead of allocated for each connection, reducing GC pressure on busy
+// servers. Buffers are grouped in size classes of powers of two, from
+// minPoolBufSize to maxPoolBufSize. Each class keeps up to bufPoolCount free
+// buffers in a leaky buffer, which survives GC, and puts the rest in a
+// sync.Pool, which GC may reclaim. Larger buffers are not pooled. Counters
+// are exported as buffer_pool in /debug/vars.
+
+const (
+	minPoolBufSize      = 1024
+	maxPoolBufSize      = 128 * 1024 // UDP packets with header room
+	defaultBufPoolCount = 32
+)
+
+var bufPoolCount int64 = defaultBufPoolCount
+
+type leakyBuf struct {
+	size int
+	mu   sync.Mutex
+	free [][]byte
+	pool sync.Pool // overflow of free
+}
+
+var bufClasses []*leakyBuf
+
+var bufPoolStat struct {
+	gets   expvar.Int
+	allocs expvar.Int // gets not served by pool
+	puts   expvar.Int
+}
+
+func init() {
+	for size := minPoolBufSize; size <= maxPoolBufSize; size *= 2 {
+		bufClasses = append(bufClasses, &leakyBuf{size: size})
+	}
+	m := expvar.NewMap("buffer_pool")
+	m.Set("gets", &bufPoolStat.gets)
+	m.Set("allocs", &bufPoolStat.allocs)
+	m.Set("puts", &bufPoolStat.puts)
+	m.Set("free", expvar.Func(func() interface{} {
+		n := 0
+		for _, c := range bufClasses {
+			c.mu.Lock()
+			n += len(c.free)
+			c.mu.Unlock()
+		}
+		return n
+	}))
+}
+
+// SetBufPoolCount sets the number of free buffers kept for each size, 0 for
+// the default.
+func SetBufPoolCount(n int) {
+	if n <= 0 {
+		n = defaultBufPoolCount
+	}
+	atomic.StoreInt64(&bufPoolCount, int64(n))
+}
+
+func bufClass(size int) *leakyBuf {
+	for _, c := range bufClasses {
+		if size <= c.size {
+			return c
+		}
+	}
+	return nil
+}
+
+// GetBuf returns buffer of size, which should be returned by PutBuf when no
+// longer used.
+func GetBuf(size int) []byte {
+	bufPoolStat.gets.Add(1)
+	c := bufClass(size)
+	if c == nil {
+		bufPoolStat.allocs.Add(1)
+		return make([]byte, size)
+	}
+	c.mu.Lock()
+	if n := len(c.free); n > 0 {
+		b := c.free[n-1]
+		c.free[n-1] = nil
+		c.free = c.free[:n-1]
+		c.mu.Unlock()
+		return b[:size]
+	}
+	c.mu.Unlock()
+	if p, ok := c.pool.Get().(*[]byte); ok {
+		return (*p)[:size]
+	}
+	bufPoolStat.allocs.Add(1)
+	return make([]byte, size, c.size)
+}
+
+// PutBuf returns buffer got from GetBuf. It must not be used afterwards.
+func PutBuf(b []byte) {
+	c := bufClass(cap(b))
+	if c == nil || c.size != cap(b) {
+		// not from GetBuf
+		return
+	}
+	bufPoolStat.puts.Add(1)
+	b = b[:cap(b)]
+	c.mu.Lock()
+	if int64(len(c.free)) < atomic.LoadInt64(&bufPoolCount) {
+		c.free = append(c.free, b)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.pool.Put(&b)
+}
@@ -0,0 +1,41 @@
+package shadowsocks
+
+import (
+	"testing"
+)
+
+func TestLeakyBuf(t *testing.T) {
+	SetBufPoolCount(2)
+	defer SetBufPoolCount(0)
+
+	b := GetBuf(3000)
+	if len(b) != 3000 || cap(b) != 4096 {
+		t.Fatalf("got buffer of len %d cap %d", len(b), cap(b))
+	}
+	b[0] = 1
+	PutBuf(b)
+	if b2 := GetBuf(2049); &b2[0] != &b[0] || len(b2) != 2049 {
+		t.Error("freed buffer should be reused")
+	}
+
+	// buffers beyond count go to sync.Pool, and are still usable
+	bufs := [][]byte{GetBuf(1024), GetBuf(1024), GetBuf(1024)}
+	for _, b := range bufs {
+		PutBuf(b)
+	}
+	c := bufClass(1024)
+	if len(c.free) != 2 {
+		t.Errorf("%d free buffers kept, should be 2", len(c.free))
+	}
+
+	if b := GetBuf(maxPoolBufSize + 1); len(b) != maxPoolBufSize+1 {
+		t.Error("large buffer should be allocated")
+	}
+	// not from pool, ignored
+	puts := bufPoolStat.puts.Value()
+	PutBuf(make([]byte, 3000))
+	PutBuf(nil)
+	if bufPoolStat.puts.Value() != puts {
+		t.Error("buffers not from pool should not be kept")
+	}
+}
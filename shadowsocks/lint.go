@@ -0,0 +1,394 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Linting reports problems in config file which are accepted when starting
+// but likely mistakes or weak settings, each with a suggestion to fix it, so
+// that config files of a fleet can be validated before deploying.
+
+// LintIssue is a problem found in config file.
+type LintIssue struct {
+	Option     string // option having the problem, like port_password.8388
+	Problem    string
+	Suggestion string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s: %s; %s", i.Option, i.Problem, i.Suggestion)
+}
+
+const (
+	lintProbeTimeout = 3 * time.Second
+	minPasswordLen   = 8
+)
+
+type linter struct {
+	issues []LintIssue
+	seen   map[string]bool
+	prefix string           // prefixed to option of issues found in profiles
+	probed map[string]error // servers already probed
+}
+
+func (l *linter) add(option, problem, suggestion string) {
+	i := LintIssue{option, problem, suggestion}
+	// issues of profiles inherited from top level are reported once
+	if l.seen[i.String()] {
+		return
+	}
+	i.Option = l.prefix + option
+	if l.seen[i.String()] {
+		return
+	}
+	l.seen[i.String()] = true
+	l.issues = append(l.issues, i)
+}
+
+// LintConfig checks config file data of server or client. probe makes client
+// also try connecting to its servers to find unreachable ones. Error is
+// returned only if data can't be parsed.
+func LintConfig(data []byte, server, probe bool) ([]LintIssue, error) {
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	l := &linter{seen: map[string]bool{}, probed: map[string]error{}}
+	for _, k := range duplicateKeys(data) {
+		l.add(k, "given more than once, only the last one is used", "remove the duplicates")
+	}
+	if server {
+		l.server(config)
+		return l.issues, nil
+	}
+	l.client(config, probe)
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile, err := config.GetProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		l.prefix = "profiles." + name + ": "
+		l.client(profile, probe)
+	}
+	return l.issues, nil
+}
+
+// LintConfigFile checks config file at path, see LintConfig.
+func LintConfigFile(path string, server, probe bool) ([]LintIssue, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LintConfig(data, server, probe)
+}
+
+func (l *linter) server(config *Config) {
+	passwd := config.PortPassword
+	if len(passwd) == 0 && config.ServerPort != 0 {
+		passwd = map[string]string{strconv.Itoa(config.ServerPort): config.Password}
+	}
+	ports := sortedKeys(passwd)
+	for _, port := range ports {
+		if m, ok := config.PortMethod[port]; ok {
+			l.method("port_method."+port, m)
+		} else {
+			l.method("method", config.Method)
+		}
+		l.password("port_password."+port, passwd[port])
+	}
+	for _, port := range sortedKeys(config.PortMethod) {
+		if _, ok := passwd[port]; !ok {
+			l.add("port_method."+port, "port is not served", "add it to port_password or remove it")
+		}
+	}
+
+	// the same port written differently, like 8388 and 08388
+	byNum := map[int]string{}
+	for _, port := range ports {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			l.add("port_password."+port, "invalid port", "use a port between 1 and 65535")
+			continue
+		}
+		if other, ok := byNum[n]; ok {
+			l.add("port_password."+port, "same port as "+other, "keep only one of them")
+			continue
+		}
+		byNum[n] = port
+	}
+	if hop, err := NewPortHop(config.PortHop, config.PortHopInterval); err == nil && hop != nil {
+		for _, port := range ports {
+			if n, _ := strconv.Atoi(port); byNum[n] == port && n >= hop.first && n <= hop.last {
+				l.add("port_hop", "range includes server port "+port,
+					"use a range not overlapping configured ports")
+			}
+		}
+	}
+
+	// a port claimed by an earlier tenant shadows later ones
+	owner := map[string]string{}
+	for _, name := range sortedKeys(config.Tenants) {
+		for _, port := range config.Tenants[name].Ports {
+			if other, ok := owner[port]; ok {
+				l.add("tenants."+name, "port "+port+" already belongs to tenant "+other,
+					"assign each port to one tenant")
+				continue
+			}
+			owner[port] = name
+			if _, ok := passwd[port]; !ok {
+				l.add("tenants."+name, "port "+port+" is not served", "add it to port_password or remove it")
+			}
+		}
+	}
+	if config.TLS && len(config.TLSAutocert) != 0 && byNum[443] == "" {
+		l.add("tls_autocert", "no port 443 to answer TLS-ALPN-01 challenge",
+			"serve port 443, or forward it to a server port")
+	}
+	l.admin(config)
+	if ExposedManager(config.ManagerAddr) {
+		l.add("manager_addr", "manager API without authentication on non-loopback address",
+			"listen on 127.0.0.1 or a unix socket")
+	}
+}
+
+func (l *linter) client(config *Config, probe bool) {
+	if c, err := ExpandServerURIs(config); err != nil {
+		l.add("server", err.Error(), "fix the ss:// URI")
+	} else {
+		config = c
+	}
+	l.method("method", config.Method)
+	servers := map[string]bool{}
+	if len(config.ServerPassword) != 0 {
+		for _, s := range sortedKeys(config.ServerPassword) {
+			l.password("server_password."+s, config.ServerPassword[s])
+			servers[s] = true
+		}
+	} else if config.ServerDiscovery == "" && config.ServerListURL == "" {
+		l.password("password", config.Password)
+		if s, ok := config.Server.(string); ok && s != "" {
+			servers[JoinHostPort(s, strconv.Itoa(config.ServerPort))] = true
+		}
+	}
+	if config.Timeout < 0 {
+		l.add("timeout", "negative", fmt.Sprintf("remove it to use the default of %d seconds", defaultTimeout))
+	}
+	if config.ServerListURL != "" && !strings.HasPrefix(config.ServerListURL, "https://") {
+		l.add("server_list_url", "not https, the list contains passwords", "enable TLS of the coordinator's admin interface")
+	}
+	if config.ACL != "" {
+		if acl, err := LoadACL(config.ACL, config.ACLGeoIP); err != nil {
+			l.add("acl", err.Error(), "fix the rule file")
+		} else {
+			for _, s := range acl.Shadowed() {
+				l.add("acl", s, "remove the rule or move it above the one shadowing it")
+			}
+		}
+	}
+	if config.SocksGSSAPI != "" {
+		if _, err := GetGSSAPIProvider(config.SocksGSSAPI); err != nil {
+			l.add("socks_gssapi", err.Error(), "rebuild client with the provider or unset it")
+		}
+	}
+	if !config.TLS && (config.TLSSNI != "" || config.TLSFingerprint != "") {
+		l.add("tls", "tls_sni or tls_fingerprint set without tls", "set tls to true if server uses TLS")
+	}
+	if len(config.DirectCountries) != 0 && config.ACLGeoIP == "" {
+		l.add("direct_countries", "no acl_geoip to look up countries", "set acl_geoip")
+	}
+	if !isLoopbackAddr(config.BindAddress) {
+		l.add("bind_address", "unauthenticated local proxy listens on non-loopback address",
+			"set it to 127.0.0.1 unless other hosts should use the proxy")
+	}
+
+	// local ports sharing a port
+	used := map[int]string{}
+	usePort := func(option string, port int) {
+		if other, ok := used[port]; ok {
+			l.add(option, "same port as "+other, "use a different port")
+			return
+		}
+		used[port] = option
+	}
+	if config.LocalPort != 0 {
+		usePort("local_port", config.LocalPort)
+	}
+	if config.LocalHTTPPort != 0 {
+		usePort("local_http_port", config.LocalHTTPPort)
+	}
+	if config.LocalRedirPort != 0 {
+		usePort("local_redir_port", config.LocalRedirPort)
+	}
+	for _, l := range config.Listeners {
+		usePort("listeners."+strconv.Itoa(l.Port), l.Port)
+	}
+	for _, port := range sortedKeys(config.LocalPorts) {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			l.add("local_ports."+port, "invalid port", "use a port between 1 and 65535")
+			continue
+		}
+		usePort("local_ports."+port, n)
+		// group is looked up before server address
+		name := config.LocalPorts[port]
+		if _, ok := config.ServerGroup[name]; ok && servers[name] {
+			l.add("local_ports."+port, "server group "+name+" shadows the server of the same address",
+				"rename the group")
+		}
+	}
+	for _, name := range sortedKeys(config.ServerGroup) {
+		if len(config.ServerGroup[name]) == 0 {
+			l.add("server_group."+name, "has no servers", "add servers or remove the group")
+		}
+	}
+	l.admin(config)
+
+	if probe {
+		l.probe(servers)
+	}
+}
+
+func (l *linter) method(option, method string) {
+	switch method {
+	case "", "table":
+		l.add(option, "table method only obfuscates traffic", "use aes-256-gcm or chacha20-ietf-poly1305")
+	case "plain":
+		l.add(option, "plain method doesn't encrypt", "use aes-256-gcm or chacha20-ietf-poly1305 outside tests")
+	default:
+		if err := CheckMethod(method); err != nil {
+			l.add(option, "unsupported method "+method, "use aes-256-gcm or chacha20-ietf-poly1305")
+		}
+	}
+}
+
+func (l *linter) password(option, password string) {
+	if password == "" {
+		l.add(option, "empty password", "use a random password")
+	} else if len(password) < minPasswordLen {
+		l.add(option, "password is short", fmt.Sprintf("use a random password of at least %d characters", minPasswordLen))
+	}
+}
+
+func (l *linter) admin(config *Config) {
+	if exposedAdmin(config) {
+		l.add("admin_addr", "admin interface on non-loopback address without tokens",
+			"set admin_tokens or listen on 127.0.0.1")
+	} else if len(config.AdminTokens) != 0 && config.AdminTLSCert == "" && config.AdminAddr != "" && !isLoopbackAddr(config.AdminAddr) {
+		l.add("admin_tokens", "tokens are sent in clear text", "set admin_tls_cert")
+	}
+}
+
+// probe connects to servers concurrently, reporting unreachable ones.
+func (l *linter) probe(servers map[string]bool) {
+	var pending []string
+	for s := range servers {
+		if _, ok := l.probed[s]; !ok {
+			pending = append(pending, s)
+		}
+	}
+	// each goroutine writes its own slot, results are merged after all done
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, s := range pending {
+		wg.Add(1)
+		go func(i int, s string) {
+			defer wg.Done()
+			c, err := net.DialTimeout("tcp", s, lintProbeTimeout)
+			if err == nil {
+				c.Close()
+			}
+			errs[i] = err
+		}(i, s)
+	}
+	wg.Wait()
+	for i, s := range pending {
+		l.probed[s] = errs[i]
+	}
+	for _, s := range sortedKeys(l.probed) {
+		if err := l.probed[s]; err != nil && servers[s] {
+			l.add("server "+s, fmt.Sprintf("unreachable: %v", err),
+				"check the address and that the server is running")
+		}
+	}
+}
+
+// duplicateKeys returns options given more than once in JSON data, which
+// encoding/json silently overwrites.
+func duplicateKeys(data []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var dups []string
+	var walk func(path string) error
+	walk = func(path string) error {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'):
+			keys := map[string]bool{}
+			for dec.More() {
+				t, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := t.(string)
+				if keys[key] {
+					dups = append(dups, path+key)
+				}
+				keys[key] = true
+				if err = walk(path + key + "."); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for dec.More() {
+				if err = walk(path); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	walk("")
+	return dups
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*TenantConfig:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string][]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]error:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// hasIssue tells whether an issue of option mentions problem.
+func hasIssue(issues []LintIssue, option, problem string) bool {
+	for _, i := range issues {
+		if i.Option == option && strings.Contains(i.Problem, problem) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLintServerConfig(t *testing.T) {
+	issues, err := LintConfig([]byte(`{
+		"port_password": {"8387": "foobar!!", "08387": "barfoo!!", "8388": "short", "8388": ""},
+		"port_method": {"8387": "aes-256-gcm", "08387": "aes-256-gcm", "8389": "aes-256-gcm"},
+		"port_hop": "8000-8999",
+		"tenants": {"a": {"ports": ["8387"]}, "b": {"ports": ["8387", "9000"]}},
+		"admin_addr": "0.0.0.0:1090",
+		"tls": true, "tls_autocert": ["example.com"]
+	}`), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ option, problem string }{
+		{"port_password.8388", "more than once"},
+		{"port_password.8388", "empty password"},
+		{"method", "table"},
+		{"port_password.8387", "same port as 08387"},
+		{"port_method.8389", "not served"},
+		{"port_hop", "server port 08387"},
+		{"tenants.b", "already belongs to tenant a"},
+		{"tenants.b", "port 9000 is not served"},
+		{"admin_addr", "without tokens"},
+		{"tls_autocert", "no port 443"},
+	} {
+		if !hasIssue(issues, c.option, c.problem) {
+			t.Errorf("%s: %q not reported in %v", c.option, c.problem, issues)
+		}
+	}
+
+	issues, err = LintConfig([]byte(`{"server_port": 8388, "password": "foobar!!", "method": "aes-256-gcm"}`), true, false)
+	if err != nil || len(issues) != 0 {
+		t.Errorf("good server config: %v %v", issues, err)
+	}
+	if _, err = LintConfig([]byte(`{"server_port": "8388"}`), true, false); err == nil {
+		t.Error("invalid config should return error")
+	}
+}
+
+func TestLintClientConfig(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := ln.Addr().String()
+	ln.Close()
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	good := ln.Addr().String()
+
+	issues, err := LintConfig([]byte(`{
+		"server_password": {"`+up+`": "foobar!!", "`+good+`": "foobar!!"},
+		"server_group": {"`+good+`": ["`+good+`"], "empty": []},
+		"local_port": 1080,
+		"local_http_port": 1080,
+		"local_ports": {"1081": "`+good+`"},
+		"method": "aes-256-gcm",
+		"bind_address": "127.0.0.1",
+		"timeout": 300,
+		"tls_sni": "example.com",
+		"profiles": {"weak": {"method": "table"}}
+	}`), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ option, problem string }{
+		{"server " + up, "unreachable"},
+		{"local_http_port", "same port as local_port"},
+		{"local_ports.1081", "shadows"},
+		{"server_group.empty", "no servers"},
+		{"profiles.weak: method", "table"},
+		{"tls", "without tls"},
+	} {
+		if !hasIssue(issues, c.option, c.problem) {
+			t.Errorf("%s: %q not reported in %v", c.option, c.problem, issues)
+		}
+	}
+	if hasIssue(issues, "server "+good, "unreachable") {
+		t.Errorf("server %s is reachable", good)
+	}
+	// inherited issues are reported once
+	if hasIssue(issues, "profiles.weak: local_http_port", "same port") {
+		t.Error("issue of top level reported again for profile")
+	}
+	if !hasIssue(issues, "server "+up, "unreachable") || hasIssue(issues, "profiles.weak: server "+up, "") {
+		t.Error("unreachable server should be reported once")
+	}
+}
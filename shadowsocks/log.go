@@ -1,8 +1,11 @@
 package shadowsocks
 
 import (
+	"expvar"
 	"log"
+	"net"
 	"os"
+	"runtime/debug"
 )
 
 type DebugLog bool
@@ -22,3 +25,27 @@ func (d DebugLog) Println(args ...interface{}) {
 		dbgLog.Println(args...)
 	}
 }
+
+var recoveredPanics = expvar.NewInt("recovered_panics")
+
+// RecoverPanic should be deferred by connection handlers. It logs the panic
+// with stack trace and the connection it happened on, instead of letting it
+// crash the whole process.
+func RecoverPanic(conn net.Conn) {
+	if r := recover(); r != nil {
+		logPanic(conn.RemoteAddr(), r)
+	}
+}
+
+// RecoverPacketPanic is like RecoverPanic, for goroutines relaying packets of
+// peer, which have no connection.
+func RecoverPacketPanic(peer net.Addr) {
+	if r := recover(); r != nil {
+		logPanic(peer, r)
+	}
+}
+
+func logPanic(peer net.Addr, r interface{}) {
+	recoveredPanics.Add(1)
+	log.Printf("panic serving %v: %v\n%s", peer, r, debug.Stack())
+}
@@ -0,0 +1,18 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRecoverPacketPanic(t *testing.T) {
+	before := recoveredPanics.Value()
+	func() {
+		defer RecoverPacketPanic(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+		var m map[string]int
+		m["a"] = 1
+	}()
+	if recoveredPanics.Value() != before+1 {
+		t.Error("panic should be recovered and counted")
+	}
+}
@@ -0,0 +1,153 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Deprecated options are detected on the raw JSON object of config file, so
+// that migrating a config file keeps options unknown to this version.
+
+type deprecation struct {
+	// check returns a warning if the deprecated usage is found
+	check func(m map[string]interface{}) string
+	// migrate rewrites the usage, nil if it can't be migrated automatically
+	migrate func(m map[string]interface{})
+}
+
+var deprecations = []deprecation{
+	{checkServerArray, migrateServerArray},
+	{checkTableMethod, nil},
+}
+
+func checkServerArray(m map[string]interface{}) string {
+	if arr, ok := m["server"].([]interface{}); ok && len(arr) > 1 {
+		return `multiple servers in "server" option is deprecated, please use "server_password" instead`
+	}
+	return ""
+}
+
+func migrateServerArray(m map[string]interface{}) {
+	arr := m["server"].([]interface{})
+	password, _ := m["password"].(string)
+	port := ""
+	if p, ok := m["server_port"].(float64); ok {
+		port = strconv.Itoa(int(p))
+	}
+	passwd := map[string]interface{}{}
+	if sp, ok := m["server_password"].(map[string]interface{}); ok {
+		passwd = sp
+	}
+	for _, s := range arr {
+		addr, ok := s.(string)
+		if !ok {
+			return
+		}
+		host, p, err := SplitHostPortDefault(addr, port)
+		if err != nil || p == "" {
+			return
+		}
+		passwd[net.JoinHostPort(host, p)] = password
+	}
+	m["server_password"] = passwd
+	delete(m, "server")
+	delete(m, "server_port")
+	delete(m, "password")
+}
+
+func checkTableMethod(m map[string]interface{}) string {
+	const warning = "table method is deprecated, it only obfuscates traffic and provides no real security, use aes-256-gcm or chacha20-ietf-poly1305"
+	if method, _ := m["method"].(string); method == "" || method == "table" {
+		return warning
+	}
+	var ports []string
+	if pm, ok := m["port_method"].(map[string]interface{}); ok {
+		for port, method := range pm {
+			if method == "table" {
+				ports = append(ports, port)
+			}
+		}
+	}
+	if len(ports) != 0 {
+		sort.Strings(ports)
+		return "port_method " + strings.Join(ports, ", ") + ": " + warning
+	}
+	return ""
+}
+
+// configWarnings returns warnings about deprecated usage in config file.
+func configWarnings(data []byte) []string {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	var warnings []string
+	for _, d := range deprecations {
+		if w := d.check(m); w != "" {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// MigrateConfig rewrites deprecated usage in config file data. Warnings are
+// returned for usage which can't be migrated automatically.
+func MigrateConfig(data []byte) (migrated []byte, warnings []string, err error) {
+	var m map[string]interface{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return
+	}
+	for _, d := range deprecations {
+		w := d.check(m)
+		if w == "" {
+			continue
+		}
+		if d.migrate != nil {
+			d.migrate(m)
+		}
+		if d.migrate == nil || d.check(m) != "" {
+			warnings = append(warnings, w)
+		}
+	}
+	migrated, err = json.MarshalIndent(m, "", "\t")
+	if err == nil {
+		migrated = append(migrated, '\n')
+	}
+	return
+}
+
+// MigrateConfigFile writes config file src with deprecated usage rewritten to
+// dst.
+func MigrateConfigFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	migrated, warnings, err := MigrateConfig(data)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		log.Printf("%s: %s, not migrated automatically\n", src, w)
+	}
+	return ioutil.WriteFile(dst, migrated, 0600)
+}
+
+// defaultTimeout is the timeout in seconds if not given.
+const defaultTimeout = 60
+
+// SetDefaults fills options not given in config file. ParseConfig calls it,
+// programs should call it for config made only of command line options.
+func SetDefaults(config *Config) {
+	if config.Method == "" {
+		config.Method = "table"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+}
@@ -0,0 +1,152 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// On IPv6-only networks, IPv4 destinations are reachable through NAT64 by
+// embedding the IPv4 address into the NAT64 prefix (RFC 6052). Only /96
+// prefixes are supported. The prefix can be given in config or detected by
+// resolving ipv4only.arpa with DNS64 (RFC 7050).
+
+const nat64Auto = "auto"
+
+var nat64 struct {
+	sync.Mutex
+	config string // empty if disabled
+	done   bool   // prefix is parsed or detected for config
+	prefix net.IP
+}
+
+// setNAT64 replaces NAT64 config, the prefix is found again when next used
+// if it changed.
+func setNAT64(config string) {
+	nat64.Lock()
+	defer nat64.Unlock()
+	if config != nat64.config {
+		nat64.config, nat64.done, nat64.prefix = config, false, nil
+	}
+}
+
+// well known IPv4 addresses of ipv4only.arpa
+var ipv4onlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+func parseNAT64Prefix(s string) (net.IP, error) {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ones, bits := ipnet.Mask.Size(); ones != 96 || bits != 128 || ip.To4() != nil {
+		return nil, fmt.Errorf("nat64 prefix %s is not an IPv6 /96 prefix", s)
+	}
+	return ipnet.IP, nil
+}
+
+// detectNAT64Prefix finds the prefix from AAAA records of ipv4only.arpa
+// synthesized by DNS64.
+func detectNAT64Prefix(ips []net.IP) (net.IP, error) {
+	for _, ip := range ips {
+		if len(ip) != net.IPv6len || ip.To4() != nil {
+			continue
+		}
+		for _, v4 := range ipv4onlyAddrs {
+			if ip[12:].Equal(v4.To4()) {
+				prefix := make(net.IP, net.IPv6len)
+				copy(prefix, ip[:12])
+				return prefix, nil
+			}
+		}
+	}
+	return nil, errors.New("no DNS64 synthesized address for ipv4only.arpa")
+}
+
+func checkNAT64(s string) error {
+	if s == "" || s == nat64Auto {
+		return nil
+	}
+	_, err := parseNAT64Prefix(s)
+	return err
+}
+
+// nat64Prefix returns the NAT64 prefix, or nil if NAT64 is disabled or the
+// prefix can't be detected.
+func nat64Prefix() net.IP {
+	nat64.Lock()
+	defer nat64.Unlock()
+	if nat64.done || nat64.config == "" {
+		return nat64.prefix
+	}
+	nat64.done = true
+	var err error
+	if nat64.config == nat64Auto {
+		var ips []net.IP
+		if ips, err = net.LookupIP("ipv4only.arpa"); err == nil {
+			nat64.prefix, err = detectNAT64Prefix(ips)
+		}
+	} else {
+		nat64.prefix, err = parseNAT64Prefix(nat64.config)
+	}
+	if err != nil {
+		log.Println("nat64 disabled:", err)
+		return nil
+	}
+	log.Println("nat64 prefix", nat64.prefix)
+	return nat64.prefix
+}
+
+func synthesizeNAT64(prefix, ip net.IP) net.IP {
+	v4 := ip.To4()
+	if prefix == nil || v4 == nil {
+		return ip
+	}
+	mapped := make(net.IP, net.IPv6len)
+	copy(mapped, prefix[:12])
+	copy(mapped[12:], v4)
+	return mapped
+}
+
+// pickIP prefers IPv6 address if NAT64 is enabled.
+func pickIP(ips []string) string {
+	if nat64Prefix() != nil {
+		for _, s := range ips {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+				return s
+			}
+		}
+	}
+	return ips[0]
+}
+
+// DialTCP connects to addr in the form of host:port. With NAT64 enabled, IPv6
+// is preferred and IPv4 addresses are mapped into the NAT64 prefix.
+func DialTCP(addr string) (net.Conn, error) {
+	return dialTCP(addr, false)
+}
+
+func dialTCP(addr string, mark bool) (net.Conn, error) {
+	prefix := nat64Prefix()
+	if prefix == nil {
+		return dial("tcp", addr, mark)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if c, err := dial("tcp6", addr, mark); err == nil {
+			return c, nil
+		}
+		// no AAAA record and the resolver doesn't do DNS64
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	return dial("tcp", JoinHostPort(synthesizeNAT64(prefix, ip).String(), port), mark)
+}
@@ -0,0 +1,33 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNAT64(t *testing.T) {
+	prefix, err := parseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := synthesizeNAT64(prefix, net.ParseIP("192.0.2.33")); ip.String() != "64:ff9b::c000:221" {
+		t.Error("wrong synthesized address:", ip)
+	}
+	if ip := synthesizeNAT64(prefix, net.ParseIP("2001:db8::1")); ip.String() != "2001:db8::1" {
+		t.Error("IPv6 address should not be changed:", ip)
+	}
+	if _, err = parseNAT64Prefix("64:ff9b::/64"); err == nil {
+		t.Error("should only support /96 prefix")
+	}
+
+	detected, err := detectNAT64Prefix([]net.IP{
+		net.ParseIP("192.0.0.170"),
+		net.ParseIP("2001:db8:64::c000:aa"),
+	})
+	if err != nil || !detected.Equal(net.ParseIP("2001:db8:64::")) {
+		t.Error("wrong detected prefix:", detected, err)
+	}
+	if _, err = detectNAT64Prefix([]net.IP{net.ParseIP("192.0.0.170")}); err == nil {
+		t.Error("should fail without synthesized address")
+	}
+}
@@ -1,34 +1,200 @@
 package shadowsocks
 
 import (
+	"context"
 	"io"
 	"net"
+	"runtime/pprof"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultRelayBufSize = 4096
+	// default maximum buffer size when auto tuning
+	defaultAutoTuneBufSize = 64 * 1024
+	minRelayBufSize        = 1024
+)
+
+// Size of buffer used to relay data. When autoTuneBuf is set, this is the
+// maximum size the buffer may grow to. Both are accessed atomically.
+var relayBufSize int32 = defaultRelayBufSize
+var autoTuneBuf int32
+
+// setRelayBuf sets buffer size, 0 for the default, and whether to auto tune.
+func setRelayBuf(size int, autoTune bool) {
+	if size == 0 {
+		size = defaultRelayBufSize
+		if autoTune {
+			size = defaultAutoTuneBufSize
+		}
+	}
+	if size < minRelayBufSize {
+		size = minRelayBufSize
+	}
+	var tune int32
+	if autoTune {
+		tune = 1
+	}
+	atomic.StoreInt32(&relayBufSize, int32(size))
+	atomic.StoreInt32(&autoTuneBuf, tune)
+}
+
+func maxRelayBufSize() int {
+	return int(atomic.LoadInt32(&relayBufSize))
+}
+
+func autoTuneEnabled() bool {
+	return atomic.LoadInt32(&autoTuneBuf) != 0
+}
+
+// RelayBuffer is the buffer used when relaying data. With auto tuning, the
+// buffer starts small and grows when reads keep filling it up, as in bulk
+// downloads, and shrinks back when reads are small, as in chatty flows. This
+// balances memory usage and throughput on devices with little memory.
+type RelayBuffer struct {
+	buf      []byte
+	fullCnt  int
+	smallCnt int
+}
+
+func newRelayBuf(size int) []byte {
+	relayStat.bufAllocs.Add(1)
+	relayStat.allocBytes.Add(int64(size))
+	return GetBuf(size)
+}
+
+func NewRelayBuffer() *RelayBuffer {
+	if autoTuneEnabled() {
+		return &RelayBuffer{buf: newRelayBuf(minRelayBufSize)}
+	}
+	return &RelayBuffer{buf: newRelayBuf(maxRelayBufSize())}
+}
+
+func (rb *RelayBuffer) Bytes() []byte {
+	return rb.buf
+}
+
+// Release returns the buffer to pool, rb must not be used afterwards.
+func (rb *RelayBuffer) Release() {
+	PutBuf(rb.buf)
+	rb.buf = nil
+}
+
+// Tune adjusts buffer size according to the number of bytes got in the last
+// read. Content of the buffer is not preserved.
+func (rb *RelayBuffer) Tune(n int) {
+	if !autoTuneEnabled() {
+		return
+	}
+	limit := maxRelayBufSize()
+	size := len(rb.buf)
+	if n == size {
+		rb.smallCnt = 0
+		if rb.fullCnt++; rb.fullCnt >= 2 && size < limit {
+			size *= 2
+		}
+	} else if n < size/4 {
+		rb.fullCnt = 0
+		if rb.smallCnt++; rb.smallCnt >= 16 && size > minRelayBufSize {
+			size /= 2
+		}
+	} else {
+		rb.fullCnt, rb.smallCnt = 0, 0
+	}
+	if size != len(rb.buf) {
+		if size > limit {
+			size = limit
+		}
+		Debug.Printf("relay buffer size %d -> %d\n", len(rb.buf), size)
+		PutBuf(rb.buf)
+		rb.buf = newRelayBuf(size)
+		rb.fullCnt, rb.smallCnt = 0, 0
+	}
+}
+
+// relayLabels marks relay goroutines in CPU profiles.
+var relayLabels = pprof.WithLabels(context.Background(), pprof.Labels("subsystem", "relay"))
+
+// The timeout option bounds how long dead peers can hold connections. It's
+// the deadline of handshakes, the timeout of dialing, and the idle timeout of
+// relaying, 0 for none.
+
+// SetTimeout sets timeout in seconds.
+func SetTimeout(seconds int) {
+	atomic.StoreInt64(&readTimeout, int64(time.Duration(seconds)*time.Second))
+}
+
+func timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&readTimeout))
+}
+
 func SetReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
+	if t := timeout(); t != 0 {
+		c.SetReadDeadline(time.Now().Add(t))
 	}
 }
 
+func setWriteTimeout(c net.Conn) {
+	if t := timeout(); t != 0 {
+		c.SetWriteDeadline(time.Now().Add(t))
+	}
+}
+
+// SetHandshakeDeadline limits reading and writing of c until
+// ClearDeadline, e.g. when reading request from socks client.
+func SetHandshakeDeadline(c net.Conn) {
+	if t := timeout(); t != 0 {
+		c.SetDeadline(time.Now().Add(t))
+	}
+}
+
+func ClearDeadline(c net.Conn) {
+	if timeout() != 0 {
+		c.SetDeadline(time.Time{})
+	}
+}
+
+// dial connects to addr, marked with dscp if mark.
+func dial(network, addr string, mark bool) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout()}
+	if mark {
+		d.Control = markControl
+	}
+	return d.Dial(network, addr)
+}
+
 func Pipe(src, dst net.Conn, end chan byte) {
+	defer func() {
+		end <- 1
+	}()
+	defer RecoverPanic(src)
+	pprof.SetGoroutineLabels(relayLabels)
+	relayStat.conns.Add(1)
+
 	// Should not use io.Copy here.
 	// io.Copy will try to use the ReadFrom interface of TCPConn, but the src
 	// here is not a regular file, so sendfile is not applicable.
 	// io.Copy will fallback to the normal copy after discovering this,
 	// introducing unnecessary overhead.
-	buf := make([]byte, 4096)
+	rb := NewRelayBuffer()
+	defer rb.Release()
 	for {
+		buf := rb.Bytes()
 		SetReadTimeout(src)
 		n, err := src.Read(buf)
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
+			setWriteTimeout(dst)
 			if _, err = dst.Write(buf[0:n]); err != nil {
 				Debug.Println("write:", err)
 				break
 			}
+			// the other direction reads dst, the connection is not idle
+			// while data flows in either direction
+			SetReadTimeout(dst)
+			relayStat.bytes.Add(int64(n))
 		}
 		if err != nil {
 			if err != io.EOF {
@@ -36,6 +202,6 @@ func Pipe(src, dst net.Conn, end chan byte) {
 			}
 			break
 		}
+		rb.Tune(n)
 	}
-	end <- 1
 }
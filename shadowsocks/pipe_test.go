@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayBufferAutoTune(t *testing.T) {
+	setRelayBuf(8192, true)
+	defer setRelayBuf(0, false)
+
+	rb := NewRelayBuffer()
+	if len(rb.Bytes()) != minRelayBufSize {
+		t.Fatal("auto tuned buffer should start with minimum size")
+	}
+	// bulk transfer fills up the buffer
+	for i := 0; i < 10; i++ {
+		rb.Tune(len(rb.Bytes()))
+	}
+	if len(rb.Bytes()) != 8192 {
+		t.Errorf("buffer should grow to %d, got %d", 8192, len(rb.Bytes()))
+	}
+	// chatty flow only reads a few bytes each time
+	for i := 0; i < 100; i++ {
+		rb.Tune(10)
+	}
+	if len(rb.Bytes()) != minRelayBufSize {
+		t.Errorf("buffer should shrink to %d, got %d", minRelayBufSize, len(rb.Bytes()))
+	}
+}
+
+func TestRelayBufferFixedSize(t *testing.T) {
+	rb := NewRelayBuffer()
+	for i := 0; i < 10; i++ {
+		rb.Tune(len(rb.Bytes()))
+	}
+	if len(rb.Bytes()) != defaultRelayBufSize {
+		t.Error("buffer size should not change without auto tuning")
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	SetTimeout(1)
+	app, local := net.Pipe()
+	remote, server := net.Pipe()
+	end := make(chan byte, 2)
+	ended := 0
+	defer func() {
+		// relays read the timeout until they end
+		app.Close()
+		server.Close()
+		local.Close()
+		remote.Close()
+		for ; ended < 2; ended++ {
+			<-end
+		}
+		SetTimeout(0)
+	}()
+	go Pipe(local, remote, end)
+	go Pipe(remote, local, end)
+	go io.Copy(io.Discard, app)
+
+	// downloading only, upload direction should not time out
+	for i := 0; i < 6; i++ {
+		if _, err := server.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-end:
+			ended++
+			t.Fatal("relay ended while data flows")
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+	select {
+	case <-end:
+		ended++
+	case <-time.After(3 * time.Second):
+		t.Error("idle relay should end")
+	}
+}
@@ -0,0 +1,105 @@
+package shadowsocks
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// SIP003 plugins transform traffic between client and server, e.g. to look
+// like websocket. On client, the plugin listens on a local address and
+// connects to server. On server, the plugin listens on the server port and
+// connects to shadowsocks listening on a local address. Addresses are passed
+// to the plugin in environment variables.
+
+// plugin is started again after exiting unexpectedly, with this delay
+var pluginRestartDelay = 3 * time.Second
+
+type Plugin struct {
+	name, opts    string
+	remote, local string
+	restartDelay  time.Duration
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+}
+
+// StartPlugin starts plugin, which transforms traffic from local to remote
+// address for client, and the reverse for server.
+func StartPlugin(name, opts, remote, local string) (*Plugin, error) {
+	p := &Plugin{name: name, opts: opts, remote: remote, local: local,
+		restartDelay: pluginRestartDelay}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LocalAddr returns the local address, which client connects to or server
+// listens on.
+func (p *Plugin) LocalAddr() string {
+	return p.local
+}
+
+// start starts the process unless the plugin is stopped, under lock so that
+// Stop can't miss a restarted process.
+func (p *Plugin) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil
+	}
+	rhost, rport, _ := net.SplitHostPort(p.remote)
+	lhost, lport, _ := net.SplitHostPort(p.local)
+	cmd := exec.Command(p.name)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+rhost, "SS_REMOTE_PORT="+rport,
+		"SS_LOCAL_HOST="+lhost, "SS_LOCAL_PORT="+lport,
+		"SS_PLUGIN_OPTIONS="+p.opts)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	setPluginAttr(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	Debug.Printf("plugin %s started for %s, local address %s\n", p.name, p.remote, p.local)
+	go p.wait(cmd)
+	return nil
+}
+
+func (p *Plugin) wait(cmd *exec.Cmd) {
+	err := cmd.Wait()
+	p.mu.Lock()
+	stopped := p.stopped
+	p.mu.Unlock()
+	if stopped {
+		return
+	}
+	log.Printf("plugin %s for %s exited: %v, restart in %v\n", p.name, p.remote, err, p.restartDelay)
+	time.Sleep(p.restartDelay)
+	if err = p.start(); err != nil {
+		log.Printf("plugin %s for %s: %v\n", p.name, p.remote, err)
+	}
+}
+
+// Stop kills the plugin process.
+func (p *Plugin) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.cmd.Process.Kill()
+}
+
+// LocalPluginAddr returns a loopback address with a free port for plugin.
+func LocalPluginAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
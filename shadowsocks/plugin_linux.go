@@ -0,0 +1,11 @@
+package shadowsocks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setPluginAttr makes plugin killed when shadowsocks exits.
+func setPluginAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"os/exec"
+)
+
+func setPluginAttr(cmd *exec.Cmd) {
+}
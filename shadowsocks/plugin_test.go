@@ -0,0 +1,61 @@
+package shadowsocks
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin script needs sh")
+	}
+	pluginRestartDelay = 100 * time.Millisecond
+	defer func() {
+		pluginRestartDelay = 3 * time.Second
+	}()
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	script := filepath.Join(dir, "plugin")
+	// exits immediately, so it's restarted and appends its environment again
+	err := os.WriteFile(script, []byte("#!/bin/sh\nenv | grep ^SS_ | sort >> "+out+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := LocalPluginAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := StartPlugin(script, "mode=websocket", "192.0.2.1:8388", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.LocalAddr() != local {
+		t.Errorf("local address %s, should be %s", p.LocalAddr(), local)
+	}
+	_, port, _ := strings.Cut(local, ":")
+	env := "SS_LOCAL_HOST=127.0.0.1\nSS_LOCAL_PORT=" + port + "\nSS_PLUGIN_OPTIONS=mode=websocket\n" +
+		"SS_REMOTE_HOST=192.0.2.1\nSS_REMOTE_PORT=8388\n"
+	var b []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, _ = os.ReadFile(out); len(b) >= 2*len(env) {
+			break
+		}
+	}
+	p.Stop()
+	if len(b) < 2*len(env) || string(b[:2*len(env)]) != env+env {
+		t.Fatalf("plugin should be started twice with environment\n%s\ngot\n%s", env, b)
+	}
+
+	// not restarted after stopped
+	time.Sleep(pluginRestartDelay * 2)
+	b, _ = os.ReadFile(out)
+	after := len(b)
+	time.Sleep(pluginRestartDelay * 2)
+	if b, _ = os.ReadFile(out); len(b) != after {
+		t.Errorf("plugin restarted after stopped")
+	}
+}
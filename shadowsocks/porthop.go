@@ -0,0 +1,72 @@
+package shadowsocks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With port hopping, each server port is also served on a port in a range,
+// which changes every interval. The port of each time slot is derived from
+// password with HMAC, so both client and server know it while it looks
+// random to others, and blocking a single port only works until next slot.
+
+const defaultPortHopInterval = 60 // in seconds
+
+type PortHop struct {
+	first, last int
+	interval    int64 // in seconds
+}
+
+// NewPortHop returns nil if portRange is empty. portRange is in the form of
+// first-last, interval is in seconds, 0 for the default.
+func NewPortHop(portRange string, interval int) (*PortHop, error) {
+	if portRange == "" {
+		return nil, nil
+	}
+	var first, last int
+	var err error
+	parts := strings.SplitN(portRange, "-", 2)
+	if len(parts) == 2 {
+		first, err = strconv.Atoi(parts[0])
+		if err == nil {
+			last, err = strconv.Atoi(parts[1])
+		}
+	}
+	if len(parts) != 2 || err != nil || first <= 0 || last > 0xffff || first > last {
+		return nil, fmt.Errorf("port_hop %s should be a port range like 20000-29999", portRange)
+	}
+	if interval < 0 {
+		return nil, errors.New("port_hop_interval should not be negative")
+	}
+	if interval == 0 {
+		interval = defaultPortHopInterval
+	}
+	return &PortHop{first, last, int64(interval)}, nil
+}
+
+// Slot returns the time slot t is in.
+func (h *PortHop) Slot(t time.Time) int64 {
+	return t.Unix() / h.interval
+}
+
+// SlotStart returns the time slot starts.
+func (h *PortHop) SlotStart(slot int64) time.Time {
+	return time.Unix(slot*h.interval, 0)
+}
+
+// Port returns the hopping port of server port with password in slot.
+func (h *PortHop) Port(password string, port int, slot int64) int {
+	var msg [10]byte
+	binary.BigEndian.PutUint16(msg[:], uint16(port))
+	binary.BigEndian.PutUint64(msg[2:], uint64(slot))
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(msg[:])
+	sum := binary.BigEndian.Uint64(mac.Sum(nil))
+	return h.first + int(sum%uint64(h.last-h.first+1))
+}
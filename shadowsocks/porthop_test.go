@@ -0,0 +1,48 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPortHop(t *testing.T) {
+	h, err := NewPortHop("20000-20999", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	slot := h.Slot(now)
+	if start := h.SlotStart(slot); start.After(now) || !h.SlotStart(slot+1).After(now) {
+		t.Errorf("slot %d starts at %v, not containing %v", slot, start, now)
+	}
+	seen := map[int]bool{}
+	for s := slot; s < slot+100; s++ {
+		p := h.Port("foobar!", 8388, s)
+		if p < 20000 || p > 20999 {
+			t.Fatalf("port %d out of range", p)
+		}
+		if p != h.Port("foobar!", 8388, s) {
+			t.Fatal("port should be the same for the same slot")
+		}
+		seen[p] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("only %d different ports in 100 slots", len(seen))
+	}
+	if h.Port("foobar!", 8388, slot) == h.Port("foobar!", 8389, slot) &&
+		h.Port("foobar!", 8388, slot+1) == h.Port("foobar!", 8389, slot+1) {
+		t.Error("different server ports should hop differently")
+	}
+
+	if h, err = NewPortHop("", 0); h != nil || err != nil {
+		t.Error("empty range should disable port hopping")
+	}
+	for _, r := range []string{"20000", "0-100", "200-100", "60000-70000", "a-b"} {
+		if _, err = NewPortHop(r, 0); err == nil {
+			t.Errorf("%s should be invalid", r)
+		}
+	}
+	if _, err = NewPortHop("20000-20999", -1); err == nil {
+		t.Error("negative interval should be invalid")
+	}
+}
@@ -0,0 +1,152 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Server list is published by a coordinator, e.g. the admin interface of a
+// server, for clients to sync servers of a fleet. The list is signed with
+// ed25519 so that clients only apply lists from the coordinator. As it
+// contains passwords, it's only fetched over HTTPS. The signed document is like
+//
+//	{
+//		"list": {"version": 3, "expires": 1700000000, "method": "aes-256-gcm",
+//			"servers": {"192.0.2.1:8388": "password", "192.0.2.2:8388": ""}},
+//		"signature": "base64 encoded ed25519 signature of the list"
+//	}
+//
+// The signature covers the list exactly as it appears in the document.
+
+// ServerList maps server address to password, empty password means the one
+// configured on client. Version must increase when the list changes, clients
+// reject lists older than the one applied, so that old lists can't be replayed.
+type ServerList struct {
+	Version int64             `json:"version"`
+	Expires int64             `json:"expires"` // unix time, 0 for never
+	Method  string            `json:"method"`
+	Servers map[string]string `json:"servers"`
+}
+
+// a coordinator not responding shouldn't block syncing forever
+var serverListClient = &http.Client{Timeout: 30 * time.Second}
+
+type signedServerList struct {
+	List      json.RawMessage `json:"list"`
+	Signature string          `json:"signature"`
+}
+
+// ParseServerListKey decodes base64 encoded ed25519 private key, either the
+// 32 bytes seed or the 64 bytes key.
+func ParseServerListKey(key string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("server list: invalid private key")
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, errors.New("server list: invalid private key")
+}
+
+// SignServerList returns signed document of list, which is json encoded
+// ServerList.
+func SignServerList(list []byte, key ed25519.PrivateKey) ([]byte, error) {
+	var l ServerList
+	if err := json.Unmarshal(list, &l); err != nil {
+		return nil, fmt.Errorf("server list: %v", err)
+	}
+	// encoding compacts the embedded list, sign what will appear. HTML
+	// escaping would change characters like & in passwords after signing.
+	var buf bytes.Buffer
+	json.Compact(&buf, list)
+	var doc bytes.Buffer
+	enc := json.NewEncoder(&doc)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&signedServerList{
+		List:      json.RawMessage(buf.Bytes()),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, buf.Bytes())),
+	}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(doc.Bytes(), []byte("\n")), nil
+}
+
+// ParseServerList verifies signed document with base64 encoded ed25519
+// public key, and returns the list if it's not expired.
+func ParseServerList(doc []byte, publicKey string) (*ServerList, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("server list: invalid public key")
+	}
+	var signed signedServerList
+	if err = json.Unmarshal(doc, &signed); err != nil {
+		return nil, fmt.Errorf("server list: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("server list: malformed signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), signed.List, sig) {
+		return nil, errors.New("server list: signature verification failed")
+	}
+	var list ServerList
+	if err = json.Unmarshal(signed.List, &list); err != nil {
+		return nil, fmt.Errorf("server list: %v", err)
+	}
+	if list.Expires != 0 && time.Now().Unix() > list.Expires {
+		return nil, fmt.Errorf("server list: version %d expired", list.Version)
+	}
+	if len(list.Servers) == 0 {
+		return nil, errors.New("server list: no server")
+	}
+	for s := range list.Servers {
+		if !HasPort(s) {
+			return nil, fmt.Errorf("server list: no port for server %s", s)
+		}
+		if err = ValidateAddr(s); err != nil {
+			return nil, err
+		}
+	}
+	return &list, nil
+}
+
+// FetchServerList gets signed server list from url, sending token as bearer
+// token if not empty. url must be https, the list and token would be
+// readable on the path otherwise.
+func FetchServerList(listURL, token, publicKey string) (*ServerList, error) {
+	if u, err := url.Parse(listURL); err != nil || u.Scheme != "https" {
+		return nil, fmt.Errorf("server list: %s should be https, as the list contains passwords", listURL)
+	}
+	req, err := http.NewRequest("GET", listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := serverListClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", listURL, resp.Status)
+	}
+	doc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ParseServerList(doc, publicKey)
+}
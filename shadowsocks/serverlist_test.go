@@ -0,0 +1,109 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerList(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := base64.StdEncoding.EncodeToString(pub)
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+	key, err := ParseServerListKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := []byte(`{"version": 2, "method": "aes-256-gcm", "servers": {"192.0.2.1:8388": "pw", "[2001:db8::1]:8388": ""}}`)
+	doc, err := SignServerList(list, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ParseServerList(doc, pubKey)
+	if err != nil {
+		t.Fatal("valid list rejected:", err)
+	}
+	if l.Version != 2 || l.Method != "aes-256-gcm" || len(l.Servers) != 2 || l.Servers["192.0.2.1:8388"] != "pw" {
+		t.Errorf("parsed list %+v", l)
+	}
+
+	// characters json escapes for HTML by default must round trip
+	doc, err = SignServerList([]byte(`{"version": 3, "servers": {"192.0.2.1:8388": "p&ss<w>rd"}}`), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := ParseServerList(doc, pubKey); err != nil || l.Servers["192.0.2.1:8388"] != "p&ss<w>rd" {
+		t.Errorf("list with HTML characters in password: %+v %v", l, err)
+	}
+	doc, _ = SignServerList(list, key)
+
+	tampered := bytes.Replace(doc, []byte("192.0.2.1"), []byte("192.0.2.9"), 1)
+	if _, err = ParseServerList(tampered, pubKey); err == nil {
+		t.Error("tampered list should be rejected")
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err = ParseServerList(doc, base64.StdEncoding.EncodeToString(otherPub)); err == nil {
+		t.Error("list signed with another key should be rejected")
+	}
+
+	for _, list := range []string{
+		`{"version": 3, "expires": 1, "servers": {"192.0.2.1:8388": ""}}`,
+		`{"version": 3, "servers": {}}`,
+		`{"version": 3, "servers": {"192.0.2.1": ""}}`,
+	} {
+		doc, err := SignServerList([]byte(list), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseServerList(doc, pubKey); err == nil {
+			t.Errorf("list %s should be rejected", list)
+		}
+	}
+	if _, err = SignServerList([]byte("not json"), key); err == nil {
+		t.Error("malformed list should not be signed")
+	}
+	if _, err = ParseServerListKey("not base64"); err == nil {
+		t.Error("malformed key should be rejected")
+	}
+}
+
+func TestFetchServerList(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	pubKey := base64.StdEncoding.EncodeToString(pub)
+	doc, err := SignServerList([]byte(`{"version": 1, "servers": {"192.0.2.1:8388": "pw"}}`), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer r-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(doc)
+	})
+
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+	client := serverListClient
+	defer func() { serverListClient = client }()
+	serverListClient = ts.Client()
+	if l, err := FetchServerList(ts.URL+"/server-list", "r-token", pubKey); err != nil || l.Version != 1 {
+		t.Errorf("got %+v %v", l, err)
+	}
+	if _, err = FetchServerList(ts.URL+"/server-list", "bad-token", pubKey); err == nil {
+		t.Error("list should not be fetched with bad token")
+	}
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	if _, err = FetchServerList(plain.URL+"/server-list", "r-token", pubKey); err == nil {
+		t.Error("list should not be fetched over plain HTTP")
+	}
+}
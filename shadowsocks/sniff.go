@@ -0,0 +1,161 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Relayed traffic is classified by the protocol sniffed from the first bytes
+// sent by clients, and by destination port, so operators can spot abuse
+// patterns like mail sent to port 25 or unexpected protocols, and tune rules.
+// Counters are exported by the admin interface at /debug/vars as
+// traffic_class, e.g. traffic_class.tls.443 is {"conns": 3, "bytes": 5120}.
+// Bytes are counted in both directions. Destination ports beyond
+// maxClassPorts of a protocol are counted as port "others".
+
+const (
+	ProtoTLS   = "tls"
+	ProtoHTTP  = "http"
+	ProtoQUIC  = "quic"
+	ProtoOther = "other"
+
+	maxClassPorts = 256
+	quicMinSize   = 1200 // initial packets are padded to this
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("CONNECT "), []byte("PATCH "), []byte("TRACE "),
+}
+
+// SniffProtocol tells the protocol of b, the first data sent by client. QUIC
+// is only detected in UDP, from its initial packet.
+func SniffProtocol(b []byte, udp bool) string {
+	if udp {
+		if isQUICInitial(b) {
+			return ProtoQUIC
+		}
+		return ProtoOther
+	}
+	// TLS handshake record
+	if len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03 {
+		return ProtoTLS
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return ProtoHTTP
+		}
+	}
+	return ProtoOther
+}
+
+func isQUICInitial(b []byte) bool {
+	// long header with fixed bit
+	if len(b) < quicMinSize || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch v := binary.BigEndian.Uint32(b[1:5]); {
+	case v == 1, v == 0x6b3343cf: // version 1 and 2
+		return true
+	case v&0xffffff00 == 0xff000000: // drafts
+		return true
+	}
+	return false
+}
+
+// TrafficClass counts connections and bytes of a protocol to a port.
+type TrafficClass struct {
+	conns expvar.Int
+	bytes expvar.Int
+}
+
+func (c *TrafficClass) String() string {
+	return fmt.Sprintf(`{"conns": %d, "bytes": %d}`, c.conns.Value(), c.bytes.Value())
+}
+
+func (c *TrafficClass) AddBytes(n int) {
+	c.bytes.Add(int64(n))
+}
+
+var trafficClass struct {
+	sync.Mutex
+	protos map[string]*expvar.Map // ports of each protocol
+	nports map[string]int
+}
+
+func init() {
+	m := expvar.NewMap("traffic_class")
+	trafficClass.protos = map[string]*expvar.Map{}
+	trafficClass.nports = map[string]int{}
+	for _, proto := range []string{ProtoTLS, ProtoHTTP, ProtoQUIC, ProtoOther} {
+		ports := new(expvar.Map).Init()
+		m.Set(proto, ports)
+		trafficClass.protos[proto] = ports
+	}
+}
+
+// Classify counts a new connection or UDP flow of proto to port, and
+// returns its class to count bytes.
+func Classify(proto, port string) *TrafficClass {
+	trafficClass.Lock()
+	defer trafficClass.Unlock()
+	ports := trafficClass.protos[proto]
+	if ports == nil {
+		proto, ports = ProtoOther, trafficClass.protos[ProtoOther]
+	}
+	c, _ := ports.Get(port).(*TrafficClass)
+	if c == nil {
+		if trafficClass.nports[proto] >= maxClassPorts {
+			port = "others"
+			c, _ = ports.Get(port).(*TrafficClass)
+		}
+		if c == nil {
+			c = &TrafficClass{}
+			ports.Set(port, c)
+			trafficClass.nports[proto]++
+		}
+	}
+	c.conns.Add(1)
+	return c
+}
+
+// ClassifyConn wraps connection to destination addr, classifying it by the
+// first data written. It's classified as other if destination sends first.
+func ClassifyConn(remote net.Conn, addr string) net.Conn {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		port = "0"
+	}
+	return &classConn{Conn: remote, port: port}
+}
+
+type classConn struct {
+	net.Conn
+	port  string
+	once  sync.Once
+	class *TrafficClass
+}
+
+func (c *classConn) classify(b []byte) {
+	c.once.Do(func() {
+		c.class = Classify(SniffProtocol(b, false), c.port)
+	})
+}
+
+func (c *classConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.classify(nil)
+	c.class.AddBytes(n)
+	return
+}
+
+func (c *classConn) Write(b []byte) (n int, err error) {
+	c.classify(b)
+	n, err = c.Conn.Write(b)
+	c.class.AddBytes(n)
+	return
+}
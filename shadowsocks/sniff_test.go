@@ -0,0 +1,66 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	quic := make([]byte, quicMinSize)
+	copy(quic, []byte{0xc3, 0, 0, 0, 1})
+	tests := []struct {
+		b     []byte
+		udp   bool
+		proto string
+	}{
+		{[]byte{0x16, 0x03, 0x01, 0x02, 0x00}, false, ProtoTLS},
+		{[]byte("GET / HTTP/1.1\r\n"), false, ProtoHTTP},
+		{[]byte("CONNECT example.com:443 HTTP/1.1\r\n"), false, ProtoHTTP},
+		{[]byte("GETTING"), false, ProtoOther},
+		{[]byte("SSH-2.0-OpenSSH_9.6\r\n"), false, ProtoOther},
+		{nil, false, ProtoOther},
+		{quic, true, ProtoQUIC},
+		{quic, false, ProtoOther},
+		{quic[:100], true, ProtoOther},
+		// DNS query whose id looks like long header
+		{append([]byte{0xc3, 0x12, 1, 0, 0, 1}, make([]byte, quicMinSize)...), true, ProtoOther},
+	}
+	for i, tt := range tests {
+		if proto := SniffProtocol(tt.b, tt.udp); proto != tt.proto {
+			t.Errorf("%d: got %s, should be %s", i, proto, tt.proto)
+		}
+	}
+}
+
+func TestClassifyConn(t *testing.T) {
+	// counters are global, reset them for -count
+	trafficClass.Lock()
+	for proto, ports := range trafficClass.protos {
+		ports.Init()
+		trafficClass.nports[proto] = 0
+	}
+	trafficClass.Unlock()
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c := ClassifyConn(a, "example.com:8443")
+	go func() {
+		b.Read(make([]byte, 64))
+		b.Write([]byte("reply"))
+	}()
+	c.Write([]byte("POST / HTTP/1.1\r\n"))
+	c.Read(make([]byte, 16))
+	c.Close()
+
+	class := trafficClass.protos[ProtoHTTP].Get("8443").(*TrafficClass)
+	if class.conns.Value() != 1 || class.bytes.Value() != 17+5 {
+		t.Errorf("got %s", class)
+	}
+
+	for i := 0; i < maxClassPorts+2; i++ {
+		Classify("unknown", string(rune('a'+i%26))+string(rune('a'+i/26)))
+	}
+	if others := trafficClass.protos[ProtoOther].Get("others"); others == nil || others.(*TrafficClass).conns.Value() != 2 {
+		t.Errorf("ports beyond the limit should be counted as others, got %v", others)
+	}
+}
@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// Socket buffers of connections between client and server can be sized to
+// the bandwidth-delay product, as default buffers limit throughput of paths
+// with high bandwidth and long RTT. Manual sizes override the computed one.
+// Operating systems may limit the size, e.g. net.core.rmem_max on Linux.
+
+type socketOptions struct {
+	bandwidth      int64 // expected bandwidth in bytes per second
+	sndBuf, rcvBuf int
+
+	// Congestion control algorithm, e.g. bbr, and TCP_NOTSENT_LOWAT, which
+	// keeps less unsent data in kernel to reduce latency. Only supported on
+	// Linux.
+	congestion   string
+	notSentLowat int
+
+	// TCP keepalive idle time and interval, and number of probes. Zero
+	// values use the defaults of Go and the operating system.
+	keepAlive      time.Duration
+	keepAliveCount int
+}
+
+// replaced on reload, read when connections are tuned
+var sockOpts struct {
+	sync.RWMutex
+	socketOptions
+}
+
+func setSocketOptions(o socketOptions) {
+	sockOpts.Lock()
+	sockOpts.socketOptions = o
+	sockOpts.Unlock()
+}
+
+func getSocketOptions() socketOptions {
+	sockOpts.RLock()
+	defer sockOpts.RUnlock()
+	return sockOpts.socketOptions
+}
+
+// Below this, OS default buffers with auto tuning are good enough.
+const minBDPBuf = 128 * 1024
+
+func bdpBufSize(bandwidth int64, rtt time.Duration) int {
+	bdp := bandwidth * int64(rtt) / int64(time.Second)
+	if bdp < minBDPBuf {
+		return 0
+	}
+	return int(bdp)
+}
+
+// TuneConn sizes socket buffers of conn with the measured rtt, which is 0 if
+// unknown, and sets TCP options.
+func TuneConn(conn net.Conn, rtt time.Duration) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	o := getSocketOptions()
+	setTCPOptions(tc, o.congestion, o.notSentLowat)
+	if o.keepAlive != 0 || o.keepAliveCount != 0 {
+		err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.keepAlive,
+			Interval: o.keepAlive,
+			Count:    o.keepAliveCount,
+		})
+		if err != nil {
+			Debug.Println("set keepalive:", err)
+		}
+	}
+	snd, rcv := o.sndBuf, o.rcvBuf
+	if size := bdpBufSize(o.bandwidth, rtt); size != 0 {
+		if snd == 0 {
+			snd = size
+		}
+		if rcv == 0 {
+			rcv = size
+		}
+	}
+	if snd != 0 {
+		if err := tc.SetWriteBuffer(snd); err != nil {
+			Debug.Println("set send buffer:", err)
+		}
+	}
+	if rcv != 0 {
+		if err := tc.SetReadBuffer(rcv); err != nil {
+			Debug.Println("set receive buffer:", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package shadowsocks
+
+import (
+	"net"
+	"syscall"
+)
+
+// not defined in syscall package
+const tcpNotSentLowat = 0x19
+
+func setTCPOptions(tc *net.TCPConn, congestion string, notSentLowat int) {
+	if congestion == "" && notSentLowat == 0 {
+		return
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		if congestion != "" {
+			if err := syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, congestion); err != nil {
+				Debug.Println("set congestion control:", err)
+			}
+		}
+		if notSentLowat != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpNotSentLowat, notSentLowat); err != nil {
+				Debug.Println("set TCP_NOTSENT_LOWAT:", err)
+			}
+		}
+	})
+}
+
+func checkTCPOptions(config *Config, dscp int) error {
+	return nil
+}
+
+func setTOS(fd uintptr, tos int) {
+	// either fails depending on the address family of socket
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	if err4 != nil && err6 != nil {
+		Debug.Println("set dscp:", err4)
+	}
+}
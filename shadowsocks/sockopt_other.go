@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+)
+
+func setTCPOptions(tc *net.TCPConn, congestion string, notSentLowat int) {
+}
+
+func setTOS(fd uintptr, tos int) {
+}
+
+func checkTCPOptions(config *Config, dscp int) error {
+	if config.TCPCongestion != "" || config.TCPNotSentLowat != 0 {
+		return errors.New("tcp_congestion and tcp_notsent_lowat are only supported on Linux")
+	}
+	if dscp >= 0 {
+		return errors.New("dscp is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBDPBufSize(t *testing.T) {
+	// 100Mbit/s with 200ms RTT
+	if size := bdpBufSize(100*1000*1000/8, 200*time.Millisecond); size != 2500000 {
+		t.Error("wrong buffer size for long fat pipe:", size)
+	}
+	if size := bdpBufSize(10*1000*1000/8, 10*time.Millisecond); size != 0 {
+		t.Error("should keep default buffer for small BDP, got", size)
+	}
+	if size := bdpBufSize(0, time.Second); size != 0 {
+		t.Error("should keep default buffer without bandwidth, got", size)
+	}
+}
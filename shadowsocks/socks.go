@@ -0,0 +1,228 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Server side of socks5 (rfc1928), used by clients to accept connections from
+// applications.
+
+var (
+	errSocksAddrType      = errors.New("socks addr type not supported")
+	errSocksVer           = errors.New("socks version not supported")
+	errSocksAuthExtraData = errors.New("socks authentication get extra data")
+	errSocksReqExtraData  = errors.New("socks request get extra data")
+	errSocksCmd           = errors.New("socks command not supported")
+	errSocksAuthVer       = errors.New("socks username/password authentication version not supported")
+	errSocksNoGSSAPI      = errors.New("socks client doesn't support required GSSAPI authentication")
+)
+
+const (
+	SocksVer5            = 5
+	SocksCmdConnect      = 1
+	SocksCmdUDPAssociate = 3
+
+	socksMethodNoAuth   = 0
+	socksMethodUserPass = 2
+	socksUserPassVer    = 1
+
+	socksRepSucceeded      = 0
+	socksRepGeneralFailure = 1
+	socksRepCmdUnsupported = 7
+)
+
+// socksReply returns reply to socks request, bound address is left empty.
+func socksReply(rep byte) []byte {
+	return []byte{SocksVer5, rep, 0x00, addrTypeIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+// getSocksUserPass reads username and password in username/password
+// authentication (rfc1929).
+func getSocksUserPass(conn net.Conn) (user, passwd string, err error) {
+	// version(1) + ulen(1) + uname(1 to 255) + plen(1) + passwd(1 to 255)
+	buf := GetBuf(513)
+	defer PutBuf(buf)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != socksUserPassVer {
+		err = errSocksAuthVer
+		return
+	}
+	ulen := int(buf[1])
+	if _, err = io.ReadFull(conn, buf[:ulen+1]); err != nil {
+		return
+	}
+	user = string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err = io.ReadFull(conn, buf[:plen]); err != nil {
+		return
+	}
+	passwd = string(buf[:plen])
+	return
+}
+
+// SocksHandShake selects authentication method with socks client. If
+// checkUser is not nil and the client supports username/password
+// authentication, the username is passed to checkUser, which fails the
+// authentication by returning error. Password is ignored.
+func SocksHandShake(conn net.Conn, checkUser func(user string) error) error {
+	_, err := SocksHandShakeGSSAPI(conn, checkUser, nil)
+	return err
+}
+
+// SocksHandShakeGSSAPI is like SocksHandShake, but if gssapi is not nil, the
+// client must authenticate with it. The returned conn should be used for the
+// rest of the connection, as it encapsulates data after GSSAPI
+// authentication.
+func SocksHandShakeGSSAPI(conn net.Conn, checkUser func(user string) error, gssapi GSSAPIProvider) (c net.Conn, err error) {
+	const (
+		idVer     = 0
+		idNmethod = 1
+	)
+	// version identification and method selection message in theory can have
+	// at most 256 methods, plus version and nmethod field in total 258 bytes
+	// the current rfc defines only 3 authentication methods (plus 2 reserved),
+	// so it won't be such long in practice
+
+	buf := GetBuf(258)
+	defer PutBuf(buf)
+
+	var n int
+	// make sure we get the nmethod field
+	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
+		return
+	}
+	if buf[idVer] != SocksVer5 {
+		return nil, errSocksVer
+	}
+	nmethod := int(buf[idNmethod])
+	msgLen := nmethod + 2
+	if n == msgLen { // handshake done, common case
+		// do nothing, jump directly to send confirmation
+	} else if n < msgLen { // has more methods to read, rare case
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
+			return
+		}
+	} else { // error, should not get extra data
+		return nil, errSocksAuthExtraData
+	}
+	userPass, gss := false, false
+	for _, m := range buf[idNmethod+1 : msgLen] {
+		switch m {
+		case socksMethodUserPass:
+			userPass = true
+		case socksMethodGSSAPI:
+			gss = true
+		}
+	}
+	if gssapi != nil {
+		if !gss {
+			conn.Write([]byte{SocksVer5, socksNoMethod})
+			return nil, errSocksNoGSSAPI
+		}
+		if _, err = conn.Write([]byte{SocksVer5, socksMethodGSSAPI}); err != nil {
+			return
+		}
+		return gssapiAuth(conn, gssapi)
+	}
+	if !userPass || checkUser == nil {
+		// send confirmation: version 5, no authentication required
+		_, err = conn.Write([]byte{SocksVer5, socksMethodNoAuth})
+		return conn, err
+	}
+
+	if _, err = conn.Write([]byte{SocksVer5, socksMethodUserPass}); err != nil {
+		return
+	}
+	user, _, err := getSocksUserPass(conn)
+	if err != nil {
+		return
+	}
+	if err = checkUser(user); err != nil {
+		// fail authentication so the client knows the username is wrong
+		conn.Write([]byte{socksUserPassVer, 1})
+		return
+	}
+	_, err = conn.Write([]byte{socksUserPassVer, 0})
+	return conn, err
+}
+
+// ReadSocksRequest reads socks request of CONNECT or UDP ASSOCIATE command.
+// rawaddr is the part of request starting from the ATYP field, which is also
+// the request header of shadowsocks connections. addr is in the form of
+// host:port.
+func ReadSocksRequest(conn net.Conn) (cmd byte, rawaddr []byte, addr string, err error) {
+	const (
+		idVer   = 0
+		idCmd   = 1
+		idType  = 3 // address type index
+		idIP0   = 4 // ip addres start index
+		idDmLen = 4 // domain address length index
+		idDm0   = 5 // domain address start index
+
+		lenIP     = 3 + 1 + 4 + 2  // 3(ver+cmd+rsv) + 1addrType + 4ip + 2port
+		lenIPv6   = 3 + 1 + 16 + 2 // 3 + 1addrType + 16ipv6 + 2port
+		lenDmBase = 3 + 1 + 1 + 2  // 3 + 1addrType + 1addrLen + 2port, plus addrLen
+	)
+	// 3(ver+cmd+rsv) + 1addrType + 1addrLen + 256(max length address) + 2port
+	buf := make([]byte, 263, 263)
+	var n int
+	// read till we get possible domain length field
+	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
+		return
+	}
+	// check version and cmd
+	if buf[idVer] != SocksVer5 {
+		err = errSocksVer
+		return
+	}
+	cmd = buf[idCmd]
+	if cmd != SocksCmdConnect && cmd != SocksCmdUDPAssociate {
+		err = errSocksCmd
+		return
+	}
+
+	var reqLen int
+	switch buf[idType] {
+	case addrTypeIPv4:
+		reqLen = lenIP
+	case addrTypeIPv6:
+		reqLen = lenIPv6
+	case addrTypeDomain:
+		reqLen = int(buf[idDmLen]) + lenDmBase
+	default:
+		err = errSocksAddrType
+		return
+	}
+
+	if n == reqLen {
+		// common case, do nothing
+	} else if n < reqLen { // rare case
+		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+			return
+		}
+	} else {
+		err = errSocksReqExtraData
+		return
+	}
+
+	rawaddr = buf[idType:reqLen]
+
+	var host string
+	switch buf[idType] {
+	case addrTypeDomain:
+		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
+	case addrTypeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case addrTypeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	}
+	port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+	addr = JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
@@ -0,0 +1,41 @@
+package shadowsocks
+
+import (
+	"expvar"
+)
+
+// Counters of each subsystem, exported by the admin interface at /debug/vars
+// so performance problems can be attributed to the right layer. CPU and heap
+// profiles are available at /debug/pprof, relay goroutines are labeled with
+// subsystem=relay.
+
+type cryptoStats struct {
+	encryptBytes expvar.Int
+	decryptBytes expvar.Int
+	allocBytes   expvar.Int // buffers allocated for encryption
+}
+
+type relayStats struct {
+	conns      expvar.Int // number of relays started
+	bytes      expvar.Int
+	bufAllocs  expvar.Int
+	allocBytes expvar.Int
+}
+
+var (
+	cryptoStat cryptoStats
+	relayStat  relayStats
+)
+
+func init() {
+	m := expvar.NewMap("crypto")
+	m.Set("encrypt_bytes", &cryptoStat.encryptBytes)
+	m.Set("decrypt_bytes", &cryptoStat.decryptBytes)
+	m.Set("alloc_bytes", &cryptoStat.allocBytes)
+
+	m = expvar.NewMap("relay")
+	m.Set("conns", &relayStat.conns)
+	m.Set("bytes", &relayStat.bytes)
+	m.Set("buffer_allocs", &relayStat.bufAllocs)
+	m.Set("alloc_bytes", &relayStat.allocBytes)
+}
@@ -0,0 +1,91 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// With strict enabled, configurations considered weak are refused instead of
+// warned, for deployments which must pass security review.
+
+// CheckStrict returns error listing weak settings in config of server or
+// client, nil if strict is not enabled. Server config should have
+// port_password unified.
+func CheckStrict(config *Config, server bool) error {
+	if !config.Strict {
+		return nil
+	}
+	var problems []string
+	weakMethod := func(what, method string) {
+		if method == "" || method == "table" || method == "plain" {
+			if method == "" {
+				method = "table"
+			}
+			problems = append(problems, fmt.Sprintf("%s uses %s method, use aes-256-gcm or chacha20-ietf-poly1305", what, method))
+		}
+	}
+	emptyPassword := func(what string, passwords map[string]string) {
+		var empty []string
+		for k, v := range passwords {
+			if v == "" {
+				empty = append(empty, k)
+			}
+		}
+		sort.Strings(empty)
+		for _, k := range empty {
+			problems = append(problems, fmt.Sprintf("%s %s has empty password", what, k))
+		}
+	}
+
+	if server {
+		ports := make(map[string]string, len(config.PortPassword))
+		for port := range config.PortPassword {
+			if m, ok := config.PortMethod[port]; ok {
+				ports[port] = m
+			} else {
+				ports[port] = config.Method
+			}
+		}
+		var names []string
+		for port := range ports {
+			names = append(names, port)
+		}
+		sort.Strings(names)
+		for _, port := range names {
+			weakMethod("port "+port, ports[port])
+		}
+		emptyPassword("port", config.PortPassword)
+	} else {
+		weakMethod("client", config.Method)
+		if len(config.ServerPassword) != 0 {
+			emptyPassword("server", config.ServerPassword)
+		} else if config.Password == "" {
+			problems = append(problems, "password is empty")
+		}
+		// socks and http proxy don't authenticate users
+		if !isLoopbackAddr(config.BindAddress) {
+			problems = append(problems, "unauthenticated local proxy listens on non-loopback address, set bind_address to 127.0.0.1")
+		}
+	}
+	if config.Timeout <= 0 {
+		problems = append(problems, "timeout is not set")
+	}
+	if exposedAdmin(config) {
+		problems = append(problems, "admin interface listens on non-loopback address without admin_tokens")
+	}
+	if server && ExposedManager(config.ManagerAddr) {
+		problems = append(problems, "manager API listens on non-loopback address")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("strict: " + strings.Join(problems, "; "))
+}
+
+// ExposedManager tells whether ss-manager API at addr, which has no
+// authentication, can be reached from other hosts.
+func ExposedManager(addr string) bool {
+	return addr != "" && !strings.Contains(addr, "/") && !isLoopbackAddr(addr)
+}
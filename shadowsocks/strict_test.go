@@ -0,0 +1,53 @@
+package shadowsocks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckStrict(t *testing.T) {
+	client := &Config{Method: "aes-256-gcm", Password: "foobar!", Timeout: 60, BindAddress: "127.0.0.1"}
+	if err := CheckStrict(client, false); err != nil {
+		t.Error("strict disabled:", err)
+	}
+	client.Strict = true
+	if err := CheckStrict(client, false); err != nil {
+		t.Error("good client config:", err)
+	}
+	weak := *client
+	weak.Method = ""
+	weak.Password = ""
+	weak.BindAddress = "0.0.0.0"
+	weak.Timeout = 0
+	err := CheckStrict(&weak, false)
+	if err == nil {
+		t.Fatal("weak client config should be refused")
+	}
+	for _, s := range []string{"table", "password", "bind_address", "timeout"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("%q not reported in %v", s, err)
+		}
+	}
+
+	server := &Config{
+		Method:       "aes-256-gcm",
+		PortPassword: map[string]string{"8387": "foobar", "8388": "barfoo"},
+		Timeout:      60,
+		Strict:       true,
+	}
+	if err := CheckStrict(server, true); err != nil {
+		t.Error("good server config:", err)
+	}
+	server.PortMethod = map[string]string{"8388": "table"}
+	server.PortPassword["8387"] = ""
+	server.AdminAddr = "0.0.0.0:1090"
+	err = CheckStrict(server, true)
+	if err == nil {
+		t.Fatal("weak server config should be refused")
+	}
+	for _, s := range []string{"port 8388 uses table", "port 8387 has empty password", "admin"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("%q not reported in %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package shadowsocks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSServer serves TLS with a self-signed certificate for example.com,
+// relaying one request to an echo destination. It returns the certificate.
+func testTLSServer(t *testing.T, tbl *EncryptTable) (net.Listener, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// echo what follows the address
+				c := NewConn(tls.Server(conn, config), tbl)
+				defer c.Close()
+				rawaddr, _ := RawAddr("example.com:80")
+				if _, err := io.ReadFull(c, make([]byte, len(rawaddr))); err != nil {
+					return
+				}
+				buf := make([]byte, 64)
+				n, _ := c.Read(buf)
+				c.Write(buf[:n])
+			}()
+		}
+	}()
+	return ln, cert
+}
+
+func TestTLSRelay(t *testing.T) {
+	tbl, _ := NewTable("aes-256-gcm", "foobar!")
+	ln, cert := testTLSServer(t, tbl)
+	defer ln.Close()
+	sum := sha256.Sum256(cert.Raw)
+	server := ln.Addr().String()
+
+	tc, err := ClientTLSConfig(server, "", hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = ClientTLSConn(conn, tc); err != nil {
+		t.Fatal(err)
+	}
+	rawaddr, _ := RawAddr("example.com:80")
+	c := NewConnWithRawAddr(conn, rawaddr, tbl)
+	defer c.Close()
+	msg := "relayed inside TLS"
+	if _, err = c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != msg {
+		t.Errorf("got %q %v, should be %q", buf, err, msg)
+	}
+}
+
+func TestClientTLSVerify(t *testing.T) {
+	tbl, _ := NewTable("aes-256-gcm", "foobar!")
+	ln, cert := testTLSServer(t, tbl)
+	defer ln.Close()
+	server := ln.Addr().String()
+	sum := sha256.Sum256(cert.Raw)
+	pin := hex.EncodeToString(sum[:])
+	wrong := sha256.Sum256([]byte("another certificate"))
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	tests := []struct {
+		sni, fingerprint string
+		roots            *x509.CertPool
+		ok               bool
+	}{
+		{"", pin, nil, true},
+		// colon separated like browsers show it
+		{"", hex.EncodeToString(sum[:1]) + ":" + pin[2:], nil, true},
+		{"", hex.EncodeToString(wrong[:]), nil, false},
+		// the pin replaces name verification
+		{"other.example", pin, nil, true},
+		{"example.com", "", roots, true},
+		{"example.com", "", nil, false}, // not signed by system CAs
+		{"", "", roots, false},          // defaults to server host 127.0.0.1
+		{"other.example", "", roots, false},
+	}
+	for i, tt := range tests {
+		tc, err := ClientTLSConfig(server, tt.sni, tt.fingerprint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.roots != nil {
+			tc.RootCAs = tt.roots
+		}
+		conn, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ClientTLSConn(conn, tc)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: handshake error %v, should succeed %v", i, err, tt.ok)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+
+	for _, bad := range []string{"00", "not hex"} {
+		if _, err := ClientTLSConfig(server, "", bad); err == nil {
+			t.Errorf("fingerprint %q should be invalid", bad)
+		}
+	}
+}
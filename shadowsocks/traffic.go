@@ -0,0 +1,116 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Traffic of each server port is accounted for billing multi-user
+// deployments. Payload relayed between clients and destinations is counted,
+// so encryption overhead is not billed. Counters live until the server exits
+// and are kept when ports are removed, so billing should record totals
+// periodically or use reset. Counters since start are never reset, for usage
+// reports and quotas which must not lose traffic to resets of others.
+
+// PortTraffic counts bytes relayed for a port.
+type PortTraffic struct {
+	Upload   int64 `json:"upload"`   // from clients to destinations
+	Download int64 `json:"download"` // from destinations to clients
+
+	// since start, not reset
+	upTotal, downTotal int64
+}
+
+var traffic struct {
+	sync.Mutex
+	ports map[string]*PortTraffic
+}
+
+// Traffic returns counters of port, creating them if there's none.
+func Traffic(port string) *PortTraffic {
+	traffic.Lock()
+	defer traffic.Unlock()
+	if traffic.ports == nil {
+		traffic.ports = map[string]*PortTraffic{}
+	}
+	t, ok := traffic.ports[port]
+	if !ok {
+		t = &PortTraffic{}
+		traffic.ports[port] = t
+	}
+	return t
+}
+
+func (t *PortTraffic) AddUpload(n int) {
+	atomic.AddInt64(&t.Upload, int64(n))
+	atomic.AddInt64(&t.upTotal, int64(n))
+}
+
+func (t *PortTraffic) AddDownload(n int) {
+	atomic.AddInt64(&t.Download, int64(n))
+	atomic.AddInt64(&t.downTotal, int64(n))
+}
+
+// Conn wraps connection to destination to count bytes relayed through it.
+func (t *PortTraffic) Conn(remote net.Conn) net.Conn {
+	return trafficConn{remote, t}
+}
+
+type trafficConn struct {
+	net.Conn
+	t *PortTraffic
+}
+
+func (c trafficConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.t.AddDownload(n)
+	return
+}
+
+func (c trafficConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.t.AddUpload(n)
+	return
+}
+
+// TrafficTotals returns counters of all ports keyed by port. With reset,
+// counters are set to zero after being read.
+func TrafficTotals(reset bool) map[string]PortTraffic {
+	traffic.Lock()
+	defer traffic.Unlock()
+	totals := make(map[string]PortTraffic, len(traffic.ports))
+	for port, t := range traffic.ports {
+		if reset {
+			totals[port] = PortTraffic{Upload: atomic.SwapInt64(&t.Upload, 0), Download: atomic.SwapInt64(&t.Download, 0)}
+		} else {
+			totals[port] = PortTraffic{Upload: atomic.LoadInt64(&t.Upload), Download: atomic.LoadInt64(&t.Download)}
+		}
+	}
+	return totals
+}
+
+// TrafficSinceStart returns counters of all ports since the server started,
+// which are not affected by reset of TrafficTotals.
+func TrafficSinceStart() map[string]PortTraffic {
+	traffic.Lock()
+	defer traffic.Unlock()
+	totals := make(map[string]PortTraffic, len(traffic.ports))
+	for port, t := range traffic.ports {
+		totals[port] = PortTraffic{Upload: atomic.LoadInt64(&t.upTotal), Download: atomic.LoadInt64(&t.downTotal)}
+	}
+	return totals
+}
+
+// ServeTraffic returns traffic of ports in JSON. POST also resets counters,
+// so that each response covers the traffic since the previous one.
+func ServeTraffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TrafficTotals(r.Method == "POST"))
+}
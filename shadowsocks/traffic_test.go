@@ -0,0 +1,64 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraffic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tr := Traffic("18387")
+	if Traffic("18387") != tr {
+		t.Fatal("counters of the same port should be shared")
+	}
+	conn := tr.Conn(c1)
+	go func() {
+		buf := make([]byte, 100)
+		io.ReadFull(c2, buf[:10])
+		c2.Write(buf)
+	}()
+	conn.Write(make([]byte, 10))
+	io.ReadFull(conn, make([]byte, 100))
+	conn.Close()
+
+	tr.AddUpload(5)
+	if got := TrafficTotals(false)["18387"]; got != (PortTraffic{Upload: 15, Download: 100}) {
+		t.Errorf("traffic %+v, should be upload 15 download 100", got)
+	}
+
+	w := httptest.NewRecorder()
+	ServeTraffic(w, httptest.NewRequest("POST", "/traffic", nil))
+	var totals map[string]PortTraffic
+	if err := json.Unmarshal(w.Body.Bytes(), &totals); err != nil {
+		t.Fatal(err)
+	}
+	if totals["18387"] != (PortTraffic{Upload: 15, Download: 100}) {
+		t.Errorf("traffic returned %+v, should be upload 15 download 100", totals["18387"])
+	}
+	if got := TrafficTotals(false)["18387"]; got != (PortTraffic{}) {
+		t.Errorf("traffic %+v after reset, should be zero", got)
+	}
+}
+
+func TestTrafficSinceStart(t *testing.T) {
+	tr := Traffic("18386")
+	last := TrafficSinceStart()["18386"]
+	tr.AddUpload(1000)
+	used := TrafficSinceStart()["18386"].Upload - last.Upload
+	last = TrafficSinceStart()["18386"]
+	// reset by POST /traffic between rollups
+	tr.AddUpload(500)
+	TrafficTotals(true)
+	tr.AddUpload(1200)
+	used += TrafficSinceStart()["18386"].Upload - last.Upload
+	if used != 2700 {
+		t.Errorf("used %d, reset should not lose traffic", used)
+	}
+	if got := TrafficTotals(false)["18386"].Upload; got != 1200 {
+		t.Errorf("traffic %d after reset, should be 1200", got)
+	}
+}
@@ -0,0 +1,94 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// UDP packets are encrypted as a whole. The plain packet starts with the
+// target address, in the same format as the request header of TCP
+// connections, followed by payload. Replies from server start with the source
+// address.
+
+// MaxPacketSize is large enough for any UDP packet.
+const MaxPacketSize = 64 * 1024
+
+const (
+	addrTypeIPv4   = 1
+	addrTypeDomain = 3
+	addrTypeIPv6   = 4
+)
+
+var errPacketAddr = errors.New("shadowsocks: malformed address in packet")
+
+// EncryptPacket appends encrypted packet b to dst.
+func EncryptPacket(encTbl *EncryptTable, dst, b []byte) []byte {
+	cryptoStat.encryptBytes.Add(int64(len(b)))
+	if encTbl.aead != nil {
+		return encTbl.aead.sealPacket(dst, b)
+	}
+	n := len(dst)
+	dst = append(dst, b...)
+	encrypt2(encTbl.EncTbl, b, dst[n:])
+	return dst
+}
+
+// DecryptPacket decrypts packet b in place and returns the plain packet, which
+// is part of b.
+func DecryptPacket(encTbl *EncryptTable, b []byte) ([]byte, error) {
+	cryptoStat.decryptBytes.Add(int64(len(b)))
+	if encTbl.aead != nil {
+		return encTbl.aead.openPacket(b)
+	}
+	encrypt2(encTbl.DecTbl, b, b)
+	return b, nil
+}
+
+// ParsePacketAddr returns the address at the start of plain packet b, in the
+// form of host:port, and the length of the address part.
+func ParsePacketAddr(b []byte) (addr string, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, errPacketAddr
+	}
+	var host string
+	switch b[0] {
+	case addrTypeIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return "", 0, errPacketAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case addrTypeIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return "", 0, errPacketAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case addrTypeDomain:
+		if len(b) < 2 {
+			return "", 0, errPacketAddr
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, errPacketAddr
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, errPacketAddr
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
+
+// PacketAddr returns addr in the address format used in packets.
+func PacketAddr(addr *net.UDPAddr) []byte {
+	var b []byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append([]byte{addrTypeIPv4}, ip4...)
+	} else {
+		b = append([]byte{addrTypeIPv6}, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
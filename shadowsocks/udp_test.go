@@ -0,0 +1,50 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestPacketAddr(t *testing.T) {
+	for _, s := range []string{"192.0.2.1:53", "[2001:db8::1]:8388"} {
+		addr, _ := net.ResolveUDPAddr("udp", s)
+		b := PacketAddr(addr)
+		parsed, n, err := ParsePacketAddr(append(b, "payload"...))
+		if err != nil || parsed != s || n != len(b) {
+			t.Errorf("%s parsed as %s, %d, %v", s, parsed, n, err)
+		}
+	}
+
+	parsed, n, err := ParsePacketAddr([]byte("\x03\x0bexample.com\x00\x35data"))
+	if err != nil || parsed != "example.com:53" || n != 15 {
+		t.Errorf("domain parsed as %s, %d, %v", parsed, n, err)
+	}
+	for _, b := range []string{"", "\x01\xc0\x00\x02", "\x03\x0bexample", "\x05\x00\x00"} {
+		if _, _, err = ParsePacketAddr([]byte(b)); err == nil {
+			t.Errorf("%q should be malformed", b)
+		}
+	}
+}
+
+func TestEncryptPacket(t *testing.T) {
+	plain := []byte("\x01\xc0\x00\x02\x01\x00\x35payload")
+	for _, method := range []string{"table", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		tbl, _ := NewTable(method, "foobar!")
+		b := EncryptPacket(tbl, nil, plain)
+		if bytes.Contains(b, plain[len(plain)-7:]) {
+			t.Errorf("%s: packet not encrypted", method)
+		}
+		got, err := DecryptPacket(tbl, b)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: decrypted packet differs: %q, %v", method, got, err)
+		}
+		if method != "table" {
+			b = EncryptPacket(tbl, nil, plain)
+			b[len(b)-1] ^= 1
+			if _, err = DecryptPacket(tbl, b); err == nil {
+				t.Errorf("%s: tampered packet should fail", method)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package shadowsocks
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Release feed and the ed25519 public key used to verify the feed and
+// downloaded binaries.
+// They are set at build time with
+//
+//	-ldflags "-X github.com/shadowsocks/shadowsocks-go/shadowsocks.updatePublicKey=..."
+//
+// Binaries built without the public key can't update themselves.
+var (
+	updateFeed      = "https://github.com/shadowsocks/shadowsocks-go/releases/latest/download/feed.json"
+	updatePublicKey = ""
+)
+
+// The release feed is a signed json document like
+//
+//	{
+//		"feed": {
+//			"version": "0.6",
+//			"files": {
+//				"shadowsocks-local-linux-arm": {
+//					"url": "https://...",
+//					"signature": "base64 encoded ed25519 signature of the binary"
+//				}
+//			}
+//		},
+//		"signature": "base64 encoded ed25519 signature of the feed"
+//	}
+//
+// The signature covers the feed exactly as it appears in the document, so
+// the version can't be altered to install an older release, which is
+// refused anyway.
+type signedReleaseFeed struct {
+	Feed      json.RawMessage `json:"feed"`
+	Signature string          `json:"signature"`
+}
+
+type releaseFeed struct {
+	Version string                 `json:"version"`
+	Files   map[string]releaseFile `json:"files"`
+}
+
+type releaseFile struct {
+	URL       string `json:"url"`
+	Signature string `json:"signature"`
+}
+
+// compareVersion compares dotted version strings numerically.
+func compareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func verifyUpdate(data []byte, signature, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("update: invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("update: malformed signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return errors.New("update: signature verification failed")
+	}
+	return nil
+}
+
+// parseReleaseFeed verifies signed feed document with publicKey.
+func parseReleaseFeed(doc []byte, publicKey string) (*releaseFeed, error) {
+	var signed signedReleaseFeed
+	if err := json.Unmarshal(doc, &signed); err != nil {
+		return nil, fmt.Errorf("update: malformed release feed: %v", err)
+	}
+	if err := verifyUpdate(signed.Feed, signed.Signature, publicKey); err != nil {
+		return nil, fmt.Errorf("release feed: %v", err)
+	}
+	var feed releaseFeed
+	if err := json.Unmarshal(signed.Feed, &feed); err != nil {
+		return nil, fmt.Errorf("update: malformed release feed: %v", err)
+	}
+	return &feed, nil
+}
+
+// Sizes of release feed and binaries downloaded are limited, so a bad mirror
+// can't exhaust memory before signatures are verified.
+const (
+	maxFeedSize   = 1 << 20
+	maxBinarySize = 256 << 20
+)
+
+// a stalled download shouldn't block updating forever, binaries may take a
+// while on slow links
+var updateClient = &http.Client{Timeout: 10 * time.Minute}
+
+// httpGet returns body of url, which must not exceed limit bytes.
+func httpGet(url string, limit int64) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("GET %s: larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+// replaceExecutable atomically replaces the running binary with data.
+func replaceExecutable(data []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	// temporary file must be in the same directory to make rename atomic
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// running executable can't be overwritten on windows, but can be renamed
+		os.Remove(exe + ".old")
+		if err = os.Rename(exe, exe+".old"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// Update checks the release feed and replaces the running binary with the
+// latest release of program, after verifying its signature.
+func Update(program string) error {
+	if updatePublicKey == "" {
+		return errors.New("update: binary built without update public key")
+	}
+	data, err := httpGet(updateFeed, maxFeedSize)
+	if err != nil {
+		return err
+	}
+	feed, err := parseReleaseFeed(data, updatePublicKey)
+	if err != nil {
+		return err
+	}
+	if compareVersion(feed.Version, version) <= 0 {
+		// also refuses replayed feeds of older releases
+		log.Println("already the latest version", version)
+		return nil
+	}
+	name := program + "-" + runtime.GOOS + "-" + runtime.GOARCH
+	file, ok := feed.Files[name]
+	if !ok {
+		return fmt.Errorf("update: no release of %s for this platform", name)
+	}
+	log.Printf("downloading %s version %s\n", name, feed.Version)
+	if data, err = httpGet(file.URL, maxBinarySize); err != nil {
+		return err
+	}
+	if err = verifyUpdate(data, file.Signature, updatePublicKey); err != nil {
+		return err
+	}
+	if err = replaceExecutable(data); err != nil {
+		return err
+	}
+	log.Printf("updated to version %s, restart to use it\n", feed.Version)
+	return nil
+}
@@ -0,0 +1,95 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompareVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+	}{
+		{"0.5", "0.5", 0},
+		{"0.5", "0.6", -1},
+		{"0.10", "0.9", 1},
+		{"1.0", "1", 0},
+		{"1.0.1", "1.0", 1},
+	}
+	for _, tt := range tests {
+		if cmp := compareVersion(tt.a, tt.b); cmp != tt.cmp {
+			t.Errorf("compareVersion(%s, %s) = %d, should be %d", tt.a, tt.b, cmp, tt.cmp)
+		}
+	}
+}
+
+func TestVerifyUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("new binary")
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))
+	key := base64.StdEncoding.EncodeToString(pub)
+
+	if err = verifyUpdate(data, sig, key); err != nil {
+		t.Error("valid signature rejected:", err)
+	}
+	if err = verifyUpdate([]byte("tampered binary"), sig, key); err == nil {
+		t.Error("tampered binary should be rejected")
+	}
+	if err = verifyUpdate(data, "not base64", key); err == nil {
+		t.Error("malformed signature should be rejected")
+	}
+}
+
+func TestParseReleaseFeed(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(pub)
+	feed := []byte(`{"version":"9.0","files":{"shadowsocks-local-linux-arm":{"url":"https://example.com/ss","signature":"c2ln"}}}`)
+	doc, _ := json.Marshal(&signedReleaseFeed{
+		Feed:      json.RawMessage(feed),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, feed)),
+	})
+
+	f, err := parseReleaseFeed(doc, key)
+	if err != nil {
+		t.Fatal("valid feed rejected:", err)
+	}
+	if f.Version != "9.0" || f.Files["shadowsocks-local-linux-arm"].URL != "https://example.com/ss" {
+		t.Errorf("parsed feed %+v", f)
+	}
+	// e.g. pointing the latest version to an older release
+	tampered := bytes.Replace(doc, []byte("9.0"), []byte("9.1"), 1)
+	if _, err = parseReleaseFeed(tampered, key); err == nil {
+		t.Error("tampered feed should be rejected")
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err = parseReleaseFeed(doc, base64.StdEncoding.EncodeToString(otherPub)); err == nil {
+		t.Error("feed signed with another key should be rejected")
+	}
+	if _, err = parseReleaseFeed(feed, key); err == nil {
+		t.Error("unsigned feed should be rejected")
+	}
+}
+
+func TestHTTPGetLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer ts.Close()
+	if data, err := httpGet(ts.URL, 100); err != nil || len(data) != 100 {
+		t.Errorf("got %d bytes, error %v", len(data), err)
+	}
+	if _, err := httpGet(ts.URL, 99); err == nil {
+		t.Error("body larger than limit should be refused")
+	}
+}
@@ -0,0 +1,190 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Other clients share servers as ss:// URIs, either in SIP002 form
+//
+//	ss://base64url(method:password)@host:port/?plugin=name%3Bopts#tag
+//
+// whose userinfo may also be percent-encoded method:password, or in the
+// legacy form ss://base64(method:password@host:port)#tag. Servers given as
+// URIs in server option or -s are moved to server_password when a profile is
+// applied. Client uses one method and plugin for all servers, so the URIs
+// must agree on them.
+
+// ServerURI is a server parsed from ss:// URI.
+type ServerURI struct {
+	Server     string // host:port
+	Method     string
+	Password   string
+	Plugin     string
+	PluginOpts string
+	Tag        string // name of the server, not used
+}
+
+// IsServerURI tells whether s is a ss:// URI instead of an address.
+func IsServerURI(s string) bool {
+	return strings.HasPrefix(s, "ss://")
+}
+
+// decodeBase64 accepts both standard and URL alphabets, with or without
+// padding, as clients differ.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// ParseServerURI parses ss:// URI in SIP002 or legacy form.
+func ParseServerURI(uri string) (*ServerURI, error) {
+	if !IsServerURI(uri) {
+		return nil, errors.New("shadowsocks: server URI should start with ss://")
+	}
+	rest := uri[len("ss://"):]
+	u := &ServerURI{}
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		u.Tag, _ = url.PathUnescape(rest[i+1:])
+		rest = rest[:i]
+	}
+	var query string
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	rest = strings.TrimSuffix(rest, "/")
+
+	var userinfo, hostport string
+	if i := strings.LastIndexByte(rest, '@'); i >= 0 {
+		userinfo, hostport = rest[:i], rest[i+1:]
+		if strings.Contains(userinfo, ":") {
+			// percent-encoded method:password
+			decoded, err := url.PathUnescape(userinfo)
+			if err != nil {
+				return nil, fmt.Errorf("shadowsocks: invalid userinfo in server URI: %v", err)
+			}
+			userinfo = decoded
+		} else {
+			decoded, err := decodeBase64(userinfo)
+			if err != nil {
+				return nil, errors.New("shadowsocks: invalid base64 userinfo in server URI")
+			}
+			userinfo = string(decoded)
+		}
+	} else {
+		// legacy form encodes everything
+		decoded, err := decodeBase64(rest)
+		if err != nil {
+			return nil, errors.New("shadowsocks: invalid base64 in server URI")
+		}
+		rest = string(decoded)
+		i := strings.LastIndexByte(rest, '@')
+		if i < 0 {
+			return nil, errors.New("shadowsocks: no server address in server URI")
+		}
+		userinfo, hostport = rest[:i], rest[i+1:]
+	}
+
+	i := strings.IndexByte(userinfo, ':')
+	if i <= 0 {
+		return nil, errors.New("shadowsocks: no method in server URI")
+	}
+	u.Method, u.Password = strings.ToLower(userinfo[:i]), userinfo[i+1:]
+	if u.Password == "" {
+		return nil, errors.New("shadowsocks: no password in server URI")
+	}
+	if err := ValidateAddr(hostport); err != nil {
+		return nil, err
+	}
+	host, port, _ := SplitHostPortDefault(hostport, "")
+	u.Server = JoinHostPort(host, port)
+
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks: invalid query in server URI: %v", err)
+		}
+		if plugin := values.Get("plugin"); plugin != "" {
+			u.Plugin = plugin
+			if i := strings.IndexByte(plugin, ';'); i >= 0 {
+				u.Plugin, u.PluginOpts = plugin[:i], plugin[i+1:]
+			}
+		}
+	}
+	return u, nil
+}
+
+// ExpandServerURIs returns a copy of config with servers given as ss:// URIs
+// moved to server_password, along with other servers. Config itself is
+// returned if there's no URI.
+func ExpandServerURIs(config *Config) (*Config, error) {
+	var uris []*ServerURI
+	var plain []string
+	for _, s := range config.GetServerArray() {
+		if !IsServerURI(s) {
+			plain = append(plain, s)
+			continue
+		}
+		u, err := ParseServerURI(s)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, u)
+	}
+	if len(uris) == 0 {
+		return config, nil
+	}
+	first := uris[0]
+	for _, u := range uris[1:] {
+		if u.Method != first.Method {
+			return nil, fmt.Errorf("shadowsocks: server URIs use different methods %s and %s, only one method is supported",
+				first.Method, u.Method)
+		}
+		if u.Plugin != first.Plugin || u.PluginOpts != first.PluginOpts {
+			return nil, errors.New("shadowsocks: server URIs use different plugins, only one plugin is supported")
+		}
+	}
+
+	c := *config
+	c.ServerPassword = make(map[string]string, len(config.ServerPassword)+len(plain)+len(uris))
+	for s, passwd := range config.ServerPassword {
+		c.ServerPassword[s] = passwd
+	}
+	for _, s := range plain {
+		host, port, err := SplitHostPortDefault(s, strconv.Itoa(config.ServerPort))
+		if err != nil {
+			return nil, err
+		}
+		if port == "0" || config.Password == "" {
+			return nil, fmt.Errorf("shadowsocks: server %s needs server_port and password, or give it as ss:// URI", s)
+		}
+		c.ServerPassword[JoinHostPort(host, port)] = config.Password
+	}
+	if len(c.ServerPassword) != 0 {
+		method := config.Method
+		if method == "" {
+			method = "table"
+		}
+		if method != first.Method {
+			return nil, fmt.Errorf("shadowsocks: server URIs use method %s, other servers use %s, only one method is supported",
+				first.Method, method)
+		}
+	}
+	if first.Plugin != "" && config.Plugin != "" && (config.Plugin != first.Plugin || config.PluginOpts != first.PluginOpts) {
+		return nil, fmt.Errorf("shadowsocks: server URIs use plugin %s, but plugin %s is configured", first.Plugin, config.Plugin)
+	}
+	for _, u := range uris {
+		c.ServerPassword[u.Server] = u.Password
+	}
+	c.Method = first.Method
+	if first.Plugin != "" {
+		c.Plugin, c.PluginOpts = first.Plugin, first.PluginOpts
+	}
+	c.Server, c.ServerPort, c.Password = nil, 0, ""
+	return &c, nil
+}
@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"testing"
+)
+
+func TestParseServerURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want ServerURI
+	}{
+		// SIP002 with base64url userinfo without padding
+		{"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYS9zcz8@example.com:8388#my%20server",
+			ServerURI{Server: "example.com:8388", Method: "chacha20-ietf-poly1305", Password: "pa/ss?", Tag: "my server"}},
+		// padded
+		{"ss://YWVzLTI1Ni1nY206dGVzdA==@[2001:db8::1]:443/",
+			ServerURI{Server: "[2001:db8::1]:443", Method: "aes-256-gcm", Password: "test"}},
+		// percent-encoded userinfo
+		{"ss://aes-256-gcm:p%40ss@192.0.2.1:8388",
+			ServerURI{Server: "192.0.2.1:8388", Method: "aes-256-gcm", Password: "p@ss"}},
+		{"ss://YWVzLTI1Ni1nY206dGVzdA@192.0.2.1:8388/?plugin=obfs-local%3Bobfs%3Dhttp%3Bobfs-host%3Dexample.com",
+			ServerURI{Server: "192.0.2.1:8388", Method: "aes-256-gcm", Password: "test",
+				Plugin: "obfs-local", PluginOpts: "obfs=http;obfs-host=example.com"}},
+		// legacy form, password containing @
+		{"ss://YWVzLTI1Ni1nY206cEBzc0AxOTIuMC4yLjE6ODM4OA==#legacy",
+			ServerURI{Server: "192.0.2.1:8388", Method: "aes-256-gcm", Password: "p@ss", Tag: "legacy"}},
+	}
+	for _, tt := range tests {
+		u, err := ParseServerURI(tt.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tt.uri, err)
+			continue
+		}
+		if *u != tt.want {
+			t.Errorf("%s: got %+v, should be %+v", tt.uri, *u, tt.want)
+		}
+	}
+
+	for _, uri := range []string{
+		"example.com:8388",
+		"ss://YWVzLTI1Ni1nY206dGVzdA@example.com",
+		"ss://YWVzLTI1Ni1nY206dGVzdA@example.com:99999",
+		"ss://aes-256-gcm:@example.com:8388",
+		"ss://!!!@example.com:8388",
+		"ss://bm90IGEgdXJp",
+	} {
+		if _, err := ParseServerURI(uri); err == nil {
+			t.Errorf("%s should be rejected", uri)
+		}
+	}
+}
+
+func TestExpandServerURIs(t *testing.T) {
+	config := &Config{
+		Server:     []interface{}{"ss://aes-256-gcm:a@192.0.2.1:8388", "192.0.2.2"},
+		ServerPort: 8389,
+		Password:   "b",
+		Method:     "aes-256-gcm",
+	}
+	c, err := ExpandServerURIs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server != nil || c.Password != "" || c.ServerPort != 0 || c.Method != "aes-256-gcm" ||
+		len(c.ServerPassword) != 2 || c.ServerPassword["192.0.2.1:8388"] != "a" || c.ServerPassword["192.0.2.2:8389"] != "b" {
+		t.Errorf("expanded config %+v", c)
+	}
+	if config.Server == nil {
+		t.Error("original config should not be changed")
+	}
+
+	// method is taken from URI when there's no other server
+	c, err = ExpandServerURIs(&Config{Server: "ss://chacha20-ietf-poly1305:a@192.0.2.1:8388", Method: "table"})
+	if err != nil || c.Method != "chacha20-ietf-poly1305" {
+		t.Errorf("single URI: %v %+v", err, c)
+	}
+
+	plain := &Config{Server: "192.0.2.1", ServerPort: 8388, Password: "a"}
+	if c, err = ExpandServerURIs(plain); err != nil || c != plain {
+		t.Error("config without URI should be returned as is")
+	}
+
+	for _, config := range []*Config{
+		{Server: []interface{}{"ss://aes-256-gcm:a@192.0.2.1:8388", "ss://aes-128-gcm:a@192.0.2.2:8388"}},
+		{Server: []interface{}{"ss://aes-256-gcm:a@192.0.2.1:8388", "192.0.2.2"}, ServerPort: 8388, Password: "b", Method: "table"},
+		{Server: []interface{}{"ss://aes-256-gcm:a@192.0.2.1:8388", "192.0.2.2"}, Method: "aes-256-gcm"},
+		{Server: "ss://aes-256-gcm:a@192.0.2.1:8388?plugin=obfs-local", Plugin: "v2ray-plugin"},
+	} {
+		if _, err = ExpandServerURIs(config); err == nil {
+			t.Errorf("%+v should be rejected", config.Server)
+		}
+	}
+}
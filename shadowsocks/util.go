@@ -2,15 +2,9 @@ package shadowsocks
 
 import (
 	"errors"
-	"fmt"
 	"os"
 )
 
-func PrintVersion() {
-	const version = "0.5"
-	fmt.Println("shadowsocks-go version", version)
-}
-
 func IsFileExists(path string) (bool, error) {
 	stat, err := os.Stat(path)
 	if err == nil {
@@ -24,12 +18,3 @@ func IsFileExists(path string) (bool, error) {
 	}
 	return false, err
 }
-
-func HasPort(s string) bool {
-	for i := len(s) - 1; i > 0; i-- {
-		if s[i] == ':' {
-			return true
-		}
-	}
-	return false
-}
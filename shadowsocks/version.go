@@ -0,0 +1,94 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+const version = "0.5.0"
+
+// Set at build time with
+//
+//	-ldflags "-X github.com/shadowsocks/shadowsocks-go/shadowsocks.buildCommit=..."
+//
+// The Makefile sets them. Commit falls back to the one recorded by go build
+// in module mode.
+var (
+	buildCommit = ""
+	buildDate   = ""
+)
+
+// Protocol features, so that management panels can tell what a node
+// supports before pushing config using them.
+var protocolFeatures = []string{
+	"aead",        // aes-256-gcm and chacha20-ietf-poly1305
+	"ipv6_addr",   // address type 4 in request header
+	"port_hop",    // port_hop and port_hop_interval
+	"server_list", // signed server list sync
+	"udp_relay",
+}
+
+// VersionInfo describes the build of the running binary.
+type VersionInfo struct {
+	Version    string   `json:"version"`
+	Commit     string   `json:"commit,omitempty"`
+	BuildDate  string   `json:"build_date,omitempty"`
+	GoVersion  string   `json:"go_version"`
+	Platform   string   `json:"platform"`
+	Methods    []string `json:"methods"`
+	Transports []string `json:"transports"`
+	Features   []string `json:"features"`
+}
+
+func GetVersionInfo() *VersionInfo {
+	info := &VersionInfo{
+		Version:    version,
+		Commit:     buildCommit,
+		BuildDate:  buildDate,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		Transports: []string{"tcp", "udp", "sip003_plugin", "tls"},
+		Features:   protocolFeatures,
+	}
+	if info.Commit == "" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "vcs.revision" {
+					info.Commit = s.Value
+				}
+			}
+		}
+	}
+	for m := range methods {
+		info.Methods = append(info.Methods, m)
+	}
+	sort.Strings(info.Methods)
+	return info
+}
+
+func PrintVersion() {
+	info := GetVersionInfo()
+	fmt.Println("shadowsocks-go version", info.Version)
+	if info.Commit != "" {
+		fmt.Println("commit", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Println("built", info.BuildDate)
+	}
+	fmt.Println(info.GoVersion, info.Platform)
+}
+
+// PrintVersionJSON prints version info as JSON object.
+func PrintVersionJSON() {
+	b, _ := json.MarshalIndent(GetVersionInfo(), "", "\t")
+	fmt.Println(string(b))
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetVersionInfo())
+}